@@ -0,0 +1,328 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// cfgdot: a tool for rendering the control-flow graphs of Go functions.
+// See Usage for details, or run with -help.
+package main // import "golang.org/x/tools/cmd/cfgdot"
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/analysis/passes/ctrlflowlite"
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/packages"
+)
+
+const Usage = `cfgdot: render the control-flow graphs of Go functions.
+
+Usage:
+
+  cfgdot [-func=name | -all [-single]] [-format=dot|mermaid|text] [-o file] package|file.go
+
+The argument is either a package pattern, which must denote a single
+package, or the name of a .go file.
+
+A package is loaded and type-checked, so calls to functions of the
+package that never return (because they panic or exit on all paths)
+and calls to well-known functions such as os.Exit and log.Fatal
+terminate their block. A file is only parsed, and only calls to panic
+and to well-known functions, recognized by name, terminate their
+block.
+
+Flags:
+
+-func      The function to render: a function name F, or a method
+           name T.M (also written (*T).M). A bare method name M is
+           accepted if no function is named M and only one type has a
+           method M.
+
+-all       Render every function and method with a body, in source
+           order. By default each is a separate graph.
+
+-single    With -all, render all functions as clusters of a single dot
+           digraph, in order of name.
+
+-format    The output format, one of:
+
+            dot         AT&T GraphViz (.dot) format.
+            mermaid     Mermaid flowchart format.
+            text        the plain listing of (*cfg.CFG).Format.
+
+-o         The output file; by default, the standard output.
+
+Examples:
+
+  Render the CFG of the Parse function of the ./parser package:
+
+    cfgdot -func Parse -o out.dot ./parser && dot -Tsvg out.dot >out.svg
+
+  List the blocks of all functions of a file:
+
+    cfgdot -all -format=text main.go
+`
+
+func main() {
+	if err := run("", os.Args[1:], os.Stdout); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "cfgdot: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// options holds the settings of the command-line flags.
+type options struct {
+	funcName    string
+	all, single bool
+	format      string
+	out         string
+}
+
+// run runs the command with the command-line arguments args, with
+// relative file names resolved relative to dir, writing its output to
+// stdout unless -o is specified.
+func run(dir string, args []string, stdout io.Writer) error {
+	var opts options
+	fs := flag.NewFlagSet("cfgdot", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), Usage) }
+	fs.StringVar(&opts.funcName, "func", "", "Name of the function (F) or method (T.M) to render")
+	fs.BoolVar(&opts.all, "all", false, "Render all functions and methods")
+	fs.BoolVar(&opts.single, "single", false, "With -all and -format=dot, render all functions as clusters of one digraph")
+	fs.StringVar(&opts.format, "format", "dot", "Output format (dot, mermaid, text)")
+	fs.StringVar(&opts.out, "o", "", "Output file (default: standard output)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := doCfgdot(dir, opts, fs.Args(), &buf); err != nil {
+		return err
+	}
+	if opts.out == "" {
+		_, err := stdout.Write(buf.Bytes())
+		return err
+	}
+	filename := opts.out
+	if dir != "" && !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0666)
+}
+
+// A function is a function or method declaration with a body.
+type function struct {
+	name string // F or T.M
+	decl *ast.FuncDecl
+}
+
+// doCfgdot renders the requested CFGs of the package or file args[0],
+// resolved relative to dir, to out.
+func doCfgdot(dir string, opts options, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("exactly one package or file required (run with -help for usage)")
+	}
+	switch opts.format {
+	case "dot", "mermaid", "text":
+	default:
+		return fmt.Errorf("invalid -format %q: must be dot, mermaid, or text", opts.format)
+	}
+	if opts.all == (opts.funcName != "") {
+		return fmt.Errorf("exactly one of -func and -all required")
+	}
+	if opts.single && (!opts.all || opts.format != "dot") {
+		return fmt.Errorf("-single requires -all and -format=dot")
+	}
+
+	fset, funcs, build, err := load(dir, args[0])
+	if err != nil {
+		return err
+	}
+	if !opts.all {
+		fn, err := lookup(funcs, opts.funcName, args[0])
+		if err != nil {
+			return err
+		}
+		funcs = []function{fn}
+	}
+
+	if opts.single {
+		graphs := make(map[string]*cfg.CFG, len(funcs))
+		for _, fn := range funcs {
+			graphs[fn.name] = build(fn.decl)
+		}
+		out.Write(cfg.DotAll(fset, graphs))
+		return nil
+	}
+	for i, fn := range funcs {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		g := build(fn.decl)
+		switch opts.format {
+		case "dot":
+			if len(funcs) > 1 {
+				fmt.Fprintf(out, "// %s\n", fn.name)
+			}
+			out.Write(g.Dot(fset))
+		case "mermaid":
+			if len(funcs) > 1 {
+				fmt.Fprintf(out, "%%%% %s\n", fn.name)
+			}
+			out.Write(g.Mermaid(fset))
+		case "text":
+			fmt.Fprintf(out, "%s:\n%s", fn.name, g.Format(fset))
+		}
+	}
+	return nil
+}
+
+// load parses the file or loads the package denoted by arg, and
+// returns its functions in source order, and a function to build
+// their CFGs.
+func load(dir, arg string) (*token.FileSet, []function, func(*ast.FuncDecl) *cfg.CFG, error) {
+	if strings.HasSuffix(arg, ".go") {
+		filename := arg
+		if dir != "" && !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, filename, nil, 0)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		build := func(decl *ast.FuncDecl) *cfg.CFG {
+			return cfg.New(decl.Body, syntacticMayReturn)
+		}
+		return fset, functions([]*ast.File{f}), build, nil
+	}
+
+	conf := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+			packages.NeedTypes | packages.NeedTypesInfo,
+		Dir: dir,
+	}
+	pkgs, err := packages.Load(conf, arg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		return nil, nil, nil, fmt.Errorf("packages contain errors")
+	}
+	if len(pkgs) != 1 {
+		return nil, nil, nil, fmt.Errorf("pattern %s matches %d packages, want 1", arg, len(pkgs))
+	}
+	pkg := pkgs[0]
+	cfgs := ctrlflowlite.New(pkg.TypesInfo, pkg.Syntax)
+	return pkg.Fset, functions(pkg.Syntax), cfgs.FuncDecl, nil
+}
+
+// functions returns the functions and methods with bodies declared in
+// files, in source order.
+func functions(files []*ast.File) []function {
+	var funcs []function
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			decl, ok := decl.(*ast.FuncDecl)
+			if !ok || decl.Body == nil {
+				continue
+			}
+			name := decl.Name.Name
+			if decl.Recv != nil && len(decl.Recv.List) > 0 {
+				if recv := recvTypeName(decl.Recv.List[0].Type); recv != "" {
+					name = recv + "." + name
+				}
+			}
+			funcs = append(funcs, function{name, decl})
+		}
+	}
+	return funcs
+}
+
+// recvTypeName returns the name of the named type of a method
+// receiver of type T or *T.
+func recvTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// lookup returns the function of funcs named name (F, T.M, or (*T).M),
+// or the unique method named name if no function is.
+func lookup(funcs []function, name, where string) (function, error) {
+	// Accept (*T).M and (T).M for T.M.
+	if strings.HasPrefix(name, "(") {
+		if i := strings.Index(name, ")."); i > 0 {
+			name = strings.TrimPrefix(name[1:i], "*") + name[i+1:]
+		}
+	}
+	var methods []function
+	for _, fn := range funcs {
+		if fn.name == name {
+			return fn, nil
+		}
+		if fn.decl.Recv != nil && fn.decl.Name.Name == name {
+			methods = append(methods, fn)
+		}
+	}
+	switch len(methods) {
+	case 0:
+		var names []string
+		for _, fn := range funcs {
+			names = append(names, fn.name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return function{}, fmt.Errorf("function %s not found in %s, which has no functions", name, where)
+		}
+		return function{}, fmt.Errorf("function %s not found in %s; available: %s", name, where, strings.Join(names, ", "))
+	case 1:
+		return methods[0], nil
+	}
+	var names []string
+	for _, fn := range methods {
+		names = append(names, fn.name)
+	}
+	return function{}, fmt.Errorf("method name %s is ambiguous in %s: use Type.Method syntax to choose one of %s", name, where, strings.Join(names, ", "))
+}
+
+// syntacticMayReturn reports whether a call may return, judging only
+// by the name of the callee: calls to panic and to the well-known
+// functions os.Exit, log.Fatal and their relatives never return.
+func syntacticMayReturn(call *ast.CallExpr) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name != "panic"
+	case *ast.SelectorExpr:
+		if x, ok := fun.X.(*ast.Ident); ok {
+			switch x.Name + "." + fun.Sel.Name {
+			case "os.Exit", "runtime.Goexit",
+				"log.Fatal", "log.Fatalf", "log.Fatalln",
+				"log.Panic", "log.Panicf", "log.Panicln":
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// No testdata on Android.
+
+// +build !android
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/internal/testenv"
+	"golang.org/x/tools/txtar"
+)
+
+// TestScripts runs the scripts in testdata/*.txt.
+//
+// Each script is a txtar archive whose files are extracted to a
+// temporary directory and whose comment is a list of commands, one
+// per line, in the style of testscript:
+//
+//	cfgdot args...      run the command, which must succeed
+//	! cfgdot args...    run the command, which must fail
+//	cmp stdout file     compare the last command's output with file
+//	cmp file1 file2     compare two files
+//	stderr regexp       match the last command's error message
+//
+// Blank lines and lines beginning with # are ignored.
+func TestScripts(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".txt"), func(t *testing.T) {
+			ar, err := txtar.ParseFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range ar.Files {
+				if f.Name == "go.mod" {
+					testenv.NeedsGoPackages(t)
+				}
+			}
+			dir, err := ioutil.TempDir("", "cfgdot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, f := range ar.Files {
+				name := filepath.Join(dir, filepath.FromSlash(f.Name))
+				if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, f.Data, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			runScript(t, dir, string(ar.Comment))
+		})
+	}
+}
+
+func runScript(t *testing.T, dir, script string) {
+	var stdout, stderr string
+	read := func(name string) string {
+		if name == "stdout" {
+			return stdout
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for i, line := range strings.Split(script, "\n") {
+		args := strings.Fields(line)
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		fail := args[0] == "!"
+		if fail {
+			args = args[1:]
+		}
+		switch args[0] {
+		case "cfgdot":
+			var buf bytes.Buffer
+			err := run(dir, args[1:], &buf)
+			stdout, stderr = buf.String(), ""
+			if err != nil {
+				stderr = err.Error()
+			}
+			if fail && err == nil {
+				t.Fatalf("line %d: %s: unexpected success", i+1, line)
+			} else if !fail && err != nil {
+				t.Fatalf("line %d: %s: %v", i+1, line, err)
+			}
+		case "cmp":
+			if got, want := read(args[1]), read(args[2]); got != want {
+				t.Errorf("line %d: %s and %s differ:\n--- %s ---\n%s--- %s ---\n%s",
+					i+1, args[1], args[2], args[1], got, args[2], want)
+			}
+		case "stderr":
+			re, err := regexp.Compile(strings.Join(args[1:], " "))
+			if err != nil {
+				t.Fatalf("line %d: %v", i+1, err)
+			}
+			if !re.MatchString(stderr) {
+				t.Errorf("line %d: error %q does not match %s", i+1, stderr, re)
+			}
+		default:
+			t.Fatalf("line %d: unknown command %q", i+1, args[0])
+		}
+	}
+}
@@ -39,6 +39,10 @@ func (*noReturn) String() string { return "noReturn" }
 
 // A CFGs holds the control-flow graphs
 // for all the functions of the current package.
+//
+// The graphs are shared by all the analyzers that use the result,
+// so they must not be modified; use cfg.CFG.Clone to obtain a copy
+// that may be.
 type CFGs struct {
 	defs      map[*ast.Ident]types.Object // from Pass.TypesInfo.Defs
 	funcDecls map[*types.Func]*declInfo
@@ -0,0 +1,270 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ctrlflowlite is an analysis that provides syntactic
+// control-flow graphs (CFGs) for the functions of a package,
+// built lazily on demand.
+//
+// Unlike ctrlflow, it neither produces nor consumes facts, so
+// analyzers that depend on it do not force a fact computation over
+// the entire import graph. The price is precision: whether a call
+// may return is inferred only from the functions declared in the
+// current package plus a fixed list of well-known functions from the
+// standard library (such as os.Exit and log.Fatal). A call to any
+// other function declared in another package is assumed to return.
+// These answers are memoized per callee (see cfg.MemoizeMayReturn).
+//
+// Memory: the analyzer itself retains only an index of the package's
+// function declarations and literals. Each CFG is built the first time
+// it is requested (or the first time the CFG of a function that calls
+// it is built) and is then retained for the lifetime of the result.
+// For very large packages in which only a few functions are of
+// interest this is considerably cheaper than ctrlflow, which builds
+// every CFG eagerly; clients that eventually visit every function
+// will use about the same amount of memory as with ctrlflow.
+//
+// By itself, it does not report any diagnostics.
+package ctrlflowlite
+
+import (
+	"go/ast"
+	"go/types"
+	"reflect"
+	"sync"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name:       "ctrlflowlite",
+	Doc:        "build control-flow graphs lazily, without facts",
+	Run:        run,
+	ResultType: reflect.TypeOf(new(CFGs)),
+	Requires:   []*analysis.Analyzer{inspect.Analyzer},
+}
+
+// A CFGs provides the control-flow graphs for the functions of the
+// current package. Its methods build each graph on first use and
+// memoize the result; they are safe for concurrent use.
+//
+// The graphs are shared by all the analyzers that use the result,
+// so they must not be modified; use cfg.CFG.Clone to obtain a copy
+// that may be.
+type CFGs struct {
+	info      *types.Info
+	mayReturn func(*ast.CallExpr) bool // memoized callMayReturn
+
+	mu        sync.Mutex // guards the fields below and all CFG construction
+	funcDecls map[*types.Func]*declInfo
+	funcLits  map[*ast.FuncLit]*litInfo
+}
+
+type declInfo struct {
+	decl     *ast.FuncDecl
+	cfg      *cfg.CFG // iff decl.Body != nil, once started
+	started  bool     // to break cycles
+	done     bool     // noReturn is final
+	noReturn bool
+}
+
+type litInfo struct {
+	cfg *cfg.CFG // nil until built
+}
+
+// FuncDecl returns the control-flow graph for a named function.
+// It returns nil if decl.Body==nil or if decl does not belong to
+// the package under analysis.
+func (c *CFGs) FuncDecl(decl *ast.FuncDecl) *cfg.CFG {
+	if decl.Body == nil {
+		return nil
+	}
+	fn, ok := c.info.Defs[decl.Name].(*types.Func)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	di, ok := c.funcDecls[fn]
+	if !ok {
+		return nil
+	}
+	c.buildDecl(fn, di)
+	return di.cfg
+}
+
+// FuncLit returns the control-flow graph for a literal function.
+// It returns nil if lit does not belong to the package under analysis.
+func (c *CFGs) FuncLit(lit *ast.FuncLit) *cfg.CFG {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	li, ok := c.funcLits[lit]
+	if !ok {
+		return nil
+	}
+	if li.cfg == nil {
+		li.cfg = cfg.New(lit.Body, c.mayReturn)
+	}
+	return li.cfg
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	inspect := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+
+	// Index the package's functions; CFGs are built lazily.
+	c := newCFGs(pass.TypesInfo)
+	nodeFilter := []ast.Node{
+		(*ast.FuncDecl)(nil),
+		(*ast.FuncLit)(nil),
+	}
+	inspect.Preorder(nodeFilter, c.index)
+	return c, nil
+}
+
+// New returns a CFGs for the functions declared in files, which must
+// have been type-checked with info (only Defs and Uses are needed).
+// It is the equivalent of the analyzer's result for clients, such as
+// command-line tools, that do not use the analysis framework.
+func New(info *types.Info, files []*ast.File) *CFGs {
+	c := newCFGs(info)
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n.(type) {
+			case *ast.FuncDecl, *ast.FuncLit:
+				c.index(n)
+			}
+			return true
+		})
+	}
+	return c
+}
+
+func newCFGs(info *types.Info) *CFGs {
+	c := &CFGs{
+		info:      info,
+		funcDecls: make(map[*types.Func]*declInfo),
+		funcLits:  make(map[*ast.FuncLit]*litInfo),
+	}
+	c.mayReturn = cfg.MemoizeMayReturn(c.callMayReturn, c.calleeKey(cfg.CalleeKey(info)))
+	return c
+}
+
+// calleeKey returns a keyer for cfg.MemoizeMayReturn that behaves like
+// key but does not memoize calls to functions of this package whose
+// CFG is under construction: until it is complete, callMayReturn's
+// answer for such a function is provisional.
+func (c *CFGs) calleeKey(key func(*ast.CallExpr) interface{}) func(*ast.CallExpr) interface{} {
+	return func(call *ast.CallExpr) interface{} {
+		k := key(call)
+		if fn, ok := k.(*types.Func); ok {
+			if di, ok := c.funcDecls[fn]; ok && !di.done {
+				return nil
+			}
+		}
+		return k
+	}
+}
+
+// index records a function declaration or literal whose CFG may
+// later be requested.
+func (c *CFGs) index(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.FuncDecl:
+		// Type information may be incomplete.
+		if fn, ok := c.info.Defs[n.Name].(*types.Func); ok {
+			c.funcDecls[fn] = &declInfo{decl: n}
+		}
+	case *ast.FuncLit:
+		c.funcLits[n] = new(litInfo)
+	}
+}
+
+// buildDecl builds the CFG of fn, if not already started.
+// c.mu must be held.
+func (c *CFGs) buildDecl(fn *types.Func, di *declInfo) {
+	// buildDecl may call itself recursively for the same function,
+	// because cfg.New is passed (a memoized form of) the
+	// callMayReturn method, which builds the CFG of the callee,
+	// leading to recursion.
+	// We mark each node when we start working on it to break cycles.
+	if !di.started { // break cycle
+		di.started = true
+
+		if di.decl.Body != nil {
+			di.cfg = cfg.New(di.decl.Body, c.mayReturn)
+			if !hasReachableReturn(di.cfg) {
+				di.noReturn = true
+			}
+		}
+		di.done = true
+	}
+}
+
+// callMayReturn reports whether the called function may return.
+// It is passed to the CFG builder; c.mu must be held.
+func (c *CFGs) callMayReturn(call *ast.CallExpr) bool {
+	if id, ok := call.Fun.(*ast.Ident); ok && c.info.Uses[id] == panicBuiltin {
+		return false // panic never returns
+	}
+
+	// Is this a static call?
+	fn := typeutil.StaticCallee(c.info, call)
+	if fn == nil {
+		return true // callee not statically known; be conservative
+	}
+
+	// Function or method declared in this package?
+	if di, ok := c.funcDecls[fn]; ok {
+		c.buildDecl(fn, di)
+		return !di.noReturn
+	}
+
+	// Not declared in this package.
+	return !isWellKnownNoReturn(fn)
+}
+
+var panicBuiltin = types.Universe.Lookup("panic").(*types.Builtin)
+
+func hasReachableReturn(g *cfg.CFG) bool {
+	for _, b := range g.Blocks {
+		if b.Live && b.Return() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isWellKnownNoReturn reports whether fn is one of the standard
+// library functions known never to return. It stands in for the
+// noReturn facts computed by ctrlflow.
+func isWellKnownNoReturn(fn *types.Func) bool {
+	if fn.Pkg() == nil {
+		return false // e.g. error.Error
+	}
+	path, name := fn.Pkg().Path(), fn.Name()
+	switch path {
+	case "log":
+		// Functions and methods of *log.Logger alike.
+		switch name {
+		case "Fatal", "Fatalf", "Fatalln", "Panic", "Panicf", "Panicln":
+			return true
+		}
+	case "os":
+		return name == "Exit"
+	case "runtime":
+		return name == "Goexit"
+	case "syscall":
+		return name == "Exit" || name == "ExitProcess" || name == "ExitThread"
+	case "testing":
+		// Methods of testing.common, promoted to *T and *B.
+		switch name {
+		case "FailNow", "Fatal", "Fatalf", "Skip", "SkipNow", "Skipf":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlflowlite_test
+
+import (
+	"go/ast"
+	"testing"
+
+	"golang.org/x/tools/go/analysis/analysistest"
+	"golang.org/x/tools/go/analysis/passes/ctrlflowlite"
+	"golang.org/x/tools/go/cfg"
+)
+
+func Test(t *testing.T) {
+	testdata := analysistest.TestData()
+
+	// load testdata/src/a/a.go
+	results := analysistest.Run(t, testdata, ctrlflowlite.Analyzer, "a")
+
+	for _, result := range results {
+		cfgs := result.Result.(*ctrlflowlite.CFGs)
+		fset := result.Pass.Fset
+
+		check := func(name string, g *cfg.CFG) {
+			for _, b := range g.Blocks {
+				for _, n := range b.Nodes {
+					stmt, ok := n.(*ast.ExprStmt)
+					if !ok {
+						continue
+					}
+					call, ok := stmt.X.(*ast.CallExpr)
+					if !ok {
+						continue
+					}
+					id, ok := call.Fun.(*ast.Ident)
+					if !ok {
+						continue
+					}
+					if id.Name == "live" && !b.Live || id.Name == "dead" && b.Live {
+						t.Errorf("%s: in %s, %s() has Live=%t",
+							fset.Position(call.Pos()), name, id.Name, b.Live)
+					}
+				}
+			}
+		}
+
+		ast.Inspect(result.Pass.Files[0], func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				g := cfgs.FuncDecl(n)
+				if n.Body == nil {
+					if g != nil {
+						t.Errorf("%s: CFG for func %s without body",
+							fset.Position(n.Pos()), n.Name.Name)
+					}
+					return true
+				}
+				if g == nil {
+					t.Errorf("%s: no CFG for func %s",
+						fset.Position(n.Pos()), n.Name.Name)
+					return true
+				}
+				if cfgs.FuncDecl(n) != g {
+					t.Errorf("%s: CFG for func %s is not memoized",
+						fset.Position(n.Pos()), n.Name.Name)
+				}
+				check(n.Name.Name, g)
+			case *ast.FuncLit:
+				g := cfgs.FuncLit(n)
+				if g == nil {
+					t.Errorf("%s: no CFG for func literal", fset.Position(n.Pos()))
+					return true
+				}
+				if cfgs.FuncLit(n) != g {
+					t.Errorf("%s: CFG for func literal is not memoized", fset.Position(n.Pos()))
+				}
+				check("func literal", g)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package a
+
+// This file tests the lazily built CFGs of ctrlflowlite.
+// A call to dead() must be unreachable, a call to live() reachable.
+
+import "lib"
+
+func live() {}
+func dead() {}
+
+var cond bool
+
+func noReturn() {
+	if cond {
+		panic("unreachable")
+	}
+	for {
+	}
+}
+
+func callsNoReturn() {
+	live()
+	noReturn()
+	dead()
+}
+
+func recursive() {
+	mutual()
+	live() // the cycle is broken arbitrarily: assume mutual may return
+}
+
+func mutual() {
+	recursive()
+	live()
+}
+
+func otherPackage() {
+	lib.NoReturn() // no facts: assumed to return
+	live()
+}
+
+type T int
+
+func (T) method() {
+	panic("unreachable")
+}
+
+func callsMethod(t T) {
+	t.method()
+	dead()
+}
+
+func literals() {
+	f := func() {
+		noReturn()
+		dead()
+	}
+	f()
+	live()
+}
+
+func noBody()
@@ -0,0 +1,8 @@
+package lib
+
+func CanReturn() {}
+
+func NoReturn() {
+	for {
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements side tables of per-block information.
+
+// An Annotation associates client-defined values with the blocks of a
+// CFG, keyed by block index, so that clients need not maintain maps
+// keyed by block pointers. Since a Clone has the same indices, an
+// annotation of a CFG is also one of its clones.
+//
+// The zero Annotation is empty and ready to use, for example from
+// Options.OnBlock, before the CFG exists. An Annotation is not safe
+// for concurrent use if any goroutine calls Set.
+type Annotation struct {
+	values []interface{}
+	ok     []bool
+}
+
+// Annotate returns an empty annotation for the blocks of g.
+func Annotate(g *CFG) *Annotation {
+	return &Annotation{
+		values: make([]interface{}, len(g.Blocks)),
+		ok:     make([]bool, len(g.Blocks)),
+	}
+}
+
+// Get returns the value associated with block b, and whether there is
+// one.
+func (a *Annotation) Get(b *Block) (interface{}, bool) {
+	if int(b.Index) >= len(a.values) {
+		return nil, false
+	}
+	return a.values[b.Index], a.ok[b.Index]
+}
+
+// Set associates value v with block b, replacing any previous value.
+func (a *Annotation) Set(b *Block, v interface{}) {
+	for int(b.Index) >= len(a.values) {
+		a.values = append(a.values, nil)
+		a.ok = append(a.ok, false)
+	}
+	a.values[b.Index] = v
+	a.ok[b.Index] = true
+}
+
+// Remap returns an annotation of the blocks of another CFG, such as
+// the new CFG returned by Rebuild, that associates each block with the
+// value of the block of a's CFG that corresponds to it according to m,
+// a mapping from that CFG's blocks to the other's. Blocks without a
+// counterpart, or whose counterpart has no value, have none.
+func (a *Annotation) Remap(m map[*Block]*Block) *Annotation {
+	res := new(Annotation)
+	for from, to := range m {
+		if v, ok := a.Get(from); ok && to != nil {
+			res.Set(to, v)
+		}
+	}
+	return res
+}
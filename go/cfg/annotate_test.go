@@ -0,0 +1,157 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const annotateSrc = `package p
+
+func f(x bool, s []int) {
+	defer func() {
+		if x {
+			a()
+		}
+	}()
+	for _, i := range s {
+		switch i {
+		case 1, 2:
+			b(i)
+		default:
+			c()
+		}
+	}
+	if x {
+		panic("x")
+	}
+}
+`
+
+func TestOnBlock(t *testing.T) {
+	var (
+		calls []*Block
+		nodes []int // number of nodes at the time of each call
+		ann   Annotation
+	)
+	opts := Options{
+		MayReturn: mayReturn,
+		MayPanic:  func(ast.Node) bool { return true },
+		Spawns:    true,
+		OnBlock: func(b *Block, kind BlockKind, stmt ast.Stmt) {
+			if kind != b.Kind || stmt != b.Stmt {
+				t.Errorf("OnBlock(%s) called with kind %s, stmt %T", b, kind, stmt)
+			}
+			calls = append(calls, b)
+			nodes = append(nodes, len(b.Nodes))
+			ann.Set(b, b.Kind.String())
+		},
+	}
+	g := buildSource(t, annotateSrc, "f", opts)
+
+	// OnBlock is called once per block of g, in order, once the
+	// block is complete, but not for the blocks of the spawned
+	// function literal's CFG.
+	if len(calls) != len(g.Blocks) {
+		t.Fatalf("OnBlock called %d times for %d blocks", len(calls), len(g.Blocks))
+	}
+	for i, b := range calls {
+		if b != g.Blocks[i] {
+			t.Errorf("call %d of OnBlock is for %s, want %s", i, b, g.Blocks[i])
+		} else if nodes[i] != len(b.Nodes) {
+			t.Errorf("OnBlock(%s) saw %d nodes, want %d", b, nodes[i], len(b.Nodes))
+		}
+	}
+	panics := 0
+	for _, b := range calls {
+		if b.Kind == KindPanic {
+			panics++
+		}
+	}
+	if panics != 1 {
+		t.Errorf("OnBlock called for %d panic blocks, want 1", panics)
+	}
+	if spawns := g.Spawns(); len(spawns) != 1 || spawns[0].Callee == nil {
+		t.Errorf("Spawns() = %v, want a defer of a function literal", spawns)
+	}
+
+	// The annotation filled in by the callback describes g's blocks,
+	// and those of its clones.
+	clone := g.Clone()
+	for i, b := range g.Blocks {
+		if v, ok := ann.Get(b); !ok || v != b.Kind.String() {
+			t.Errorf("Get(%s) = %v, %t, want %s", b, v, ok, b.Kind)
+		}
+		if v, _ := ann.Get(clone.Blocks[i]); v != b.Kind.String() {
+			t.Errorf("Get(clone of %s) = %v, want %s", b, v, b.Kind)
+		}
+	}
+
+	// A nil body yields a single call.
+	calls = nil
+	Build(nil, opts)
+	if len(calls) != 1 || calls[0].Kind != KindBody {
+		t.Errorf("Build(nil) called OnBlock for %v, want only the entry block", calls)
+	}
+}
+
+func TestAnnotationRemap(t *testing.T) {
+	old := buildSource(t, annotateSrc, "f", Options{MayReturn: mayReturn})
+	ann := Annotate(old)
+	if _, ok := ann.Get(old.Blocks[0]); ok {
+		t.Errorf("Get of a new annotation found a value")
+	}
+	for _, b := range old.Blocks {
+		if b.Kind == KindSwitchCaseBody {
+			ann.Set(b, int(b.Index))
+		}
+	}
+
+	// After an edit that adds blocks before the switch, the values
+	// follow the corresponding blocks to their new indices.
+	edited := strings.Replace(annotateSrc, "\tfor _, i", "\tif x {\n\t\tc()\n\t}\n\tfor _, i", 1)
+	g, mapping := Rebuild(old, buildSource(t, edited, "f", Options{}).Blocks[0].Stmt.(*ast.BlockStmt), Options{MayReturn: mayReturn})
+	remapped := ann.Remap(mapping)
+	n := 0
+	for _, b := range g.Blocks {
+		v, ok := remapped.Get(b)
+		if b.Kind != KindSwitchCaseBody {
+			if ok {
+				t.Errorf("Remap: %s has value %v, want none", b, v)
+			}
+			continue
+		}
+		n++
+		if !ok {
+			t.Errorf("Remap: %s has no value", b)
+		} else if old := old.Blocks[v.(int)]; mapping[old] != b {
+			t.Errorf("Remap: %s has the value of %s, which corresponds to %s", b, old, mapping[old])
+		} else if old.Index == b.Index {
+			t.Errorf("Remap: %s kept its index", b)
+		}
+	}
+	if n != 2 {
+		t.Errorf("Remap: found %d case bodies, want 2", n)
+	}
+}
+
+// buildSource parses src and returns the CFG of the named function,
+// built with opts.
+func buildSource(t *testing.T, src, name string, opts Options) *CFG {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "input.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl, err := lookupFunc(f, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Build(decl.Body, opts)
+}
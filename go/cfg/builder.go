@@ -13,11 +13,29 @@ import (
 )
 
 type builder struct {
-	cfg       *CFG
-	mayReturn func(*ast.CallExpr) bool
-	current   *Block
-	lblocks   map[*ast.Object]*lblock // labeled blocks
-	targets   *targets                // linked stack of branch targets
+	cfg        *CFG
+	mayReturn  func(*ast.CallExpr) bool
+	filterNode func(ast.Node) bool // may be nil
+	current    *Block
+	lblocks    map[string]*lblock // labeled blocks, by label name
+	targets    *targets           // linked stack of branch targets
+
+	// Panic modeling; see Options.MayPanic.
+	mayPanic      func(ast.Node) bool     // nil => panic modeling disabled
+	recoverDefers map[*ast.DeferStmt]bool // top-level defers that recover
+	protected     bool                    // a recovering defer has been added
+	panicBlock    *Block                  // target of panic edges, if any
+	recoverBlock  *Block                  // target of recovered panic edges, if any
+	panicEdges    map[*Block]*[2]bool     // block => edge to {panicBlock, recoverBlock}
+
+	spawnOpts *Options // options for the CFGs of spawned literals; nil => spawns not recorded
+
+	// Deferred calls; see Options.RunDefers.
+	runDefers   bool
+	defers      []*ast.DeferStmt // in order of appearance
+	deferBlocks map[*Block][]int // block => indices in defers of its defer statements
+
+	depth, maxDepth int // current and maximum nesting of stmt calls; see BuildStats
 }
 
 func (b *builder) stmt(_s ast.Stmt) {
@@ -26,46 +44,89 @@ func (b *builder) stmt(_s ast.Stmt) {
 	// within the body of switch/typeswitch/select/for/range.
 	// It is effectively an additional default-nil parameter of stmt().
 	var label *lblock
+	b.depth++
+	if b.depth > b.maxDepth {
+		b.maxDepth = b.depth
+	}
 start:
 	switch s := _s.(type) {
 	case *ast.BadStmt,
 		*ast.SendStmt,
 		*ast.IncDecStmt,
-		*ast.GoStmt,
-		*ast.DeferStmt,
 		*ast.EmptyStmt,
 		*ast.AssignStmt:
 		// No effect on control flow.
 		b.add(s)
 
-	case *ast.ExprStmt:
+	case *ast.GoStmt:
+		b.add(s)
+		b.spawn(s, SpawnGo, s.Call)
+
+	case *ast.DeferStmt:
 		b.add(s)
+		b.spawn(s, SpawnDefer, s.Call)
+		if b.runDefers {
+			b.deferBlocks[b.current] = append(b.deferBlocks[b.current], len(b.defers))
+			b.defers = append(b.defers, s)
+		}
+		if b.recoverDefers[s] {
+			// Panics occurring from now on are recovered.
+			b.protected = true
+			b.cfg.recoverDefers = append(b.cfg.recoverDefers, s)
+		}
+
+	case *ast.ExprStmt:
 		if call, ok := s.X.(*ast.CallExpr); ok && !b.mayReturn(call) {
 			// Calls to panic, os.Exit, etc, never return.
-			b.current = b.newBlock("unreachable.call")
+			b.addRequired(s)
+			if isPanic(call) {
+				if b.mayPanic != nil {
+					b.cfg.panics[s] = true
+					b.panicEdge(b.current)
+				}
+				b.terminate(b.current, TerminalPanic, s)
+			} else {
+				b.terminate(b.current, TerminalNoReturnCall, s)
+			}
+			prev := b.current
+			b.current = b.newBlock(KindUnreachable, s)
+			prev.noReturnSucc = b.current
+		} else {
+			b.add(s)
 		}
 
 	case *ast.DeclStmt:
 		// Treat each var ValueSpec as a separate statement.
 		d := s.Decl.(*ast.GenDecl)
 		if d.Tok == token.VAR {
+			keep := b.keep(s)
 			for _, spec := range d.Specs {
 				if spec, ok := spec.(*ast.ValueSpec); ok {
-					b.add(spec)
+					if keep {
+						b.add(spec)
+					} else {
+						b.notePanic(spec)
+					}
 				}
 			}
 		}
 
 	case *ast.LabeledStmt:
 		label = b.labeledBlock(s.Label)
+		label._goto.Stmt = s
 		b.jump(label._goto)
 		b.current = label._goto
-		_s = s.Stmt
-		goto start // effectively: tailcall stmt(g, s.Stmt, label)
+		switch s.Stmt.(type) {
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt, *ast.ForStmt, *ast.RangeStmt:
+			_s = s.Stmt
+			goto start // effectively: tailcall stmt(g, s.Stmt, label)
+		}
+		b.labeledStmt(s, label)
 
 	case *ast.ReturnStmt:
-		b.add(s)
-		b.current = b.newBlock("unreachable.return")
+		b.addRequired(s)
+		b.terminate(b.current, TerminalReturn, s)
+		b.current = b.newBlock(KindUnreachable, s)
 
 	case *ast.BranchStmt:
 		b.branchStmt(s)
@@ -75,15 +136,15 @@ start:
 
 	case *ast.IfStmt:
 		if s.Init != nil {
-			b.stmt(s.Init)
+			b.initStmt(KindIfInit, s, s.Init)
 		}
-		then := b.newBlock("if.then")
-		done := b.newBlock("if.done")
+		then := b.newBlock(KindIfThen, s)
+		done := b.newBlock(KindIfDone, s)
 		_else := done
 		if s.Else != nil {
-			_else = b.newBlock("if.else")
+			_else = b.newBlock(KindIfElse, s)
 		}
-		b.add(s.Cond)
+		b.addRequired(s.Cond)
 		b.ifelse(then, _else)
 		b.current = then
 		b.stmt(s.Body)
@@ -115,6 +176,7 @@ start:
 	default:
 		panic(fmt.Sprintf("unexpected statement kind: %T", s))
 	}
+	b.depth--
 }
 
 func (b *builder) stmtList(list []ast.Stmt) {
@@ -124,12 +186,22 @@ func (b *builder) stmtList(list []ast.Stmt) {
 }
 
 func (b *builder) branchStmt(s *ast.BranchStmt) {
+	if s.Label != nil {
+		lb := b.labeledBlock(s.Label)
+		lb.refs = append(lb.refs, s)
+	}
 	var block *Block
 	switch s.Tok {
 	case token.BREAK:
 		if s.Label != nil {
 			if lb := b.labeledBlock(s.Label); lb != nil {
 				block = lb._break
+				if block == nil && lb.enclosing {
+					// The target is created on demand,
+					// as most labeled statements have none.
+					lb._break = b.newBlock(KindLabelDone, lb._goto.Stmt)
+					block = lb._break
+				}
 			}
 		} else {
 			for t := b.targets; t != nil && block == nil; t = t.tail {
@@ -155,24 +227,45 @@ func (b *builder) branchStmt(s *ast.BranchStmt) {
 
 	case token.GOTO:
 		if s.Label != nil {
-			block = b.labeledBlock(s.Label)._goto
+			lb := b.labeledBlock(s.Label)
+			lb.gotos = append(lb.gotos, s)
+			block = lb._goto
 		}
 	}
 	if block == nil {
-		block = b.newBlock("undefined.branch")
+		block = b.newBlock(KindUndefinedBranch, s)
+		b.terminate(block, TerminalUndefinedLabelJump, s)
 	}
 	b.jump(block)
-	b.current = b.newBlock("unreachable.branch")
+	b.current = b.newBlock(KindUnreachable, s)
+}
+
+// labeledStmt builds the statement labeled by s, other than a loop,
+// switch, or select statement. The Go specification permits break
+// statements only within those, but the builder treats a break that
+// targets another enclosing labeled statement, such as a block or an
+// if statement, as leaving that statement, so that the graph of such
+// (ill-typed) code still has the evident shape.
+func (b *builder) labeledStmt(s *ast.LabeledStmt, label *lblock) {
+	label.enclosing = true
+	b.depth-- // a label does not add to the nesting of statements
+	b.stmt(s.Stmt)
+	b.depth++
+	label.enclosing = false
+	if label._break != nil {
+		b.jump(label._break)
+		b.current = label._break
+	}
 }
 
 func (b *builder) switchStmt(s *ast.SwitchStmt, label *lblock) {
 	if s.Init != nil {
-		b.stmt(s.Init)
+		b.initStmt(KindSwitchInit, s, s.Init)
 	}
 	if s.Tag != nil {
 		b.add(s.Tag)
 	}
-	done := b.newBlock("switch.done")
+	done := b.newBlock(KindSwitchDone, s)
 	if label != nil {
 		label._break = done
 	}
@@ -188,16 +281,17 @@ func (b *builder) switchStmt(s *ast.SwitchStmt, label *lblock) {
 	for i, clause := range s.Body.List {
 		body := fallthru
 		if body == nil {
-			body = b.newBlock("switch.body") // first case only
+			body = b.newBlock(KindSwitchCaseBody, nil) // first case only
 		}
 
 		// Preallocate body block for the next case.
 		fallthru = done
 		if i+1 < ncases {
-			fallthru = b.newBlock("switch.body")
+			fallthru = b.newBlock(KindSwitchCaseBody, nil)
 		}
 
 		cc := clause.(*ast.CaseClause)
+		body.Stmt = cc
 		if cc.List == nil {
 			// Default case.
 			defaultBody = &cc.Body
@@ -208,8 +302,8 @@ func (b *builder) switchStmt(s *ast.SwitchStmt, label *lblock) {
 
 		var nextCond *Block
 		for _, cond := range cc.List {
-			nextCond = b.newBlock("switch.next")
-			b.add(cond) // one half of the tag==cond condition
+			nextCond = b.newBlock(KindSwitchNextCase, cc)
+			b.addRequired(cond) // one half of the tag==cond condition
 			b.ifelse(body, nextCond)
 			b.current = nextCond
 		}
@@ -241,13 +335,13 @@ func (b *builder) switchStmt(s *ast.SwitchStmt, label *lblock) {
 
 func (b *builder) typeSwitchStmt(s *ast.TypeSwitchStmt, label *lblock) {
 	if s.Init != nil {
-		b.stmt(s.Init)
+		b.initStmt(KindSwitchInit, s, s.Init)
 	}
 	if s.Assign != nil {
 		b.add(s.Assign)
 	}
 
-	done := b.newBlock("typeswitch.done")
+	done := b.newBlock(KindSwitchDone, s)
 	if label != nil {
 		label._break = done
 	}
@@ -258,10 +352,12 @@ func (b *builder) typeSwitchStmt(s *ast.TypeSwitchStmt, label *lblock) {
 			default_ = cc
 			continue
 		}
-		body := b.newBlock("typeswitch.body")
+		body := b.newBlock(KindSwitchCaseBody, cc)
+		body.typeSwitch = true
 		var next *Block
 		for _, casetype := range cc.List {
-			next = b.newBlock("typeswitch.next")
+			next = b.newBlock(KindSwitchNextCase, cc)
+			next.typeSwitch = true
 			// casetype is a type, so don't call b.add(casetype).
 			// This block logically contains a type assertion,
 			// x.(casetype), but it's unclear how to represent x.
@@ -292,6 +388,22 @@ func (b *builder) typeCaseBody(cc *ast.CaseClause, done *Block) {
 }
 
 func (b *builder) selectStmt(s *ast.SelectStmt, label *lblock) {
+	// The cases are tested in a chain, in source order:
+	//
+	//      ...comm statements...
+	//      if case1 goto body1 else next1
+	// next1:
+	//      if case2 goto body2 else next2
+	// next2:
+	//      jump default                      (if there is a default case)
+	// default:
+	//      ...
+	//
+	// Each body (KindSelectCaseBody) and next (KindSelectAfterCase)
+	// block has the case's CommClause as its Stmt. The default case,
+	// wherever it appears in the source, comes last. A select with no
+	// cases at all jumps to a terminal block of KindSelectForever.
+
 	// First evaluate channel expressions.
 	// TODO(adonovan): fix: evaluate only channel exprs here.
 	for _, clause := range s.Body.List {
@@ -300,20 +412,20 @@ func (b *builder) selectStmt(s *ast.SelectStmt, label *lblock) {
 		}
 	}
 
-	done := b.newBlock("select.done")
+	done := b.newBlock(KindSelectDone, s)
 	if label != nil {
 		label._break = done
 	}
 
-	var defaultBody *[]ast.Stmt
+	var defaultClause *ast.CommClause
 	for _, cc := range s.Body.List {
 		clause := cc.(*ast.CommClause)
 		if clause.Comm == nil {
-			defaultBody = &clause.Body
+			defaultClause = clause
 			continue
 		}
-		body := b.newBlock("select.body")
-		next := b.newBlock("select.next")
+		body := b.newBlock(KindSelectCaseBody, clause)
+		next := b.newBlock(KindSelectAfterCase, clause)
 		b.ifelse(body, next)
 		b.current = body
 		b.targets = &targets{
@@ -331,19 +443,33 @@ func (b *builder) selectStmt(s *ast.SelectStmt, label *lblock) {
 		b.jump(done)
 		b.current = next
 	}
-	if defaultBody != nil {
+	if defaultClause != nil {
+		body := b.newBlock(KindSelectCaseBody, defaultClause)
+		b.jump(body)
+		b.current = body
 		b.targets = &targets{
 			tail:   b.targets,
 			_break: done,
 		}
-		b.stmtList(*defaultBody)
+		b.stmtList(defaultClause.Body)
 		b.targets = b.targets.tail
 		b.jump(done)
+	} else if len(s.Body.List) == 0 {
+		// select {} blocks forever.
+		forever := b.newBlock(KindSelectForever, s)
+		b.terminate(forever, TerminalBlockForever, s)
+		b.jump(forever)
+	} else {
+		// No case is chosen: impossible, as the select blocks
+		// until one can proceed.
+		b.terminate(b.current, TerminalUnreachable, s)
 	}
 	b.current = done
 }
 
 func (b *builder) forStmt(s *ast.ForStmt, label *lblock) {
+	//	jump init
+	// init:
 	//	...init...
 	//      jump loop
 	// loop:
@@ -355,18 +481,25 @@ func (b *builder) forStmt(s *ast.ForStmt, label *lblock) {
 	//      ...post...
 	//      jump loop
 	// done:                                 (target of break)
+	//
+	// The init statement, if any, has a block of its own (KindForInit)
+	// preceding the loop. Only a loop with a condition has a dedicated
+	// loop block (KindForLoop), whose last node is the condition;
+	// otherwise the body block is the target of the back-edge. A post
+	// statement, if any, has a block of its own (KindForPost) on the
+	// back-edge.
 	if s.Init != nil {
-		b.stmt(s.Init)
+		b.initStmt(KindForInit, s, s.Init)
 	}
-	body := b.newBlock("for.body")
-	done := b.newBlock("for.done") // target of 'break'
-	loop := body                   // target of back-edge
+	body := b.newBlock(KindForBody, s)
+	done := b.newBlock(KindForDone, s) // target of 'break'
+	loop := body                       // target of back-edge
 	if s.Cond != nil {
-		loop = b.newBlock("for.loop")
+		loop = b.newBlock(KindForLoop, s)
 	}
 	cont := loop // target of 'continue'
 	if s.Post != nil {
-		cont = b.newBlock("for.post")
+		cont = b.newBlock(KindForPost, s)
 	}
 	if label != nil {
 		label._break = done
@@ -375,7 +508,7 @@ func (b *builder) forStmt(s *ast.ForStmt, label *lblock) {
 	b.jump(loop)
 	b.current = loop
 	if loop != body {
-		b.add(s.Cond)
+		b.addRequired(s.Cond)
 		b.ifelse(body, done)
 		b.current = body
 	}
@@ -397,6 +530,11 @@ func (b *builder) forStmt(s *ast.ForStmt, label *lblock) {
 }
 
 func (b *builder) rangeStmt(s *ast.RangeStmt, label *lblock) {
+	// A range over an integer, as in 'for i := range 10', has the
+	// same shape as one over a container: without type information
+	// the two cannot be told apart, as the operand may be a variable,
+	// so the blocks have the same kinds. In both, the operand is
+	// evaluated once, before the loop, and Key and Value may be nil.
 	b.add(s.X)
 
 	if s.Key != nil {
@@ -414,12 +552,12 @@ func (b *builder) rangeStmt(s *ast.RangeStmt, label *lblock) {
 	// 	jump loop
 	// done:                                   (target of break)
 
-	loop := b.newBlock("range.loop")
+	loop := b.newBlock(KindRangeLoop, s)
 	b.jump(loop)
 	b.current = loop
 
-	body := b.newBlock("range.body")
-	done := b.newBlock("range.done")
+	body := b.newBlock(KindRangeBody, s)
+	done := b.newBlock(KindRangeDone, s)
 	b.ifelse(body, done)
 	b.current = body
 
@@ -443,7 +581,6 @@ func (b *builder) rangeStmt(s *ast.RangeStmt, label *lblock) {
 // Destinations associated with unlabeled for/switch/select stmts.
 // We push/pop one of these as we enter/leave each construct and for
 // each BranchStmt we scan for the innermost target of the right type.
-//
 type targets struct {
 	tail         *targets // rest of stack
 	_break       *Block
@@ -454,51 +591,182 @@ type targets struct {
 // Destinations associated with a labeled block.
 // We populate these as labels are encountered in forward gotos or
 // labeled statements.
-//
 type lblock struct {
 	_goto     *Block
 	_break    *Block
 	_continue *Block
+	gotos     []*ast.BranchStmt // goto statements targeting the label
+	refs      []*ast.BranchStmt // all branch statements referring to the label
+	enclosing bool              // within a labeled statement that break may leave; see labeledStmt
 }
 
 // labeledBlock returns the branch target associated with the
 // specified label, creating it if needed.
-//
 func (b *builder) labeledBlock(label *ast.Ident) *lblock {
-	lb := b.lblocks[label.Obj]
+	// Labels have function scope, so their names are unique.
+	// (Keying by label.Obj would conflate undefined labels,
+	// which the parser leaves unresolved.)
+	lb := b.lblocks[label.Name]
 	if lb == nil {
-		lb = &lblock{_goto: b.newBlock(label.Name)}
+		lb = &lblock{_goto: b.newBlock(KindLabel, nil)}
+		lb._goto.label = label.Name
 		if b.lblocks == nil {
-			b.lblocks = make(map[*ast.Object]*lblock)
+			b.lblocks = make(map[string]*lblock)
 		}
-		b.lblocks[label.Obj] = lb
+		b.lblocks[label.Name] = lb
 	}
 	return lb
 }
 
+// initStmt starts the head block of s, of the specified kind, with
+// s's init statement: the block in which the init statement and, for
+// if and switch statements, the condition or tag are evaluated.
+func (b *builder) initStmt(kind BlockKind, s, init ast.Stmt) {
+	head := b.newBlock(kind, s)
+	b.jump(head)
+	b.current = head
+	b.stmt(init)
+}
+
 // newBlock appends a new unconnected basic block to b.cfg's block
 // slice and returns it.
 // It does not automatically become the current block.
-// comment is an optional string for more readable debugging output.
-func (b *builder) newBlock(comment string) *Block {
+// kind and stmt describe the block's purpose (see BlockKind), and
+// determine its name in debugging output.
+func (b *builder) newBlock(kind BlockKind, stmt ast.Stmt) *Block {
 	g := b.cfg
 	block := &Block{
-		Index:   int32(len(g.Blocks)),
-		comment: comment,
+		Index: int32(len(g.Blocks)),
+		Kind:  kind,
+		Stmt:  stmt,
+
+		protected: b.protected,
 	}
 	block.Succs = block.succs2[:0]
 	g.Blocks = append(g.Blocks, block)
 	return block
 }
 
+// add appends n to the current block, unless the filter rejects it.
 func (b *builder) add(n ast.Node) {
+	b.notePanic(n)
+	if b.keep(n) {
+		b.current.Nodes = append(b.current.Nodes, n)
+	}
+}
+
+// addRequired appends n to the current block regardless of the
+// filter. It is used for the nodes that determine the shape of the
+// graph: conditions, return statements, and calls that never return.
+func (b *builder) addRequired(n ast.Node) {
+	b.notePanic(n)
 	b.current.Nodes = append(b.current.Nodes, n)
 }
 
+// notePanic records a panic edge from the current block if n, about
+// to be added to it, may panic.
+func (b *builder) notePanic(n ast.Node) {
+	if b.mayPanic != nil && b.mayPanic(n) {
+		b.cfg.panics[n] = true
+		b.panicEdge(b.current)
+	}
+}
+
+// panicEdge records a panic edge from block, to the synthetic panic
+// block or, if panics are being recovered, the synthetic recover
+// block. The edges are added to Succs once the graph is complete,
+// so that they follow all other successors.
+func (b *builder) panicEdge(block *Block) {
+	edges := b.panicEdges[block]
+	if edges == nil {
+		edges = new([2]bool)
+		b.panicEdges[block] = edges
+	}
+	if b.protected {
+		if b.recoverBlock == nil {
+			b.recoverBlock = b.newBlock(KindRecover, nil)
+			b.recoverBlock.protected = false
+		}
+		edges[1] = true
+	} else {
+		if b.panicBlock == nil {
+			b.panicBlock = b.newBlock(KindPanic, nil)
+		}
+		edges[0] = true
+	}
+}
+
+// addPanicEdges adds the recorded panic edges to the successors of
+// their blocks.
+func (b *builder) addPanicEdges() {
+	for _, block := range b.cfg.Blocks {
+		if edges := b.panicEdges[block]; edges != nil {
+			if edges[0] {
+				block.Succs = append(block.Succs, b.panicBlock)
+				b.panicBlock.Preds = append(b.panicBlock.Preds, block)
+			}
+			if edges[1] {
+				block.Succs = append(block.Succs, b.recoverBlock)
+				b.recoverBlock.Preds = append(b.recoverBlock.Preds, block)
+			}
+		}
+	}
+	if b.panicBlock != nil {
+		b.terminate(b.panicBlock, TerminalPanicking, nil)
+	}
+	if b.recoverBlock != nil {
+		b.terminate(b.recoverBlock, TerminalRecovered, nil)
+	}
+}
+
+// addExit adds the exit block, and the edges to it from the terminal
+// blocks from which control leaves the function; see Options.ExitBlock.
+func (b *builder) addExit() {
+	exit := b.newBlock(KindExit, nil)
+	for _, t := range b.cfg.terminals {
+		if !leaves(t) {
+			continue
+		}
+		block := t.Block
+		if len(block.Succs) > 0 && block.Succs[0] == exit {
+			continue
+		}
+		// The edge to the exit precedes any panic edges.
+		block.Succs = append(block.Succs, nil)
+		copy(block.Succs[1:], block.Succs)
+		block.Succs[0] = exit
+		exit.Preds = append(exit.Preds, block)
+		exit.Live = exit.Live || block.Live
+		exit.reachable = exit.reachable || block.reachable
+	}
+	b.cfg.exit = exit
+}
+
+// leaves reports whether control leaves the function from the terminal
+// block t, as opposed to blocking forever or jumping nowhere.
+func leaves(t TerminalBlock) bool {
+	switch t.Reason {
+	case TerminalReturn, TerminalFallOffEnd, TerminalNoReturnCall, TerminalNoBody,
+		TerminalPanicking, TerminalRecovered:
+		return true
+	case TerminalPanic:
+		// With a panic edge, the panic leaves through the KindPanic
+		// block.
+		return !hasPanicEdge(t.Block)
+	}
+	return false
+}
+
+// keep reports whether the filter accepts n.
+func (b *builder) keep(n ast.Node) bool {
+	return b.filterNode == nil || b.filterNode(n)
+}
+
 // jump adds an edge from the current block to the target block,
 // and sets b.current to nil.
 func (b *builder) jump(target *Block) {
 	b.current.Succs = append(b.current.Succs, target)
+	target.Preds = append(target.Preds, b.current)
 	b.current = nil
 }
 
@@ -506,5 +774,7 @@ func (b *builder) jump(target *Block) {
 // and sets b.current to nil.
 func (b *builder) ifelse(t, f *Block) {
 	b.current.Succs = append(b.current.Succs, t, f)
+	t.Preds = append(t.Preds, b.current)
+	f.Preds = append(f.Preds, b.current)
 	b.current = nil
 }
@@ -5,7 +5,8 @@
 // Package cfg constructs a simple control-flow graph (CFG) of the
 // statements and expressions within a single function.
 //
-// Use cfg.New to construct the CFG for a function body.
+// Use cfg.New to construct the CFG for a function body,
+// or cfg.Build for more control over its construction.
 //
 // The blocks of the CFG contain all the function's non-control
 // statements.  The CFG does not contain control statements such as If,
@@ -29,13 +30,21 @@
 //        succs: 4
 //    4:
 //
+// The init statement of an if, for, switch, or type switch statement
+// begins a head block of its own (here, block 1, of kind KindIfInit),
+// which also holds the condition, tag, or type switch assignment, if
+// any; see CFG.InitBlock.
+//
 // The CFG does contain Return statements; even implicit returns are
 // materialized (at the position of the function's closing brace).
 //
-// The CFG does not record conditions associated with conditional branch
-// edges, nor the short-circuit semantics of the && and || operators,
-// nor abnormal control flow caused by panic.  If you need this
-// information, use golang.org/x/tools/go/ssa instead.
+// The condition of a conditional branch is the last node of the block
+// from which the two edges leave, the first of them when it holds;
+// CFG.EdgeLabel describes each edge in these terms. The CFG does not
+// record the short-circuit semantics of the && and || operators, nor,
+// unless requested (see Options.MayPanic), abnormal control flow
+// caused by panic.  If you need this information, use
+// golang.org/x/tools/go/ssa instead.
 //
 package cfg
 
@@ -45,46 +54,385 @@ import (
 	"go/ast"
 	"go/format"
 	"go/token"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 // A CFG represents the control-flow graph of a single function.
 //
 // The entry point is Blocks[0]; there may be multiple return blocks.
+//
+// A CFG returned by New or Build, and its blocks, must be treated as
+// immutable: they are often shared, for example among the analyzers
+// that use the result of a CFG-providing analysis, and they cache
+// derived results such as their dominator trees. Clients that need to
+// modify a CFG should modify a copy made by Clone.
 type CFG struct {
 	Blocks []*Block // block[0] is entry; order otherwise undefined
+
+	terminals     []TerminalBlock   // blocks terminated by the builder; see TerminalBlocks
+	panics        map[ast.Node]bool // nodes that may panic; nil unless panic modeling is enabled
+	recoverDefers []*ast.DeferStmt  // see RecoverDefers
+	exit          *Block            // see Exit
+	spawns        []SpawnEdge       // see Spawns
+	labels        []LabelInfo       // see Labels
+
+	// Lazily computed results.
+	domOnce, pdomOnce sync.Once
+	dom, pdom         *DomTree
+	indexOnce         sync.Once
+	index             map[ast.Node]nodeRef // see BlockOf
+	loopsOnce         sync.Once
+	loops             []*Loop // see LoopsContaining
+	reachOnce         sync.Once
+	reachDone         uint32     // atomically set once reach is computed
+	reach             []blockSet // blocks reachable from each live block; see BuildReachability
 }
 
 // A Block represents a basic block: a list of statements and
 // expressions that are always evaluated sequentially.
 //
 // A block may have 0-2 successors: zero for a return block or a block
-// that calls a function such as panic that never returns; one for a
-// normal (jump) block; and two for a conditional (if) block.
+// that calls a function such as panic that never returns (unless the
+// CFG has an exit block, to which they have an edge; see
+// Options.ExitBlock); one for a normal (jump) block; and two for a
+// conditional (if) block.
+// When panics are modeled (see Options.MayPanic), a block may also
+// have one or two panic edges, which follow its other successors.
+//
+// Preds holds the blocks of which a block is a successor, once for
+// each such edge, so that p is in b.Preds as many times as b is in
+// p.Succs, including for the synthetic blocks. It is in the order in
+// which the builder created the edges, which depends only on the
+// function body; panic edges, created once the graph is otherwise
+// complete, come last.
 type Block struct {
 	Nodes []ast.Node // statements, expressions, and ValueSpecs
 	Succs []*Block   // successor nodes in the graph
+	Preds []*Block   // predecessor nodes in the graph (including unreachable ones), in order of edge creation
 	Index int32      // index within CFG.Blocks
 	Live  bool       // block is reachable from entry
+	Kind  BlockKind  // block kind
+	Stmt  ast.Stmt   // statement that gave rise to this block (see BlockKind for details)
 
-	comment string    // for debugging
-	succs2  [2]*Block // underlying array for Succs
+	label      string    // name of a KindLabel block
+	typeSwitch bool      // block of a clause of a TypeSwitchStmt
+	succs2     [2]*Block // underlying array for Succs
+
+	noReturnSucc *Block // successor but for a call that never returns, or nil
+	reachable    bool   // block is reachable from entry if all calls return
+	protected    bool   // block follows a recovering defer; see Protected
 }
 
-// New returns a new control-flow graph for the specified function body,
-// which must be non-nil.
+// A BlockKind identifies the purpose of a block.
+// It also determines the possible types of its Stmt field.
+//
+// The blocks of a range over an integer, such as 'for i := range 10',
+// have the same kinds as those of a range over a container, since the
+// two cannot be told apart without type information.
+type BlockKind uint8
+
+const (
+	KindInvalid BlockKind = iota // Stmt=nil
+
+	KindUnreachable     // unreachable block after {Branch,Return}Stmt / no-return call ExprStmt
+	KindBody            // function body BlockStmt
+	KindExit            // synthetic exit of the function (Stmt=nil); see Options.ExitBlock
+	KindForBody         // body of ForStmt
+	KindForDone         // block after ForStmt
+	KindForInit         // init statement of ForStmt
+	KindForLoop         // head of ForStmt with a condition; the condition is its last node
+	KindForPost         // post statement of ForStmt
+	KindIfDone          // block after IfStmt
+	KindIfElse          // else block of IfStmt
+	KindIfInit          // head of IfStmt with an init statement, followed by the condition
+	KindIfThen          // then block of IfStmt
+	KindLabel           // labeled block of LabeledStmt (Stmt may be nil for dangling label)
+	KindLabelDone       // block after a LabeledStmt other than a loop, switch, or select, if break targets it
+	KindPanic           // synthetic target of panic edges (Stmt=nil); see Options.MayPanic
+	KindRangeBody       // body of RangeStmt
+	KindRangeDone       // block after RangeStmt
+	KindRangeLoop       // head block of RangeStmt
+	KindRecover         // synthetic target of recovered panic edges (Stmt=nil); see Options.ModelRecover
+	KindSelectCaseBody  // body of CommClause, including the default case
+	KindSelectDone      // block after SelectStmt
+	KindSelectAfterCase // block after a CommClause
+	KindSelectForever   // terminal block of SelectStmt with no cases, which blocks forever
+	KindSwitchCaseBody  // body of CaseClause
+	KindSwitchDone      // block after {Type.}SwitchStmt
+	KindSwitchInit      // head of {Type.}SwitchStmt with an init statement, followed by the tag or assignment
+	KindSwitchNextCase  // secondary expression of a multi-expression CaseClause
+	KindUndefinedBranch // target of BranchStmt with no valid destination
+)
+
+func (kind BlockKind) String() string {
+	return [...]string{
+		KindInvalid:         "Invalid",
+		KindUnreachable:     "Unreachable",
+		KindBody:            "Body",
+		KindExit:            "Exit",
+		KindForBody:         "ForBody",
+		KindForDone:         "ForDone",
+		KindForInit:         "ForInit",
+		KindForLoop:         "ForLoop",
+		KindForPost:         "ForPost",
+		KindIfDone:          "IfDone",
+		KindIfElse:          "IfElse",
+		KindIfInit:          "IfInit",
+		KindIfThen:          "IfThen",
+		KindLabel:           "Label",
+		KindLabelDone:       "LabelDone",
+		KindPanic:           "Panic",
+		KindRangeBody:       "RangeBody",
+		KindRangeDone:       "RangeDone",
+		KindRangeLoop:       "RangeLoop",
+		KindRecover:         "Recover",
+		KindSelectCaseBody:  "SelectCaseBody",
+		KindSelectDone:      "SelectDone",
+		KindSelectAfterCase: "SelectAfterCase",
+		KindSelectForever:   "SelectForever",
+		KindSwitchCaseBody:  "SwitchCaseBody",
+		KindSwitchDone:      "SwitchDone",
+		KindSwitchInit:      "SwitchInit",
+		KindSwitchNextCase:  "SwitchNextCase",
+		KindUndefinedBranch: "UndefinedBranch",
+	}[kind]
+}
+
+// New returns a new control-flow graph for the specified function body.
+//
+// A nil body, that of a function implemented externally (for example,
+// in assembly), yields a CFG of a single empty live block with no
+// successors, reported by TerminalBlocks as TerminalNoBody. An empty
+// body yields a single block holding only the implicit return
+// statement, reported as TerminalFallOffEnd.
 //
 // The CFG builder calls mayReturn to determine whether a given function
 // call may return.  For example, calls to panic, os.Exit, and log.Fatal
 // do not return, so the builder can remove infeasible graph edges
 // following such calls.  The builder calls mayReturn only for a
 // CallExpr beneath an ExprStmt.
+//
+// mayReturn must be pure: its result must depend only on the call.
+// The builder may call it any number of times, in any order; clients
+// building many CFGs with an expensive predicate may wish to wrap it
+// using MemoizeMayReturn.
 func New(body *ast.BlockStmt, mayReturn func(*ast.CallExpr) bool) *CFG {
+	return Build(body, Options{MayReturn: mayReturn})
+}
+
+// NewFunc returns a new control-flow graph for the function declared
+// by decl, as New does for its body, with an exit block (see
+// Options.ExitBlock) and the calls deferred by its defer statements
+// run on the way to it (see Options.RunDefers).
+func NewFunc(decl *ast.FuncDecl, mayReturn func(*ast.CallExpr) bool) *CFG {
+	return Build(decl.Body, Options{MayReturn: mayReturn, ExitBlock: true, RunDefers: true})
+}
+
+// Options controls the construction of a CFG by Build.
+type Options struct {
+	// MayReturn reports whether a given function call may return;
+	// see New. If nil, all calls are assumed to return.
+	MayReturn func(*ast.CallExpr) bool
+
+	// FilterNode, if non-nil, is consulted before each node is
+	// appended to a block's Nodes; nodes for which it returns false
+	// are omitted. For a var declaration, it is consulted first for
+	// the DeclStmt and then for each of its ValueSpecs.
+	//
+	// Filtering never affects the structure of the graph: the
+	// blocks, their kinds, successors, and liveness are the same as
+	// without a filter, although some blocks may end up empty.
+	// For the same reason, the nodes that determine that structure
+	// are exempt from filtering: the conditions of if and for
+	// statements and the expressions of switch cases (each of which
+	// is the last node of a block with two successors), return
+	// statements (explicit or implicit), and calls that never return.
+	// Neither is it consulted for the DeferRun nodes of RunDefers.
+	FilterNode func(ast.Node) bool
+
+	// MayPanic, if non-nil, enables the modeling of panics. It is
+	// consulted for each node added to a block (and for those
+	// that FilterNode omits), other than the implicit return
+	// statement at the end of the body, and reports whether
+	// evaluating the node may panic. Each block containing such a
+	// node, or ending with a call to the panic built-in, has an
+	// additional successor, after all others: a synthetic block of
+	// kind KindPanic, with no nodes or successors, which represents
+	// the propagation of the panic to the caller (after the
+	// deferred calls have run).
+	//
+	// Panic edges leave from blocks, not nodes: the nodes of a
+	// block that follow the one that panics are not executed on
+	// the path through its panic edge.
+	MayPanic func(ast.Node) bool
+
+	// ModelRecover, with MayPanic, enables the modeling of
+	// deferred calls that recover from panics. If the function
+	// body contains, among its top-level statements, a defer
+	// statement that recovers (see IsRecoverDefer), then the
+	// panic edges of the nodes that follow it, being recovered,
+	// lead instead to a synthetic block of kind KindRecover, with
+	// no nodes or successors, which represents the return of the
+	// function to its caller once the deferred calls have run.
+	//
+	// Only unconditional defer statements are considered: a
+	// defer statement nested within another statement may not be
+	// executed, so it protects nothing, and panic edges after it
+	// conservatively lead to the KindPanic block.
+	ModelRecover bool
+
+	// IsRecoverDefer reports whether a defer statement defers a call
+	// that recovers from panics. If nil, a defer statement recovers
+	// if it calls a function literal whose body (not counting any
+	// nested function literals) calls recover. Type-aware clients
+	// may wish to also recognize calls of named functions.
+	IsRecoverDefer func(*ast.DeferStmt) bool
+
+	// SkipNoReturnLiveness disables the computation of the second
+	// result of Block.Liveness, which then reports every block as
+	// reachable if all calls return.
+	SkipNoReturnLiveness bool
+
+	// Stats, if non-nil, is filled in with statistics about the
+	// construction of the CFG.
+	Stats *BuildStats
+
+	// Spawns enables the recording of the go and defer statements
+	// of the function body, each with the CFG of the function
+	// literal it calls, if any, built recursively with the same
+	// options; see CFG.Spawns.
+	Spawns bool
+
+	// ExitBlock adds a synthetic block of kind KindExit, with no
+	// nodes or successors, which represents the exit of the function
+	// once its deferred calls have run (see CFG.Exit). Each block
+	// from which control leaves the function has an edge to it, before
+	// any panic edges: return blocks, explicit or implicit, of kind
+	// EdgeReturn; blocks that end with a call that never returns, of
+	// kind EdgeNoReturn; and, when panics are modeled, the KindPanic
+	// block, of kind EdgeNoReturn, and the KindRecover block, of kind
+	// EdgeReturn. (A call to panic whose block has a panic edge leaves
+	// through the KindPanic block.) Blocks from which control never
+	// leaves, such as that of an empty select statement, have no such
+	// edge.
+	//
+	// The exit block, which is the last of the CFG, is live if one of
+	// its predecessors is; it does not affect the liveness of the
+	// other blocks.
+	ExitBlock bool
+
+	// RunDefers adds to the end of each block from which control
+	// leaves the function (see ExitBlock) a synthetic DeferRun node
+	// for each defer statement executed on some path to it, in the
+	// reverse order of the statements, so that the nodes of the
+	// block follow the order in which the deferred calls run. (A
+	// defer statement that may be executed more than once, as in a
+	// loop, has a single DeferRun, and branches such as goto may
+	// execute defer statements out of order, so the order is
+	// approximate.) If the statement is executed on some paths to
+	// the block but not all, as within an if statement, the DeferRun
+	// is marked May.
+	//
+	// The paths include panic edges (see MayPanic), which may leave
+	// a block before its defer statements, so that the KindPanic and
+	// KindRecover blocks run only the deferred calls of the defer
+	// statements executed before the blocks that may panic. The
+	// deferred calls are not themselves considered to panic.
+	RunDefers bool
+
+	// OnBlock, if non-nil, is called once for each block of the
+	// CFG, in order of Index, with the block and its Kind and Stmt,
+	// so that clients may compute per-block information during
+	// construction (see Annotate).
+	//
+	// The calls happen at the end of construction, once the graph is
+	// complete: the block's Nodes, Succs, Preds, Live, and Liveness
+	// are final, as are those of every other block, including the
+	// synthetic panic blocks. (The builder may append nodes and
+	// successors to a block after starting others, so no earlier
+	// moment is final for all of them.) OnBlock must not modify the
+	// CFG. It is not called for the blocks of the CFGs of spawned
+	// function literals (see Spawns).
+	OnBlock func(b *Block, kind BlockKind, stmt ast.Stmt)
+}
+
+// Build returns a new control-flow graph for the specified function
+// body, constructed according to opts. See New for the treatment of
+// nil and empty bodies.
+func Build(body *ast.BlockStmt, opts Options) *CFG {
+	var start time.Time
+	if opts.Stats != nil {
+		start = time.Now()
+	}
+	if body == nil {
+		g := new(CFG)
+		entry := &Block{Live: true, reachable: true, Kind: KindBody}
+		entry.Succs = entry.succs2[:0]
+		g.Blocks = []*Block{entry}
+		g.terminals = []TerminalBlock{{Block: entry, Reason: TerminalNoBody}}
+		if opts.ExitBlock {
+			b := builder{cfg: g}
+			b.addExit()
+		}
+		if opts.OnBlock != nil {
+			for _, blk := range g.Blocks {
+				opts.OnBlock(blk, blk.Kind, blk.Stmt)
+			}
+		}
+		g.freeze()
+		if opts.Stats != nil {
+			g.recordStats(opts.Stats, 0, 0, start)
+		}
+		return g
+	}
+
+	mayReturn := opts.MayReturn
+	if mayReturn == nil {
+		mayReturn = func(*ast.CallExpr) bool { return true }
+	}
 	b := builder{
-		mayReturn: mayReturn,
-		cfg:       new(CFG),
+		mayReturn:  mayReturn,
+		filterNode: opts.FilterNode,
+		cfg:        new(CFG),
+	}
+	if opts.RunDefers {
+		b.runDefers = true
+		b.deferBlocks = make(map[*Block][]int)
+	}
+	if opts.Spawns {
+		spawnOpts := opts
+		spawnOpts.Stats = nil // the statistics are those of this CFG only
+		spawnOpts.OnBlock = nil
+		b.spawnOpts = &spawnOpts
 	}
-	b.current = b.newBlock("entry")
+	if opts.MayPanic != nil {
+		b.mayPanic = opts.MayPanic
+		b.panicEdges = make(map[*Block]*[2]bool)
+		b.cfg.panics = make(map[ast.Node]bool)
+		if opts.ModelRecover {
+			isRecoverDefer := opts.IsRecoverDefer
+			if isRecoverDefer == nil {
+				isRecoverDefer = deferOfRecover
+			}
+			for _, s := range body.List {
+				if s, ok := s.(*ast.DeferStmt); ok && isRecoverDefer(s) {
+					if b.recoverDefers == nil {
+						b.recoverDefers = make(map[*ast.DeferStmt]bool)
+					}
+					b.recoverDefers[s] = true
+				}
+			}
+		}
+	}
+	b.current = b.newBlock(KindBody, body)
 	b.stmt(body)
+	if b.mayPanic != nil {
+		b.addPanicEdges()
+	}
 
 	// Compute liveness (reachability from entry point), breadth-first.
 	q := make([]*Block, 0, len(b.cfg.Blocks))
@@ -99,41 +447,291 @@ func New(body *ast.BlockStmt, mayReturn func(*ast.CallExpr) bool) *CFG {
 		}
 	}
 
+	// Compute liveness again as if all calls returned, restoring
+	// the edges removed after calls that do not.
+	if opts.SkipNoReturnLiveness {
+		for _, b := range b.cfg.Blocks {
+			b.reachable = true
+		}
+	} else {
+		q = append(q, b.cfg.Blocks[0])
+		for len(q) > 0 {
+			b := q[len(q)-1]
+			q = q[:len(q)-1]
+
+			if !b.reachable {
+				b.reachable = true
+				q = append(q, b.Succs...)
+				if b.noReturnSucc != nil {
+					q = append(q, b.noReturnSucc)
+				}
+			}
+		}
+	}
+
 	// Does control fall off the end of the function's body?
 	// Make implicit return explicit.
 	if b.current != nil && b.current.Live {
-		b.add(&ast.ReturnStmt{
+		ret := &ast.ReturnStmt{
 			Return: body.End() - 1,
-		})
+		}
+		// The implicit return evaluates nothing, so it cannot
+		// panic; in any case, the panic edges have been added.
+		b.current.Nodes = append(b.current.Nodes, ret)
+		b.terminate(b.current, TerminalFallOffEnd, ret)
+	}
+
+	// A goto to a label that is never defined jumps to a block
+	// with no successors.
+	for _, lb := range b.lblocks {
+		if lb._goto.Stmt == nil && len(lb.gotos) > 0 {
+			b.terminate(lb._goto, TerminalUndefinedLabelJump, lb.gotos[0])
+		}
+	}
+	// A break or continue statement whose label is defined, but
+	// not on a statement it may target, is invalid instead.
+	for i, t := range b.cfg.terminals {
+		if s, ok := t.Node.(*ast.BranchStmt); ok && t.Reason == TerminalUndefinedLabelJump && s.Tok != token.GOTO && s.Label != nil {
+			if b.lblocks[s.Label.Name]._goto.Stmt != nil {
+				b.cfg.terminals[i].Reason = TerminalInvalidBranch
+			}
+		}
+	}
+	if opts.RunDefers {
+		b.addDeferRuns()
+	}
+	if opts.ExitBlock {
+		b.addExit()
+	}
+	b.recordLabels()
+	if opts.OnBlock != nil {
+		for _, blk := range b.cfg.Blocks {
+			opts.OnBlock(blk, blk.Kind, blk.Stmt)
+		}
 	}
 
+	b.cfg.freeze()
+	if opts.Stats != nil {
+		b.cfg.recordStats(opts.Stats, b.maxDepth, len(b.lblocks), start)
+	}
 	return b.cfg
 }
 
+// kindNames holds the names of the blocks of each kind; see Block.name.
+var kindNames = [...]string{
+	KindInvalid:         "invalid",
+	KindBody:            "entry",
+	KindExit:            "exit",
+	KindForBody:         "for.body",
+	KindForDone:         "for.done",
+	KindForInit:         "for.init",
+	KindForLoop:         "for.loop",
+	KindForPost:         "for.post",
+	KindIfDone:          "if.done",
+	KindIfElse:          "if.else",
+	KindIfInit:          "if.init",
+	KindIfThen:          "if.then",
+	KindLabelDone:       "label.done",
+	KindPanic:           "panic",
+	KindRangeBody:       "range.body",
+	KindRangeDone:       "range.done",
+	KindRangeLoop:       "range.loop",
+	KindRecover:         "recover",
+	KindSelectCaseBody:  "select.body",
+	KindSelectDone:      "select.done",
+	KindSelectAfterCase: "select.next",
+	KindSelectForever:   "select.forever",
+	KindSwitchCaseBody:  "switch.body",
+	KindSwitchDone:      "switch.done",
+	KindSwitchInit:      "switch.init",
+	KindSwitchNextCase:  "switch.next",
+	KindUndefinedBranch: "undefined.branch",
+}
+
+// name returns the short description of b, such as "if.then", as
+// shown by String, Name, and Format, which is derived from its Kind
+// and Stmt: that of a labeled block is the label.
+func (b *Block) name() string {
+	switch b.Kind {
+	case KindLabel:
+		return b.label
+	case KindUnreachable:
+		// The statement after which control cannot continue.
+		switch b.Stmt.(type) {
+		case *ast.ExprStmt:
+			return "unreachable.call"
+		case *ast.ReturnStmt:
+			return "unreachable.return"
+		}
+		return "unreachable.branch"
+	case KindSelectCaseBody:
+		if clause, ok := b.Stmt.(*ast.CommClause); ok && clause.Comm == nil {
+			return "select.default"
+		}
+	case KindSwitchDone, KindSwitchInit:
+		if _, ok := b.Stmt.(*ast.TypeSwitchStmt); ok {
+			return "type" + kindNames[b.Kind]
+		}
+	case KindSwitchCaseBody, KindSwitchNextCase:
+		if b.typeSwitch {
+			return "type" + kindNames[b.Kind]
+		}
+	}
+	if int(b.Kind) < len(kindNames) {
+		return kindNames[b.Kind]
+	}
+	return ""
+}
+
 func (b *Block) String() string {
-	return fmt.Sprintf("block %d (%s)", b.Index, b.comment)
+	return fmt.Sprintf("block %d (%s)", b.Index, b.name())
+}
+
+// Name returns a descriptive name for the block, suitable for
+// display: its short description, derived from its Kind and Stmt,
+// followed by the file name and line of the statement that gave rise
+// to it, for example "for.body@parser.go:142". Blocks without such a
+// statement (such as the target of a goto to an undefined label), and
+// those whose statement has no position, have only the short
+// description.
+func (b *Block) Name(fset *token.FileSet) string {
+	if b.Stmt == nil || !b.Stmt.Pos().IsValid() {
+		return b.name()
+	}
+	posn := fset.Position(b.Stmt.Pos())
+	return fmt.Sprintf("%s@%s:%d", b.name(), filepath.Base(posn.Filename), posn.Line)
+}
+
+// Liveness reports whether the block is reachable from the entry
+// block (which is the same as Live), and whether it would be if all
+// calls returned, that is, if the mayReturn predicate had reported
+// true for all calls.
+//
+// A block that is unreachable only because of calls that do not
+// return is dead as a consequence of the predicate, which may be a
+// heuristic; a block that is unreachable in both senses, such as one
+// following a return statement or an unconditional break, can never
+// execute.
+//
+// If the CFG was built with Options.SkipNoReturnLiveness, the second
+// result is true for every block.
+func (b *Block) Liveness() (reachable, reachableIgnoringNoReturn bool) {
+	return b.Live, b.reachable
+}
+
+// exits reports whether control leaves the function from b, which has
+// no successors other than panic edges and the edge to the exit block.
+func (b *Block) exits() bool {
+	for _, s := range b.Succs {
+		if s.Kind != KindPanic && s.Kind != KindRecover && s.Kind != KindExit {
+			return false
+		}
+	}
+	return true
+}
+
+// Protected reports whether a deferred call that recovers from panics
+// has been registered on every path to the start of the block, so
+// that panics within the block are recovered. It is always false
+// unless the CFG was built with Options.ModelRecover.
+func (b *Block) Protected() bool {
+	return b.protected
+}
+
+// Exit returns the exit block of g, through which control leaves the
+// function, or nil unless g was built with Options.ExitBlock.
+func (g *CFG) Exit() *Block {
+	return g.exit
+}
+
+// RecoverDefers returns the top-level defer statements whose deferred
+// calls recover from panics, in source order; after the first of
+// them, the panic edges of the CFG lead to its KindRecover block,
+// and blocks are Protected. It returns nil unless the CFG was built
+// with Options.ModelRecover.
+func (g *CFG) RecoverDefers() []*ast.DeferStmt {
+	return g.recoverDefers
+}
+
+// deferOfRecover reports whether s defers a call of a function
+// literal whose body calls recover.
+func deferOfRecover(s *ast.DeferStmt) bool {
+	lit, ok := s.Call.Fun.(*ast.FuncLit)
+	if !ok {
+		return false
+	}
+	found := false
+	ast.Inspect(lit.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false // a nested literal's recover is not effective
+		case *ast.CallExpr:
+			if id, ok := n.Fun.(*ast.Ident); ok && id.Name == "recover" {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
 }
 
 // Return returns the return statement at the end of this block if present, nil otherwise.
+// (The DeferRun nodes of Options.RunDefers that follow it are ignored.)
 func (b *Block) Return() (ret *ast.ReturnStmt) {
-	if len(b.Nodes) > 0 {
-		ret, _ = b.Nodes[len(b.Nodes)-1].(*ast.ReturnStmt)
-	}
+	ret, _ = b.lastNode().(*ast.ReturnStmt)
 	return
 }
 
+// lastNode returns the last node of b, not counting the DeferRun nodes
+// that follow it, or nil if there is none.
+func (b *Block) lastNode() ast.Node {
+	for i := len(b.Nodes) - 1; i >= 0; i-- {
+		if _, ok := b.Nodes[i].(*DeferRun); !ok {
+			return b.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// A FormatOption modifies the listing of a CFG by Format.
+type FormatOption uint8
+
+const (
+	// FormatPreds adds the number of predecessors of each block to
+	// the line that introduces it, as in ".4: # if.done (preds: 2)".
+	FormatPreds FormatOption = 1 << iota
+
+	// FormatEdges follows each successor, but those of unconditional
+	// edges, with a short description of the label of its edge (see
+	// CFG.EdgeLabel), as in "succs: 2 (true) 3 (false)".
+	FormatEdges
+)
+
 // Format formats the control-flow graph for ease of debugging.
-func (g *CFG) Format(fset *token.FileSet) string {
+func (g *CFG) Format(fset *token.FileSet, opts ...FormatOption) string {
+	var opt FormatOption
+	for _, o := range opts {
+		opt |= o
+	}
 	var buf bytes.Buffer
 	for _, b := range g.Blocks {
-		fmt.Fprintf(&buf, ".%d: # %s\n", b.Index, b.comment)
+		fmt.Fprintf(&buf, ".%d: # %s", b.Index, b.name())
+		if opt&FormatPreds != 0 {
+			fmt.Fprintf(&buf, " (preds: %d)", len(b.Preds))
+		}
+		buf.WriteByte('\n')
 		for _, n := range b.Nodes {
 			fmt.Fprintf(&buf, "\t%s\n", formatNode(fset, n))
 		}
 		if len(b.Succs) > 0 {
 			fmt.Fprintf(&buf, "\tsuccs:")
-			for _, succ := range b.Succs {
+			for i, succ := range b.Succs {
 				fmt.Fprintf(&buf, " %d", succ.Index)
+				if opt&FormatEdges != 0 {
+					if text := b.SuccLabel(i).text(fset); text != "" {
+						fmt.Fprintf(&buf, " (%s)", text)
+					}
+				}
 			}
 			buf.WriteByte('\n')
 		}
@@ -142,9 +740,60 @@ func (g *CFG) Format(fset *token.FileSet) string {
 	return buf.String()
 }
 
-func formatNode(fset *token.FileSet, n ast.Node) string {
+// DumpSSALike writes a listing of the control-flow graph to w in a
+// layout resembling the block listings of golang.org/x/tools/go/ssa,
+// for comparison with them. Each block is introduced by a line of the
+// form
+//
+//	N: comment (preds: P...) (succs: S...)
+//
+// where comment is the block's short description (such as "if.then",
+// the same as that of the corresponding SSA block); it is followed by
+// one line for each node, holding its position and its source, with
+// line breaks rendered as \n and tabs as \t.
+//
+// Unlike SSA, the listing includes unreachable blocks.
+func (g *CFG) DumpSSALike(fset *token.FileSet, w io.Writer) {
+	var buf bytes.Buffer
+	for _, b := range g.Blocks {
+		fmt.Fprintf(&buf, "%d: %s (preds:", b.Index, b.name())
+		for _, pred := range b.Preds {
+			fmt.Fprintf(&buf, " %d", pred.Index)
+		}
+		buf.WriteString(") (succs:")
+		for _, succ := range b.Succs {
+			fmt.Fprintf(&buf, " %d", succ.Index)
+		}
+		buf.WriteString(")\n")
+		for _, n := range b.Nodes {
+			posn := fset.Position(n.Pos())
+			posn.Filename = filepath.Base(posn.Filename)
+			fmt.Fprintf(&buf, "\t%s\t%s\n", posn, formatNodeLine(fset, n))
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+// printNode returns the source of n, as printed by go/format.
+func printNode(fset *token.FileSet, n ast.Node) string {
+	if d, ok := n.(*DeferRun); ok {
+		s := "defer-run " + printNode(fset, d.Defer.Call)
+		if d.May {
+			s += " // may run"
+		}
+		return s
+	}
 	var buf bytes.Buffer
 	format.Node(&buf, fset, n)
+	return buf.String()
+}
+
+func formatNode(fset *token.FileSet, n ast.Node) string {
 	// Indent secondary lines by a tab.
-	return string(bytes.Replace(buf.Bytes(), []byte("\n"), []byte("\n\t"), -1))
+	return strings.Replace(printNode(fset, n), "\n", "\n\t", -1)
+}
+
+// formatNodeLine is like formatNode but renders n on a single line.
+func formatNodeLine(fset *token.FileSet, n ast.Node) string {
+	return strings.NewReplacer("\n", `\n`, "\t", `\t`).Replace(printNode(fset, n))
 }
@@ -10,168 +10,812 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-const src = `package main
-
-import "log"
-
-func f1() {
-	live()
-	return
-	dead()
+// A trivial mayReturn predicate that looks only at syntax, not types.
+func mayReturn(call *ast.CallExpr) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name != "panic"
+	case *ast.SelectorExpr:
+		return fun.Sel.Name != "Fatal"
+	}
+	return true
 }
 
-func f2() {
+func TestBlockName(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+	if x {
+		goto L
+	}
 	for {
-		live()
 	}
-	dead()
 }
-
-func f3() {
-	if true { // even known values are ignored
-		return
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "name.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
 	}
-	for true { // even known values are ignored
-		live()
+	g := New(f.Decls[0].(*ast.FuncDecl).Body, mayReturn)
+	var names []string
+	for _, b := range g.Blocks {
+		names = append(names, b.Name(fset))
 	}
-	for {
-		live()
+	got := strings.Join(names, " ")
+	want := "entry@name.go:3 if.then@name.go:4 if.done@name.go:4 L unreachable.branch@name.go:5 for.body@name.go:7 for.done@name.go:7"
+	if got != want {
+		t.Errorf("got block names %s, want %s", got, want)
+	}
+	// String's short form is unaffected.
+	if got, want := g.Blocks[5].String(), "block 5 (for.body)"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
 	}
-	dead()
 }
 
-func f4(x int) {
-	switch x {
-	case 1:
-		live()
+func TestBlockKinds(t *testing.T) {
+	const src = `package p
+
+func f(x int, y interface{}, ch chan int) {
+	defer func() { recover() }()
+	if v := x; v > 0 {
+		a()
+	} else {
+		b()
+	}
+	for i := 0; i < x; i++ {
+		if i == 1 {
+			continue
+		}
+	}
+	for range ch {
+		break
+	}
+	switch z := x; z {
+	case 1, 2:
 		fallthrough
-	case 2:
-		live()
-		log.Fatal()
 	default:
-		panic("oops")
+		c()
+	case 3:
+	}
+	switch y.(type) {
+	case int, string:
+	default:
 	}
-	dead()
-}
-
-func f4(ch chan int) {
 	select {
 	case <-ch:
-		live()
-		return
 	default:
-		live()
-		panic("oops")
 	}
-	dead()
+L:
+	if x > 1 {
+		break L
+	}
+	goto M
+	if x > 2 {
+		log.Fatal()
+	}
+	if x > 3 {
+		continue
+	}
+	if x > 4 {
+		goto N
+	}
+	select {}
+M:
+	return
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "kinds.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := Build(f.Decls[0].(*ast.FuncDecl).Body, Options{
+		MayReturn:    mayReturn,
+		MayPanic:     func(ast.Node) bool { return true },
+		ModelRecover: true,
+		ExitBlock:    true,
+	})
+	var lines []string
+	seen := make(map[BlockKind]bool)
+	for _, b := range g.Blocks {
+		stmt := "nil"
+		if b.Stmt != nil {
+			stmt = fmt.Sprintf("%T", b.Stmt)
+		}
+		lines = append(lines, fmt.Sprintf("%d %s %s %s", b.Index, b.name(), b.Kind, stmt))
+		seen[b.Kind] = true
+		if got, want := b.String(), fmt.Sprintf("block %d (%s)", b.Index, b.name()); got != want {
+			t.Errorf("String() = %s, want %s", got, want)
+		}
+	}
+	got := strings.Join(lines, "\n")
+	// The name of a block follows from its kind and statement.
+	const want = `0 entry Body *ast.BlockStmt
+1 panic Panic nil
+2 if.init IfInit *ast.IfStmt
+3 recover Recover nil
+4 if.then IfThen *ast.IfStmt
+5 if.done IfDone *ast.IfStmt
+6 if.else IfElse *ast.IfStmt
+7 for.init ForInit *ast.ForStmt
+8 for.body ForBody *ast.ForStmt
+9 for.done ForDone *ast.ForStmt
+10 for.loop ForLoop *ast.ForStmt
+11 for.post ForPost *ast.ForStmt
+12 if.then IfThen *ast.IfStmt
+13 if.done IfDone *ast.IfStmt
+14 unreachable.branch Unreachable *ast.BranchStmt
+15 range.loop RangeLoop *ast.RangeStmt
+16 range.body RangeBody *ast.RangeStmt
+17 range.done RangeDone *ast.RangeStmt
+18 unreachable.branch Unreachable *ast.BranchStmt
+19 switch.init SwitchInit *ast.SwitchStmt
+20 switch.done SwitchDone *ast.SwitchStmt
+21 switch.body SwitchCaseBody *ast.CaseClause
+22 switch.body SwitchCaseBody *ast.CaseClause
+23 switch.next SwitchNextCase *ast.CaseClause
+24 switch.next SwitchNextCase *ast.CaseClause
+25 unreachable.branch Unreachable *ast.BranchStmt
+26 switch.body SwitchCaseBody *ast.CaseClause
+27 switch.next SwitchNextCase *ast.CaseClause
+28 typeswitch.done SwitchDone *ast.TypeSwitchStmt
+29 typeswitch.body SwitchCaseBody *ast.CaseClause
+30 typeswitch.next SwitchNextCase *ast.CaseClause
+31 typeswitch.next SwitchNextCase *ast.CaseClause
+32 select.done SelectDone *ast.SelectStmt
+33 select.body SelectCaseBody *ast.CommClause
+34 select.next SelectAfterCase *ast.CommClause
+35 select.default SelectCaseBody *ast.CommClause
+36 L Label *ast.LabeledStmt
+37 if.then IfThen *ast.IfStmt
+38 if.done IfDone *ast.IfStmt
+39 label.done LabelDone *ast.LabeledStmt
+40 unreachable.branch Unreachable *ast.BranchStmt
+41 M Label *ast.LabeledStmt
+42 unreachable.branch Unreachable *ast.BranchStmt
+43 if.then IfThen *ast.IfStmt
+44 if.done IfDone *ast.IfStmt
+45 unreachable.call Unreachable *ast.ExprStmt
+46 if.then IfThen *ast.IfStmt
+47 if.done IfDone *ast.IfStmt
+48 undefined.branch UndefinedBranch *ast.BranchStmt
+49 unreachable.branch Unreachable *ast.BranchStmt
+50 if.then IfThen *ast.IfStmt
+51 if.done IfDone *ast.IfStmt
+52 N Label nil
+53 unreachable.branch Unreachable *ast.BranchStmt
+54 select.done SelectDone *ast.SelectStmt
+55 select.forever SelectForever *ast.SelectStmt
+56 unreachable.return Unreachable *ast.ReturnStmt
+57 exit Exit nil`
+	if got != want {
+		t.Errorf("blocks:\n%s\nwant:\n%s", got, want)
+	}
+	for kind := KindUnreachable; kind <= KindUndefinedBranch; kind++ {
+		if !seen[kind] {
+			t.Errorf("no block of kind %s", kind)
+		}
+	}
 }
 
-func f5(unknown bool) {
-	for {
-		if unknown {
-			break
+func TestFilterNode(t *testing.T) {
+	const src = `package p
+
+func f(x int) {
+	var a, b = 1, 2
+	;
+	for i := 0; i < x; i++ {
+		var c int
+		if c == a {
+			var d int
+			return
+		}
+	}
+	switch x {
+	case a:
+		var e int
+	}
+	var f int
+}
+`
+	filter := func(n ast.Node) bool {
+		_, isDecl := n.(*ast.DeclStmt)
+		_, isEmpty := n.(*ast.EmptyStmt)
+		return !isDecl && !isEmpty
+	}
+	for _, src := range []string{src, domSrc, loopsSrc} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "filter.go", src, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			decl, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			g := Build(decl.Body, Options{MayReturn: mayReturn})
+			filtered := Build(decl.Body, Options{MayReturn: mayReturn, FilterNode: filter})
+			if len(g.Blocks) != len(filtered.Blocks) {
+				t.Errorf("%s: %d blocks, want %d", decl.Name.Name, len(filtered.Blocks), len(g.Blocks))
+				continue
+			}
+			for i, b := range g.Blocks {
+				fb := filtered.Blocks[i]
+				if fb.Kind != b.Kind || fb.Live != b.Live || fb.String() != b.String() ||
+					fmt.Sprint(indices(fb.Succs)) != fmt.Sprint(indices(b.Succs)) {
+					t.Errorf("%s: filtered %s (kind %s, live %t, succs %v) differs from %s (kind %s, live %t, succs %v)",
+						decl.Name.Name, fb, fb.Kind, fb.Live, indices(fb.Succs), b, b.Kind, b.Live, indices(b.Succs))
+				}
+				// The filtered nodes are exactly the unfiltered
+				// ones that the filter accepts.
+				// (Compare them by their formatting: the implicit
+				// return statement is created anew by each Build.)
+				var want []string
+				for _, n := range b.Nodes {
+					if _, ok := n.(*ast.ValueSpec); ok {
+						continue // only DeclStmts are rejected; see below
+					}
+					if filter(n) {
+						want = append(want, formatNode(fset, n))
+					}
+				}
+				var got []string
+				for _, n := range fb.Nodes {
+					if _, ok := n.(*ast.ValueSpec); ok {
+						t.Errorf("%s: %s: ValueSpec of rejected DeclStmt survived: %s",
+							decl.Name.Name, fb, formatNode(fset, n))
+						continue
+					}
+					got = append(got, formatNode(fset, n))
+				}
+				if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+					t.Errorf("%s: %s: got nodes %q, want %q", decl.Name.Name, fb, got, want)
+				}
+			}
 		}
-		continue
-		dead()
 	}
-	live()
 }
 
-func f6(unknown bool) {
-outer:
-	for {
-		for {
-			break outer
-			dead()
+func TestForLoopLayout(t *testing.T) {
+	for _, test := range []struct {
+		loop string
+		head BlockKind // kind of the back-edge target
+	}{
+		{"for i := 0; i < n; i++ { body() }", KindForLoop},
+		{"for ; i < n; i++ { body() }", KindForLoop},
+		{"for i := 0; ; i++ { body() }", KindForBody},
+		{"for i := 0; i < n; { body() }", KindForLoop},
+		{"for { body() }", KindForBody},
+	} {
+		src := "package p\nfunc f(i, n int) {\n" + test.loop + "\n}\n"
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "for.go", src, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := f.Decls[0].(*ast.FuncDecl).Body
+		s := body.List[0].(*ast.ForStmt)
+		g := New(body, mayReturn)
+
+		// blockOf returns the block containing n, and n's index within it.
+		blockOf := func(n ast.Node) (*Block, int) {
+			for _, b := range g.Blocks {
+				for i, m := range b.Nodes {
+					if m == n {
+						return b, i
+					}
+				}
+			}
+			t.Fatalf("%s: node %s not found", test.loop, formatNode(fset, n))
+			return nil, 0
+		}
+		var head *Block
+		for _, b := range g.Blocks {
+			if b.Kind == test.head {
+				head = b
+			}
+		}
+		if head == nil {
+			t.Errorf("%s: no %s block", test.loop, test.head)
+			continue
+		}
+
+		if s.Init != nil {
+			// The init statement is alone in its block, which
+			// follows the entry block and jumps to the loop head.
+			b, _ := blockOf(s.Init)
+			if b.Kind != KindForInit || len(b.Nodes) != 1 || len(b.Succs) != 1 || b.Succs[0] != head ||
+				g.Blocks[0].Succs[0] != b || g.InitBlock(s) != b {
+				t.Errorf("%s: init in %s (kind %s, succs %v), want init block between entry and %s",
+					test.loop, b, b.Kind, indices(b.Succs), head)
+			}
+		}
+		if s.Cond != nil {
+			// The condition is the last node of the loop block,
+			// which branches to the body and the done block.
+			b, i := blockOf(s.Cond)
+			if b != head || i != len(b.Nodes)-1 || len(b.Succs) != 2 ||
+				b.Succs[0].Kind != KindForBody || b.Succs[1].Kind != KindForDone {
+				t.Errorf("%s: cond is node %d of %s (kind %s, succs %v), want last node of loop block",
+					test.loop, i, b, b.Kind, indices(b.Succs))
+			}
+		} else {
+			for _, b := range g.Blocks {
+				if b.Kind == KindForLoop {
+					t.Errorf("%s: unexpected %s block without condition", test.loop, b.Kind)
+				}
+			}
+		}
+		if s.Post != nil {
+			// The post statement is alone in its block on the back-edge.
+			b, _ := blockOf(s.Post)
+			if b.Kind != KindForPost || len(b.Nodes) != 1 || len(b.Succs) != 1 || b.Succs[0] != head {
+				t.Errorf("%s: post in %s (kind %s, %d nodes, succs %v), want sole node of post block jumping to %s",
+					test.loop, b, b.Kind, len(b.Nodes), indices(b.Succs), head)
+			}
+		}
+
+		// The body's statements are in the body block.
+		call := s.Body.List[0]
+		if b, _ := blockOf(call); b.Kind != KindForBody || b.Stmt != s {
+			t.Errorf("%s: body in %s (kind %s), want body block", test.loop, b, b.Kind)
 		}
-		dead()
 	}
-	live()
 }
 
-func f7() {
-	for {
-		break nosuchlabel
-		dead()
+func TestRangeLoopLayout(t *testing.T) {
+	for _, loop := range []string{
+		"for i := range 10 {",
+		"for range n {",
+		"for i = range n {",
+		"for i, x := range s {",
+	} {
+		src := "package p\nfunc f(i, n int, s []int, x int) {\n" + loop + `
+	if c() {
+		continue
+	}
+	if d() {
+		break
 	}
-	dead()
+	body()
 }
+}
+`
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "range.go", src, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := f.Decls[0].(*ast.FuncDecl).Body
+		s := body.List[0].(*ast.RangeStmt)
+		g := New(body, mayReturn)
 
-func f8() {
-	select{}
-	dead()
+		// The operand, key, and value are evaluated before the loop.
+		entry := g.Blocks[0]
+		var want []ast.Node
+		for _, n := range []ast.Expr{s.X, s.Key, s.Value} {
+			if n != nil {
+				want = append(want, n)
+			}
+		}
+		if fmt.Sprint(entry.Nodes) != fmt.Sprint(want) {
+			t.Errorf("%s: entry nodes %v, want %v", loop, entry.Nodes, want)
+		}
+
+		// The head has no nodes and branches to the body and
+		// the done block; it is the target of the back-edge.
+		head := entry.Succs[0]
+		if head.Kind != KindRangeLoop || head.Stmt != s || len(head.Nodes) != 0 || len(head.Succs) != 2 ||
+			head.Succs[0].Kind != KindRangeBody || head.Succs[1].Kind != KindRangeDone {
+			t.Errorf("%s: head %s (kind %s, succs %v), want range loop block", loop, head, head.Kind, indices(head.Succs))
+			continue
+		}
+		loopBody, done := head.Succs[0], head.Succs[1]
+		if b := g.BlockOf(s.Body.List[2]); b.Kind != KindIfDone || len(b.Succs) != 1 || b.Succs[0] != head {
+			t.Errorf("%s: body() in %s (succs %v), want block jumping to %s", loop, b, indices(b.Succs), head)
+		}
+		if b := g.BlockOf(s.Body.List[0].(*ast.IfStmt).Cond); b != loopBody {
+			t.Errorf("%s: first condition in %s, want body block %s", loop, b, loopBody)
+		}
+
+		// Continue jumps to the head, and break to the done block.
+		for i, target := range []*Block{head, done} {
+			then := g.BlockOf(s.Body.List[i].(*ast.IfStmt).Cond).Succs[0]
+			if then.Kind != KindIfThen || len(then.Succs) != 1 || then.Succs[0] != target {
+				t.Errorf("%s: %s jumps to %v, want %s", loop, formatNode(fset, s.Body.List[i].(*ast.IfStmt).Body.List[0]), indices(then.Succs), target)
+			}
+		}
+		if !done.Live || len(done.Succs) != 0 {
+			t.Errorf("%s: done block %s (live %t, succs %v), want live exit", loop, done, done.Live, indices(done.Succs))
+		}
+	}
 }
 
-func f9(ch chan int) {
-	select {
-	case <-ch:
-		return
+func TestInitBlocks(t *testing.T) {
+	for _, test := range []struct {
+		stmt string
+		want string // the head block's kind, nodes, and successors' kinds
+	}{
+		{"if x := f(); x != nil { T() }", "IfInit[x := f(); x != nil] -> IfThen IfDone"},
+		{"if x := f(); x { T() } else { F() }", "IfInit[x := f(); x] -> IfThen IfElse"},
+		{"L: if x := f(); x { T() }", "IfInit[x := f(); x] -> IfThen IfDone"},
+		{"if f() { T() }", ""},
+		{"for i := 0; i < n; i++ { T() }", "ForInit[i := 0] -> ForLoop"},
+		{"for i := 0; ; i++ { T() }", "ForInit[i := 0] -> ForBody"},
+		{"switch x := f(); x { case 1: T() }", "SwitchInit[x := f(); x; 1] -> SwitchCaseBody SwitchNextCase"},
+		{"switch x := f(); { case x: T() }", "SwitchInit[x := f(); x] -> SwitchCaseBody SwitchNextCase"},
+		{"switch x := f(); { default: T() }", "SwitchInit[x := f()] -> SwitchCaseBody"},
+		{"switch x := f(); y := x.(type) { case int: T(y) }", "SwitchInit[x := f(); y := x.(type)] -> SwitchCaseBody SwitchNextCase"},
+		{"switch x := f(); x.(type) {}", "SwitchInit[x := f(); x.(type)] -> SwitchDone"},
+	} {
+		src := "package p\nfunc f(n int) {\n" + test.stmt + "\n}\n"
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "init.go", src, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := f.Decls[0].(*ast.FuncDecl).Body
+		s := body.List[0]
+		if l, ok := s.(*ast.LabeledStmt); ok {
+			s = l.Stmt
+		}
+		g := New(body, mayReturn)
+
+		var got string
+		if head := g.InitBlock(s); head != nil {
+			var nodes, succs []string
+			for _, n := range head.Nodes {
+				nodes = append(nodes, formatNode(fset, n))
+			}
+			for _, succ := range head.Succs {
+				succs = append(succs, succ.Kind.String())
+			}
+			got = fmt.Sprintf("%s[%s] -> %s", head.Kind, strings.Join(nodes, "; "), strings.Join(succs, " "))
+
+			// The head block has no other predecessors, and
+			// precedes the blocks of the statement, so that
+			// Format and Dot render it next to them.
+			if len(head.Preds) != 1 || head.Preds[0].Index >= head.Index {
+				t.Errorf("%s: head block has preds %v", test.stmt, indices(head.Preds))
+			}
+			if next := g.Blocks[head.Index+1]; next.Stmt != s {
+				t.Errorf("%s: head block %d is followed by %s, not a block of the statement", test.stmt, head.Index, next)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s: InitBlock: got %q, want %q\n%s", test.stmt, got, test.want, g.Format(fset))
+		}
 	}
-	dead()
 }
 
-func f10(ch chan int) {
-	select {
-	case <-ch:
-		return
-		dead()
-	default:
+func TestSelectOrder(t *testing.T) {
+	for _, test := range []struct {
+		stmt string
+		want string // the chain of blocks from the head, described by kind and case
+	}{
+		{
+			// The default case comes last, regardless of source order.
+			`select {
+			default:
+			case <-a:
+			case b <- 1:
+			}`,
+			"SelectCaseBody(<-a) SelectAfterCase(<-a) SelectCaseBody(b <- 1) SelectAfterCase(b <- 1) SelectCaseBody(default)",
+		},
+		{
+			`select {
+			case <-a:
+			}`,
+			"SelectCaseBody(<-a) SelectAfterCase(<-a)",
+		},
+		{
+			`select {}`,
+			"SelectForever",
+		},
+	} {
+		src := "package p\nfunc f(a, b chan int) {\n" + test.stmt + "\n}\n"
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "select.go", src, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := New(f.Decls[0].(*ast.FuncDecl).Body, mayReturn)
+
+		// Follow the chain: the first successor of each test is the
+		// body, the second is the next test.
+		var chain []string
+		describe := func(b *Block) {
+			s := b.Kind.String()
+			if cc, ok := b.Stmt.(*ast.CommClause); ok {
+				if cc.Comm == nil {
+					s += "(default)"
+				} else {
+					s += "(" + formatNode(fset, cc.Comm) + ")"
+				}
+			}
+			chain = append(chain, s)
+		}
+		for b := g.Blocks[0]; len(b.Succs) > 0; {
+			if len(b.Succs) == 1 {
+				b = b.Succs[0]
+				describe(b)
+				break
+			}
+			describe(b.Succs[0])
+			b = b.Succs[1]
+			describe(b)
+		}
+		if got := strings.Join(chain, " "); got != test.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", test.stmt, got, test.want)
+		}
+		for _, b := range g.Blocks {
+			if b.Kind == KindSelectForever && (len(b.Succs) != 0 || !b.Live) {
+				t.Errorf("%s: %s is not a live terminal block", test.stmt, b)
+			}
+			if b.Kind == KindSelectDone && b.Live != (test.stmt != "select {}") {
+				t.Errorf("%s: %s has Live=%t", test.stmt, b, b.Live)
+			}
+		}
 	}
-	live()
 }
 
-func f11() {
-	goto; // mustn't crash
-	dead()
+func TestLiveness(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+	if x {
+		log.Fatal("x")
+		afterFatal()
+		if x {
+			return
+		}
+		afterFatalReturn()
+	}
+	if x {
+		for {
+		}
+		afterLoop()
+	}
+	live()
+	return
+	afterReturn()
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := f.Decls[0].(*ast.FuncDecl).Body
+	for _, skip := range []bool{false, true} {
+		g := Build(body, Options{MayReturn: mayReturn, SkipNoReturnLiveness: skip})
+		got := make(map[string]string)
+		for _, b := range g.Blocks {
+			for _, n := range b.Nodes {
+				if s, ok := n.(*ast.ExprStmt); ok {
+					reachable, ignoring := b.Liveness()
+					got[formatNode(fset, s)] = fmt.Sprint(reachable, ignoring)
+				}
+			}
+		}
+		for stmt, want := range map[string]string{
+			`log.Fatal("x")`:     "true true",
+			"afterFatal()":       "false true",
+			"afterFatalReturn()": "false true",
+			"afterLoop()":        "false false",
+			"live()":             "true true",
+			"afterReturn()":      "false false",
+		} {
+			if skip && strings.HasPrefix(want, "false") {
+				want = "false true"
+			}
+			if got[stmt] != want {
+				t.Errorf("skip=%t: Liveness of block of %s = %s, want %s", skip, stmt, got[stmt], want)
+			}
+		}
+	}
 }
 
+func TestDumpSSALike(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+	for x {
+		if x {
+			break
+		}
+		g(func() {
+			h("\t")
+		})
+	}
+	log.Fatal(x)
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(f.Decls[0].(*ast.FuncDecl).Body, mayReturn)
+	var buf bytes.Buffer
+	g.DumpSSALike(fset, &buf)
+	const want = `0: entry (preds:) (succs: 3)
+1: for.body (preds: 3) (succs: 4 5)
+	input.go:5:6	x
+2: for.done (preds: 3 4) (succs:)
+	input.go:12:2	log.Fatal(x)
+3: for.loop (preds: 0 5) (succs: 1 2)
+	input.go:4:6	x
+4: if.then (preds: 1) (succs: 2)
+5: if.done (preds: 1 6) (succs: 3)
+	input.go:8:3	g(func() {\n\th("\t")\n})
+6: unreachable.branch (preds:) (succs: 5)
+7: unreachable.call (preds:) (succs:)
 `
+	if got := buf.String(); got != want {
+		t.Errorf("DumpSSALike:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEmptyBodies(t *testing.T) {
+	const src = `package p
+
+func external()
 
-func TestDeadCode(t *testing.T) {
-	// We'll use dead code detection to verify the CFG.
+func empty() {}
 
+func comment() {
+	// nothing to see here
+}
+`
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, "dummy.go", src, parser.Mode(0))
+	f, err := parser.ParseFile(fset, "input.go", src, parser.ParseComments)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for _, decl := range f.Decls {
-		if decl, ok := decl.(*ast.FuncDecl); ok {
-			g := New(decl.Body, mayReturn)
+	for _, test := range []struct {
+		name, format string
+		reason       TerminalReason
+	}{
+		{"external", ".0: # entry\n\n", TerminalNoBody},
+		{"empty", ".0: # entry\n\treturn\n\n", TerminalFallOffEnd},
+		{"comment", ".0: # entry\n\treturn\n\n", TerminalFallOffEnd},
+	} {
+		var body *ast.BlockStmt
+		for _, decl := range f.Decls {
+			if decl := decl.(*ast.FuncDecl); decl.Name.Name == test.name {
+				body = decl.Body
+			}
+		}
+		g := New(body, mayReturn)
+		if got := g.Format(fset); got != test.format {
+			t.Errorf("%s: Format() = %q, want %q", test.name, got, test.format)
+		}
+		entry := g.Blocks[0]
+		if !entry.Live || len(entry.Succs) != 0 {
+			t.Errorf("%s: entry block has Live=%t, %d successors", test.name, entry.Live, len(entry.Succs))
+		}
+		if terms := g.TerminalBlocks(); len(terms) != 1 || terms[0].Block != entry || terms[0].Reason != test.reason {
+			t.Errorf("%s: TerminalBlocks() = %v, want the entry block, for %s", test.name, terms, test.reason)
+		}
+	}
+}
 
-			// Print statements in unreachable blocks
-			// (in order determined by builder).
-			var buf bytes.Buffer
-			for _, b := range g.Blocks {
-				if !b.Live {
-					for _, n := range b.Nodes {
-						fmt.Fprintf(&buf, "\t%s\n", formatNode(fset, n))
-					}
+// corpusBodies returns the bodies of the functions and function
+// literals of the test sources of the package and of its Go files.
+func corpusBodies(t *testing.T) (*token.FileSet, []*ast.BlockStmt) {
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for i, src := range []string{
+		annotateSrc, domSrc, instrumentSrc, loopsSrc, memoSrc, panicSrc,
+		precedeSrc, selfSrc, statsSrc, termSrc, weightsSrc,
+	} {
+		f, err := parser.ParseFile(fset, fmt.Sprintf("src%d.go", i), src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	for _, pattern := range []string{"*.go", filepath.Join("testdata", "*.go")} {
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			f, err := parser.ParseFile(fset, name, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, f)
+		}
+	}
+	var bodies []*ast.BlockStmt
+	for _, f := range files {
+		ast.Inspect(f, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncDecl:
+				if node.Body != nil {
+					bodies = append(bodies, node.Body)
 				}
+			case *ast.FuncLit:
+				bodies = append(bodies, node.Body)
 			}
+			return true
+		})
+	}
+	return fset, bodies
+}
 
-			// Check that the result contains "dead" at least once but not "live".
-			if !bytes.Contains(buf.Bytes(), []byte("dead")) ||
-				bytes.Contains(buf.Bytes(), []byte("live")) {
-				t.Errorf("unexpected dead statements in function %s:\n%s",
-					decl.Name.Name,
-					&buf)
-				t.Logf("control flow graph:\n%s", g.Format(fset))
+// TestPreds checks that Preds is the inverse of Succs in the CFGs of
+// all the functions of the test sources and of this package, with and
+// without panic edges, and the predecessors of blocks where control
+// flow joins.
+func TestPreds(t *testing.T) {
+	fset, bodies := corpusBodies(t)
+	for _, body := range bodies {
+		for _, opts := range []Options{
+			{MayReturn: mayReturn},
+			{MayReturn: mayReturn, MayPanic: func(ast.Node) bool { return true }, ModelRecover: true},
+		} {
+			if err := checkInvariants(Build(body, opts)); err != nil {
+				t.Errorf("%s: %v", fset.Position(body.Pos()), err)
 			}
 		}
 	}
-}
+	if n := len(bodies); n < 100 {
+		t.Errorf("checked only %d functions", n)
+	}
 
-// A trivial mayReturn predicate that looks only at syntax, not types.
-func mayReturn(call *ast.CallExpr) bool {
-	switch fun := call.Fun.(type) {
-	case *ast.Ident:
-		return fun.Name != "panic"
-	case *ast.SelectorExpr:
-		return fun.Sel.Name != "Fatal"
+	const joins = `package p
+
+func f(x bool) {
+	for i := 0; x; i++ {
+		if x {
+			continue
+		}
+	}
+	if x {
+		a()
+	} else {
+		b()
+	}
+	c()
+}
+`
+	g, fset, err := FromSource(joins, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The loop header follows the init and the post statement, which
+	// follows the continue and the end of the body; the block after
+	// the if statement follows both branches.
+	want := map[BlockKind][]BlockKind{
+		KindForLoop: {KindForInit, KindForPost},
+		KindForPost: {KindIfThen, KindIfDone},
+		KindIfDone:  {KindIfThen, KindIfElse},
+	}
+	for _, b := range g.Blocks {
+		kinds, ok := want[b.Kind]
+		if !ok || b.Kind == KindIfDone && b.Stmt != g.Blocks[0].Stmt.(*ast.BlockStmt).List[1] {
+			continue
+		}
+		delete(want, b.Kind)
+		var got []BlockKind
+		for _, p := range b.Preds {
+			got = append(got, p.Kind)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(kinds) {
+			t.Errorf("preds of %s: got %v, want %v\n%s", b.Name(fset), got, kinds, g.Format(fset, FormatPreds))
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("no blocks of kinds %v\n%s", want, g.Format(fset, FormatPreds))
 	}
-	return true
 }
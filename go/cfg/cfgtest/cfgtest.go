@@ -0,0 +1,106 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cfgtest provides utilities for tests of control-flow graphs
+// built by golang.org/x/tools/go/cfg, such as those of the cfg package
+// itself.
+//
+// This package is test-support API: it is intended to be imported
+// only by tests, and its compatibility promise is weaker than that of
+// the cfg package. Its functions may change, for example to report
+// failures in more detail, as the needs of tests evolve.
+package cfgtest // import "golang.org/x/tools/go/cfg/cfgtest"
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+)
+
+// FormatNode returns the source form of n, as it appears in the
+// output of CFG.Format: secondary lines are indented by a tab.
+func FormatNode(fset *token.FileSet, n ast.Node) string {
+	var buf bytes.Buffer
+	format.Node(&buf, fset, n)
+	// Indent secondary lines by a tab.
+	return strings.Replace(buf.String(), "\n", "\n\t", -1)
+}
+
+// DeadStmts returns the nodes of the unreachable blocks of g, each
+// formatted by FormatNode, in the order of the blocks.
+func DeadStmts(fset *token.FileSet, g *cfg.CFG) []string {
+	var res []string
+	for _, b := range g.Blocks {
+		if !b.Live {
+			for _, n := range b.Nodes {
+				res = append(res, FormatNode(fset, n))
+			}
+		}
+	}
+	return res
+}
+
+// AssertDeadLive checks the convention by which tests of dead-code
+// detection mark the statements of a function: among the nodes of
+// the unreachable blocks of g, the CFG of the function named name,
+// there must be one containing "dead", and none containing "live".
+// Otherwise it reports an error, and logs the CFG and its terminal
+// blocks.
+func AssertDeadLive(t testing.TB, fset *token.FileSet, g *cfg.CFG, name string) {
+	t.Helper()
+	dead := strings.Join(DeadStmts(fset, g), "\n")
+	if !strings.Contains(dead, "dead") || strings.Contains(dead, "live") {
+		t.Errorf("unexpected dead statements in function %s:\n\t%s", name, strings.Replace(dead, "\n", "\n\t", -1))
+		t.Logf("control flow graph:\n%s", g.Format(fset))
+		for _, term := range g.TerminalBlocks() {
+			t.Logf("%s ends the path: %s at %s", term.Block, term.Reason, fset.Position(term.Pos))
+		}
+	}
+}
+
+// Golden compares got, such as the output of CFG.Format or CFG.Dot,
+// with the contents of the named golden file, reporting an error if
+// they differ. If update is set, it instead writes got to the file.
+//
+// Tests typically obtain update from a flag:
+//
+//	var update = flag.Bool("update", false, "update the golden files")
+//
+// so that after an intended change of output, the golden files may be
+// updated by running the tests with the -update flag.
+func Golden(t testing.TB, filename string, got []byte, update bool) {
+	t.Helper()
+	if update {
+		if err := ioutil.WriteFile(filename, got, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("reading golden file: %v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output does not match %s (run with -update to update it):\n%s\nwant:\n%s", filename, got, want)
+	}
+}
+
+// MayReturn is a mayReturn predicate (see cfg.New) that looks only at
+// syntax: it reports that calls to panic, and calls of methods named
+// Fatal, such as log.Fatal, do not return.
+func MayReturn(call *ast.CallExpr) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name != "panic"
+	case *ast.SelectorExpr:
+		return fun.Sel.Name != "Fatal"
+	}
+	return true
+}
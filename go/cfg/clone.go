@@ -0,0 +1,103 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements copying of CFGs.
+
+import "go/ast"
+
+// Clone returns a deep copy of g, for clients that wish to modify a
+// CFG, which they must not do to one shared with others (see CFG).
+// The copy has its own blocks, and its own Blocks, Nodes, Succs, and
+// Preds slices, whose elements refer to the blocks of the copy. The
+// syntax nodes themselves are shared with g; the CFGs of spawned
+// function literals (see Spawns) are cloned too.
+//
+// Results computed lazily by g, such as its dominator tree, are not
+// copied; the copy computes them afresh from its own, possibly
+// modified, blocks.
+func (g *CFG) Clone() *CFG {
+	clone := &CFG{
+		Blocks:        make([]*Block, len(g.Blocks)),
+		recoverDefers: append([]*ast.DeferStmt(nil), g.recoverDefers...),
+	}
+	blocks := make(map[*Block]*Block, len(g.Blocks)) // original => copy
+	for i, b := range g.Blocks {
+		c := new(Block)
+		*c = *b
+		clone.Blocks[i] = c
+		blocks[b] = c
+	}
+	remap := func(list []*Block) []*Block {
+		if list == nil {
+			return nil
+		}
+		res := make([]*Block, len(list))
+		for i, b := range list {
+			res[i] = blocks[b]
+		}
+		return res
+	}
+	for _, c := range clone.Blocks {
+		if c.Nodes != nil {
+			c.Nodes = append([]ast.Node(nil), c.Nodes...)
+		}
+		c.Succs = remap(c.Succs)
+		c.Preds = remap(c.Preds)
+		c.succs2 = [2]*Block{}
+		if c.noReturnSucc != nil {
+			c.noReturnSucc = blocks[c.noReturnSucc]
+		}
+	}
+	if g.exit != nil {
+		clone.exit = blocks[g.exit]
+	}
+	if g.terminals != nil {
+		clone.terminals = make([]TerminalBlock, len(g.terminals))
+		for i, t := range g.terminals {
+			t.Block = blocks[t.Block]
+			clone.terminals[i] = t
+		}
+	}
+	if g.spawns != nil {
+		clone.spawns = make([]SpawnEdge, len(g.spawns))
+		for i, s := range g.spawns {
+			s.FromBlock = blocks[s.FromBlock]
+			if s.Callee != nil {
+				s.Callee = s.Callee.Clone()
+			}
+			clone.spawns[i] = s
+		}
+	}
+	if g.labels != nil {
+		clone.labels = make([]LabelInfo, len(g.labels))
+		for i, l := range g.labels {
+			if l.Block != nil {
+				l.Block = blocks[l.Block]
+			}
+			clone.labels[i] = l
+		}
+	}
+	if g.panics != nil {
+		clone.panics = make(map[ast.Node]bool, len(g.panics))
+		for n := range g.panics {
+			clone.panics[n] = true
+		}
+	}
+	return clone
+}
+
+// freeze trims the capacity of the slices of g to their length, so
+// that a client appending to a slice of a shared CFG (which it must
+// not modify) gets a new copy rather than corrupting the space beyond
+// the end of the slice, which another append may have used.
+func (g *CFG) freeze() {
+	g.Blocks = g.Blocks[:len(g.Blocks):len(g.Blocks)]
+	for _, b := range g.Blocks {
+		b.Nodes = b.Nodes[:len(b.Nodes):len(b.Nodes)]
+		b.Succs = b.Succs[:len(b.Succs):len(b.Succs)]
+		b.Preds = b.Preds[:len(b.Preds):len(b.Preds)]
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// checkInvariants reports an error if g is inconsistent, as it may be
+// after a client has inadvertently modified it.
+func checkInvariants(g *CFG) error {
+	in := make(map[*Block]bool)
+	for i, b := range g.Blocks {
+		if int(b.Index) != i {
+			return fmt.Errorf("block %d has Index %d", i, b.Index)
+		}
+		in[b] = true
+	}
+	edges := make(map[[2]*Block]int) // number of Succs edges minus number of Preds edges
+	for _, b := range g.Blocks {
+		for _, s := range b.Succs {
+			if !in[s] {
+				return fmt.Errorf("%s has a successor not in the CFG", b)
+			}
+			edges[[2]*Block{b, s}]++
+		}
+		for _, p := range b.Preds {
+			if !in[p] {
+				return fmt.Errorf("%s has a predecessor not in the CFG", b)
+			}
+			edges[[2]*Block{p, b}]--
+		}
+	}
+	for e, n := range edges {
+		if n != 0 {
+			return fmt.Errorf("edge %s -> %s: Succs and Preds disagree", e[0], e[1])
+		}
+	}
+	live := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if !live[b] {
+			live[b] = true
+			for _, s := range b.Succs {
+				visit(s)
+			}
+		}
+	}
+	if len(g.Blocks) > 0 {
+		visit(g.Blocks[0])
+	}
+	for _, b := range g.Blocks {
+		if b.Live != live[b] {
+			return fmt.Errorf("%s: Live = %t, want %t", b, b.Live, live[b])
+		}
+	}
+	return nil
+}
+
+func TestClone(t *testing.T) {
+	fset := token.NewFileSet()
+	var graphs []*CFG
+	for _, src := range []string{domSrc, panicSrc} {
+		f, err := parser.ParseFile(fset, "input.go", src, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			body := decl.(*ast.FuncDecl).Body
+			graphs = append(graphs,
+				New(body, mayReturn),
+				Build(body, Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true}))
+		}
+	}
+
+	for _, g := range graphs {
+		if err := checkInvariants(g); err != nil {
+			t.Fatal(err)
+		}
+		want := g.Format(fset)
+		fingerprint := g.Fingerprint(0)
+		terminals := fmt.Sprint(g.TerminalBlocks())
+
+		clone := g.Clone()
+		if err := checkInvariants(clone); err != nil {
+			t.Errorf("clone: %v", err)
+		}
+		if got := clone.Format(fset); got != want {
+			t.Errorf("clone:\n%s\nwant:\n%s", got, want)
+		}
+		if clone.Fingerprint(0) != fingerprint {
+			t.Errorf("clone of\n%s\nhas a different fingerprint", want)
+		}
+		for i, c := range clone.Blocks {
+			b := g.Blocks[i]
+			if c == b {
+				t.Fatalf("clone shares block %s", b)
+			}
+			for _, s := range append(c.Succs, c.Preds...) {
+				if s != clone.Blocks[s.Index] {
+					t.Fatalf("clone block %s refers to an original block", c)
+				}
+			}
+			if got, want := c.Liveness, b.Liveness; fmt.Sprint(got()) != fmt.Sprint(want()) {
+				t.Errorf("clone block %s: Liveness() = %v, want %v", c, fmt.Sprint(got()), fmt.Sprint(want()))
+			}
+		}
+		if got, want := len(clone.TerminalBlocks()), len(g.TerminalBlocks()); got != want {
+			t.Errorf("clone has %d terminal blocks, want %d", got, want)
+		}
+		for _, tb := range clone.TerminalBlocks() {
+			if tb.Block != clone.Blocks[tb.Block.Index] {
+				t.Errorf("clone terminal block %s is an original block", tb.Block)
+			}
+		}
+
+		// Modifying the clone must not affect the original.
+		for _, c := range clone.Blocks {
+			c.Nodes = append(c.Nodes[:0], &ast.EmptyStmt{})
+			c.Succs = append(c.Succs, clone.Blocks[0])
+			c.Live = !c.Live
+		}
+		clone.Blocks = append(clone.Blocks[:1], clone.Blocks[0])
+		clone.Dominators()
+		if got := g.Format(fset); got != want {
+			t.Errorf("after modifying clone, original is:\n%s\nwant:\n%s", got, want)
+		}
+		if g.Fingerprint(0) != fingerprint || fmt.Sprint(g.TerminalBlocks()) != terminals {
+			t.Errorf("modifying clone affected original:\n%s", want)
+		}
+		if err := checkInvariants(g); err != nil {
+			t.Errorf("after modifying clone: %v", err)
+		}
+	}
+}
+
+// TestFrozen checks that appending to the slices of a CFG does not
+// write to memory shared with the CFG.
+func TestFrozen(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", domSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		g := New(decl.(*ast.FuncDecl).Body, mayReturn)
+		want := g.Format(fset)
+		_ = append(g.Blocks, nil)
+		for _, b := range g.Blocks {
+			_ = append(b.Nodes, nil)
+			_ = append(b.Succs, nil)
+			_ = append(b.Preds, nil)
+		}
+		if err := checkInvariants(g); err != nil {
+			t.Error(err)
+		}
+		if got := g.Format(fset); got != want {
+			t.Errorf("after appending, CFG is:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
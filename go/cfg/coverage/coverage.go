@@ -0,0 +1,80 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package coverage maps the coverage profiles produced by
+// "go test -coverprofile" onto the blocks of the control-flow graphs
+// constructed by golang.org/x/tools/go/cfg, so that untested branches
+// can be reported more precisely than by line coverage.
+package coverage // import "golang.org/x/tools/go/cfg/coverage"
+
+import (
+	"go/token"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/tools/cover"
+	"golang.org/x/tools/go/cfg"
+)
+
+// ProfileFor returns the profile, among those returned by
+// cover.ParseProfiles, of the named source file of the package with
+// the given import path, or nil if there is none. Profiles name each
+// file by its package path and base name, such as
+// "example.com/p/p.go".
+func ProfileFor(profiles []*cover.Profile, pkgPath, filename string) *cover.Profile {
+	name := path.Join(pkgPath, filepath.Base(filename))
+	for _, p := range profiles {
+		if p.FileName == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Counts returns the execution counts of the blocks of g, a CFG of a
+// function in the file described by profile, according to the
+// profile. It reports false if the nodes of g lie in a file with a
+// different base name, in which case profile cannot describe them.
+//
+// A block's count is the greatest count of the profile blocks that
+// overlap the position range of any of its nodes. Profile blocks
+// follow the statements of the source rather than the CFG, so a node
+// may overlap several, as does a statement containing a function
+// literal; the block is covered if any of its nodes falls in a covered
+// profile block. Conversely, several CFG blocks may share a profile
+// block, as do the condition and post statement of a for loop.
+//
+// Blocks without nodes, and blocks whose nodes overlap no profile
+// block, are absent from the result, since the profile says nothing
+// about them; a block with count zero was instrumented but never
+// executed.
+func Counts(profile *cover.Profile, fset *token.FileSet, g *cfg.CFG) (map[*cfg.Block]int, bool) {
+	base := path.Base(profile.FileName)
+	counts := make(map[*cfg.Block]int)
+	for _, b := range g.Blocks {
+		for _, n := range b.Nodes {
+			if _, ok := n.(*cfg.DeferRun); ok {
+				continue // the deferred call belongs to the block of its defer statement
+			}
+			start, end := fset.Position(n.Pos()), fset.Position(n.End())
+			if filepath.Base(start.Filename) != base {
+				return nil, false
+			}
+			for _, pb := range profile.Blocks {
+				if less(start.Line, start.Column, pb.EndLine, pb.EndCol) &&
+					less(pb.StartLine, pb.StartCol, end.Line, end.Column) {
+					if c, ok := counts[b]; !ok || pb.Count > c {
+						counts[b] = pb.Count
+					}
+				}
+			}
+		}
+	}
+	return counts, true
+}
+
+// less reports whether line1:col1 precedes line2:col2.
+func less(line1, col1, line2, col2 int) bool {
+	return line1 < line2 || line1 == line2 && col1 < col2
+}
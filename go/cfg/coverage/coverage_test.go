@@ -0,0 +1,79 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage_test
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/cover"
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/coverage"
+)
+
+func TestCounts(t *testing.T) {
+	filename := filepath.Join("testdata", "p.go")
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := cfg.New(f.Decls[0].(*ast.FuncDecl).Body, func(*ast.CallExpr) bool { return true })
+
+	profiles, err := cover.ParseProfiles(filepath.Join("testdata", "cover.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := coverage.ProfileFor(profiles, "example.com/p", filename)
+	if profile == nil {
+		t.Fatalf("ProfileFor(example.com/p, %s) = nil", filename)
+	}
+	counts, ok := coverage.Counts(profile, fset, g)
+	if !ok {
+		t.Fatalf("Counts reports that %s is not in the profile", filename)
+	}
+
+	var lines []string
+	for _, b := range g.Blocks {
+		line := b.Name(fset)
+		if c, ok := counts[b]; ok {
+			line += fmt.Sprintf(": %d", c)
+		}
+		lines = append(lines, line)
+	}
+	got := strings.Join(lines, "\n")
+	// The else branch was never executed; the block after the if
+	// statement, which precedes the loop's init block, and the one
+	// after the return statement have no nodes, and so no count.
+	want := `entry@p.go:3: 2
+if.then@p.go:5: 2
+if.done@p.go:5
+if.else@p.go:5: 0
+for.init@p.go:10: 2
+for.body@p.go:10: 22
+for.done@p.go:10: 2
+for.loop@p.go:10: 2
+for.post@p.go:10: 2
+unreachable.return@p.go:13`
+	if got != want {
+		t.Errorf("got counts:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The profile of a file with the same base name in another
+	// package does not describe p.go's function, nor does that of a
+	// file with a different base name.
+	if p := coverage.ProfileFor(profiles, "example.com/r", filename); p != nil {
+		t.Errorf("ProfileFor(example.com/r, %s) = %s, want nil", filename, p.FileName)
+	}
+	other := &cover.Profile{FileName: "example.com/p/q.go", Mode: "count"}
+	if counts, ok := coverage.Counts(other, fset, g); ok {
+		t.Errorf("Counts(q.go profile) = %v, true; want false", counts)
+	}
+}
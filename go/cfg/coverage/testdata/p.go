@@ -0,0 +1,14 @@
+package p
+
+func classify(x int) string {
+	var s string
+	if x > 9 {
+		s = "large"
+	} else {
+		s = "small"
+	}
+	for i := 0; i < x; i++ {
+		s += "!"
+	}
+	return s
+}
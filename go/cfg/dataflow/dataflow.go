@@ -0,0 +1,139 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dataflow provides a framework for dataflow analyses over the
+// control-flow graphs constructed by golang.org/x/tools/go/cfg.
+//
+// A client describes an analysis by a Lattice of facts and a transfer
+// function that computes the fact that holds after a block (or, for a
+// backward analysis, before it) from the fact that holds before it (or
+// after it). Forward and Backward then iterate the transfer function
+// over the blocks of a CFG until the facts reach a fixed point.
+//
+// Facts are represented by values of type interface{}; the framework
+// only passes them to the methods of the Lattice and to the transfer
+// function, so each analysis uses its own concrete type.
+package dataflow // import "golang.org/x/tools/go/cfg/dataflow"
+
+import (
+	"errors"
+
+	"golang.org/x/tools/go/cfg"
+)
+
+// A Lattice describes the facts of a dataflow analysis, which form a
+// join semi-lattice of finite height: a partial order in which every
+// pair of facts has a least upper bound, their join.
+type Lattice interface {
+	// Bottom returns the least fact, the identity of Join.
+	// It is the initial fact of every block, and the final
+	// fact of blocks that the analysis does not reach.
+	Bottom() interface{}
+
+	// Join returns the least upper bound of x and y: the fact that
+	// holds where control flow from paths with facts x and y merges.
+	// It must be commutative, associative and idempotent.
+	Join(x, y interface{}) interface{}
+
+	// Equal reports whether x and y are the same fact.
+	Equal(x, y interface{}) bool
+}
+
+// A TransferFunc returns the fact that results from the execution of
+// block b, given the fact in that holds beforehand (for a backward
+// analysis, the fact that holds before b, given the fact in that holds
+// afterwards). It must be monotone: if in is less than or equal to
+// another fact, so must be the corresponding results.
+type TransferFunc func(b *cfg.Block, in interface{}) interface{}
+
+// MaxRounds is the maximum number of passes over the blocks of a CFG
+// that Forward and Backward make before giving up with ErrNoFixpoint.
+// A monotone analysis over a lattice of finite height converges long
+// before: the number of passes is bounded by the height of the lattice
+// times the number of blocks, and in practice by a small multiple of
+// the loop nesting depth.
+const MaxRounds = 1000
+
+// ErrNoFixpoint is the error returned by Forward and Backward when the
+// facts are still changing after MaxRounds passes, which suggests that
+// the transfer function is not monotone or that the lattice has
+// infinite ascending chains.
+var ErrNoFixpoint = errors.New("dataflow: no fixed point reached; is the transfer function monotone?")
+
+// Forward performs a forward dataflow analysis of g: it returns, for
+// each block of g, the fact that holds on entry to the block, which
+// is the join of the results of the transfer function for its live
+// predecessors, and, for the entry block, of the fact entry.
+//
+// Only live blocks take part; the fact of an unreachable block is
+// lat.Bottom(). Blocks are visited in reverse postorder, so that all
+// the predecessors of a block but those along back edges are visited
+// before it.
+//
+// If no fixed point is reached within MaxRounds passes, Forward
+// returns the current facts and ErrNoFixpoint.
+func Forward(g *cfg.CFG, lat Lattice, entry interface{}, transfer TransferFunc) (map[*cfg.Block]interface{}, error) {
+	order := g.ReversePostorder()
+	edges := func(b *cfg.Block) ([]*cfg.Block, bool) {
+		return b.Preds, b == g.Blocks[0]
+	}
+	return solve(g, lat, entry, transfer, order, edges)
+}
+
+// Backward performs a backward dataflow analysis of g: it returns,
+// for each block of g, the fact that holds on exit from the block,
+// which is the join of the results of the transfer function for its
+// live successors and, for a block without successors, of the fact
+// exit.
+//
+// Only live blocks take part; the fact of an unreachable block is
+// lat.Bottom(). Blocks are visited in postorder, so that most of the
+// successors of a block are visited before it.
+//
+// If no fixed point is reached within MaxRounds passes, Backward
+// returns the current facts and ErrNoFixpoint.
+func Backward(g *cfg.CFG, lat Lattice, exit interface{}, transfer TransferFunc) (map[*cfg.Block]interface{}, error) {
+	order := g.Postorder()
+	edges := func(b *cfg.Block) ([]*cfg.Block, bool) {
+		return b.Succs, len(b.Succs) == 0
+	}
+	return solve(g, lat, exit, transfer, order, edges)
+}
+
+// solve iterates transfer over the blocks in order until a fixed
+// point is reached. For each block, edges returns the blocks whose
+// results are joined to form its input, and whether the boundary
+// fact is joined too.
+func solve(g *cfg.CFG, lat Lattice, boundary interface{}, transfer TransferFunc, order []*cfg.Block, edges func(*cfg.Block) ([]*cfg.Block, bool)) (map[*cfg.Block]interface{}, error) {
+	in := make(map[*cfg.Block]interface{}, len(g.Blocks))
+	out := make(map[*cfg.Block]interface{}, len(g.Blocks))
+	for _, b := range g.Blocks {
+		in[b] = lat.Bottom()
+		out[b] = lat.Bottom()
+	}
+	for round := 0; round < MaxRounds; round++ {
+		changed := false
+		for _, b := range order {
+			fact := lat.Bottom()
+			blocks, isBoundary := edges(b)
+			if isBoundary {
+				fact = lat.Join(fact, boundary)
+			}
+			for _, x := range blocks {
+				if x.Live {
+					fact = lat.Join(fact, out[x])
+				}
+			}
+			in[b] = fact
+			if res := transfer(b, fact); !lat.Equal(res, out[b]) {
+				out[b] = res
+				changed = true
+			}
+		}
+		if !changed {
+			return in, nil
+		}
+	}
+	return in, ErrNoFixpoint
+}
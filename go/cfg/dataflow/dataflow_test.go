@@ -0,0 +1,225 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dataflow_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/dataflow"
+)
+
+const src = `package p
+
+func f(x bool) {
+	if x {
+		return
+	}
+	for x {
+		if x {
+			a()
+			break
+		}
+		b()
+		continue
+		c()
+	}
+	d()
+	log.Fatal()
+	e()
+}
+
+func g(x bool) {
+	init()
+	if x {
+		f()
+		a()
+	} else {
+		b()
+	}
+	c()
+	for x {
+		f()
+	}
+	d()
+	if x {
+		return
+	}
+	f()
+	e()
+}
+`
+
+func parse(t *testing.T) map[string]*cfg.CFG {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mayReturn := func(call *ast.CallExpr) bool {
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		return !ok || sel.Sel.Name != "Fatal"
+	}
+	graphs := make(map[string]*cfg.CFG)
+	for _, decl := range f.Decls {
+		decl := decl.(*ast.FuncDecl)
+		graphs[decl.Name.Name] = cfg.New(decl.Body, mayReturn)
+	}
+	return graphs
+}
+
+// A boolLattice is a lattice of booleans.
+// Under the "or" order, false < true; under the "and" order, true < false.
+type boolLattice struct{ and bool }
+
+func (l boolLattice) Bottom() interface{} { return l.and }
+
+func (l boolLattice) Join(x, y interface{}) interface{} {
+	if l.and {
+		return x.(bool) && y.(bool)
+	}
+	return x.(bool) || y.(bool)
+}
+
+func (boolLattice) Equal(x, y interface{}) bool { return x == y }
+
+// TestReachability reimplements the computation of Block.Live.
+func TestReachability(t *testing.T) {
+	graphs := parse(t)
+	for name, g := range graphs {
+		identity := func(b *cfg.Block, in interface{}) interface{} { return in }
+		facts, err := dataflow.Forward(g, boolLattice{}, true, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range g.Blocks {
+			if got := facts[b].(bool); got != b.Live {
+				t.Errorf("%s: %s: reachable = %t, want %t", name, b, got, b.Live)
+			}
+		}
+	}
+}
+
+// call returns the name of the function called by n, if n is a call
+// statement of a function referred to by name.
+func call(n ast.Node) string {
+	if s, ok := n.(*ast.ExprStmt); ok {
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok {
+				return id.Name
+			}
+		}
+	}
+	return ""
+}
+
+// calls reports whether block b contains a call to the named function.
+func calls(b *cfg.Block, name string) bool {
+	for _, n := range b.Nodes {
+		if call(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// TestDefinitelyCalled computes, for each call statement, whether f
+// has been called on every path that reaches it.
+func TestDefinitelyCalled(t *testing.T) {
+	graphs := parse(t)
+	transfer := func(b *cfg.Block, in interface{}) interface{} {
+		return in.(bool) || calls(b, "f")
+	}
+	facts, err := dataflow.Forward(graphs["g"], boolLattice{and: true}, false, transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for b, fact := range facts {
+		if !b.Live {
+			continue
+		}
+		called := fact.(bool)
+		for _, n := range b.Nodes {
+			switch name := call(n); name {
+			case "":
+			case "f":
+				called = true
+			default:
+				got[name] = called
+			}
+		}
+	}
+	want := map[string]bool{
+		"init": false,
+		"a":    true,
+		"b":    false,
+		"c":    false,
+		"d":    false,
+		"e":    true,
+	}
+	for name, w := range want {
+		if g, ok := got[name]; !ok {
+			t.Errorf("no live call of %s", name)
+		} else if g != w {
+			t.Errorf("f definitely called before %s = %t, want %t", name, g, w)
+		}
+	}
+}
+
+// TestBackward computes whether d may be called after each block.
+func TestBackward(t *testing.T) {
+	graphs := parse(t)
+	g := graphs["f"]
+	transfer := func(b *cfg.Block, out interface{}) interface{} {
+		return out.(bool) || calls(b, "d")
+	}
+	facts, err := dataflow.Backward(g, boolLattice{}, false, transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range g.Blocks {
+		var want bool
+		switch {
+		case b == g.Blocks[0], calls(b, "a"), calls(b, "b"):
+			want = true
+		case calls(b, "d"), calls(b, "e"), b.Return() != nil:
+			want = false
+		default:
+			continue
+		}
+		if got := facts[b].(bool); got != want {
+			t.Errorf("%s: d may follow = %t, want %t", b, got, want)
+		}
+	}
+}
+
+// TestNoFixpoint checks that a non-terminating analysis is detected.
+func TestNoFixpoint(t *testing.T) {
+	graphs := parse(t)
+	g := graphs["f"]
+	count := func(b *cfg.Block, in interface{}) interface{} { return in.(int) + 1 }
+	if _, err := dataflow.Forward(g, maxLattice{}, 0, count); err != dataflow.ErrNoFixpoint {
+		t.Errorf("Forward returned error %v, want ErrNoFixpoint", err)
+	}
+}
+
+// maxLattice is the lattice of integers ordered by <=,
+// which has infinite ascending chains.
+type maxLattice struct{}
+
+func (maxLattice) Bottom() interface{} { return 0 }
+
+func (maxLattice) Join(x, y interface{}) interface{} {
+	if x.(int) > y.(int) {
+		return x
+	}
+	return y
+}
+
+func (maxLattice) Equal(x, y interface{}) bool { return x == y }
@@ -0,0 +1,195 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/cfgtest"
+)
+
+const src = `package main
+
+import "log"
+
+func f1() {
+	live()
+	return
+	dead()
+}
+
+func f2() {
+	for {
+		live()
+	}
+	dead()
+}
+
+func f3() {
+	if true { // even known values are ignored
+		return
+	}
+	for true { // even known values are ignored
+		live()
+	}
+	for {
+		live()
+	}
+	dead()
+}
+
+func f4(x int) {
+	switch x {
+	case 1:
+		live()
+		fallthrough
+	case 2:
+		live()
+		log.Fatal()
+	default:
+		panic("oops")
+	}
+	dead()
+}
+
+func f4(ch chan int) {
+	select {
+	case <-ch:
+		live()
+		return
+	default:
+		live()
+		panic("oops")
+	}
+	dead()
+}
+
+func f5(unknown bool) {
+	for {
+		if unknown {
+			break
+		}
+		continue
+		dead()
+	}
+	live()
+}
+
+func f6(unknown bool) {
+outer:
+	for {
+		for {
+			break outer
+			dead()
+		}
+		dead()
+	}
+	live()
+}
+
+func f7() {
+	for {
+		break nosuchlabel
+		dead()
+	}
+	dead()
+}
+
+func f8() {
+	select{}
+	dead()
+}
+
+func f9(ch chan int) {
+	select {
+	case <-ch:
+		return
+	}
+	dead()
+}
+
+func f10(ch chan int) {
+	select {
+	case <-ch:
+		return
+		dead()
+	default:
+	}
+	live()
+}
+
+func f12(n int) {
+	for i := range 10 {
+		live()
+		if i > n {
+			break
+		}
+		return
+		dead()
+	}
+	for range n {
+		live()
+		continue
+		dead()
+	}
+	live()
+}
+
+func f13() {
+	for i := range 10 {
+		if i == 0 {
+			continue
+		}
+		for {
+			live()
+		}
+		dead()
+	}
+	live()
+	return
+	dead()
+}
+
+`
+
+// badSrc is parsed apart from src, since its syntax error stops the
+// parse of the file. The parser drops the statements after the error,
+// so the CFG of what it recovers need only be built without crashing.
+const badSrc = `package main
+
+func f11() {
+	goto; // mustn't crash
+}
+`
+
+func TestDeadCode(t *testing.T) {
+	// We'll use dead code detection to verify the CFG.
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "dummy.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok {
+			g := cfg.New(decl.Body, cfgtest.MayReturn)
+			cfgtest.AssertDeadLive(t, fset, g, decl.Name.Name)
+		}
+	}
+
+	bad, err := parser.ParseFile(fset, "bad.go", badSrc, parser.Mode(0))
+	if err == nil {
+		t.Fatal("no syntax error in badSrc")
+	}
+	for _, decl := range bad.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok {
+			cfg.New(decl.Body, cfgtest.MayReturn)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the running of deferred calls as control leaves
+// the function; see Options.RunDefers.
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// A DeferRun is a synthetic node, at the end of a block from which
+// control leaves the function, that represents the running of the call
+// deferred by a defer statement; see Options.RunDefers.
+type DeferRun struct {
+	Defer *ast.DeferStmt
+
+	// May reports whether the defer statement is executed on some
+	// paths to the block but not all, so that the deferred call may
+	// not run.
+	May bool
+}
+
+func (d *DeferRun) Pos() token.Pos { return d.Defer.Call.Pos() }
+func (d *DeferRun) End() token.Pos { return d.Defer.Call.End() }
+
+// addDeferRuns appends a DeferRun to each block from which control
+// leaves the function for each defer statement executed on some path
+// to it, last executed first.
+func (b *builder) addDeferRuns() {
+	n := len(b.defers)
+	if n == 0 {
+		return
+	}
+	// For each block, the defer statements executed on some (may)
+	// and all (must) paths from the entry to its start, and within
+	// it (gen). A panic edge may leave a block before its defer
+	// statements, so it carries only those executed before it.
+	blocks := b.cfg.Blocks
+	mayIn := make([][]bool, len(blocks))
+	mustIn := make([][]bool, len(blocks))
+	gen := make([][]bool, len(blocks))
+	for i, blk := range blocks {
+		mayIn[i] = make([]bool, n)
+		mustIn[i] = make([]bool, n)
+		gen[i] = make([]bool, n)
+		for _, d := range b.deferBlocks[blk] {
+			gen[i][d] = true
+		}
+		if i > 0 {
+			for d := range mustIn[i] {
+				mustIn[i][d] = true
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i, blk := range blocks {
+			if i == 0 || !blk.Live {
+				continue
+			}
+			may := make([]bool, n)
+			must := make([]bool, n)
+			first := true
+			for _, pred := range blk.Preds {
+				if !pred.Live {
+					continue
+				}
+				j := pred.Index
+				panicEdge := blk.Kind == KindPanic || blk.Kind == KindRecover
+				for d := 0; d < n; d++ {
+					may[d] = may[d] || mayIn[j][d] || gen[j][d]
+					out := mustIn[j][d] || gen[j][d] && !panicEdge
+					must[d] = out && (first || must[d])
+				}
+				first = false
+			}
+			for d := 0; d < n; d++ {
+				if may[d] != mayIn[i][d] || must[d] != mustIn[i][d] {
+					mayIn[i], mustIn[i] = may, must
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	seen := make(map[*Block]bool)
+	for _, t := range b.cfg.terminals {
+		blk := t.Block
+		if !leaves(t) || seen[blk] {
+			continue
+		}
+		seen[blk] = true
+		i := blk.Index
+		for d := n - 1; d >= 0; d-- {
+			// The terminating node, if any, follows the defer
+			// statements of the block.
+			may := mayIn[i][d] || gen[i][d]
+			must := mustIn[i][d] || gen[i][d]
+			if may {
+				blk.Nodes = append(blk.Nodes, &DeferRun{Defer: b.defers[d], May: !must})
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const deferSrc = `package p
+
+import "log"
+
+func loop(n int) {
+	defer a()
+	for i := 0; i < n; i++ {
+		defer b(i)
+	}
+	c()
+}
+
+func conditional(x bool) {
+	if x {
+		defer a()
+	} else {
+		defer b()
+	}
+	defer c()
+	if x {
+		defer d()
+	}
+}
+
+func returns(x, y bool) int {
+	defer a()
+	if x {
+		return 1
+	}
+	defer b()
+	if y {
+		return 2
+	}
+	log.Fatal()
+}
+
+func panics() {
+	x()
+	defer a()
+	y()
+}
+
+func none() {
+	a()
+}
+
+func forever() {
+	defer a()
+	select {}
+}
+`
+
+func TestRunDefers(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "defer.go", deferSrc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := make(map[string]*ast.FuncDecl)
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok {
+			funcs[decl.Name.Name] = decl
+		}
+	}
+	mayPanic := func(n ast.Node) bool { return true }
+
+	for _, test := range []struct {
+		fn       string
+		mayPanic bool
+		exits    []string // for each predecessor of the exit, its last non-DeferRun node and DeferRuns
+	}{
+		{
+			fn:    "loop",
+			exits: []string{"return; defer-run b(i) // may run; defer-run a()"},
+		},
+		{
+			fn:    "conditional",
+			exits: []string{"return; defer-run d() // may run; defer-run c(); defer-run b() // may run; defer-run a() // may run"},
+		},
+		{
+			fn: "returns",
+			exits: []string{
+				"return 1; defer-run a()",
+				"return 2; defer-run b(); defer-run a()",
+				"log.Fatal(); defer-run b(); defer-run a()",
+			},
+		},
+		{
+			fn:    "panics",
+			exits: []string{"return; defer-run a()"},
+		},
+		{
+			// The panic may occur before or after the defer statement.
+			fn:       "panics",
+			mayPanic: true,
+			exits:    []string{"(none); defer-run a() // may run", "return; defer-run a()"},
+		},
+		{
+			fn:    "none",
+			exits: []string{"return"},
+		},
+		{
+			fn:    "forever",
+			exits: nil,
+		},
+	} {
+		opts := Options{MayReturn: mayReturn, ExitBlock: true, RunDefers: true}
+		if test.mayPanic {
+			opts.MayPanic = mayPanic
+		}
+		g := Build(funcs[test.fn].Body, opts)
+		if err := checkInvariants(g); err != nil {
+			t.Errorf("%s: %v", test.fn, err)
+			continue
+		}
+		var exits []string
+		for _, p := range g.Exit().Preds {
+			last := "(none)"
+			if n := p.lastNode(); n != nil {
+				last = formatNodeLine(fset, n)
+			}
+			parts := []string{last}
+			for _, n := range p.Nodes {
+				if _, ok := n.(*DeferRun); ok {
+					parts = append(parts, formatNodeLine(fset, n))
+				}
+			}
+			exits = append(exits, strings.Join(parts, "; "))
+		}
+		if !reflect.DeepEqual(exits, test.exits) {
+			t.Errorf("%s (panics: %t): exits =\n\t%s\nwant\n\t%s", test.fn, test.mayPanic,
+				strings.Join(exits, "\n\t"), strings.Join(test.exits, "\n\t"))
+		}
+	}
+
+	// NewFunc builds the CFG with an exit and deferred calls, and
+	// DeferRun nodes do not hide the return statement or the kind
+	// of the edge to the exit.
+	g := NewFunc(funcs["returns"], mayReturn)
+	if g.Exit() == nil {
+		t.Fatal("NewFunc: no exit block")
+	}
+	var kinds []string
+	for _, p := range g.Exit().Preds {
+		label, _ := g.EdgeLabel(p, g.Exit())
+		kinds = append(kinds, label.Kind.String())
+		if (p.Return() != nil) != (label.Kind == EdgeReturn) {
+			t.Errorf("%s: Return() = %v, but the edge to the exit has kind %s", p, p.Return(), label.Kind)
+		}
+	}
+	if want := []string{"Return", "Return", "NoReturn"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("NewFunc: kinds of exit edges = %v, want %v", kinds, want)
+	}
+	if g := NewFunc(&ast.FuncDecl{Name: ast.NewIdent("f")}, mayReturn); len(g.Exit().Preds) != 1 {
+		t.Errorf("NewFunc without body: exit has preds %v", g.Exit().Preds)
+	}
+
+	// The CFG is the same as without deferred calls, but for the
+	// DeferRun nodes.
+	for _, body := range []*ast.BlockStmt{funcs["loop"].Body, funcs["conditional"].Body, funcs["returns"].Body} {
+		with := Build(body, Options{MayReturn: mayReturn, MayPanic: mayPanic, RunDefers: true})
+		without := Build(body, Options{MayReturn: mayReturn, MayPanic: mayPanic})
+		for _, b := range with.Blocks {
+			var nodes []ast.Node
+			for _, n := range b.Nodes {
+				if _, ok := n.(*DeferRun); !ok {
+					nodes = append(nodes, n)
+				}
+			}
+			b.Nodes = nodes
+		}
+		if got, want := with.Format(fset), without.Format(fset); got != want {
+			t.Errorf("%s: CFG without DeferRun nodes:\n%s\nwant:\n%s", fset.Position(body.Pos()), got, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements dominator and post-dominator trees,
+// dominance frontiers, and control dependence.
+
+import "sort"
+
+// A DomTree is a dominator tree or a post-dominator tree over the
+// live blocks of a CFG.
+//
+// Block a dominates block b if every path from the entry block to b
+// passes through a. Block a post-dominates block b if every path from
+// b to the exit of the function passes through a.
+//
+// Only live blocks (those reachable from the entry) take part:
+// unreachable blocks are excluded from the tree, have no immediate
+// dominator, dominate nothing, and have empty frontiers. Edges from
+// unreachable blocks to live ones are likewise ignored.
+//
+// A function may have many exits (returns, calls that never return,
+// blocking forever in a select statement without cases, and so on),
+// so post-dominance is computed with respect to a virtual exit node
+// that is a successor of every live block that has no successors
+// other than panic edges (see Options.MayPanic). The virtual exit is
+// not a Block; it is represented by nil, so Idom returns nil for a
+// block immediately post-dominated by the virtual exit, and
+// Children(nil) returns those blocks.
+// If the CFG has an exit block (see Options.ExitBlock), the virtual
+// exit joins it with the other live blocks that have no successors at
+// all, such as that of an empty select statement. Blocks that cannot
+// reach any exit, such as those of an infinite loop, are outside the
+// post-dominator tree.
+//
+// For uniformity, nil also denotes the parent of the entry block in
+// a dominator tree.
+type DomTree struct {
+	post     bool
+	in       []bool     // in[i]: block i is a node of the tree
+	idom     []*Block   // idom[i]: immediate (post)dominator of block i; nil for root or outside
+	children [][]*Block // children[i]: blocks immediately (post)dominated by block i
+	roots    []*Block   // children of the (virtual) root
+	pre, end []int32    // pre-order number and last descendant's pre-order number
+	frontier [][]*Block // frontier[i]: (post)dominance frontier of block i
+	inverse  [][]*Block // inverse[i]: blocks whose frontier contains block i
+}
+
+// Dominators returns the dominator tree of the live blocks of g.
+// The tree is computed on first use and shared by later calls.
+func (g *CFG) Dominators() *DomTree {
+	g.domOnce.Do(func() {
+		n := len(g.Blocks)
+		succs := func(i int) []int {
+			b := g.Blocks[i]
+			res := make([]int, 0, len(b.Succs))
+			for _, s := range b.Succs {
+				res = append(res, int(s.Index))
+			}
+			return res
+		}
+		g.dom = newDomTree(g, false, n, 0, succs)
+	})
+	return g.dom
+}
+
+// PostDominators returns the post-dominator tree of the live blocks
+// of g, computed on the reverse graph with respect to a virtual exit
+// node that joins all live blocks that have no successors, other than
+// panic edges.
+// The tree is computed on first use and shared by later calls.
+func (g *CFG) PostDominators() *DomTree {
+	g.pdomOnce.Do(func() {
+		n := len(g.Blocks)
+		preds := make([][]int, n+1) // preds[n] is the virtual exit's successors in the reverse graph
+		exits := (*Block).exits
+		if g.exit != nil {
+			// Control leaves the function through the exit block.
+			exits = func(b *Block) bool { return len(b.Succs) == 0 }
+		}
+		for _, b := range g.Blocks {
+			if !b.Live {
+				continue
+			}
+			if exits(b) {
+				preds[n] = append(preds[n], int(b.Index))
+			}
+			for _, s := range b.Succs {
+				preds[s.Index] = append(preds[s.Index], int(b.Index))
+			}
+		}
+		succs := func(i int) []int { return preds[i] }
+		g.pdom = newDomTree(g, true, n+1, n, succs)
+	})
+	return g.pdom
+}
+
+// newDomTree computes the dominator tree of the graph of n nodes
+// rooted at root, using the iterative algorithm of Cooper, Harvey and
+// Kennedy ("A Simple, Fast Dominance Algorithm", 2001).
+// Nodes 0..len(g.Blocks)-1 are blocks of g; only live blocks are
+// considered. A root of index len(g.Blocks) denotes the virtual exit.
+func newDomTree(g *CFG, post bool, n, root int, succs func(int) []int) *DomTree {
+	nblocks := len(g.Blocks)
+	live := func(i int) bool { return i == nblocks || g.Blocks[i].Live }
+
+	// Compute the reverse postorder of the nodes reachable from root.
+	order := make([]int, n) // order[i]: postorder number of node i, or -1 if unvisited
+	for i := range order {
+		order[i] = -1
+	}
+	var postorder []int
+	visited := make([]bool, n)
+	var visit func(i int)
+	visit = func(i int) {
+		visited[i] = true
+		for _, s := range succs(i) {
+			if !visited[s] && live(s) {
+				visit(s)
+			}
+		}
+		order[i] = len(postorder)
+		postorder = append(postorder, i)
+	}
+	if live(root) {
+		visit(root)
+	}
+
+	// Compute predecessors restricted to visited nodes.
+	preds := make([][]int, n)
+	for _, i := range postorder {
+		for _, s := range succs(i) {
+			if visited[s] {
+				preds[s] = append(preds[s], i)
+			}
+		}
+	}
+
+	idom := make([]int, n)
+	for i := range idom {
+		idom[i] = -1
+	}
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] < order[b] {
+				a = idom[a]
+			}
+			for order[b] < order[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	if len(postorder) > 0 {
+		idom[root] = root
+	}
+	for changed := true; changed; {
+		changed = false
+		for k := len(postorder) - 2; k >= 0; k-- { // reverse postorder, excluding root
+			i := postorder[k]
+			newIdom := -1
+			for _, p := range preds[i] {
+				if idom[p] < 0 {
+					continue // not yet processed
+				}
+				if newIdom < 0 {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if idom[i] != newIdom {
+				idom[i] = newIdom
+				changed = true
+			}
+		}
+	}
+
+	// Build the tree.
+	t := &DomTree{
+		post:     post,
+		in:       make([]bool, nblocks),
+		idom:     make([]*Block, nblocks),
+		children: make([][]*Block, nblocks),
+		pre:      make([]int32, nblocks),
+		end:      make([]int32, nblocks),
+		frontier: make([][]*Block, nblocks),
+		inverse:  make([][]*Block, nblocks),
+	}
+	block := func(i int) *Block {
+		if i == nblocks {
+			return nil // virtual exit
+		}
+		return g.Blocks[i]
+	}
+	for i := 0; i < nblocks; i++ {
+		if !visited[i] {
+			continue
+		}
+		t.in[i] = true
+		if i == root {
+			t.roots = append(t.roots, g.Blocks[i])
+			continue
+		}
+		if d := idom[i]; d == nblocks {
+			t.roots = append(t.roots, g.Blocks[i])
+		} else {
+			t.idom[i] = block(d)
+			t.children[d] = append(t.children[d], g.Blocks[i])
+		}
+	}
+
+	// Number the tree in pre-order for constant-time Dominates queries.
+	var num int32
+	var number func(b *Block)
+	number = func(b *Block) {
+		t.pre[b.Index] = num
+		num++
+		for _, c := range t.children[b.Index] {
+			number(c)
+		}
+		t.end[b.Index] = num - 1
+	}
+	for _, r := range t.roots {
+		number(r)
+	}
+
+	// Compute dominance frontiers bottom-up over the tree, following
+	// Cytron et al. ("Efficiently Computing Static Single Assignment
+	// Form and the Control Dependence Graph", 1991):
+	//
+	//	DF(x) = DF_local(x) ∪ ⋃_{z ∈ children(x)} DF_up(z)
+	//
+	// where DF_local(x) holds the successors of x that x does not
+	// immediately dominate, and DF_up(z) holds the members of DF(z)
+	// that x does not immediately dominate.
+	var df func(b *Block)
+	df = func(b *Block) {
+		set := make(map[*Block]bool)
+		for _, s := range succs(int(b.Index)) {
+			if s < nblocks && t.in[s] && t.idom[s] != b {
+				set[g.Blocks[s]] = true
+			}
+		}
+		for _, c := range t.children[b.Index] {
+			df(c)
+			for _, y := range t.frontier[c.Index] {
+				if t.idom[y.Index] != b {
+					set[y] = true
+				}
+			}
+		}
+		t.frontier[b.Index] = sortedBlocks(set)
+	}
+	for _, r := range t.roots {
+		df(r)
+	}
+	for _, b := range g.Blocks {
+		for _, y := range t.frontier[b.Index] {
+			t.inverse[y.Index] = append(t.inverse[y.Index], b)
+		}
+	}
+	return t
+}
+
+func sortedBlocks(set map[*Block]bool) []*Block {
+	if len(set) == 0 {
+		return nil
+	}
+	res := make([]*Block, 0, len(set))
+	for b := range set {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Index < res[j].Index })
+	return res
+}
+
+// Contains reports whether b is a node of the tree:
+// for a dominator tree, whether b is live; for a post-dominator
+// tree, whether b is live and can reach an exit.
+func (t *DomTree) Contains(b *Block) bool {
+	return b != nil && t.in[b.Index]
+}
+
+// Idom returns the immediate dominator (or post-dominator) of b.
+// It returns nil if b is the entry block, if b is immediately
+// post-dominated by the virtual exit, or if b is outside the tree.
+func (t *DomTree) Idom(b *Block) *Block {
+	return t.idom[b.Index]
+}
+
+// Children returns the blocks immediately dominated (or
+// post-dominated) by b, in increasing order of Index.
+// Children(nil) returns the children of the root: the entry block
+// of a dominator tree, or the blocks immediately post-dominated by
+// the virtual exit.
+func (t *DomTree) Children(b *Block) []*Block {
+	if b == nil {
+		return t.roots
+	}
+	return t.children[b.Index]
+}
+
+// Dominates reports whether a dominates (or post-dominates) b.
+// Every block of the tree dominates itself.
+// Dominates reports false if either block is outside the tree.
+func (t *DomTree) Dominates(a, b *Block) bool {
+	if !t.Contains(a) || !t.Contains(b) {
+		return false
+	}
+	return t.pre[a.Index] <= t.pre[b.Index] && t.pre[b.Index] <= t.end[a.Index]
+}
+
+// Frontier returns the dominance frontier of b, in increasing order
+// of Index: the set of blocks y such that b dominates a predecessor
+// of y but does not strictly dominate y.
+//
+// For a post-dominator tree, it returns the post-dominance frontier:
+// the set of blocks y such that b post-dominates a successor of y but
+// does not strictly post-dominate y. The virtual exit, which has no
+// successors, never appears in a frontier.
+func (t *DomTree) Frontier(b *Block) []*Block {
+	return t.frontier[b.Index]
+}
+
+// ControlDependents returns the blocks whose frontier contains b,
+// in increasing order of Index.
+//
+// For a post-dominator tree, these are the blocks that are control
+// dependent on b: b has a successor that leads to them
+// unconditionally and another that may bypass them.
+func (t *DomTree) ControlDependents(b *Block) []*Block {
+	return t.inverse[b.Index]
+}
@@ -0,0 +1,370 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const domSrc = `package main
+
+func diamond(x bool) {
+	if x {
+		a()
+	} else {
+		b()
+	}
+	c()
+}
+
+func nested(x, y bool) {
+	if x {
+		if y {
+			return
+		}
+		a()
+	}
+	b()
+}
+
+func loop(x bool) {
+	for i := 0; x; i++ {
+		if x {
+			break
+		}
+		if x {
+			continue
+		}
+		a()
+	}
+	b()
+}
+
+func multipleExits(x int) {
+	switch x {
+	case 0:
+		return
+	case 1:
+		panic("oops")
+	case 2:
+		for {
+		}
+	}
+	a()
+}
+
+func unreachable() {
+	return
+	for {
+		a()
+	}
+}
+
+func infinite(x bool) {
+	for {
+		if x {
+			a()
+		}
+	}
+}
+
+func blockForever() {
+	select {}
+}
+`
+
+func TestDominators(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "dummy.go", domSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok {
+			g := New(decl.Body, mayReturn)
+			checkDomTree(t, decl.Name.Name, g, g.Dominators(), false)
+			checkDomTree(t, decl.Name.Name, g, g.PostDominators(), true)
+		}
+	}
+}
+
+// checkDomTree validates the dominator (or post-dominator) tree t of
+// g against brute-force definitions.
+func checkDomTree(t *testing.T, name string, g *CFG, tree *DomTree, post bool) {
+	t.Helper()
+
+	// next returns the successors of a block in the graph on which
+	// dominance is defined (the reverse graph for post-dominance).
+	preds := make(map[*Block][]*Block)
+	for _, b := range g.Blocks {
+		if b.Live {
+			for _, s := range b.Succs {
+				preds[s] = append(preds[s], b)
+			}
+		}
+	}
+	next, prev := func(b *Block) []*Block { return b.Succs }, func(b *Block) []*Block { return preds[b] }
+	if post {
+		next, prev = prev, next
+	}
+
+	// roots holds the blocks from which the search starts: the
+	// entry, or the exits.
+	var roots []*Block
+	if post {
+		for _, b := range g.Blocks {
+			if b.Live && len(b.Succs) == 0 {
+				roots = append(roots, b)
+			}
+		}
+	} else {
+		roots = g.Blocks[:1]
+	}
+
+	// reach returns the set of live blocks reachable from roots
+	// without passing through avoid.
+	reach := func(avoid *Block) map[*Block]bool {
+		seen := make(map[*Block]bool)
+		var visit func(b *Block)
+		visit = func(b *Block) {
+			if b == avoid || !b.Live || seen[b] {
+				return
+			}
+			seen[b] = true
+			for _, s := range next(b) {
+				visit(s)
+			}
+		}
+		for _, r := range roots {
+			visit(r)
+		}
+		return seen
+	}
+	inTree := reach(nil)
+	dominates := func(a, b *Block) bool {
+		if !inTree[a] || !inTree[b] {
+			return false
+		}
+		return a == b || !reach(a)[b]
+	}
+
+	for _, b := range g.Blocks {
+		if got := tree.Contains(b); got != inTree[b] {
+			t.Errorf("%s: post=%t: Contains(%s) = %t, want %t", name, post, b, got, inTree[b])
+		}
+
+		// Immediate dominator: the strict dominator of b
+		// dominated by all other strict dominators of b.
+		var want *Block
+		for _, d := range g.Blocks {
+			if d == b || !dominates(d, b) {
+				continue
+			}
+			imm := true
+			for _, e := range g.Blocks {
+				if e != b && e != d && dominates(e, b) && !dominates(e, d) {
+					imm = false
+				}
+			}
+			if imm {
+				want = d
+			}
+		}
+		if got := tree.Idom(b); got != want {
+			t.Errorf("%s: post=%t: Idom(%s) = %v, want %v", name, post, b, got, want)
+		}
+		if want != nil && !containsBlock(tree.Children(want), b) {
+			t.Errorf("%s: post=%t: Children(%s) lacks %s", name, post, want, b)
+		}
+
+		for _, a := range g.Blocks {
+			if got, want := tree.Dominates(a, b), dominates(a, b); got != want {
+				t.Errorf("%s: post=%t: Dominates(%s, %s) = %t, want %t", name, post, a, b, got, want)
+			}
+		}
+
+		// Frontier: the blocks y such that b dominates a
+		// predecessor of y but does not strictly dominate y.
+		var frontier []*Block
+		for _, y := range g.Blocks {
+			if !inTree[y] || (y != b && dominates(b, y)) {
+				continue
+			}
+			for _, p := range prev(y) {
+				if dominates(b, p) {
+					frontier = append(frontier, y)
+					break
+				}
+			}
+		}
+		if got := tree.Frontier(b); !equalBlocks(got, frontier) {
+			t.Errorf("%s: post=%t: Frontier(%s) = %v, want %v", name, post, b, got, frontier)
+		}
+		for _, y := range frontier {
+			if !containsBlock(tree.ControlDependents(y), b) {
+				t.Errorf("%s: post=%t: ControlDependents(%s) lacks %s", name, post, y, b)
+			}
+		}
+	}
+}
+
+func containsBlock(blocks []*Block, b *Block) bool {
+	for _, x := range blocks {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
+
+func equalBlocks(x, y []*Block) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestControlDependents(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "dummy.go", domSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		decl, ok := decl.(*ast.FuncDecl)
+		if !ok || decl.Name.Name != "diamond" {
+			continue
+		}
+		g := New(decl.Body, mayReturn)
+		pdom := g.PostDominators()
+
+		// The entry block holds the condition; the then and else
+		// blocks depend on it, the join block c() does not.
+		entry := g.Blocks[0]
+		var deps []string
+		for _, b := range pdom.ControlDependents(entry) {
+			deps = append(deps, b.name())
+		}
+		if got, want := fmt.Sprint(deps), "[if.then if.else]"; got != want {
+			t.Errorf("ControlDependents(entry) = %s, want %s", got, want)
+		}
+		if got := pdom.Frontier(entry); got != nil {
+			t.Errorf("Frontier(entry) = %v, want none", got)
+		}
+	}
+}
+
+const domTreesSrc = `package p
+
+func nestedIfs(x, y bool) {
+	if x {
+		if y {
+			a()
+		}
+		b()
+	}
+	c()
+}
+
+func loopBreaks(x, y bool) {
+	for x {
+		if y {
+			break
+		}
+		a()
+	}
+	b()
+}
+
+func chain(x int) {
+	if x == 0 {
+		a()
+	} else if x == 1 {
+		b()
+	} else {
+		return
+	}
+	c()
+}
+
+func forever() {
+	a()
+	select {}
+}
+`
+
+// TestDomTrees checks the dominator and post-dominator trees of some
+// functions against trees computed by hand.
+func TestDomTrees(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "dummy.go", domTreesSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each tree lists the blocks by Index, each with the Index of its
+	// immediate (post)dominator, "-" for none, or "x" if it is outside
+	// the tree.
+	for _, test := range []struct {
+		name, dom, pdom string
+	}{
+		// 0: x; 1: y; 2: c(); 3: a(); 4: b().
+		{"nestedIfs", "0:- 1:0 2:0 3:1 4:1", "0:2 1:4 2:- 3:4 4:2"},
+		// 0: entry; 1: y; 2: b(); 3: x; 4: break; 5: a(); 6: unreachable.
+		{"loopBreaks", "0:- 1:3 2:3 3:0 4:1 5:1 6:x", "0:3 1:2 2:- 3:2 4:2 5:3 6:x"},
+		// 0: x == 0; 1: a(); 2: c(); 3: x == 1; 4: b(); 5: join;
+		// 6: return; 7: unreachable. The entry and the else if, one
+		// of whose branches returns, are post-dominated only by the
+		// virtual exit.
+		{"chain", "0:- 1:0 2:0 3:0 4:3 5:4 6:3 7:x", "0:- 1:2 2:- 3:- 4:5 5:2 6:- 7:x"},
+		// 0: a(); 1: unreachable select.done; 2: select.forever, which
+		// has no successors.
+		{"forever", "0:- 1:x 2:0", "0:2 1:x 2:-"},
+	} {
+		var g *CFG
+		for _, decl := range f.Decls {
+			if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name == test.name {
+				g = New(decl.Body, mayReturn)
+			}
+		}
+		checkDomTree(t, test.name, g, g.Dominators(), false)
+		checkDomTree(t, test.name, g, g.PostDominators(), true)
+		for _, tree := range []struct {
+			name string
+			tree *DomTree
+			want string
+		}{
+			{"Dominators", g.Dominators(), test.dom},
+			{"PostDominators", g.PostDominators(), test.pdom},
+		} {
+			var idoms []string
+			for _, b := range g.Blocks {
+				idom := "x"
+				if tree.tree.Contains(b) {
+					idom = "-"
+					if d := tree.tree.Idom(b); d != nil {
+						idom = fmt.Sprint(d.Index)
+					}
+				}
+				idoms = append(idoms, fmt.Sprintf("%d:%s", b.Index, idom))
+			}
+			if got := strings.Join(idoms, " "); got != tree.want {
+				t.Errorf("%s: %s: got %s, want %s\n%s", test.name, tree.name, got, tree.want, g.Format(fset))
+			}
+		}
+		if children := g.Dominators().Children(nil); len(children) != 1 || children[0] != g.Blocks[0] {
+			t.Errorf("%s: the root of the dominator tree has children %v, want the entry", test.name, children)
+		}
+	}
+}
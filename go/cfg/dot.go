@@ -0,0 +1,326 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the Graphviz and Mermaid renderings of a CFG.
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A DotOption modifies the rendering of a CFG by Dot, DotCluster, and
+// DotAll.
+type DotOption uint8
+
+const (
+	// ClusterLoops renders the blocks of each natural loop (see
+	// Loops) as a subgraph cluster labeled with the Name of the
+	// loop header, nested within the cluster of the enclosing
+	// loop; each block appears in the cluster of its innermost
+	// loop. The blocks of irreducible regions, which have no
+	// single header, are not clustered but outlined in red, and
+	// unreachable blocks, which belong to no loop, are dashed.
+	ClusterLoops DotOption = 1 << iota
+
+	// ShowPreds adds the number of predecessors of each block to its
+	// label, on a line of the form "preds: 2" after its Name.
+	ShowPreds
+
+	// LabelEdges labels each edge with a short description of its
+	// EdgeLabel, such as "true", "false", "case x > 0", or "next",
+	// except for unconditional edges.
+	LabelEdges
+
+	// ShowKinds begins the label of each block with its Index and
+	// follows its Name with its Kind, as in "3: for.loop@a.go:4
+	// (ForLoop)".
+	ShowKinds
+
+	// ShowPositions precedes each node of a block with the line and
+	// column at which it begins, as in "5:2: x++".
+	ShowPositions
+
+	// HighlightUnreachable renders unreachable blocks, those that are
+	// not Live, in gray.
+	HighlightUnreachable
+)
+
+// Dot returns the control-flow graph in the Graphviz dot language,
+// as a single digraph with one node per block, labeled with the
+// block's Name and its nodes, and one edge per successor, in order.
+// The options add to the labels of nodes and edges, and group or
+// highlight the nodes; see DotOption.
+//
+// Node names (b0, b1, ...) are derived from block indices and are
+// therefore stable across runs.
+func (g *CFG) Dot(fset *token.FileSet, opts ...DotOption) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph {\n")
+	buf.WriteString("\tnode [shape=box];\n")
+	g.writeDotBody(&buf, fset, "\t", "b", "cluster_", dotOptions(opts))
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// DotCluster returns the control-flow graph as a Graphviz subgraph
+// named cluster_id and labeled with label, for inclusion in an
+// enclosing digraph alongside the clusters of other functions.
+// Node names are prefixed by "f<id>_" to keep them distinct.
+func (g *CFG) DotCluster(fset *token.FileSet, id int, label string, opts ...DotOption) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "\tsubgraph cluster_%d {\n", id)
+	fmt.Fprintf(&buf, "\t\tlabel=\"%s\";\n", dotEscape(label))
+	g.writeDotBody(&buf, fset, "\t\t", fmt.Sprintf("f%d_b", id), fmt.Sprintf("cluster_%d_", id), dotOptions(opts))
+	buf.WriteString("\t}\n")
+	return buf.Bytes()
+}
+
+// DotAll returns the control-flow graphs of several functions as a
+// single Graphviz digraph, with one subgraph cluster per function, in
+// order of name. The keys of graphs are the function names, typically
+// of the form "pkg.Func" or "Type.Method"; each cluster is named
+// cluster_ followed by the name with characters other than letters,
+// digits, and underscores replaced by underscores, and is labeled
+// with the name and the position of the function body. Node names
+// are prefixed by "f<i>_" for the ith function, and are rendered as
+// by Dot.
+func DotAll(fset *token.FileSet, graphs map[string]*CFG, opts ...DotOption) []byte {
+	names := make([]string, 0, len(graphs))
+	for name := range graphs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph {\n")
+	buf.WriteString("\tnode [shape=box];\n")
+	used := make(map[string]bool)
+	for i, name := range names {
+		g := graphs[name]
+		id := dotSanitize(name)
+		if used[id] {
+			// Distinct names may sanitize alike, e.g. T.M and T_M.
+			id = fmt.Sprintf("%s_%d", id, i)
+		}
+		used[id] = true
+		label := name
+		if entry := g.Blocks[0]; entry.Stmt != nil && entry.Stmt.Pos().IsValid() {
+			posn := fset.Position(entry.Stmt.Pos())
+			label = fmt.Sprintf("%s (%s:%d)", name, filepath.Base(posn.Filename), posn.Line)
+		}
+		fmt.Fprintf(&buf, "\tsubgraph cluster_%s {\n", id)
+		fmt.Fprintf(&buf, "\t\tlabel=\"%s\";\n", dotEscape(label))
+		g.writeDotBody(&buf, fset, "\t\t", fmt.Sprintf("f%d_b", i), fmt.Sprintf("cluster_%s_", id), dotOptions(opts))
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// dotSanitize returns s with each character other than an ASCII letter,
+// digit, or underscore replaced by an underscore, for use within a dot
+// identifier.
+func dotSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func dotOptions(opts []DotOption) DotOption {
+	var res DotOption
+	for _, opt := range opts {
+		res |= opt
+	}
+	return res
+}
+
+// writeDotBody writes the nodes and edges of g to buf, each line
+// beginning with indent, using prefix for node names and
+// clusterPrefix for the names of loop clusters.
+func (g *CFG) writeDotBody(buf *bytes.Buffer, fset *token.FileSet, indent, prefix, clusterPrefix string, opts DotOption) {
+	if opts&ClusterLoops != 0 {
+		g.writeDotLoops(buf, fset, indent, prefix, clusterPrefix, opts)
+	} else {
+		for _, b := range g.Blocks {
+			writeDotNode(buf, fset, indent, prefix, b, "", opts)
+		}
+	}
+	for _, b := range g.Blocks {
+		for i, succ := range b.Succs {
+			var attrs string
+			if opts&LabelEdges != 0 {
+				if text := b.SuccLabel(i).text(fset); text != "" {
+					attrs = fmt.Sprintf(" [label=\"%s\"]", dotEscape(text))
+				}
+			}
+			fmt.Fprintf(buf, "%s%s%d -> %s%d%s;\n", indent, prefix, b.Index, prefix, succ.Index, attrs)
+		}
+	}
+}
+
+// writeDotNode writes the node of block b to buf, with the given
+// additional attributes, if any.
+func writeDotNode(buf *bytes.Buffer, fset *token.FileSet, indent, prefix string, b *Block, attrs string, opts DotOption) {
+	var label strings.Builder
+	if opts&ShowKinds != 0 {
+		fmt.Fprintf(&label, "%d: %s (%s)", b.Index, dotEscape(b.Name(fset)), b.Kind)
+	} else {
+		label.WriteString(dotEscape(b.Name(fset)))
+	}
+	label.WriteString(`\l`)
+	if opts&ShowPreds != 0 {
+		fmt.Fprintf(&label, "preds: %d\\l", len(b.Preds))
+	}
+	for _, n := range b.Nodes {
+		if opts&ShowPositions != 0 {
+			posn := fset.Position(n.Pos())
+			fmt.Fprintf(&label, "%d:%d: ", posn.Line, posn.Column)
+		}
+		label.WriteString(dotEscape(formatNode(fset, n)))
+		label.WriteString(`\l`)
+	}
+	if b.Kind == KindExit {
+		attrs += ", peripheries=2"
+	}
+	if opts&HighlightUnreachable != 0 && !b.Live {
+		attrs += ", color=gray, fontcolor=gray"
+	}
+	fmt.Fprintf(buf, "%s%s%d [label=\"%s\"%s];\n", indent, prefix, b.Index, label.String(), attrs)
+}
+
+// writeDotLoops writes the nodes of g to buf, grouped into nested
+// clusters by natural loop; see ClusterLoops.
+func (g *CFG) writeDotLoops(buf *bytes.Buffer, fset *token.FileSet, indent, prefix, clusterPrefix string, opts DotOption) {
+	// Assign each block to its innermost natural loop, the
+	// smallest containing it, and each loop to its innermost
+	// enclosing natural loop.
+	var loops []*Loop
+	irreducible := make(map[*Block]bool)
+	for _, l := range g.Loops() {
+		if l.Irreducible {
+			for _, b := range l.Blocks {
+				irreducible[b] = true
+			}
+		} else {
+			loops = append(loops, l)
+		}
+	}
+	innermost := func(b *Block, except *Loop) *Loop {
+		var res *Loop
+		for _, l := range loops {
+			if l != except && l.Contains(b) && (res == nil || len(l.Blocks) < len(res.Blocks)) {
+				res = l
+			}
+		}
+		return res
+	}
+	blocks := make(map[*Loop][]*Block) // nil => outside all loops
+	for _, b := range g.Blocks {
+		l := innermost(b, nil)
+		blocks[l] = append(blocks[l], b)
+	}
+	children := make(map[*Loop][]*Loop)
+	for _, l := range loops {
+		parent := innermost(l.Header, l)
+		children[parent] = append(children[parent], l)
+	}
+
+	var write func(indent string, l *Loop)
+	write = func(indent string, l *Loop) {
+		for _, b := range blocks[l] {
+			var attrs string
+			switch {
+			case !b.Live:
+				attrs = ", style=dashed"
+			case irreducible[b]:
+				attrs = ", color=red"
+			}
+			writeDotNode(buf, fset, indent, prefix, b, attrs, opts)
+		}
+		for _, child := range children[l] {
+			fmt.Fprintf(buf, "%ssubgraph %sloop%d {\n", indent, clusterPrefix, child.Header.Index)
+			fmt.Fprintf(buf, "%s\tlabel=\"%s\";\n", indent, dotEscape(child.Header.Name(fset)))
+			write(indent+"\t", child)
+			fmt.Fprintf(buf, "%s}\n", indent)
+		}
+	}
+	write(indent, nil)
+}
+
+// dotEscape escapes s for use within a double-quoted dot string,
+// rendering each line break as a left-justified line break.
+func dotEscape(s string) string {
+	var buf strings.Builder
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case '\n':
+			buf.WriteString(`\l`)
+		case '\t':
+			buf.WriteString("    ")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// Mermaid returns the control-flow graph as a Mermaid flowchart, with
+// one node per block, labeled with the block's Name and its nodes,
+// and one edge per successor.
+func (g *CFG) Mermaid(fset *token.FileSet) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("flowchart TD\n")
+	for _, b := range g.Blocks {
+		lines := []string{mermaidEscape(b.Name(fset))}
+		for _, n := range b.Nodes {
+			lines = append(lines, mermaidEscape(formatNode(fset, n)))
+		}
+		fmt.Fprintf(&buf, "\tb%d[\"%s\"]\n", b.Index, strings.Join(lines, "<br/>"))
+	}
+	for _, b := range g.Blocks {
+		for _, succ := range b.Succs {
+			fmt.Fprintf(&buf, "\tb%d --> b%d\n", b.Index, succ.Index)
+		}
+	}
+	return buf.Bytes()
+}
+
+// mermaidEscape escapes s for use within a double-quoted Mermaid
+// label, using entity codes for characters that Mermaid would
+// otherwise interpret.
+func mermaidEscape(s string) string {
+	var buf strings.Builder
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString("#quot;")
+		case '<':
+			buf.WriteString("#lt;")
+		case '>':
+			buf.WriteString("#gt;")
+		case '#':
+			buf.WriteString("#35;")
+		case '\n':
+			buf.WriteString("<br/>")
+		case '\t':
+			buf.WriteString("    ")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
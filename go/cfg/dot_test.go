@@ -0,0 +1,70 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDot(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+	if x {
+		print("a\"b", '<', "#")
+	}
+}
+`
+	g, fset, err := FromSource(src, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const wantDot = `digraph {
+	node [shape=box];
+	b0 [label="entry@input.go:3\lx\l"];
+	b1 [label="if.then@input.go:4\lprint(\"a\\\"b\", '<', \"#\")\l"];
+	b2 [label="if.done@input.go:4\lreturn\l"];
+	b0 -> b1;
+	b0 -> b2;
+	b1 -> b2;
+}
+`
+	if got := string(g.Dot(fset)); got != wantDot {
+		t.Errorf("Dot:\n%s\nwant:\n%s", got, wantDot)
+	}
+
+	const wantCluster = `	subgraph cluster_1 {
+		label="f \"x\"";
+		f1_b0 [label="entry@input.go:3\lx\l"];
+		f1_b1 [label="if.then@input.go:4\lprint(\"a\\\"b\", '<', \"#\")\l"];
+		f1_b2 [label="if.done@input.go:4\lreturn\l"];
+		f1_b0 -> f1_b1;
+		f1_b0 -> f1_b2;
+		f1_b1 -> f1_b2;
+	}
+`
+	if got := string(g.DotCluster(fset, 1, `f "x"`)); got != wantCluster {
+		t.Errorf("DotCluster:\n%s\nwant:\n%s", got, wantCluster)
+	}
+
+	const wantMermaid = `flowchart TD
+	b0["entry@input.go:3<br/>x"]
+	b1["if.then@input.go:4<br/>print(#quot;a\#quot;b#quot;, '#lt;', #quot;#35;#quot;)"]
+	b2["if.done@input.go:4<br/>return"]
+	b0 --> b1
+	b0 --> b2
+	b1 --> b2
+`
+	if got := string(g.Mermaid(fset)); got != wantMermaid {
+		t.Errorf("Mermaid:\n%s\nwant:\n%s", got, wantMermaid)
+	}
+
+	const wantPreds = `b2 [label="if.done@input.go:4\lpreds: 2\lreturn\l"];`
+	if got := string(g.Dot(fset, ShowPreds)); !strings.Contains(got, wantPreds) {
+		t.Errorf("Dot with ShowPreds:\n%s\nwant a line %s", got, wantPreds)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/cfgtest"
+)
+
+func TestDotAll(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filepath.Join("testdata", "dotall.go"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphs := make(map[string]*cfg.CFG)
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			name := "p." + fn.Name.Name
+			if fn.Recv != nil {
+				name = "(*T)." + fn.Name.Name
+			}
+			graphs[name] = cfg.New(fn.Body, cfgtest.MayReturn)
+		}
+	}
+	golden := filepath.Join("testdata", "dotall.golden")
+	cfgtest.Golden(t, golden, cfg.DotAll(fset, graphs, cfg.ClusterLoops), *update)
+
+	// Names that sanitize alike still yield distinct clusters.
+	g := graphs["p.first"]
+	got := string(cfg.DotAll(fset, map[string]*cfg.CFG{"T.M": g, "T_M": g}))
+	for _, want := range []string{"subgraph cluster_T_M {", "subgraph cluster_T_M_1 {", "f1_b0 ->"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("DotAll lacks %q:\n%s", want, got)
+		}
+	}
+}
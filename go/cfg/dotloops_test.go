@@ -0,0 +1,37 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg_test
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/cfgtest"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestDotClusterLoops(t *testing.T) {
+	for _, name := range []string{"nested", "irreducible"} {
+		g, fset, err := cfg.FromFile(filepath.Join("testdata", "loops.go"), name, cfgtest.MayReturn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", "loops_"+name+".golden")
+		cfgtest.Golden(t, golden, g.Dot(fset, cfg.ClusterLoops), *update)
+	}
+
+	// Cluster names are qualified by the function's cluster.
+	g, fset, err := cfg.FromFile(filepath.Join("testdata", "loops.go"), "nested", cfgtest.MayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(g.DotCluster(fset, 1, "nested", cfg.ClusterLoops)); !strings.Contains(got, "\t\t\tsubgraph cluster_1_loop6 {\n") {
+		t.Errorf("DotCluster(ClusterLoops) lacks nested cluster_1_loop6:\n%s", got)
+	}
+}
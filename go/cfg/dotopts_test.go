@@ -0,0 +1,33 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/cfgtest"
+)
+
+// TestDotOptions checks the renderings by Dot of some functions of the
+// test sources with all the options that annotate blocks and edges.
+func TestDotOptions(t *testing.T) {
+	for _, test := range []struct {
+		file, name string
+		opts       []cfg.DotOption
+	}{
+		{"loops.go", "nested", []cfg.DotOption{cfg.ClusterLoops}},
+		{"text.go", "constructs", nil},
+	} {
+		g, fset, err := cfg.FromFile(filepath.Join("testdata", test.file), test.name, cfgtest.MayReturn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := append(test.opts, cfg.ShowKinds, cfg.ShowPositions, cfg.ShowPreds, cfg.LabelEdges, cfg.HighlightUnreachable)
+		golden := filepath.Join("testdata", "dot_"+test.name+".golden")
+		cfgtest.Golden(t, golden, g.Dot(fset, opts...), *update)
+	}
+}
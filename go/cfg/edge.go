@@ -0,0 +1,186 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// An Edge is an edge of a CFG, from a block to one of its successors.
+type Edge struct {
+	From, To *Block
+}
+
+// An EdgeKind identifies the reason control may follow an edge.
+// The kind of an edge depends only on the block from which it leaves
+// and its position among that block's successors.
+type EdgeKind uint8
+
+const (
+	EdgeUnconditional EdgeKind = iota // sole successor (other than panic edges)
+	EdgeCondTrue                      // first successor of a block ending with an if or for condition: it holds
+	EdgeCondFalse                     // second successor of such a block: the condition does not hold
+	EdgeSwitchCase                    // to the body of a switch case: an expression (or type) of the case matches
+	EdgeSwitchNext                    // to the next test of a switch: it does not
+	EdgeSelectCase                    // to the body of a select case: its communication proceeds
+	EdgeSelectNext                    // to the next case of a select: it does not
+	EdgeRangeBody                     // to the body of a range loop: there is another iteration
+	EdgeRangeDone                     // to the block after a range loop: there is not
+	EdgePanic                         // panic edge, to a block of kind KindPanic or KindRecover; see Options.MayPanic
+	EdgeReturn                        // to the exit block, from a return or the KindRecover block; see Options.ExitBlock
+	EdgeNoReturn                      // to the exit block, from a call that never returns or the KindPanic block
+)
+
+func (kind EdgeKind) String() string {
+	return [...]string{
+		EdgeUnconditional: "Unconditional",
+		EdgeCondTrue:      "CondTrue",
+		EdgeCondFalse:     "CondFalse",
+		EdgeSwitchCase:    "SwitchCase",
+		EdgeSwitchNext:    "SwitchNext",
+		EdgeSelectCase:    "SelectCase",
+		EdgeSelectNext:    "SelectNext",
+		EdgeRangeBody:     "RangeBody",
+		EdgeRangeDone:     "RangeDone",
+		EdgePanic:         "Panic",
+		EdgeReturn:        "Return",
+		EdgeNoReturn:      "NoReturn",
+	}[kind]
+}
+
+// edgeKind returns the kind of the edge from b to b.Succs[i].
+func edgeKind(b *Block, i int) EdgeKind {
+	succs := normalSuccs(b)
+	switch {
+	case i >= len(succs):
+		return EdgePanic
+	case succs[i].Kind == KindExit:
+		// Other than by returning, control leaves the function
+		// only after a call that never returns, which the block
+		// ends with, or by panicking.
+		if b.Kind == KindPanic {
+			return EdgeNoReturn
+		}
+		if _, ok := b.lastNode().(*ast.ExprStmt); ok {
+			return EdgeNoReturn
+		}
+		return EdgeReturn
+	case len(succs) == 1:
+		return EdgeUnconditional
+	}
+	// A block with two successors tests one condition; the kind
+	// of the second successor identifies the statement.
+	var kinds [2]EdgeKind
+	switch succs[1].Kind {
+	case KindSwitchNextCase:
+		kinds = [2]EdgeKind{EdgeSwitchCase, EdgeSwitchNext}
+	case KindSelectAfterCase:
+		kinds = [2]EdgeKind{EdgeSelectCase, EdgeSelectNext}
+	case KindRangeDone:
+		kinds = [2]EdgeKind{EdgeRangeBody, EdgeRangeDone}
+	default:
+		kinds = [2]EdgeKind{EdgeCondTrue, EdgeCondFalse}
+	}
+	return kinds[i]
+}
+
+// An EdgeLabel describes the condition under which control follows an
+// edge of a CFG from one block to another; see CFG.EdgeLabel.
+type EdgeLabel struct {
+	Kind EdgeKind
+
+	// Cond is the expression that the block from which the edge
+	// leaves tests last: the condition of an if or for statement, for
+	// EdgeCondTrue and EdgeCondFalse, or the expression (or type) of
+	// a switch case, for EdgeSwitchCase and EdgeSwitchNext. It is nil
+	// for edges of other kinds.
+	Cond ast.Expr
+
+	// Clause is the clause of the case that the block tests, an
+	// *ast.CaseClause for EdgeSwitchCase and EdgeSwitchNext, or an
+	// *ast.CommClause for EdgeSelectCase and EdgeSelectNext, whose
+	// List or Comm the edges follow the success or failure of. It is
+	// nil for edges of other kinds.
+	Clause ast.Stmt
+}
+
+// EdgeLabel returns the label of the first edge from block from to
+// block to, and whether there is one. Blocks with two successors,
+// other than panic edges, always have the one for which their
+// condition holds first.
+func (g *CFG) EdgeLabel(from, to *Block) (EdgeLabel, bool) {
+	for i, s := range from.Succs {
+		if s == to {
+			return from.SuccLabel(i), true
+		}
+	}
+	return EdgeLabel{}, false
+}
+
+// SuccLabel returns the label of the edge from b to b.Succs[i].
+func (b *Block) SuccLabel(i int) EdgeLabel {
+	label := EdgeLabel{Kind: edgeKind(b, i)}
+	switch label.Kind {
+	case EdgeCondTrue, EdgeCondFalse:
+		if len(b.Nodes) > 0 {
+			label.Cond, _ = b.Nodes[len(b.Nodes)-1].(ast.Expr)
+		}
+	case EdgeSwitchCase, EdgeSwitchNext:
+		// The tests of a case clause form a chain of blocks, each
+		// but the first of which is the KindSwitchNextCase block
+		// to which its predecessor leads, one for each expression
+		// (or type) of its List.
+		cc, _ := b.Succs[1].Stmt.(*ast.CaseClause)
+		label.Clause = cc
+		if cc != nil {
+			k := 0
+			for x := b; x.Kind == KindSwitchNextCase && x.Stmt == cc && len(x.Preds) == 1; x = x.Preds[0] {
+				k++
+			}
+			if k < len(cc.List) {
+				label.Cond = cc.List[k]
+			}
+		}
+	case EdgeSelectCase, EdgeSelectNext:
+		cc, _ := b.Succs[1].Stmt.(*ast.CommClause)
+		label.Clause = cc
+	}
+	return label
+}
+
+// text returns a short description of the label for the edges of a
+// rendering of a CFG, such as "true", "case int", or "next".
+func (label EdgeLabel) text(fset *token.FileSet) string {
+	switch label.Kind {
+	case EdgeCondTrue:
+		return "true"
+	case EdgeCondFalse:
+		return "false"
+	case EdgeSwitchCase:
+		if label.Cond != nil {
+			return "case " + formatNodeLine(fset, label.Cond)
+		}
+		return "case"
+	case EdgeSelectCase:
+		if cc, ok := label.Clause.(*ast.CommClause); ok && cc.Comm != nil {
+			return "case " + formatNodeLine(fset, cc.Comm)
+		}
+		return "case"
+	case EdgeSwitchNext, EdgeSelectNext:
+		return "next"
+	case EdgeRangeBody:
+		return "range"
+	case EdgeRangeDone:
+		return "done"
+	case EdgePanic:
+		return "panic"
+	case EdgeReturn:
+		return "return"
+	case EdgeNoReturn:
+		return "no return"
+	}
+	return ""
+}
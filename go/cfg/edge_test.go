@@ -0,0 +1,133 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const edgeSrc = `package p
+
+func ifThen(x bool) {
+	if x {
+		a()
+	}
+}
+
+func ifElse(x int) {
+	if x > 0 {
+		a()
+	} else {
+		b()
+	}
+}
+
+func forCond(n int) {
+	for i := 0; i < n; i++ {
+		a()
+	}
+}
+
+func switchDefault(x int) {
+	switch x {
+	case 1, 2:
+		a()
+	default:
+		b()
+	case 3:
+		c()
+	}
+}
+
+func typeSwitch(y interface{}) {
+	switch y.(type) {
+	case int, string:
+		a()
+	case error:
+		b()
+	}
+}
+
+func rangeSelect(s []int, ch chan int) {
+	for range s {
+		select {
+		case v := <-ch:
+			a(v)
+		default:
+		}
+	}
+}
+`
+
+// TestEdgeLabels checks the labels of the edges of the CFGs of various
+// statements. Each edge is listed as "from->to Kind", followed by the
+// condition, if any, and by the line of the clause, if any.
+func TestEdgeLabels(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", edgeSrc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphs := make(map[string]*CFG)
+	for _, decl := range f.Decls {
+		decl := decl.(*ast.FuncDecl)
+		graphs[decl.Name.Name] = New(decl.Body, mayReturn)
+	}
+	for _, test := range []struct {
+		name, edges string
+	}{
+		{"ifThen", "0->1 CondTrue x, 0->2 CondFalse x, 1->2 Unconditional"},
+		{"ifElse", "0->1 CondTrue x > 0, 0->3 CondFalse x > 0, 1->2 Unconditional, 3->2 Unconditional"},
+		{"forCond", "0->1 Unconditional, 1->4 Unconditional, 2->5 Unconditional, 4->2 CondTrue i < n, 4->3 CondFalse i < n, 5->4 Unconditional"},
+		// The default case, tested last, follows the failure of
+		// the test of the case after it.
+		{"switchDefault", "0->2 SwitchCase 1 @25, 0->4 SwitchNext 1 @25, 2->1 Unconditional, 3->1 Unconditional, " +
+			"4->2 SwitchCase 2 @25, 4->5 SwitchNext 2 @25, 5->6 SwitchCase 3 @29, 5->7 SwitchNext 3 @29, " +
+			"6->1 Unconditional, 7->3 Unconditional"},
+		{"typeSwitch", "0->2 SwitchCase int @36, 0->3 SwitchNext int @36, 2->1 Unconditional, " +
+			"3->2 SwitchCase string @36, 3->4 SwitchNext string @36, 4->5 SwitchCase error @38, 4->6 SwitchNext error @38, " +
+			"5->1 Unconditional, 6->1 Unconditional"},
+		{"rangeSelect", "0->1 Unconditional, 1->2 RangeBody, 1->3 RangeDone, 2->5 SelectCase @46, 2->6 SelectNext @46, " +
+			"4->1 Unconditional, 5->4 Unconditional, 6->7 Unconditional, 7->4 Unconditional"},
+	} {
+		g := graphs[test.name]
+		var edges []string
+		for _, b := range g.Blocks {
+			for i, s := range b.Succs {
+				label := b.SuccLabel(i)
+				if l, ok := g.EdgeLabel(b, s); !ok || l != label {
+					t.Errorf("%s: EdgeLabel(%s, %s) = %v, %t, want %v", test.name, b, s, l, ok, label)
+				}
+				edge := fmt.Sprintf("%d->%d %s", b.Index, s.Index, label.Kind)
+				if label.Cond != nil {
+					edge += " " + formatNodeLine(fset, label.Cond)
+				}
+				if label.Clause != nil {
+					edge += fmt.Sprintf(" @%d", fset.Position(label.Clause.Pos()).Line)
+				}
+				edges = append(edges, edge)
+			}
+		}
+		if got := strings.Join(edges, ", "); got != test.edges {
+			t.Errorf("%s: got edges %s, want %s\n%s", test.name, got, test.edges, g.Format(fset, FormatEdges))
+		}
+	}
+
+	g := graphs["typeSwitch"]
+	if _, ok := g.EdgeLabel(g.Blocks[0], g.Blocks[1]); ok {
+		t.Errorf("EdgeLabel reports an edge from %s to %s", g.Blocks[0], g.Blocks[1])
+	}
+	if got, want := g.Format(fset, FormatEdges), "succs: 2 (case string) 4 (next)\n"; !strings.Contains(got, want) {
+		t.Errorf("Format(FormatEdges) lacks %q:\n%s", want, got)
+	}
+	if got, want := string(g.Dot(fset, LabelEdges)), "b3 -> b2 [label=\"case string\"];\n\tb3 -> b4 [label=\"next\"];\n"; !strings.Contains(got, want) {
+		t.Errorf("Dot(LabelEdges) lacks %q:\n%s", want, got)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const exitSrc = `package p
+
+import "log"
+
+func f4(x int) {
+	switch x {
+	case 1:
+		live()
+		fallthrough
+	case 2:
+		live()
+		log.Fatal()
+	default:
+		panic("oops")
+	}
+	dead()
+}
+
+func returns(x bool) {
+	if x {
+		return
+	}
+	live()
+}
+
+func forever() {
+	live()
+	select {}
+}
+`
+
+func TestExitBlock(t *testing.T) {
+	fset, bodies := corpusBodies(t)
+	for _, body := range bodies {
+		for _, opts := range []Options{
+			{MayReturn: mayReturn},
+			{MayReturn: mayReturn, MayPanic: func(ast.Node) bool { return true }},
+			{MayReturn: mayReturn, MayPanic: func(ast.Node) bool { return true }, ModelRecover: true},
+		} {
+			without := Build(body, opts)
+			opts.ExitBlock = true
+			g := Build(body, opts)
+			if err := checkExit(g, without); err != nil {
+				t.Errorf("%s: %v", fset.Position(body.Pos()), err)
+			}
+		}
+	}
+
+	fset = token.NewFileSet()
+	f, err := parser.ParseFile(fset, "exit.go", exitSrc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		fn    string
+		preds []string // last statement of each predecessor of the exit, and edge kind
+		live  bool
+	}{
+		// The unreachable call to dead is not followed by an exit.
+		{"f4", []string{"log.Fatal(): NoReturn", `panic("oops"): NoReturn`}, true},
+		// The second return is the implicit one after live().
+		{"returns", []string{"return: Return", "return: Return"}, true},
+		{"forever", nil, false},
+	} {
+		var body *ast.BlockStmt
+		for _, decl := range f.Decls {
+			if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name == test.fn {
+				body = decl.Body
+			}
+		}
+		g := Build(body, Options{MayReturn: mayReturn, ExitBlock: true})
+		if err := checkExit(g, New(body, mayReturn)); err != nil {
+			t.Errorf("%s: %v", test.fn, err)
+			continue
+		}
+		exit := g.Exit()
+		var preds []string
+		for _, p := range exit.Preds {
+			last := "(empty)"
+			if len(p.Nodes) > 0 {
+				last = strings.TrimSuffix(formatNode(fset, p.Nodes[len(p.Nodes)-1]), "\n")
+			}
+			label, _ := g.EdgeLabel(p, exit)
+			preds = append(preds, last+": "+label.Kind.String())
+		}
+		if !reflect.DeepEqual(preds, test.preds) {
+			t.Errorf("%s: exit preds = %q, want %q", test.fn, preds, test.preds)
+		}
+		if exit.Live != test.live {
+			t.Errorf("%s: exit Live = %t, want %t", test.fn, exit.Live, test.live)
+		}
+	}
+
+	// A function without a body leaves through its entry block.
+	g := Build(nil, Options{ExitBlock: true})
+	if len(g.Blocks) != 2 || !reflect.DeepEqual(g.Blocks[0].Succs, []*Block{g.Exit()}) || !g.Exit().Live {
+		t.Errorf("CFG of no body:\n%s", g.Format(token.NewFileSet()))
+	}
+}
+
+// checkExit checks the invariants of g, built with Options.ExitBlock,
+// and that it is otherwise the same as without, built without it.
+func checkExit(g, without *CFG) error {
+	if err := checkInvariants(g); err != nil {
+		return err
+	}
+	exit := g.Exit()
+	if exit == nil || exit != g.Blocks[len(g.Blocks)-1] {
+		return fmt.Errorf("exit block %v is not the last block", exit)
+	}
+	if without.Exit() != nil {
+		return fmt.Errorf("CFG without ExitBlock has exit block %v", without.Exit())
+	}
+	if len(exit.Succs) > 0 || len(exit.Nodes) > 0 {
+		return fmt.Errorf("%s has successors or nodes", exit)
+	}
+	if len(g.Blocks) != len(without.Blocks)+1 {
+		return fmt.Errorf("%d blocks, want %d", len(g.Blocks), len(without.Blocks)+1)
+	}
+	for i, b := range without.Blocks {
+		if g.Blocks[i].Kind == KindExit {
+			return fmt.Errorf("%s is a second exit block", g.Blocks[i])
+		}
+		if g.Blocks[i].Live != b.Live {
+			return fmt.Errorf("%s: Live = %t, want %t", g.Blocks[i], g.Blocks[i].Live, b.Live)
+		}
+	}
+	for _, p := range exit.Preds {
+		if p.Succs[0] != exit {
+			return fmt.Errorf("%s: edge to the exit is not the first", p)
+		}
+		if kind := edgeKind(p, 0); kind != EdgeReturn && kind != EdgeNoReturn {
+			return fmt.Errorf("%s: edge to the exit has kind %s", p, kind)
+		}
+	}
+	if got, want := len(g.TerminalBlocks()), len(without.TerminalBlocks()); got != want {
+		return fmt.Errorf("%d terminal blocks, want %d", got, want)
+	}
+	return nil
+}
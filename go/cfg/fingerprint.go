@@ -0,0 +1,162 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements structural fingerprints of CFGs.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"go/ast"
+	"go/token"
+	"hash"
+	"reflect"
+)
+
+// A FingerprintMode controls the information included in a fingerprint.
+type FingerprintMode uint8
+
+const (
+	// FingerprintNoNames excludes the names of identifiers, so that
+	// functions differing only in the names of their variables,
+	// labels, and callees have the same fingerprint.
+	FingerprintNoNames FingerprintMode = 1 << iota
+)
+
+// fingerprintVersion identifies the encoding hashed by Fingerprint.
+// It must be incremented whenever the encoding changes.
+const fingerprintVersion = 1
+
+// Fingerprint returns a hash of the structure of g: the kind and
+// successors of each block, and the shape of each of its nodes, that
+// is, the types of the syntax nodes beneath it, their operators and
+// literal values, and, unless mode includes FingerprintNoNames, the
+// names of their identifiers. Positions and comments are ignored, so
+// that a function moved within its file, or to another file, keeps
+// its fingerprint. A change to the body of a function literal changes
+// the fingerprint of the enclosing function.
+//
+// Clients such as incremental analysis drivers may use fingerprints as
+// cache keys, so their stability is part of the API: for a given CFG
+// and mode, the fingerprint is the same in every process, on every
+// platform, and (except as below) in every Go release. The hashed
+// encoding starts with a version number, which is incremented whenever
+// the encoding changes, so that fingerprints of different versions
+// differ. A changed fingerprint may also result from a change to the
+// CFG that this package builds for the same source, or from new
+// fields, set by a newer parser, of the syntax nodes of go/ast; fields
+// that are unset do not contribute to the hash.
+func (g *CFG) Fingerprint(mode FingerprintMode) [sha256.Size]byte {
+	f := fingerprinter{mode: mode, h: sha256.New()}
+	f.uint(fingerprintVersion)
+	f.uint(uint64(mode))
+	f.uint(uint64(len(g.Blocks)))
+	for _, b := range g.Blocks {
+		f.string(b.Kind.String())
+		f.uint(uint64(len(b.Succs)))
+		for _, s := range b.Succs {
+			f.uint(uint64(s.Index))
+		}
+		f.uint(uint64(len(b.Nodes)))
+		for _, n := range b.Nodes {
+			f.value(reflect.ValueOf(n))
+		}
+	}
+	var sum [sha256.Size]byte
+	f.h.Sum(sum[:0])
+	return sum
+}
+
+// A fingerprinter writes the encoding of a CFG to a hash.
+type fingerprinter struct {
+	mode FingerprintMode
+	h    hash.Hash
+	buf  [binary.MaxVarintLen64]byte
+}
+
+func (f *fingerprinter) uint(x uint64) {
+	f.h.Write(f.buf[:binary.PutUvarint(f.buf[:], x)])
+}
+
+func (f *fingerprinter) string(s string) {
+	f.uint(uint64(len(s)))
+	f.h.Write([]byte(s))
+}
+
+var (
+	posType     = reflect.TypeOf(token.NoPos)
+	tokenType   = reflect.TypeOf(token.ILLEGAL)
+	objectType  = reflect.TypeOf((*ast.Object)(nil))
+	scopeType   = reflect.TypeOf((*ast.Scope)(nil))
+	commentType = reflect.TypeOf((*ast.CommentGroup)(nil))
+	identType   = reflect.TypeOf(ast.Ident{})
+)
+
+// value writes the encoding of v, a syntax node or a field of one.
+// Each node is written as its type name followed by its non-zero
+// fields, each preceded by its name; positions, comments, and
+// resolved objects are skipped.
+func (f *fingerprinter) value(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Interface:
+		f.value(v.Elem())
+	case reflect.Ptr:
+		f.string(v.Type().Elem().Name())
+		f.value(v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fv := v.Field(i)
+			if field.PkgPath != "" || isZero(fv) {
+				continue
+			}
+			switch field.Type {
+			case posType, objectType, scopeType, commentType:
+				continue
+			}
+			if t == identType && field.Name == "Name" && f.mode&FingerprintNoNames != 0 {
+				continue
+			}
+			f.string(field.Name)
+			f.value(fv)
+		}
+		f.string("") // end of fields
+	case reflect.Slice:
+		f.uint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			f.value(v.Index(i))
+		}
+	case reflect.String:
+		f.string(v.String())
+	case reflect.Bool:
+		f.uint(1) // only true values are written
+	case reflect.Int:
+		if v.Type() == tokenType {
+			// Token values may be renumbered; their spelling is stable.
+			f.string(token.Token(v.Int()).String())
+		} else {
+			f.uint(uint64(v.Int()))
+		}
+	}
+}
+
+// isZero reports whether v is the zero value of its type,
+// for the kinds of values that occur in syntax nodes.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.Len() == 0
+	case reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	}
+	return false
+}
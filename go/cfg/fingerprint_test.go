@@ -0,0 +1,116 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	const base = `package p
+
+func f(x bool) {
+	if x {
+		a()
+	}
+	for i := range s {
+		b(i, "s", 'r')
+	}
+}
+`
+	for _, test := range []struct {
+		name   string
+		src    string
+		same   bool // fingerprint equals that of base when names are included
+		noName bool // fingerprint equals that of base when names are excluded
+	}{
+		{"identical", base, true, true},
+		{"moved", `package p
+
+// A comment, and some blank lines.
+
+
+
+func f(x bool) { if x { a() }
+	// Another comment.
+	for i := range s { b(i, "s", 'r') }
+}
+`, true, true},
+		{"renamed", `package p
+
+func f(y bool) {
+	if y {
+		a()
+	}
+	for j := range s {
+		b(j, "s", 'r')
+	}
+}
+`, false, true},
+		{"condition", `package p
+
+func f(x bool) {
+	if !x {
+		a()
+	}
+	for i := range s {
+		b(i, "s", 'r')
+	}
+}
+`, false, false},
+		{"literal", `package p
+
+func f(x bool) {
+	if x {
+		a()
+	}
+	for i := range s {
+		b(i, "t", 'r')
+	}
+}
+`, false, false},
+		{"statement", `package p
+
+func f(x bool) {
+	if x {
+		a()
+		a()
+	}
+	for i := range s {
+		b(i, "s", 'r')
+	}
+}
+`, false, false},
+		{"control", `package p
+
+func f(x bool) {
+	if x {
+		a()
+	}
+	for i := range s {
+		b(i, "s", 'r')
+		break
+	}
+}
+`, false, false},
+	} {
+		if got := fingerprint(t, test.src, 0) == fingerprint(t, base, 0); got != test.same {
+			t.Errorf("%s: same fingerprint = %t, want %t", test.name, got, test.same)
+		}
+		if got := fingerprint(t, test.src, FingerprintNoNames) == fingerprint(t, base, FingerprintNoNames); got != test.noName {
+			t.Errorf("%s: same fingerprint without names = %t, want %t", test.name, got, test.noName)
+		}
+	}
+
+	if fingerprint(t, base, 0) == fingerprint(t, base, FingerprintNoNames) {
+		t.Errorf("fingerprints with and without names are equal")
+	}
+}
+
+func fingerprint(t *testing.T, src string, mode FingerprintMode) [32]byte {
+	g, _, err := FromSource(src, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g.Fingerprint(mode)
+}
@@ -0,0 +1,298 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the computation of instrumentation points.
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// An InsertionKind describes where a statement may be inserted so as
+// to execute exactly when control follows an edge.
+type InsertionKind uint8
+
+const (
+	// InsertAtTarget means that the statement may be inserted at
+	// the start of the edge's destination block, which has no
+	// other predecessors.
+	InsertAtTarget InsertionKind = iota
+
+	// InsertAtSource means that the statement may be inserted at
+	// the end of the edge's source block, which has no other
+	// successors.
+	InsertAtSource
+
+	// InsertNewBlock means that there is no place for a single
+	// statement: realizing the edge requires a new block, such as
+	// the body of an else clause added to an if statement, or
+	// another restructuring of the source.
+	InsertNewBlock
+)
+
+func (kind InsertionKind) String() string {
+	return [...]string{
+		InsertAtTarget: "AtTarget",
+		InsertAtSource: "AtSource",
+		InsertNewBlock: "NewBlock",
+	}[kind]
+}
+
+// An InsertionPoint describes where a statement may be inserted into
+// the source of a function so as to execute exactly when control
+// follows an edge of its CFG, as when instrumenting edges with tracing
+// or coverage counters. See InstrumentationPoints.
+type InsertionPoint struct {
+	Edge Edge
+	Kind InsertionKind
+
+	// Pos is the position at which to insert the statement, before
+	// the source at that position, or token.NoPos if Kind is
+	// InsertNewBlock. (A statement inserted at Pos may need to be
+	// followed by a semicolon or a line break.)
+	Pos token.Pos
+
+	// Critical reports whether the edge is critical: whether its
+	// source has other successors and its destination other
+	// predecessors. A critical edge always has Kind InsertNewBlock.
+	Critical bool
+}
+
+// InstrumentationPoints returns an insertion point for each edge from
+// a live block of g, other than a panic edge, in order of the source
+// block's Index and then its successors. It only analyzes the source:
+// the CFG and the syntax are not modified.
+//
+// Inserting at the start of the destination, before its first node,
+// is preferred; it is possible only if the destination has no other
+// predecessors and starts a statement list: the body of an if, for,
+// or range statement, or of a case clause, or the statements after an
+// if, for, range, switch, or select statement, or after a labeled
+// statement that a break leaves (see KindLabelDone). (The body of a
+// select case starts after its communication, which is part of the
+// choice of the case.) The start of a loop header and of the tests of switch
+// cases, which are expressions, of the head block of a statement with
+// an init statement (see InitBlock), which starts in the statement's
+// header, and of a labeled statement, which would change the target of
+// the label, are not valid points.
+//
+// Otherwise, inserting at the end of the source, after its last node,
+// is possible if the source has no other successors and that node is
+// an element of a statement list, or the header of a range statement,
+// or of a switch statement without init statement, that is; in the
+// latter case the statement is inserted before the compound statement,
+// at the end of the part of the block that precedes its header. A source block without nodes
+// whose start is a valid point may instead be instrumented there.
+//
+// Predecessors that cannot execute, as the blocks following a return
+// statement, do not count; those that are unreachable only because of
+// a call that does not return do. Points are computed from nodes that
+// were retained: those omitted by Options.FilterNode are ignored.
+func (g *CFG) InstrumentationPoints() []InsertionPoint {
+	if len(g.Blocks) == 0 {
+		return nil
+	}
+	body, ok := g.Blocks[0].Stmt.(*ast.BlockStmt)
+	if !ok {
+		return nil // no body
+	}
+	ctx := newSyntaxContext(body)
+
+	npreds := make(map[*Block]int)
+	for _, b := range g.Blocks {
+		if _, reachable := b.Liveness(); reachable {
+			for _, s := range normalSuccs(b) {
+				npreds[s]++
+			}
+		}
+	}
+
+	var points []InsertionPoint
+	for _, b := range g.Blocks {
+		if !b.Live {
+			continue
+		}
+		succs := normalSuccs(b)
+		for _, s := range succs {
+			p := InsertionPoint{Edge: Edge{b, s}, Kind: InsertNewBlock}
+			if npreds[s] == 1 {
+				if pos := ctx.start(s); pos.IsValid() {
+					p.Kind, p.Pos = InsertAtTarget, pos
+				}
+			}
+			if p.Kind == InsertNewBlock && len(succs) == 1 {
+				if pos := ctx.end(b); pos.IsValid() {
+					p.Kind, p.Pos = InsertAtSource, pos
+				}
+			}
+			p.Critical = len(succs) > 1 && npreds[s] > 1
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// A syntaxContext records the syntactic context of the statements of
+// a function body, as needed to find insertion points.
+type syntaxContext struct {
+	// listed holds the elements of statement lists, and the
+	// statements labeled by those that are labeled statements. A
+	// statement may be inserted after any of them.
+	listed map[ast.Node]bool
+
+	// owners maps each header of a compound statement that is an
+	// unlabeled element of a statement list, and whose evaluation
+	// belongs to the preceding block, to that statement. A
+	// statement may be inserted before the owner, ahead of the
+	// header.
+	owners map[ast.Node]ast.Stmt
+
+	// decls maps each ValueSpec of a var declaration to the
+	// declaration.
+	decls map[ast.Node]*ast.DeclStmt
+}
+
+func newSyntaxContext(body *ast.BlockStmt) *syntaxContext {
+	ctx := &syntaxContext{
+		listed: make(map[ast.Node]bool),
+		owners: make(map[ast.Node]ast.Stmt),
+		decls:  make(map[ast.Node]*ast.DeclStmt),
+	}
+	var list func(stmts []ast.Stmt)
+	list = func(stmts []ast.Stmt) {
+		for _, s := range stmts {
+			ctx.listed[s] = true
+			for l, ok := s.(*ast.LabeledStmt); ok; l, ok = l.Stmt.(*ast.LabeledStmt) {
+				ctx.listed[l.Stmt] = true
+			}
+			own := func(headers ...ast.Node) {
+				for _, h := range headers {
+					if h != nil {
+						ctx.owners[h] = s
+					}
+				}
+			}
+			// An init statement, where present, starts a head
+			// block of its own, so that the statement starts in
+			// the preceding block only if it has none.
+			switch s := s.(type) {
+			case *ast.RangeStmt:
+				own(s.X, s.Key, s.Value)
+			case *ast.SwitchStmt:
+				if s.Init == nil {
+					own(s.Tag)
+				}
+			case *ast.TypeSwitchStmt:
+				if s.Init == nil {
+					own(s.Assign)
+				}
+			case *ast.SelectStmt:
+				for _, cc := range s.Body.List {
+					own(cc.(*ast.CommClause).Comm)
+				}
+			}
+		}
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BlockStmt:
+			list(n.List)
+		case *ast.CaseClause:
+			list(n.Body)
+		case *ast.CommClause:
+			list(n.Body)
+		case *ast.DeclStmt:
+			if d, ok := n.Decl.(*ast.GenDecl); ok {
+				for _, spec := range d.Specs {
+					ctx.decls[spec] = n
+				}
+			}
+		}
+		return true
+	})
+	return ctx
+}
+
+// start returns the position at which a statement may be inserted at
+// the start of block b, or token.NoPos if there is none.
+func (ctx *syntaxContext) start(b *Block) token.Pos {
+	after := func(s ast.Stmt) token.Pos {
+		if ctx.listed[s] {
+			return s.End()
+		}
+		return token.NoPos
+	}
+	switch s := b.Stmt.(type) {
+	case *ast.BlockStmt:
+		if b.Kind == KindBody {
+			return s.Lbrace + 1
+		}
+	case *ast.IfStmt:
+		switch b.Kind {
+		case KindIfThen:
+			return s.Body.Lbrace + 1
+		case KindIfElse:
+			if e, ok := s.Else.(*ast.BlockStmt); ok {
+				return e.Lbrace + 1
+			}
+			// An else-if clause must first become a block.
+		case KindIfDone:
+			return after(s)
+		}
+	case *ast.ForStmt:
+		switch b.Kind {
+		case KindForBody:
+			return s.Body.Lbrace + 1
+		case KindForDone:
+			return after(s)
+		}
+	case *ast.RangeStmt:
+		switch b.Kind {
+		case KindRangeBody:
+			return s.Body.Lbrace + 1
+		case KindRangeDone:
+			return after(s)
+		}
+	case *ast.CaseClause:
+		if b.Kind == KindSwitchCaseBody {
+			return s.Colon + 1
+		}
+	case *ast.CommClause:
+		if b.Kind == KindSelectCaseBody {
+			return s.Colon + 1
+		}
+	case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		if b.Kind == KindSwitchDone || b.Kind == KindSelectDone {
+			return after(s)
+		}
+	case *ast.LabeledStmt:
+		if b.Kind == KindLabelDone {
+			return after(s)
+		}
+	}
+	return token.NoPos
+}
+
+// end returns the position at which a statement may be inserted at the
+// end of block b, or token.NoPos if there is none.
+func (ctx *syntaxContext) end(b *Block) token.Pos {
+	last := b.lastNode()
+	if last == nil {
+		return ctx.start(b)
+	}
+	if d, ok := ctx.decls[last]; ok {
+		last = d
+	}
+	if ctx.listed[last] {
+		return last.End()
+	}
+	if owner, ok := ctx.owners[last]; ok {
+		return owner.Pos()
+	}
+	return token.NoPos
+}
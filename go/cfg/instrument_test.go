@@ -0,0 +1,286 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const instrumentSrc = `package p
+
+func ifElse(x bool) {
+	if x {
+		a()
+	} else {
+		b()
+	}
+	c()
+}
+
+func ifNoElse(x bool) {
+	if x {
+		a()
+	}
+}
+
+func elseIf(x, y bool) {
+	if x {
+		a()
+	} else if y {
+		b()
+	}
+}
+
+func forLoop(n int) {
+	for i := 0; i < n; i++ {
+		if i == n {
+			continue
+		}
+		a()
+	}
+}
+
+func forever(x bool) {
+	var y, z = x, !x
+	for {
+		if y || z {
+			break
+		}
+	}
+	a()
+}
+
+func rangeLoop(list []int) {
+	for _, x := range list {
+		a()
+		_ = x
+	}
+}
+
+func switchStmt(x int) {
+	switch x {
+	case 1, 2:
+		a()
+		fallthrough
+	case 3:
+		b()
+	default:
+	}
+}
+
+func typeSwitch(x interface{}) {
+	switch x.(type) {
+	case int:
+		a()
+	}
+}
+
+func selectStmt(ch chan int) {
+	select {
+	case v := <-ch:
+		_ = v
+	case ch <- 1:
+	}
+	var y, z = 1, 2
+	_, _ = y, z
+}
+
+func labeled(x bool) {
+L:
+	for x {
+		if x {
+			break L
+		}
+		goto M
+	M:
+	}
+}
+`
+
+func TestInstrumentationPoints(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string // edge: kind, position of insertion, and ! if critical
+	}{
+		{"ifElse", `
+0->1: AtTarget 4:8
+0->3: AtTarget 6:10
+1->2: AtSource 5:6
+3->2: AtSource 7:6
+`},
+		{"ifNoElse", `
+0->1: AtTarget 13:8
+0->2: NewBlock!
+1->2: AtSource 14:6
+`},
+		{"elseIf", `
+0->1: AtTarget 19:8
+0->3: NewBlock
+1->2: AtSource 20:6
+3->4: AtTarget 21:15
+3->5: NewBlock!
+4->5: AtSource 22:6
+5->2: NewBlock
+`},
+		{"forLoop", `
+0->1: AtSource 26:22
+1->4: NewBlock
+2->6: AtTarget 28:14
+2->7: AtTarget 30:4
+4->2: AtTarget 27:26
+4->3: AtTarget 32:3
+5->4: NewBlock
+6->5: AtSource 28:14
+7->5: AtSource 31:6
+`},
+		{"forever", `
+0->1: AtSource 36:18
+1->3: AtTarget 38:14
+1->4: AtTarget 40:4
+3->2: AtTarget 41:3
+4->1: AtSource 40:4
+`},
+		{"rangeLoop", `
+0->1: AtSource 46:2
+1->2: AtTarget 46:26
+1->3: AtTarget 49:3
+2->1: AtSource 48:8
+`},
+		{"switchStmt", `
+0->2: NewBlock!
+0->4: NewBlock
+2->3: AtSource 55:6
+3->1: AtSource 58:6
+4->2: NewBlock!
+4->5: NewBlock
+5->3: NewBlock!
+5->8: NewBlock
+7->1: AtSource 59:10
+8->7: AtTarget 59:10
+`},
+		{"typeSwitch", `
+0->2: AtTarget 65:11
+0->3: NewBlock
+2->1: AtSource 66:6
+3->1: NewBlock
+`},
+		{"selectStmt", `
+0->2: AtTarget 72:17
+0->3: NewBlock
+2->1: AtSource 73:8
+3->4: AtTarget 74:15
+3->5: NewBlock
+4->1: AtSource 74:15
+`},
+		{"labeled", `
+0->1: AtSource 80:23
+1->4: NewBlock
+2->5: AtTarget 83:9
+2->6: AtTarget 85:4
+4->2: AtTarget 82:9
+4->3: NewBlock!
+5->3: AtSource 83:9
+6->8: AtSource 85:4
+8->4: AtSource 88:2
+`},
+	} {
+		fset, decl := parseInstrumentFunc(t, instrumentSrc, test.name)
+		g := New(decl.Body, mayReturn)
+		points := g.InstrumentationPoints()
+		var lines []string
+		for _, p := range points {
+			line := fmt.Sprintf("%d->%d: %s", p.Edge.From.Index, p.Edge.To.Index, p.Kind)
+			if p.Pos.IsValid() {
+				posn := fset.Position(p.Pos)
+				line += fmt.Sprintf(" %d:%d", posn.Line, posn.Column)
+			}
+			if p.Critical {
+				line += "!"
+			}
+			lines = append(lines, line)
+		}
+		if got := strings.Join(lines, "\n"); got != strings.TrimSpace(test.want) {
+			t.Errorf("%s: got points:\n%s\nwant:\n%s\n%s", test.name, got, test.want, g.Format(fset))
+		}
+		checkInsertions(t, test.name, fset, points)
+	}
+}
+
+// parseInstrumentFunc parses src and returns the named function.
+func parseInstrumentFunc(t *testing.T, src, name string) (*token.FileSet, *ast.FuncDecl) {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name == name {
+			return fset, decl
+		}
+	}
+	t.Fatalf("no function %s", name)
+	return nil, nil
+}
+
+// checkInsertions inserts a call of trace at each insertion point in
+// turn and checks that the result parses and that the call is a node
+// of a block of the same kind as the one instrumented.
+func checkInsertions(t *testing.T, name string, fset *token.FileSet, points []InsertionPoint) {
+	t.Helper()
+	for _, p := range points {
+		if p.Kind == InsertNewBlock {
+			if p.Pos.IsValid() {
+				t.Errorf("%s: %d->%d: NewBlock point has a position", name, p.Edge.From.Index, p.Edge.To.Index)
+			}
+			continue
+		}
+		if p.Critical {
+			t.Errorf("%s: %d->%d: critical edge has a point", name, p.Edge.From.Index, p.Edge.To.Index)
+		}
+		offset := fset.Position(p.Pos).Offset
+		src := instrumentSrc[:offset] + "; trace();" + instrumentSrc[offset:]
+		fset2, decl := parseInstrumentFunc(t, src, name)
+		g := New(decl.Body, mayReturn)
+		want := p.Edge.To
+		if p.Kind == InsertAtSource {
+			want = p.Edge.From
+		}
+		var got *Block
+		ast.Inspect(decl.Body, func(n ast.Node) bool {
+			if call, ok := n.(*ast.ExprStmt); ok && isCallTo(call, "trace") {
+				got = g.BlockOf(call)
+			}
+			return got == nil
+		})
+		if got == nil || got.Kind != want.Kind || got.Stmt == nil != (want.Stmt == nil) {
+			t.Errorf("%s: %d->%d: %s: trace() inserted at %s is in block %v, want one of kind %s",
+				name, p.Edge.From.Index, p.Edge.To.Index, p.Kind, fset.Position(p.Pos), got, want.Kind)
+			continue
+		}
+		wantOffset := fset.Position(want.Stmt.Pos()).Offset
+		if p.Pos <= want.Stmt.Pos() {
+			wantOffset += len("; trace();")
+		}
+		if fset2.Position(got.Stmt.Pos()).Offset != wantOffset {
+			t.Errorf("%s: %d->%d: %s: trace() inserted at %s is in %s, want %s",
+				name, p.Edge.From.Index, p.Edge.To.Index, p.Kind, fset.Position(p.Pos), got.Name(fset2), want.Name(fset))
+		}
+	}
+}
+
+func isCallTo(s *ast.ExprStmt, name string) bool {
+	call, ok := s.X.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	id, ok := call.Fun.(*ast.Ident)
+	return ok && id.Name == name
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the reporting of labels.
+
+import (
+	"go/ast"
+	"go/token"
+	"sort"
+)
+
+// A LabelKind classifies the statement labeled by a label, which
+// determines the branch statements that may target it.
+type LabelKind uint8
+
+const (
+	LabelUndefined LabelKind = iota // the label is not defined
+	LabelLoop                       // a for or range statement: the target of goto, break, and continue
+	LabelSwitch                     // a switch or type switch statement: the target of goto and break
+	LabelSelect                     // a select statement: the target of goto and break
+	LabelBlock                      // a block: the target of goto (and, for the builder, of break)
+	LabelIf                         // an if statement: the target of goto (and, for the builder, of break)
+	LabelOther                      // any other statement: the target of goto (and, for the builder, of break)
+)
+
+func (kind LabelKind) String() string {
+	return [...]string{
+		LabelUndefined: "Undefined",
+		LabelLoop:      "Loop",
+		LabelSwitch:    "Switch",
+		LabelSelect:    "Select",
+		LabelBlock:     "Block",
+		LabelIf:        "If",
+		LabelOther:     "Other",
+	}[kind]
+}
+
+// A LabelInfo describes a label of a function: its definition, if
+// any, and the branch statements that refer to it.
+type LabelInfo struct {
+	Name string
+	Stmt *ast.LabeledStmt // labeled statement, or nil if the label is undefined
+	Kind LabelKind        // kind of the statement labeled by Stmt
+
+	// Block is the block of the labeled statement, the target of
+	// goto statements (of kind KindLabel), or nil if the label is
+	// undefined. The targets of break and continue statements are
+	// the blocks that follow, and those that continue, the
+	// labeled loop, switch, or select statement. A break that
+	// targets another kind of statement, which the Go
+	// specification does not permit, leads to the block of kind
+	// KindLabelDone that follows the statement.
+	//
+	// A break or continue statement that refers to a label but
+	// does not lie within a statement it may target, such as a
+	// continue targeting a block, leads to a block without
+	// successors that TerminalBlocks reports as
+	// TerminalInvalidBranch.
+	Block *Block
+
+	// Refs are the break, continue, and goto statements referring
+	// to the label, in source order; there are none if the label is
+	// unused. The references to an undefined label lead to blocks
+	// that TerminalBlocks reports as TerminalUndefinedLabelJump:
+	// one block for each break or continue statement, with that
+	// statement as Node, and one for all the goto statements, with
+	// the first of them as Node.
+	Refs []*ast.BranchStmt
+}
+
+// Labels returns the labels defined or referred to in the function
+// body (not counting function literals), in order of their first
+// appearance, be it the definition or a reference.
+func (g *CFG) Labels() []LabelInfo {
+	return g.labels
+}
+
+// recordLabels records the labels of the function in the CFG.
+func (b *builder) recordLabels() {
+	for name, lb := range b.lblocks {
+		l := LabelInfo{Name: name, Refs: lb.refs}
+		if s, ok := lb._goto.Stmt.(*ast.LabeledStmt); ok {
+			l.Stmt = s
+			l.Kind = labelKind(s.Stmt)
+			l.Block = lb._goto
+		}
+		b.cfg.labels = append(b.cfg.labels, l)
+	}
+	first := func(l LabelInfo) token.Pos {
+		pos := token.NoPos
+		if l.Stmt != nil {
+			pos = l.Stmt.Pos()
+		}
+		if len(l.Refs) > 0 && (pos == token.NoPos || l.Refs[0].Pos() < pos) {
+			pos = l.Refs[0].Pos()
+		}
+		return pos
+	}
+	sort.Slice(b.cfg.labels, func(i, j int) bool {
+		return first(b.cfg.labels[i]) < first(b.cfg.labels[j])
+	})
+}
+
+// labelKind returns the kind of a label of statement s.
+func labelKind(s ast.Stmt) LabelKind {
+	switch s.(type) {
+	case *ast.ForStmt, *ast.RangeStmt:
+		return LabelLoop
+	case *ast.SwitchStmt, *ast.TypeSwitchStmt:
+		return LabelSwitch
+	case *ast.SelectStmt:
+		return LabelSelect
+	case *ast.BlockStmt:
+		return LabelBlock
+	case *ast.IfStmt:
+		return LabelIf
+	}
+	return LabelOther
+}
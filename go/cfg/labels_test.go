@@ -0,0 +1,306 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+outer:
+	for x {
+	inner:
+		for x {
+			if x {
+				continue outer
+			}
+			if x {
+				break inner
+			}
+			break outer
+		}
+	}
+	if x {
+		goto done
+	}
+unused:
+	a()
+done:
+	b()
+	for x {
+		break missing
+	}
+	if x {
+		goto nowhere
+	}
+	goto nowhere
+}
+`
+	g, fset, err := FromSource(src, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range g.Labels() {
+		def := "undefined"
+		if l.Stmt != nil {
+			def = fmt.Sprintf("line %d", fset.Position(l.Stmt.Pos()).Line)
+			if l.Block == nil || l.Block.Stmt != l.Stmt || l.Block.Kind != KindLabel {
+				t.Errorf("label %s: Block = %v, want the block of its statement", l.Name, l.Block)
+			}
+		} else if l.Block != nil {
+			t.Errorf("undefined label %s has block %v", l.Name, l.Block)
+		}
+		var refs []string
+		for _, ref := range l.Refs {
+			refs = append(refs, fmt.Sprintf("%s@%d", ref.Tok, fset.Position(ref.Pos()).Line))
+		}
+		got = append(got, fmt.Sprintf("%s: %s [%s]", l.Name, def, strings.Join(refs, " ")))
+	}
+	want := []string{
+		"outer: line 4 [continue@9 break@14]",
+		"inner: line 6 [break@12]",
+		"done: line 22 [goto@18]",
+		"unused: line 20 []",
+		"missing: undefined [break@25]",
+		"nowhere: undefined [goto@28 goto@30]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Labels:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// References to undefined labels lead to terminal blocks.
+	var undefined []string
+	for _, tb := range g.TerminalBlocks() {
+		if tb.Reason == TerminalUndefinedLabelJump {
+			undefined = append(undefined, fmt.Sprintf("%s@%d", formatNode(fset, tb.Node), fset.Position(tb.Pos).Line))
+		}
+	}
+	if got, want := strings.Join(undefined, ", "), "break missing@25, goto nowhere@28"; got != want {
+		t.Errorf("undefined label jumps: %s, want %s", got, want)
+	}
+}
+
+func TestLabeledStatements(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+block:
+	{
+		if x {
+			break block
+		}
+		a()
+		break block
+		b()
+	}
+	c()
+cond:
+	if x {
+		break cond
+		d()
+	}
+simple:
+	e()
+	for x {
+		continue block
+	}
+	if x {
+		continue simple
+	}
+	if x {
+		break simple
+	}
+loop:
+	for x {
+		continue loop
+	}
+	if x {
+		break missing
+	}
+}
+`
+	g, fset, err := FromSource(src, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkInvariants(g); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, l := range g.Labels() {
+		kinds = append(kinds, fmt.Sprintf("%s %s", l.Name, l.Kind))
+	}
+	if got, want := strings.Join(kinds, ", "), "block Block, cond If, simple Other, loop Loop, missing Undefined"; got != want {
+		t.Errorf("label kinds: %s, want %s", got, want)
+	}
+
+	// A break leaving a labeled block or if statement continues
+	// after it, and the rest of the statement is dead.
+	calls := make(map[string]*Block)
+	ast.Inspect(g.Blocks[0].Stmt, func(n ast.Node) bool {
+		if s, ok := n.(*ast.ExprStmt); ok {
+			name := s.X.(*ast.CallExpr).Fun.(*ast.Ident).Name
+			calls[name] = g.BlockOf(s)
+		}
+		return true
+	})
+	for name, live := range map[string]bool{"a": true, "b": false, "c": true, "d": false, "e": true} {
+		if b := calls[name]; b == nil || b.Live != live {
+			t.Errorf("block of %s() = %v, want one with Live = %t", name, b, live)
+		}
+	}
+	labels := g.Labels()
+	if b := calls["c"]; b.Kind != KindLabelDone || b.Stmt != labels[0].Stmt || len(b.Preds) != 3 {
+		t.Errorf("c() is in %s (of %s), with %d predecessors; want the block after the labeled block, with 3",
+			b, formatNode(fset, b.Stmt), len(b.Preds))
+	}
+	if b := calls["e"]; b.Kind != KindLabel || b.Stmt != labels[2].Stmt {
+		t.Errorf("e() is in %s, want the block of its label", b)
+	}
+	if b := calls["e"].Preds[0]; b.Kind != KindLabelDone || b.Stmt != labels[1].Stmt {
+		t.Errorf("e() is preceded by %s, want the block after the labeled if statement", b)
+	}
+
+	// A break or continue that its label does not permit is
+	// invalid, and one to an undefined label is an undefined jump.
+	var terms []string
+	for _, tb := range g.TerminalBlocks() {
+		if tb.Reason != TerminalReturn && tb.Reason != TerminalFallOffEnd {
+			terms = append(terms, fmt.Sprintf("%s %s@%d", tb.Reason, formatNode(fset, tb.Node), fset.Position(tb.Pos).Line))
+		}
+	}
+	want := []string{
+		"InvalidBranch continue block@22",
+		"InvalidBranch continue simple@25",
+		"InvalidBranch break simple@28",
+		"UndefinedLabelJump break missing@35",
+	}
+	if strings.Join(terms, "\n") != strings.Join(want, "\n") {
+		t.Errorf("terminal blocks:\n%s\nwant:\n%s", strings.Join(terms, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGoto(t *testing.T) {
+	const src = `package p
+
+func forward() {
+	a()
+	goto L
+	dead()
+L:
+	b()
+}
+
+func backward(n int) {
+	i := 0
+L:
+	a()
+	i++
+	if i < n {
+		goto L
+	}
+	b()
+}
+
+func middle(x bool) {
+	if x {
+		goto M
+	}
+	a()
+	b()
+M:
+	c()
+	d()
+	return
+	dead()
+}
+
+func overDecls() {
+	goto L
+	{
+		var v = dead()
+		dead(v)
+	}
+L:
+	a()
+}
+
+func forever() {
+L:
+	a()
+	goto L
+	dead()
+}
+`
+	for _, test := range []struct {
+		fn   string
+		live []string // the live calls; the others are dead
+		loop bool     // the label is in a loop
+	}{
+		{"forward", []string{"a", "b"}, false},
+		{"backward", []string{"a", "b"}, true},
+		{"middle", []string{"a", "b", "c", "d"}, false},
+		{"overDecls", []string{"a"}, false},
+		{"forever", []string{"a"}, true},
+	} {
+		g, _, err := FromSource(src, test.fn, mayReturn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkInvariants(g); err != nil {
+			t.Errorf("%s: %v", test.fn, err)
+		}
+
+		var live []string
+		ast.Inspect(g.Blocks[0].Stmt, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpr); ok {
+				name := call.Fun.(*ast.Ident).Name
+				var b *Block
+				for _, blk := range g.Blocks {
+					for _, node := range blk.Nodes {
+						if node.Pos() <= call.Pos() && call.End() <= node.End() {
+							b = blk
+						}
+					}
+				}
+				if b == nil {
+					t.Errorf("%s: no block of call to %s", test.fn, name)
+				} else if b.Live != (name != "dead") {
+					t.Errorf("%s: block of call to %s has Live = %t", test.fn, name, b.Live)
+				} else if b.Live {
+					live = append(live, name)
+				}
+			}
+			return true
+		})
+		if got, want := strings.Join(live, " "), strings.Join(test.live, " "); got != want {
+			t.Errorf("%s: live calls: %s, want %s", test.fn, got, want)
+		}
+
+		// The block of each label is entered from the statement
+		// before it and from each goto statement, and is in a loop
+		// if one of them follows it.
+		for _, l := range g.Labels() {
+			if got, want := len(l.Block.Preds), 1+len(l.Refs); got != want {
+				t.Errorf("%s: block of label %s has %d predecessors, want %d", test.fn, l.Name, got, want)
+			}
+			var inLoop bool
+			for _, p := range l.Block.Preds {
+				inLoop = inLoop || g.Reachable(l.Block, p)
+			}
+			if inLoop != test.loop {
+				t.Errorf("%s: label %s is in a loop: %t, want %t", test.fn, l.Name, inLoop, test.loop)
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements natural loop detection and related queries.
+
+import (
+	"go/ast"
+	"sort"
+)
+
+// A Loop is a natural loop of a CFG: the blocks of a cycle entered
+// only through a single block, its header, which dominates all its
+// other blocks.
+//
+// A Loop may instead describe an irreducible region, a cycle that
+// can be entered at more than one block, as created by a goto into
+// the middle of a loop. Such a Loop has Irreducible set, its Header
+// is the entry block with the lowest Index (which does not dominate
+// the other blocks), and it has no Latches.
+type Loop struct {
+	Header      *Block   // loop header; dominates all of Blocks unless Irreducible
+	Blocks      []*Block // blocks of the loop, including Header, in increasing order of Index
+	Latches     []*Block // sources of the back edges to Header, in increasing order of Index
+	Parent      *Loop    // innermost enclosing loop, or nil
+	Irreducible bool     // the loop is an irreducible region with several entries
+
+	in map[*Block]bool
+}
+
+// Contains reports whether b is one of the blocks of the loop.
+func (l *Loop) Contains(b *Block) bool {
+	return l.in[b]
+}
+
+// Exits returns the blocks outside of the loop that are successors of
+// blocks within it, in increasing order of Index.
+func (l *Loop) Exits() []*Block {
+	set := make(map[*Block]bool)
+	for _, b := range l.Blocks {
+		for _, s := range b.Succs {
+			if !l.in[s] {
+				set[s] = true
+			}
+		}
+	}
+	return sortedBlocks(set)
+}
+
+// Loops returns the natural loops of the live blocks of g, followed
+// by its irreducible regions, if any; each group is in increasing
+// order of the Index of the loop headers. Loops sharing a header are
+// merged into one.
+//
+// A back edge is an edge whose destination dominates its source; the
+// natural loop of a back edge from b to h consists of h plus the
+// blocks that can reach b without passing through h. The cycles that
+// remain once all back edges are removed are the irreducible regions:
+// each is reported as a Loop with Irreducible set, whose blocks are a
+// strongly connected component of the graph without back edges.
+//
+// On irreducible graphs, the natural loops are still exact but do not
+// account for all cycles; only the irreducible regions cover the
+// rest. See Reducible.
+func (g *CFG) Loops() []*Loop {
+	dom := g.Dominators()
+
+	loopOf := make(map[*Block]*Loop) // keyed by header
+	var loops []*Loop
+	for _, b := range g.Blocks {
+		if !b.Live {
+			continue
+		}
+		for _, h := range b.Succs {
+			if !dom.Dominates(h, b) {
+				continue
+			}
+			// b->h is a back edge.
+			l := loopOf[h]
+			if l == nil {
+				l = &Loop{Header: h, in: map[*Block]bool{h: true}}
+				loopOf[h] = l
+				loops = append(loops, l)
+			}
+			l.Latches = append(l.Latches, b)
+		}
+	}
+
+	// Compute the body of each loop by walking predecessors
+	// backwards from the latches, stopping at the header.
+	preds := make(map[*Block][]*Block)
+	for _, b := range g.Blocks {
+		if b.Live {
+			for _, s := range b.Succs {
+				preds[s] = append(preds[s], b)
+			}
+		}
+	}
+	for _, l := range loops {
+		stack := append([]*Block(nil), l.Latches...)
+		for len(stack) > 0 {
+			b := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if l.in[b] {
+				continue
+			}
+			l.in[b] = true
+			stack = append(stack, preds[b]...)
+		}
+		for b := range l.in {
+			l.Blocks = append(l.Blocks, b)
+		}
+		sortBlocks(l.Blocks)
+	}
+	sort.Slice(loops, func(i, j int) bool { return loops[i].Header.Index < loops[j].Header.Index })
+	loops = append(loops, irreducibleRegions(g, dom, preds)...)
+
+	// The parent of a loop is the smallest other loop containing
+	// its header. Natural loops are either disjoint or nested.
+	for _, l := range loops {
+		for _, m := range loops {
+			if m != l && m.in[l.Header] && (l.Parent == nil || len(m.Blocks) < len(l.Parent.Blocks)) {
+				l.Parent = m
+			}
+		}
+	}
+	return loops
+}
+
+// Reducible reports whether the live portion of g is reducible: that
+// is, whether every cycle is entered only through a header that
+// dominates it, or equivalently, whether the graph is acyclic once its
+// back edges are removed. Graphs built from structured statements are
+// always reducible; only goto statements can make them irreducible.
+//
+// Dominator trees and frontiers are exact for any graph. On an
+// irreducible graph, Loops reports the offending cycles as regions
+// with Irreducible set, whose Header does not dominate their blocks.
+func (g *CFG) Reducible() bool {
+	return len(irreducibleRegions(g, g.Dominators(), nil)) == 0
+}
+
+// irreducibleRegions returns the nontrivial strongly connected
+// components of the live blocks of g once the back edges (according
+// to dom) are removed, each as an irreducible Loop, in increasing
+// order of the Index of their headers. preds, if non-nil, holds the
+// live predecessors of each block.
+func irreducibleRegions(g *CFG, dom *DomTree, preds map[*Block][]*Block) []*Loop {
+	forward := func(b *Block) []*Block {
+		var res []*Block
+		for _, s := range b.Succs {
+			if s.Live && !dom.Dominates(s, b) {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+
+	var live []*Block
+	for _, b := range g.Blocks {
+		if b.Live {
+			live = append(live, b)
+		}
+	}
+	var sccs [][]*Block
+	for _, scc := range stronglyConnected(live, forward) {
+		if len(scc) > 1 { // self-edges are always back edges
+			sccs = append(sccs, scc)
+		}
+	}
+	if len(sccs) == 0 {
+		return nil
+	}
+
+	if preds == nil {
+		preds = make(map[*Block][]*Block)
+		for _, b := range g.Blocks {
+			if b.Live {
+				for _, s := range b.Succs {
+					preds[s] = append(preds[s], b)
+				}
+			}
+		}
+	}
+	var regions []*Loop
+	for _, scc := range sccs {
+		l := &Loop{Irreducible: true, in: make(map[*Block]bool)}
+		for _, b := range scc {
+			l.in[b] = true
+		}
+		l.Blocks = scc
+		sortBlocks(l.Blocks)
+		for _, b := range l.Blocks {
+			for _, p := range preds[b] {
+				if !l.in[p] {
+					// b is an entry: the first one is the header.
+					l.Header = b
+					break
+				}
+			}
+			if l.Header != nil {
+				break
+			}
+		}
+		if l.Header == nil {
+			l.Header = l.Blocks[0] // the function's entry
+		}
+		regions = append(regions, l)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Header.Index < regions[j].Header.Index })
+	return regions
+}
+
+func sortBlocks(blocks []*Block) {
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Index < blocks[j].Index })
+}
+
+// CanReturn reports whether the function can return normally to its
+// caller: whether any live block ends with a return statement,
+// explicit or implicit.
+//
+// Blocks whose last node is a call that does not return, according
+// to the mayReturn function passed to New, do not count: a function
+// all of whose paths panic or exit cannot return.
+func (g *CFG) CanReturn() bool {
+	for _, b := range g.Blocks {
+		if b.Live && b.Return() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// InfiniteLoops returns the headers of the live loops of g that
+// control can never leave, in increasing order of Index: no block of
+// the loop has a successor outside the loop, nor is any block of the
+// loop terminal (a return, or a call that does not return).
+//
+// Such a loop need not be a mistake: a server's main loop, for
+// example, is often intended to run forever.
+func (g *CFG) InfiniteLoops() []*Block {
+	var headers []*Block
+	for _, l := range g.Loops() {
+		infinite := true
+		for _, b := range l.Blocks {
+			if len(b.Succs) == 0 {
+				infinite = false
+				break
+			}
+			for _, s := range b.Succs {
+				if !l.in[s] {
+					infinite = false
+				}
+			}
+		}
+		if infinite {
+			headers = append(headers, l.Header)
+		}
+	}
+	return headers
+}
+
+// LoopsContaining returns the loops of g (see Loops) that contain the
+// block of statement s, innermost first, and reports whether s is a
+// node of a live block of g; if not, it returns nil, false.
+//
+// The loops are those of the CFG, not of the syntax: a statement
+// lexically within a loop statement is not within a loop if control
+// always leaves the loop before reaching the statement again, as when
+// the body ends with an unconditional break, and a statement not
+// within a loop statement is within a loop formed by a backward goto.
+// Irreducible regions are included, ordered among the natural loops
+// by size.
+//
+// The loops of g are computed on first use.
+func (g *CFG) LoopsContaining(s ast.Stmt) ([]*Loop, bool) {
+	b := g.BlockOf(s)
+	if b == nil || !b.Live {
+		return nil, false
+	}
+	g.loopsOnce.Do(func() { g.loops = g.Loops() })
+	var res []*Loop
+	for _, l := range g.loops {
+		if l.in[b] {
+			res = append(res, l)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return len(res[i].Blocks) < len(res[j].Blocks) })
+	return res, true
+}
+
+// InLoop reports whether statement s is a node of a live block of g
+// that is within a loop; see LoopsContaining.
+func (g *CFG) InLoop(s ast.Stmt) bool {
+	loops, _ := g.LoopsContaining(s)
+	return len(loops) > 0
+}
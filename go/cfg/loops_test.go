@@ -0,0 +1,252 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+const loopsSrc = `package main
+
+func empty() {
+	for {
+	}
+}
+
+func breaks(x bool) {
+	for {
+		if x {
+			break
+		}
+	}
+}
+
+func returns(x bool) {
+	for {
+		if x {
+			return
+		}
+	}
+}
+
+func panics(x bool) {
+	if x {
+		panic("x")
+	}
+	panic("!x")
+}
+
+func nested(x bool) {
+	for {
+		for x {
+		}
+	}
+}
+
+func sequence(x bool) {
+	for x {
+	}
+	for i := 0; i < 10; i++ {
+		if x {
+			continue
+		}
+	}
+}
+
+func gotoLoop(x bool) {
+L:
+	if x {
+		goto L
+	}
+}
+
+func irreducible(x bool) {
+	if x {
+		goto A
+	}
+B:
+	b()
+A:
+	a()
+	goto B
+}
+`
+
+func TestLoops(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		loops     string // header index and blocks of each loop, index of parent's header, ! if irreducible
+		infinite  string // indices of InfiniteLoops headers
+		canReturn bool
+	}{
+		{"empty", "[1:[1]]", "[1]", false},
+		{"breaks", "[1:[1 4]]", "[]", true},
+		{"returns", "[1:[1 4]]", "[]", true},
+		{"panics", "[]", "[]", false},
+		{"nested", "[1:[1 3 4 5] 5:[3 5]<1]", "[1]", false},
+		{"sequence", "[3:[1 3] 7:[5 7 8 9 10]]", "[]", true},
+		{"gotoLoop", "[1:[1 2]]", "[]", true},
+		{"irreducible", "[3:[3 5]!]", "[3]", false},
+	} {
+		g := parseFunc(t, loopsSrc, test.name)
+		var loops []string
+		for _, l := range g.Loops() {
+			s := fmt.Sprintf("%d:%v", l.Header.Index, indices(l.Blocks))
+			if l.Parent != nil {
+				s += fmt.Sprintf("<%d", l.Parent.Header.Index)
+			}
+			if l.Irreducible {
+				s += "!"
+			}
+			loops = append(loops, s)
+		}
+		if got := fmt.Sprint(loops); got != test.loops {
+			t.Errorf("%s: Loops() = %s, want %s\n%s", test.name, got, test.loops, g.Format(token.NewFileSet()))
+		}
+		if got := fmt.Sprint(indices(g.InfiniteLoops())); got != test.infinite {
+			t.Errorf("%s: InfiniteLoops() = %s, want %s", test.name, got, test.infinite)
+		}
+		if got := g.CanReturn(); got != test.canReturn {
+			t.Errorf("%s: CanReturn() = %t, want %t", test.name, got, test.canReturn)
+		}
+		if got, want := g.Reducible(), test.name != "irreducible"; got != want {
+			t.Errorf("%s: Reducible() = %t, want %t", test.name, got, want)
+		}
+		checkDomTree(t, test.name, g, g.Dominators(), false)
+		checkDomTree(t, test.name, g, g.PostDominators(), true)
+	}
+}
+
+// parseFunc parses src and returns the CFG of the named function.
+func parseFunc(t *testing.T, src, name string) *CFG {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "dummy.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name == name {
+			return New(decl.Body, mayReturn)
+		}
+	}
+	t.Fatalf("no function %s", name)
+	return nil
+}
+
+func indices(blocks []*Block) []int32 {
+	res := []int32{}
+	for _, b := range blocks {
+		res = append(res, b.Index)
+	}
+	return res
+}
+
+func TestLoopsContaining(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+	before()
+L:
+	gotoLoop()
+	for x {
+		inner()
+		if x {
+			goto L
+		}
+	}
+	for {
+		once()
+		break
+	}
+	for x {
+		return
+		dead()
+	}
+	after()
+}
+`
+	g, fset, err := FromSource(src, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := g.Blocks[0].Stmt.(*ast.BlockStmt)
+
+	// lexical reports whether s is lexically within a loop statement.
+	lexical := func(s ast.Stmt) bool {
+		var path []ast.Node
+		found := false
+		ast.Inspect(body, func(n ast.Node) bool {
+			if found {
+				return false
+			}
+			if n == nil {
+				path = path[:len(path)-1]
+				return true
+			}
+			if n == s {
+				for _, p := range path {
+					switch p.(type) {
+					case *ast.ForStmt, *ast.RangeStmt:
+						found = true
+					}
+				}
+				return false
+			}
+			path = append(path, n)
+			return true
+		})
+		return found
+	}
+
+	for _, test := range []struct {
+		call    string
+		lexical bool
+		loops   int // number of CFG loops, or -1 if not live
+	}{
+		{"before", false, 0},
+		{"gotoLoop", false, 1},
+		{"inner", true, 2},
+		{"once", true, 0},
+		{"dead", true, -1},
+		{"after", false, 0},
+	} {
+		var stmt ast.Stmt
+		ast.Inspect(body, func(n ast.Node) bool {
+			if s, ok := n.(*ast.ExprStmt); ok && formatNode(fset, s) == test.call+"()" {
+				stmt = s
+			}
+			return true
+		})
+		if got := lexical(stmt); got != test.lexical {
+			t.Errorf("%s: lexically in loop = %t, want %t", test.call, got, test.lexical)
+		}
+		loops, ok := g.LoopsContaining(stmt)
+		if test.loops < 0 {
+			if ok || loops != nil {
+				t.Errorf("%s: LoopsContaining = %v, %t, want nil, false", test.call, loops, ok)
+			}
+			continue
+		}
+		if !ok || len(loops) != test.loops {
+			t.Errorf("%s: LoopsContaining returned %d loops, %t, want %d, true", test.call, len(loops), ok, test.loops)
+			continue
+		}
+		for i, l := range loops {
+			if !l.Contains(g.BlockOf(stmt)) {
+				t.Errorf("%s: loop %d does not contain statement", test.call, i)
+			}
+			if i > 0 && len(l.Blocks) < len(loops[i-1].Blocks) {
+				t.Errorf("%s: loops are not innermost first", test.call)
+			}
+		}
+		if got := g.InLoop(stmt); got != (test.loops > 0) {
+			t.Errorf("%s: InLoop = %t", test.call, got)
+		}
+	}
+}
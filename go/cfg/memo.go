@@ -0,0 +1,97 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements memoization of mayReturn predicates.
+
+import (
+	"go/ast"
+	"go/types"
+	"sync"
+)
+
+// MemoizeMayReturn returns a mayReturn predicate equivalent to pred that
+// remembers the result of pred for each key returned by keyer, so
+// that pred is called only once for all calls sharing a key. This is
+// worthwhile when building the CFGs of many functions with an
+// expensive predicate, such as one that consults type information.
+//
+// keyer must return a comparable value identifying the callee, such
+// that pred reports the same result for all calls with equal keys;
+// CalleeKey returns such a keyer for type-checked code. A nil key
+// means the result for that call is not to be remembered. If keyer
+// is nil, each call expression is its own key, which helps only
+// clients that query the same call repeatedly.
+//
+// As with any mayReturn predicate, pred must be pure: its result must
+// depend only on the call, not on the order or number of queries.
+//
+// The resulting predicate is safe for concurrent use if pred is. It
+// does not hold any lock while calling pred, which may therefore build
+// other CFGs using the same predicate.
+func MemoizeMayReturn(pred func(*ast.CallExpr) bool, keyer func(*ast.CallExpr) interface{}) func(*ast.CallExpr) bool {
+	if keyer == nil {
+		keyer = func(call *ast.CallExpr) interface{} { return call }
+	}
+	var (
+		mu   sync.Mutex
+		memo = make(map[interface{}]bool)
+	)
+	return func(call *ast.CallExpr) bool {
+		key := keyer(call)
+		if key == nil {
+			return pred(call)
+		}
+		mu.Lock()
+		res, ok := memo[key]
+		mu.Unlock()
+		if !ok {
+			res = pred(call)
+			mu.Lock()
+			memo[key] = res
+			mu.Unlock()
+		}
+		return res
+	}
+}
+
+// CalleeKey returns a keyer for MemoizeMayReturn that identifies each
+// call by the object of its callee, as recorded in info.Uses: a
+// function, method, or built-in referred to by name, possibly
+// qualified by a package name or receiver expression. It returns nil,
+// so that results are not remembered, for calls whose callee is not
+// such an object, such as calls of function values and conversions.
+//
+// Calls of an interface method are keyed by the method, so a predicate
+// used with this keyer must not distinguish among the dynamic callees
+// of such a call.
+func CalleeKey(info *types.Info) func(*ast.CallExpr) interface{} {
+	return func(call *ast.CallExpr) interface{} {
+		var id *ast.Ident
+		switch fun := unparen(call.Fun).(type) {
+		case *ast.Ident:
+			id = fun
+		case *ast.SelectorExpr:
+			id = fun.Sel
+		default:
+			return nil
+		}
+		switch obj := info.Uses[id].(type) {
+		case *types.Func, *types.Builtin:
+			return obj
+		}
+		return nil
+	}
+}
+
+func unparen(e ast.Expr) ast.Expr {
+	for {
+		p, ok := e.(*ast.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.X
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+const memoSrc = `package p
+
+type T struct{ f func() }
+
+func (T) m() {}
+
+func fatal() { panic("fatal") }
+
+func g(t T, h func()) {
+	fatal()
+	fatal()
+	(fatal)()
+	t.m()
+	t.m()
+	t.f()
+	h()
+	h()
+	print()
+	_ = int(0)
+}
+`
+
+func TestMemoizeMayReturn(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "memo.go", memoSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{Uses: make(map[*ast.Ident]types.Object)}
+	if _, err := new(types.Config).Check("p", fset, []*ast.File{f}, info); err != nil {
+		t.Fatal(err)
+	}
+	var calls []*ast.CallExpr
+	ast.Inspect(f.Decls[len(f.Decls)-1], func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			calls = append(calls, call)
+		}
+		return true
+	})
+
+	count := make(map[string]int)
+	pred := func(call *ast.CallExpr) bool {
+		name := formatNode(fset, call.Fun)
+		count[name]++
+		return name != "fatal" && name != "(fatal)"
+	}
+	for _, test := range []struct {
+		keyer func(*ast.CallExpr) interface{}
+		query int // number of times each call is queried
+		want  string
+	}{
+		{nil, 1, "map[(fatal):1 fatal:2 h:2 int:1 print:1 t.f:1 t.m:2]"},
+		{nil, 2, "map[(fatal):1 fatal:2 h:2 int:1 print:1 t.f:1 t.m:2]"},
+		// Calls of fatal and (fatal) share a key; so do calls of t.m.
+		// Calls of function values and conversions are never memoized.
+		{CalleeKey(info), 1, "map[fatal:1 h:2 int:1 print:1 t.f:1 t.m:1]"},
+		{CalleeKey(info), 2, "map[fatal:1 h:4 int:2 print:1 t.f:2 t.m:1]"},
+	} {
+		count = make(map[string]int)
+		mayReturn := MemoizeMayReturn(pred, test.keyer)
+		for i := 0; i < test.query; i++ {
+			for _, call := range calls {
+				if got, want := mayReturn(call), pred(call); got != want {
+					t.Errorf("mayReturn(%s) = %t, want %t", formatNode(fset, call), got, want)
+				}
+			}
+		}
+		// Subtract the calls to pred made to check the results.
+		for _, call := range calls {
+			name := formatNode(fset, call.Fun)
+			if count[name] -= test.query; count[name] == 0 {
+				delete(count, name)
+			}
+		}
+		if got := fmt.Sprint(count); got != test.want {
+			t.Errorf("query=%d: calls to pred = %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+// BenchmarkMayReturn compares the cost of building the CFGs of a
+// large package with a types-aware predicate, with and without
+// memoization.
+func BenchmarkMayReturn(b *testing.B) {
+	// Generate a package of many functions that each call a
+	// few of a small set of helpers, some of which never return.
+	var src strings.Builder
+	src.WriteString("package p\n\n")
+	const helpers, funcs = 20, 2000
+	for i := 0; i < helpers; i++ {
+		if i%5 == 0 {
+			fmt.Fprintf(&src, "func h%d() { panic(\"h%d\") }\n", i, i)
+		} else {
+			fmt.Fprintf(&src, "func h%d() {}\n", i)
+		}
+	}
+	for i := 0; i < funcs; i++ {
+		fmt.Fprintf(&src, "func f%d(x bool) {\n", i)
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&src, "\tif x {\n\t\th%d()\n\t}\n\th%d()\n", (i+j)%helpers, (i*j+1)%helpers)
+		}
+		src.WriteString("}\n")
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "bench.go", src.String(), parser.Mode(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	if _, err := new(types.Config).Check("p", fset, []*ast.File{f}, info); err != nil {
+		b.Fatal(err)
+	}
+
+	// The raw predicate finds the declaration of the callee and
+	// inspects its body, as a types-aware predicate might.
+	decls := make(map[types.Object]*ast.FuncDecl)
+	for _, decl := range f.Decls {
+		decl := decl.(*ast.FuncDecl)
+		decls[info.Defs[decl.Name]] = decl
+	}
+	raw := func(call *ast.CallExpr) bool {
+		id, ok := call.Fun.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		decl := decls[info.Uses[id]]
+		if decl == nil {
+			return true
+		}
+		mayReturn := true
+		ast.Inspect(decl.Body, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpr); ok {
+				if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "panic" {
+					mayReturn = false
+				}
+			}
+			return mayReturn
+		})
+		return mayReturn
+	}
+
+	for _, bench := range []struct {
+		name string
+		pred func() func(*ast.CallExpr) bool
+	}{
+		{"raw", func() func(*ast.CallExpr) bool { return raw }},
+		{"memoized", func() func(*ast.CallExpr) bool { return MemoizeMayReturn(raw, CalleeKey(info)) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				mayReturn := bench.pred()
+				for _, decl := range f.Decls {
+					New(decl.(*ast.FuncDecl).Body, mayReturn)
+				}
+			}
+		})
+	}
+}
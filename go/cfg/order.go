@@ -0,0 +1,42 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements depth-first orderings of the blocks of a CFG.
+
+// Postorder returns the live blocks of g in postorder: each block
+// appears after all the blocks reachable from it by a depth-first
+// search from the entry block that visits successors in order,
+// except those to which it has a back edge.
+func (g *CFG) Postorder() []*Block {
+	order := make([]*Block, 0, len(g.Blocks))
+	seen := make([]bool, len(g.Blocks))
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b.Index] = true
+		for _, s := range b.Succs {
+			if !seen[s.Index] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	if len(g.Blocks) > 0 {
+		visit(g.Blocks[0])
+	}
+	return order
+}
+
+// ReversePostorder returns the live blocks of g in reverse postorder,
+// starting with the entry block. Except along back edges, each block
+// appears before its successors, which makes it the usual order of
+// iteration for forward dataflow analyses.
+func (g *CFG) ReversePostorder() []*Block {
+	order := g.Postorder()
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestReversePostorder(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "dummy.go", loopsSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		decl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		g := New(decl.Body, mayReturn)
+		dom := g.Dominators()
+		rpo := g.ReversePostorder()
+		pos := make(map[*Block]int)
+		for i, b := range rpo {
+			pos[b] = i
+		}
+		for _, b := range g.Blocks {
+			if _, ok := pos[b]; ok != b.Live {
+				t.Errorf("%s: %s: in order = %t, Live = %t", decl.Name.Name, b, ok, b.Live)
+			}
+		}
+		if len(rpo) > 0 && rpo[0] != g.Blocks[0] {
+			t.Errorf("%s: order starts with %s, not the entry", decl.Name.Name, rpo[0])
+		}
+		// Every edge that is not a retreating edge goes forward.
+		// In a reducible graph, the retreating edges are the
+		// back edges, whose targets dominate their sources.
+		for _, b := range rpo {
+			for _, s := range b.Succs {
+				if pos[s] <= pos[b] && g.Reducible() && !dom.Dominates(s, b) {
+					t.Errorf("%s: edge %s -> %s goes backward", decl.Name.Name, b, s)
+				}
+			}
+		}
+		post := g.Postorder()
+		for i := range post {
+			if post[i] != rpo[len(rpo)-1-i] {
+				t.Errorf("%s: Postorder is not the reverse of ReversePostorder", decl.Name.Name)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const panicSrc = `package p
+
+func plain(x bool) {
+	a()
+	if x {
+		panic("x")
+	}
+	b()
+}
+
+func wrapped(x bool) (err error) {
+	a()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered: %v", r)
+		}
+	}()
+	b()
+	if x {
+		panic("x")
+	}
+	return nil
+}
+
+func conditional(x bool) {
+	if x {
+		defer func() {
+			recover()
+		}()
+	}
+	b()
+}
+
+func nested() {
+	defer func() {
+		func() { recover() }()
+	}()
+	b()
+}
+
+func named() {
+	defer handle()
+	b()
+}
+
+func falloff(x bool) {
+	if x {
+		return
+	}
+	b()
+}
+
+func empty() {}
+`
+
+// mayPanic reports that calls other than to recover, and statements
+// containing them, may panic.
+func mayPanic(n ast.Node) bool {
+	switch s := n.(type) {
+	case *ast.ReturnStmt:
+		return false
+	case *ast.DeferStmt:
+		// The deferred function is not called now.
+		n = &ast.CompositeLit{Elts: s.Call.Args}
+	}
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CallExpr:
+			if id, ok := n.Fun.(*ast.Ident); !ok || id.Name != "recover" {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func TestPanicEdges(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "panic.go", panicSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		opts  Options
+		want  string   // panic edges, as "from->to" block comments
+		terms string   // reasons of the terminal blocks, in Index order
+		prots []string // protected blocks, by comment
+	}{
+		{
+			name:  "plain",
+			opts:  Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true},
+			want:  "entry->panic if.then->panic if.done->panic",
+			terms: "[Panicking Panic FallOffEnd]",
+		},
+		{
+			name:  "plain",
+			opts:  Options{MayReturn: mayReturn},
+			want:  "",
+			terms: "[Panic FallOffEnd]",
+		},
+		{
+			// Panics after the recovering defer go to
+			// the recover block; those before it do not.
+			name:  "wrapped",
+			opts:  Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true},
+			want:  "entry->panic entry->recover if.then->recover",
+			terms: "[Panicking Recovered Panic Return]",
+			prots: []string{"if.then", "if.done", "unreachable.call", "unreachable.return"},
+		},
+		{
+			// Without ModelRecover, all panics propagate.
+			name:  "wrapped",
+			opts:  Options{MayReturn: mayReturn, MayPanic: mayPanic},
+			want:  "entry->panic if.then->panic",
+			terms: "[Panicking Panic Return]",
+		},
+		{
+			// A conditional defer protects nothing.
+			name:  "conditional",
+			opts:  Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true},
+			want:  "if.done->panic",
+			terms: "[FallOffEnd Panicking]",
+		},
+		{
+			// A recover in a nested function literal is not effective.
+			name:  "nested",
+			opts:  Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true},
+			want:  "entry->panic",
+			terms: "[FallOffEnd Panicking]",
+		},
+		{
+			name:  "named",
+			opts:  Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true},
+			want:  "entry->panic",
+			terms: "[FallOffEnd Panicking]",
+		},
+		{
+			// The hook can recognize calls of named functions.
+			name: "named",
+			opts: Options{MayReturn: mayReturn, MayPanic: mayPanic, ModelRecover: true,
+				IsRecoverDefer: func(s *ast.DeferStmt) bool {
+					id, ok := s.Call.Fun.(*ast.Ident)
+					return ok && id.Name == "handle"
+				}},
+			want:  "entry->recover",
+			terms: "[FallOffEnd Recovered]",
+		},
+		{
+			// Only explicit return statements may panic; the
+			// implicit one at the end of the body evaluates
+			// nothing.
+			name:  "falloff",
+			opts:  Options{MayReturn: mayReturn, MayPanic: func(ast.Node) bool { return true }},
+			want:  "entry->panic if.then->panic if.done->panic",
+			terms: "[Return FallOffEnd Panicking]",
+		},
+		{
+			name:  "empty",
+			opts:  Options{MayReturn: mayReturn, MayPanic: func(ast.Node) bool { return true }},
+			want:  "",
+			terms: "[FallOffEnd]",
+		},
+	} {
+		var decl *ast.FuncDecl
+		for _, d := range f.Decls {
+			if d := d.(*ast.FuncDecl); d.Name.Name == test.name {
+				decl = d
+			}
+		}
+		g := Build(decl.Body, test.opts)
+		var edges, prots []string
+		for _, b := range g.Blocks {
+			for _, s := range b.Succs {
+				if s.Kind == KindPanic || s.Kind == KindRecover {
+					edges = append(edges, b.name()+"->"+s.name())
+				}
+			}
+			if b.Protected() {
+				prots = append(prots, b.name())
+			}
+			if b.Kind == KindPanic || b.Kind == KindRecover {
+				if len(b.Succs) > 0 {
+					t.Errorf("%s: %s has successors", test.name, b)
+				}
+				if len(b.Preds) == 0 {
+					t.Errorf("%s: %s has no predecessors", test.name, b)
+				}
+			}
+		}
+		if got := strings.Join(edges, " "); got != test.want {
+			t.Errorf("%s: panic edges = %s, want %s", test.name, got, test.want)
+		}
+		if got, want := strings.Join(prots, " "), strings.Join(test.prots, " "); got != want {
+			t.Errorf("%s: protected blocks = %s, want %s", test.name, got, want)
+		}
+		var reasons []TerminalReason
+		for _, tb := range g.TerminalBlocks() {
+			reasons = append(reasons, tb.Reason)
+		}
+		if got := fmt.Sprint(reasons); got != test.terms {
+			t.Errorf("%s: terminal reasons = %s, want %s", test.name, got, test.terms)
+		}
+		if got, want := len(g.RecoverDefers()) > 0, strings.Contains(test.want, "recover"); got != want {
+			t.Errorf("%s: RecoverDefers() = %v", test.name, g.RecoverDefers())
+		}
+	}
+}
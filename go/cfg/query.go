@@ -0,0 +1,179 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements queries about the nodes of a CFG.
+
+import (
+	"errors"
+	"go/ast"
+)
+
+// A nodeRef locates a node within a CFG.
+type nodeRef struct {
+	block *Block
+	i     int // index within block.Nodes
+}
+
+// lookup returns the location of n among the nodes of g's blocks.
+func (g *CFG) lookup(n ast.Node) (nodeRef, bool) {
+	g.indexOnce.Do(func() {
+		g.index = make(map[ast.Node]nodeRef)
+		for _, b := range g.Blocks {
+			for i, n := range b.Nodes {
+				g.index[n] = nodeRef{b, i}
+			}
+		}
+	})
+	ref, ok := g.index[n]
+	return ref, ok
+}
+
+// BlockOf returns the block whose Nodes include n, or nil if there is
+// none. The nodes of a CFG are its simple statements (including
+// return statements), the conditions and other expressions evaluated
+// by its control statements, and the ValueSpecs of its var
+// declarations; see the package documentation.
+//
+// The index from nodes to blocks is built on first use.
+func (g *CFG) BlockOf(n ast.Node) *Block {
+	ref, _ := g.lookup(n)
+	return ref.block
+}
+
+// InitBlock returns the head block of s, an if, for, switch, or type
+// switch statement with an init statement: the block, of kind
+// KindIfInit, KindForInit, or KindSwitchInit, whose first node is the
+// init statement (unless it was omitted by Options.FilterNode). It
+// returns nil if s is not such a statement of g.
+func (g *CFG) InitBlock(s ast.Stmt) *Block {
+	for _, b := range g.Blocks {
+		switch b.Kind {
+		case KindIfInit, KindForInit, KindSwitchInit:
+			if b.Stmt == s {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// MustPrecede reports whether every path from the entry of the
+// function to statement b passes through statement a: that is,
+// whether a must have executed by the time b first executes. Every
+// live statement must precede itself.
+//
+// Both statements must be nodes of g (see BlockOf); MustPrecede
+// reports false if either is not. It also reports false if b is
+// unreachable, although every path to b, there being none, vacuously
+// passes through a; callers that need to distinguish this case should
+// check BlockOf(b).Live.
+//
+// When a and b are in the same block, a must precede b within it.
+// Otherwise, the block of a must dominate the block of b: since
+// control leaves a block only after its last node, a's block is then
+// executed in full before b's.
+func (g *CFG) MustPrecede(a, b ast.Stmt) bool {
+	ra, ok := g.lookup(a)
+	if !ok || !ra.block.Live {
+		return false
+	}
+	rb, ok := g.lookup(b)
+	if !ok || !rb.block.Live {
+		return false
+	}
+	if ra.block == rb.block {
+		// Even if the block is in a loop, b is first
+		// reached without passing through a later node.
+		return ra.i <= rb.i
+	}
+	return g.Dominators().Dominates(ra.block, rb.block)
+}
+
+// MayPanicBetween reports whether a node that may panic can execute
+// after statement a and before the next execution of statement b: that
+// is, whether such a node lies on some path from a that has not yet
+// passed through b. The path need not reach b: a panic may prevent it
+// from doing so. A node may panic if the MayPanic predicate given to
+// Build reported so, or if it is a call to the panic built-in. The
+// statements a and b themselves are not considered.
+//
+// MayPanicBetween returns an error if the CFG was built without
+// Options.MayPanic, or if a or b is not a node of g (see BlockOf).
+//
+// Within the blocks of a and b, only the nodes after a and before b
+// are considered, in order. The blocks in between are considered in
+// full, according to their panic edges, so that nodes omitted by
+// Options.FilterNode are accounted for there, but not in the blocks of
+// a and b. Each block is visited at most once, so loops do not affect
+// the cost, which is linear in the size of the graph.
+func (g *CFG) MayPanicBetween(a, b ast.Stmt) (bool, error) {
+	if g.panics == nil {
+		return false, errors.New("cfg: MayPanicBetween requires a CFG built with Options.MayPanic")
+	}
+	ra, ok := g.lookup(a)
+	if !ok {
+		return false, errors.New("cfg: MayPanicBetween: first statement is not a node of the CFG")
+	}
+	rb, ok := g.lookup(b)
+	if !ok {
+		return false, errors.New("cfg: MayPanicBetween: second statement is not a node of the CFG")
+	}
+	if !ra.block.Live {
+		return false, nil
+	}
+	panics := func(nodes []ast.Node) bool {
+		for _, n := range nodes {
+			if g.panics[n] {
+				return true
+			}
+		}
+		return false
+	}
+	if ra.block == rb.block && ra.i < rb.i {
+		// Every path from a reaches b within the block.
+		return panics(ra.block.Nodes[ra.i+1 : rb.i]), nil
+	}
+	if panics(ra.block.Nodes[ra.i+1:]) {
+		return true, nil
+	}
+
+	// Search the blocks reachable from a's block without passing
+	// through b's, stopping at the first that may panic.
+	seen := make(map[*Block]bool)
+	stack := []*Block{ra.block}
+	for len(stack) > 0 {
+		blk := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, succ := range blk.Succs {
+			switch {
+			case seen[succ], succ.Kind == KindPanic, succ.Kind == KindRecover, succ.Kind == KindExit:
+				// Already visited, or the path leaves the function.
+			case succ == rb.block:
+				if panics(rb.block.Nodes[:rb.i]) {
+					return true, nil
+				}
+				seen[succ] = true
+			case hasPanicEdge(succ):
+				return true, nil
+			default:
+				seen[succ] = true
+				stack = append(stack, succ)
+			}
+		}
+	}
+	return false, nil
+}
+
+// hasPanicEdge reports whether b has a panic edge, to a block of kind
+// KindPanic or KindRecover.
+func hasPanicEdge(b *Block) bool {
+	for _, s := range b.Succs {
+		if s.Kind == KindPanic || s.Kind == KindRecover {
+			return true
+		}
+	}
+	return false
+}
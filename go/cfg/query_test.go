@@ -0,0 +1,343 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+const precedeSrc = `package p
+
+func diamond(x bool) {
+	open()
+	if x {
+		then()
+	} else {
+		els()
+	}
+	join()
+}
+
+func early(x bool) {
+	open()
+	if x {
+		return
+	}
+	ok()
+	close()
+}
+
+func loop(x bool) {
+	before()
+	for x {
+		head()
+		if x {
+			brk()
+			break
+		}
+		if x {
+			cont()
+			continue
+		}
+		tail()
+	}
+	after()
+}
+
+func loopCond(x bool) {
+	for i := 0; x; i++ {
+		body()
+	}
+	after()
+}
+
+func dead(x bool) {
+	live()
+	return
+	dead1()
+	dead2()
+}
+`
+
+func TestMustPrecede(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "precede.go", precedeSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		decl := decl.(*ast.FuncDecl)
+		g := New(decl.Body, mayReturn)
+		var stmts []ast.Stmt
+		for _, b := range g.Blocks {
+			for _, n := range b.Nodes {
+				if s, ok := n.(ast.Stmt); ok {
+					stmts = append(stmts, s)
+				}
+			}
+		}
+		for _, a := range stmts {
+			for _, b := range stmts {
+				got := g.MustPrecede(a, b)
+				if want := mustPrecedeBrute(g, a, b); got != want {
+					t.Errorf("%s: MustPrecede(%s, %s) = %t, want %t",
+						decl.Name.Name, formatNode(fset, a), formatNode(fset, b), got, want)
+				}
+			}
+		}
+	}
+
+	// Spot checks.
+	for _, test := range []struct {
+		fn, a, b string
+		want     bool
+	}{
+		{"diamond", "open()", "join()", true},
+		{"diamond", "then()", "join()", false},
+		{"early", "open()", "close()", true},
+		{"early", "ok()", "close()", true},
+		{"early", "close()", "ok()", false},
+		{"loop", "head()", "after()", false}, // the loop condition may fail at once
+		{"loop", "head()", "brk()", true},
+		{"loop", "tail()", "head()", false},
+		{"loopCond", "i := 0", "after()", true},
+		{"loopCond", "body()", "i++", true},
+		{"dead", "live()", "dead2()", false},
+		{"dead", "dead1()", "dead2()", false},
+	} {
+		var g *CFG
+		stmts := make(map[string]ast.Stmt)
+		for _, decl := range f.Decls {
+			decl := decl.(*ast.FuncDecl)
+			if decl.Name.Name != test.fn {
+				continue
+			}
+			g = New(decl.Body, mayReturn)
+			ast.Inspect(decl.Body, func(n ast.Node) bool {
+				if s, ok := n.(ast.Stmt); ok {
+					stmts[formatNode(fset, s)] = s
+				}
+				return true
+			})
+		}
+		if got := g.MustPrecede(stmts[test.a], stmts[test.b]); got != test.want {
+			t.Errorf("%s: MustPrecede(%s, %s) = %t, want %t", test.fn, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// mustPrecedeBrute reports whether b is reachable, and every path
+// from the entry to b passes through a, by a search over the graph of
+// individual nodes.
+func mustPrecedeBrute(g *CFG, a, b ast.Stmt) bool {
+	// reach reports whether b is reachable from the entry without
+	// executing the node avoid.
+	reach := func(avoid ast.Node) bool {
+		seen := make(map[*Block]bool)
+		var visit func(blk *Block) bool
+		visit = func(blk *Block) bool {
+			if seen[blk] {
+				return false
+			}
+			seen[blk] = true
+			for _, n := range blk.Nodes {
+				if n == b {
+					return true
+				}
+				if n == avoid {
+					return false
+				}
+			}
+			for _, s := range blk.Succs {
+				if visit(s) {
+					return true
+				}
+			}
+			return false
+		}
+		return visit(g.Blocks[0])
+	}
+	return reach(nil) && (a == b || !reach(a))
+}
+
+func TestBlockOf(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "precede.go", precedeSrc, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := f.Decls[0].(*ast.FuncDecl).Body
+	g := New(body, mayReturn)
+	for _, b := range g.Blocks {
+		for _, n := range b.Nodes {
+			if got := g.BlockOf(n); got != b {
+				t.Errorf("BlockOf(%s) = %v, want %v", formatNode(fset, n), got, b)
+			}
+		}
+	}
+	ifStmt := body.List[1].(*ast.IfStmt)
+	if got := g.BlockOf(ifStmt); got != nil {
+		t.Errorf("BlockOf(if statement) = %v, want nil", got)
+	}
+	if got := g.BlockOf(ifStmt.Cond); got != g.Blocks[0] {
+		t.Errorf("BlockOf(if condition) = %v, want %v", got, g.Blocks[0])
+	}
+}
+
+func TestMayPanicBetween(t *testing.T) {
+	const src = `package p
+
+func calls(x bool) {
+	start := x
+	if x {
+		g()
+	}
+	end := start
+}
+
+func arith(x, y int) {
+	start := x
+	if x > 0 {
+		y = x + y
+	} else {
+		y = x * 2
+	}
+	end := y
+}
+
+func index(s []int, i int) {
+	start := i
+	v := s[i]
+	end := v
+}
+
+func explicit(x bool) {
+	start := x
+	if x {
+		panic(x)
+	}
+	end := x
+}
+
+func loopBefore(x bool) {
+	for x {
+		end := x
+		g()
+		start := x
+	}
+}
+
+func loopAfter(x bool) {
+	for x {
+		end := x
+		start := x
+		g()
+	}
+}
+
+func disjoint(x bool) {
+	if x {
+		start := x
+	} else {
+		end := x
+	}
+}
+
+func unreached(x bool) {
+	if x {
+		start := x
+	} else {
+		end := x
+	}
+	g()
+}
+
+func self(s []int, x bool) {
+	for x {
+		start, end := x, x
+		_ = s[0]
+	}
+}
+`
+	// Calls (other than to the panic built-in, which is
+	// modeled regardless) and index expressions may panic.
+	mayPanic := func(n ast.Node) bool {
+		found := false
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if id, ok := n.Fun.(*ast.Ident); !ok || id.Name != "panic" {
+					found = true
+				}
+			case *ast.IndexExpr:
+				found = true
+			}
+			return !found
+		})
+		return found
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"calls", true},
+		{"arith", false},
+		{"index", true},
+		{"explicit", true},
+		{"loopBefore", false},
+		{"loopAfter", true},
+		{"disjoint", false},
+		{"unreached", true},
+		{"self", true},
+	} {
+		var decl *ast.FuncDecl
+		for _, d := range f.Decls {
+			if d := d.(*ast.FuncDecl); d.Name.Name == test.name {
+				decl = d
+			}
+		}
+		// Find the assignments to start and end.
+		var start, end ast.Stmt
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if assign, ok := n.(*ast.AssignStmt); ok {
+				for _, lhs := range assign.Lhs {
+					switch lhs.(*ast.Ident).Name {
+					case "start":
+						start = assign
+					case "end":
+						end = assign
+					}
+				}
+			}
+			return true
+		})
+
+		g := Build(decl.Body, Options{MayReturn: mayReturn, MayPanic: mayPanic})
+		got, err := g.MayPanicBetween(start, end)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: MayPanicBetween = %t, want %t", test.name, got, test.want)
+		}
+
+		if _, err := New(decl.Body, mayReturn).MayPanicBetween(start, end); err == nil {
+			t.Errorf("%s: MayPanicBetween without panic modeling succeeded", test.name)
+		}
+		if _, err := g.MayPanicBetween(start, decl.Body); err == nil {
+			t.Errorf("%s: MayPanicBetween of a statement not in the CFG succeeded", test.name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements reachability queries about the blocks of a CFG.
+
+import "sync/atomic"
+
+// A blockSet is a set of blocks of a CFG, as a bitmap indexed by
+// Block.Index.
+type blockSet []uint64
+
+func newBlockSet(n int) blockSet    { return make(blockSet, (n+63)/64) }
+func (s blockSet) add(i int32)      { s[i/64] |= 1 << (uint(i) % 64) }
+func (s blockSet) has(i int32) bool { return s[i/64]&(1<<(uint(i)%64)) != 0 }
+
+func (s blockSet) addAll(t blockSet) {
+	for i, w := range t {
+		s[i] |= w
+	}
+}
+
+// Reachable reports whether there is a path in g, of zero or more
+// edges, from block from to block to: whether control may reach to
+// once it reaches from. A live block reaches itself, and, whatever its
+// successors, a block that is not live reaches nothing, since control
+// never reaches it (see Block.Live). Together with BlockOf, it answers
+// such questions as whether one statement may execute after another.
+//
+// Reachable searches the graph once per query, unless BuildReachability
+// has been called, in which case it takes constant time.
+func (g *CFG) Reachable(from, to *Block) bool {
+	if !from.Live {
+		return false
+	}
+	if atomic.LoadUint32(&g.reachDone) != 0 {
+		return g.reach[from.Index].has(to.Index)
+	}
+	return g.ReachableAvoiding(from, to, nil)
+}
+
+// ReachableAvoiding reports whether, as for Reachable, there is a path
+// in g from block from to block to, none of whose blocks other than
+// from and to satisfies avoid: whether control may reach to after
+// leaving from without passing through such a block. If avoid is nil,
+// no block is avoided.
+//
+// ReachableAvoiding visits each block at most once, so loops do not
+// affect the cost of a query, which is linear in the size of the graph
+// (or constant, if BuildReachability has been called and to is not
+// reachable from from at all).
+func (g *CFG) ReachableAvoiding(from, to *Block, avoid func(*Block) bool) bool {
+	if !from.Live {
+		return false
+	}
+	if from == to {
+		return true
+	}
+	if atomic.LoadUint32(&g.reachDone) != 0 && !g.reach[from.Index].has(to.Index) {
+		return false
+	}
+	seen := newBlockSet(len(g.Blocks))
+	seen.add(from.Index)
+	stack := []*Block{from}
+	for len(stack) > 0 {
+		b := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, succ := range b.Succs {
+			switch {
+			case succ == to:
+				return true
+			case seen.has(succ.Index):
+			case avoid != nil && avoid(succ):
+				seen.add(succ.Index)
+			default:
+				seen.add(succ.Index)
+				stack = append(stack, succ)
+			}
+		}
+	}
+	return false
+}
+
+// BuildReachability precomputes the blocks reachable from each live
+// block of g, so that later queries by Reachable take constant time,
+// for clients that make many queries about large functions. The table
+// takes space quadratic in the number of blocks, and time linear in the
+// size of the graph times the number of blocks to compute. Calls after
+// the first have no effect; it is safe to call BuildReachability
+// concurrently with queries.
+func (g *CFG) BuildReachability() {
+	g.reachOnce.Do(func() {
+		reach := make([]blockSet, len(g.Blocks))
+		var live []*Block
+		for _, b := range g.Blocks {
+			if b.Live {
+				live = append(live, b)
+			}
+		}
+		// The components come in reverse topological order, so the
+		// successors of the blocks of each, outside it, are done.
+		// The blocks of a component share their set.
+		for _, scc := range stronglyConnected(live, func(b *Block) []*Block { return b.Succs }) {
+			set := newBlockSet(len(g.Blocks))
+			for _, b := range scc {
+				set.add(b.Index)
+			}
+			for _, b := range scc {
+				for _, succ := range b.Succs {
+					if !set.has(succ.Index) {
+						set.addAll(reach[succ.Index])
+					}
+				}
+			}
+			for _, b := range scc {
+				reach[b.Index] = set
+			}
+		}
+		g.reach = reach
+		atomic.StoreUint32(&g.reachDone, 1)
+	})
+}
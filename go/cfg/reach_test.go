@@ -0,0 +1,168 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// The functions are those of the loops, breaks, and gotos of the tests
+// of cfg_test.go, with a call naming each block of interest.
+const reachSrc = `package p
+
+func gotos(x bool) {
+	a()
+	if x {
+		goto L
+	}
+	b()
+L:
+	c()
+	if x {
+		goto L
+	}
+	d()
+}
+
+func breaks(x bool) {
+	a()
+	for x {
+		if x {
+			b()
+			break
+		}
+		c()
+	}
+	d()
+	log.Fatal(x)
+	e()
+}
+
+func loops(x bool) {
+	for {
+		a()
+		if x {
+			continue
+		}
+		b()
+	}
+	c()
+}
+`
+
+func TestReachable(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "reach.go", reachSrc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs := make(map[string]*CFG)
+	for _, decl := range f.Decls {
+		decl := decl.(*ast.FuncDecl)
+		cfgs[decl.Name.Name] = New(decl.Body, mayReturn)
+	}
+	// block returns the block of the call to the named function, or
+	// else the first block with the given comment.
+	block := func(g *CFG, name string) *Block {
+		for _, b := range g.Blocks {
+			for _, n := range b.Nodes {
+				if s, ok := n.(*ast.ExprStmt); ok {
+					if id, ok := s.X.(*ast.CallExpr).Fun.(*ast.Ident); ok && id.Name == name {
+						return g.BlockOf(s)
+					}
+				}
+			}
+		}
+		for _, b := range g.Blocks {
+			if b.name() == name {
+				return b
+			}
+		}
+		t.Fatalf("no block %s", name)
+		return nil
+	}
+
+	for _, test := range []struct {
+		fn, from, to, avoid string // avoid is empty, or the block to avoid
+		want                bool
+	}{
+		// The second goto loops back to the label.
+		{"gotos", "a", "d", "", true},
+		{"gotos", "b", "c", "", true},
+		{"gotos", "c", "c", "", true},
+		{"gotos", "d", "c", "", false},
+		{"gotos", "c", "b", "", false},
+		{"gotos", "a", "d", "b", true},
+		{"gotos", "a", "b", "if.then", true},
+		{"gotos", "a", "d", "L", false},
+		{"gotos", "a", "L", "L", true},
+
+		// The break leaves the loop; the call to log.Fatal never
+		// returns, so e is dead.
+		{"breaks", "a", "b", "", true},
+		{"breaks", "c", "b", "", true},
+		{"breaks", "b", "c", "", false},
+		{"breaks", "b", "d", "", true},
+		{"breaks", "d", "a", "", false},
+		{"breaks", "a", "e", "", false},
+		{"breaks", "e", "e", "", false},
+		{"breaks", "b", "d", "for.loop", true},
+		{"breaks", "c", "d", "for.loop", false},
+		{"breaks", "a", "d", "c", true},
+
+		// The loop never ends, so c is dead; continue skips b.
+		{"loops", "a", "b", "", true},
+		{"loops", "b", "a", "", true},
+		{"loops", "a", "a", "", true},
+		{"loops", "a", "c", "", false},
+		{"loops", "c", "a", "", false},
+		{"loops", "b", "a", "if.then", true},
+		{"loops", "a", "a", "b", true},
+	} {
+		g := cfgs[test.fn]
+		from, to := block(g, test.from), block(g, test.to)
+		var avoid func(*Block) bool
+		if test.avoid != "" {
+			avoided := block(g, test.avoid)
+			avoid = func(b *Block) bool { return b == avoided }
+		}
+		if got := g.ReachableAvoiding(from, to, avoid); got != test.want {
+			t.Errorf("%s: ReachableAvoiding(%s, %s, %q) = %t, want %t", test.fn, from, to, test.avoid, got, test.want)
+		}
+		if test.avoid == "" {
+			if got := g.Reachable(from, to); got != test.want {
+				t.Errorf("%s: Reachable(%s, %s) = %t, want %t", test.fn, from, to, got, test.want)
+			}
+		}
+	}
+
+	// The precomputed reachability agrees with the searches over
+	// all pairs of blocks, and does not change the answers.
+	cfset, bodies := corpusBodies(t)
+	for _, body := range bodies {
+		for _, g := range []*CFG{New(body, mayReturn), Build(body, Options{MayReturn: mayReturn, MayPanic: func(ast.Node) bool { return true }})} {
+			want := make(map[[2]*Block]bool)
+			for _, from := range g.Blocks {
+				for _, to := range g.Blocks {
+					want[[2]*Block{from, to}] = g.Reachable(from, to)
+				}
+			}
+			g.BuildReachability()
+			for pair, reachable := range want {
+				if got := g.Reachable(pair[0], pair[1]); got != reachable {
+					t.Fatalf("%s: with BuildReachability, Reachable(%s, %s) = %t, want %t",
+						cfset.Position(body.Pos()), pair[0], pair[1], got, reachable)
+				}
+				if got := g.ReachableAvoiding(pair[0], pair[1], nil); got != reachable {
+					t.Fatalf("%s: with BuildReachability, ReachableAvoiding(%s, %s, nil) = %t, want %t",
+						cfset.Position(body.Pos()), pair[0], pair[1], got, reachable)
+				}
+			}
+		}
+	}
+}
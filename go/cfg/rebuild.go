@@ -0,0 +1,102 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the rebuilding of a CFG after an edit.
+
+import (
+	"crypto/sha256"
+	"go/ast"
+	"reflect"
+)
+
+// Rebuild returns the CFG of newBody, an edited version of the body
+// of the function whose CFG is old, built by Build(newBody, opts), and
+// a best-effort correspondence from the blocks of old to those of the
+// new CFG, which clients may use to migrate facts they have cached
+// about the blocks of old. The new CFG is the same as if built afresh;
+// the correspondence is advisory, and blocks of old that have no
+// counterpart have no entry.
+//
+// Blocks correspond only if they have the same kind, and their
+// controlling statements (Stmt) the same type. Since the builder
+// creates blocks in source order, an edit of one statement does not
+// disturb the order of the others; Rebuild aligns the two sequences of
+// blocks so as to match as many blocks as possible, preferring
+// matches of blocks whose nodes have the same shape (see Fingerprint)
+// and the same number of successors.
+func Rebuild(old *CFG, newBody *ast.BlockStmt, opts Options) (*CFG, map[*Block]*Block) {
+	g := Build(newBody, opts)
+	return g, correspond(old.Blocks, g.Blocks)
+}
+
+// correspond returns the alignment of xs and ys that maximizes the
+// total score of its matched pairs.
+func correspond(xs, ys []*Block) map[*Block]*Block {
+	xshapes := blockShapes(xs)
+	yshapes := blockShapes(ys)
+	score := func(i, j int) int {
+		x, y := xs[i], ys[j]
+		if x.Kind != y.Kind || reflect.TypeOf(x.Stmt) != reflect.TypeOf(y.Stmt) {
+			return 0
+		}
+		s := 1
+		if xshapes[i] == yshapes[j] {
+			s += 2
+		}
+		if len(x.Succs) == len(y.Succs) {
+			s++
+		}
+		return s
+	}
+
+	// best[i][j] is the best total score aligning xs[i:] and ys[j:].
+	best := make([][]int, len(xs)+1)
+	for i := range best {
+		best[i] = make([]int, len(ys)+1)
+	}
+	for i := len(xs) - 1; i >= 0; i-- {
+		for j := len(ys) - 1; j >= 0; j-- {
+			b := best[i+1][j]
+			if best[i][j+1] > b {
+				b = best[i][j+1]
+			}
+			if s := score(i, j); s > 0 && best[i+1][j+1]+s > b {
+				b = best[i+1][j+1] + s
+			}
+			best[i][j] = b
+		}
+	}
+
+	res := make(map[*Block]*Block)
+	for i, j := 0, 0; i < len(xs) && j < len(ys); {
+		switch s := score(i, j); {
+		case s > 0 && best[i][j] == best[i+1][j+1]+s:
+			res[xs[i]] = ys[j]
+			i++
+			j++
+		case best[i][j] == best[i+1][j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return res
+}
+
+// blockShapes returns a hash of the shape of the nodes of each block,
+// ignoring positions.
+func blockShapes(blocks []*Block) [][sha256.Size]byte {
+	shapes := make([][sha256.Size]byte, len(blocks))
+	for i, b := range blocks {
+		f := fingerprinter{h: sha256.New()}
+		f.uint(uint64(len(b.Nodes)))
+		for _, n := range b.Nodes {
+			f.value(reflect.ValueOf(n))
+		}
+		f.h.Sum(shapes[i][:0])
+	}
+	return shapes
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+
+func TestRebuild(t *testing.T) {
+	const src = `package p
+
+func f(x bool, s []int) {
+	a()
+	if x {
+		b()
+	} else {
+		c()
+	}
+	for i := range s {
+		if x {
+			continue
+		}
+		d(i)
+	}
+	switch {
+	case x:
+		e()
+	default:
+		f()
+	}
+	for x {
+		if x {
+			break
+		}
+		g()
+	}
+	h()
+}
+`
+	old, _, err := FromSource(src, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		old, new string
+		identity bool // each block corresponds to that of the same index
+	}{
+		{"call", "d(i)", "d(i, x)", true},
+		{"condition", "if x {\n\t\t\tcontinue", "if !x && len(s) > 1 {\n\t\t\tcontinue", true},
+		{"statement", "\tg()\n", "\tg()\n\tg()\n", true},
+		{"newline", "\n\ta()\n", "\n\n\n\ta()\n", true},
+		{"if", "\th()\n", "\tif x {\n\t\th()\n\t}\n", false},
+		{"loop", "\ta()\n", "\tfor x {\n\t\ta()\n\t}\n", false},
+	} {
+		edited := strings.Replace(src, test.old, test.new, 1)
+		if edited == src {
+			t.Fatalf("%s: edit did not apply", test.name)
+		}
+		fresh, fset, err := FromSource(edited, "f", mayReturn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, mapping := Rebuild(old, fresh.Blocks[0].Stmt.(*ast.BlockStmt), Options{MayReturn: mayReturn})
+		if got, want := g.Format(fset), fresh.Format(fset); got != want {
+			t.Errorf("%s: Rebuild:\n%s\nwant:\n%s", test.name, got, want)
+		}
+		for x, y := range mapping {
+			if x != old.Blocks[x.Index] || y != g.Blocks[y.Index] {
+				t.Errorf("%s: mapping %s -> %s is not from old to new blocks", test.name, x, y)
+			} else if x.Kind != y.Kind {
+				t.Errorf("%s: mapping %s -> %s changes kind", test.name, x, y)
+			} else if test.identity && x.Index != y.Index {
+				t.Errorf("%s: mapping %s -> %s, want identity", test.name, x, y)
+			}
+		}
+		if n := len(mapping); n*10 <= len(old.Blocks)*9 {
+			t.Errorf("%s: only %d of %d blocks correspond", test.name, n, len(old.Blocks))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements strongly connected components and the
+// condensation of a CFG.
+
+import "fmt"
+
+// A Component is a strongly connected component of a CFG: a maximal
+// set of blocks each of which can reach all the others.
+type Component struct {
+	Blocks []*Block // in increasing order of Index
+	IsLoop bool     // the blocks lie on a cycle: there are several, or one with a self-edge
+}
+
+// Condensation returns the strongly connected components of the live
+// blocks of g in topological order: each component appears after all
+// the components with an edge into it, so the first is that of the
+// entry block. Among the components that may come next, the one
+// containing the block of lowest Index comes first, so the order is
+// deterministic.
+//
+// Collapsing each component to a single node yields an acyclic graph,
+// so clients may process the blocks "in dependency order" by visiting
+// the components in turn, iterating over those with IsLoop set until
+// a fixed point is reached. Unlike Loops, Condensation treats natural
+// loops and irreducible regions alike: a component with IsLoop set
+// contains one or more of either, along with the blocks between them.
+//
+// Condensation returns an error if g is malformed: if some successor
+// of a block of g is not itself among its blocks, as may happen to a
+// CFG modified by a client or constructed by hand.
+func (g *CFG) Condensation() ([]Component, error) {
+	var live []*Block
+	for i, b := range g.Blocks {
+		if b.Index != int32(i) {
+			return nil, fmt.Errorf("cfg: block %d has Index %d", i, b.Index)
+		}
+		if !b.Live {
+			continue
+		}
+		for _, s := range b.Succs {
+			if int(s.Index) >= len(g.Blocks) || s.Index < 0 || g.Blocks[s.Index] != s {
+				return nil, fmt.Errorf("cfg: successor of block %d is not a block of the CFG", b.Index)
+			}
+		}
+		live = append(live, b)
+	}
+	succs := func(b *Block) []*Block { return b.Succs }
+	sccs := stronglyConnected(live, succs)
+
+	// Order the components by Kahn's algorithm, choosing, among the
+	// ready components, the one whose first block has the lowest Index.
+	comp := make(map[*Block]int) // block -> index into sccs
+	for i, scc := range sccs {
+		sortBlocks(scc)
+		for _, b := range scc {
+			comp[b] = i
+		}
+	}
+	npreds := make([]int, len(sccs)) // edges from other components
+	for _, b := range live {
+		for _, s := range b.Succs {
+			if comp[s] != comp[b] {
+				npreds[comp[s]]++
+			}
+		}
+	}
+	var ready []int // indexes of sccs, in decreasing order of first block
+	push := func(i int) {
+		j := len(ready)
+		ready = append(ready, i)
+		for ; j > 0 && sccs[ready[j-1]][0].Index < sccs[i][0].Index; j-- {
+			ready[j] = ready[j-1]
+		}
+		ready[j] = i
+	}
+	for i := range sccs {
+		if npreds[i] == 0 {
+			push(i)
+		}
+	}
+	res := make([]Component, 0, len(sccs))
+	for len(ready) > 0 {
+		i := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		c := Component{Blocks: sccs[i], IsLoop: len(sccs[i]) > 1}
+		for _, b := range c.Blocks {
+			for _, s := range b.Succs {
+				if j := comp[s]; j == i {
+					c.IsLoop = true
+				} else if npreds[j]--; npreds[j] == 0 {
+					push(j)
+				}
+			}
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// stronglyConnected returns the strongly connected components of the
+// graph of the given blocks and edges, as computed by Tarjan's
+// algorithm: in reverse topological order, each in no particular
+// order. Every block reachable from blocks must be among them.
+func stronglyConnected(blocks []*Block, succs func(*Block) []*Block) [][]*Block {
+	var (
+		index   = make(map[*Block]int)
+		lowlink = make(map[*Block]int)
+		onStack = make(map[*Block]bool)
+		stack   []*Block
+		sccs    [][]*Block
+	)
+	var strongconnect func(b *Block)
+	strongconnect = func(b *Block) {
+		index[b] = len(index)
+		lowlink[b] = index[b]
+		stack = append(stack, b)
+		onStack[b] = true
+		for _, s := range succs(b) {
+			if _, ok := index[s]; !ok {
+				strongconnect(s)
+				if lowlink[s] < lowlink[b] {
+					lowlink[b] = lowlink[s]
+				}
+			} else if onStack[s] && index[s] < lowlink[b] {
+				lowlink[b] = index[s]
+			}
+		}
+		if lowlink[b] == index[b] {
+			var scc []*Block
+			for {
+				x := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[x] = false
+				scc = append(scc, x)
+				if x == b {
+					break
+				}
+			}
+			sccs = append(sccs, scc)
+		}
+	}
+	for _, b := range blocks {
+		if _, ok := index[b]; !ok {
+			strongconnect(b)
+		}
+	}
+	return sccs
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/token"
+	"testing"
+)
+
+const selfSrc = `package main
+
+func self(x bool) {
+	if x {
+		return
+	}
+L:
+	goto L
+	println()
+}
+`
+
+func TestCondensation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string // blocks of each component, ! if IsLoop
+	}{
+		{"empty", "[[0] [1]!]"},
+		{"breaks", "[[0] [1 4]! [3] [2]]"},
+		{"returns", "[[0] [1 4]! [3]]"},
+		{"panics", "[[0] [1] [2]]"},
+		{"nested", "[[0] [1 3 4 5]!]"},
+		{"sequence", "[[0] [1 3]! [2] [4] [5 7 8 9 10]! [6]]"},
+		{"gotoLoop", "[[0] [1 2]! [3]]"},
+		{"irreducible", "[[0] [1] [2] [3 5]!]"},
+		{"self", "[[0] [1] [2] [4]!]"}, // a self-edge, and unreachable blocks
+	} {
+		src := loopsSrc
+		if test.name == "self" {
+			src = selfSrc
+		}
+		g := parseFunc(t, src, test.name)
+		comps, err := g.Condensation()
+		if err != nil {
+			t.Errorf("%s: Condensation failed: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, c := range comps {
+			s := fmt.Sprint(indices(c.Blocks))
+			if c.IsLoop {
+				s += "!"
+			}
+			got = append(got, s)
+		}
+		if got := fmt.Sprint(got); got != test.want {
+			t.Errorf("%s: Condensation() = %s, want %s\n%s", test.name, got, test.want, g.Format(token.NewFileSet()))
+		}
+		checkCondensation(t, test.name, g, comps)
+	}
+}
+
+// checkCondensation checks comps against a brute-force computation of
+// the strongly connected components of g, as the classes of mutually
+// reachable live blocks.
+func checkCondensation(t *testing.T, name string, g *CFG, comps []Component) {
+	t.Helper()
+	n := len(g.Blocks)
+	reach := make([][]bool, n) // reach[i][j]: a non-empty path leads from block i to block j
+	for _, b := range g.Blocks {
+		reach[b.Index] = make([]bool, n)
+		for _, s := range b.Succs {
+			reach[b.Index][s.Index] = true
+		}
+	}
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if reach[i][k] && reach[k][j] {
+					reach[i][j] = true
+				}
+			}
+		}
+	}
+
+	position := make(map[*Block]int) // index into comps
+	for i, c := range comps {
+		for j, b := range c.Blocks {
+			if _, ok := position[b]; ok {
+				t.Errorf("%s: block %d is in several components", name, b.Index)
+			}
+			position[b] = i
+			if j > 0 && c.Blocks[j-1].Index >= b.Index {
+				t.Errorf("%s: blocks of component %d are not in order of Index", name, i)
+			}
+		}
+	}
+	for _, a := range g.Blocks {
+		i, ok := position[a]
+		if ok != a.Live {
+			t.Errorf("%s: block %d (Live=%t) in components: %t", name, a.Index, a.Live, ok)
+			continue
+		}
+		if !a.Live {
+			continue
+		}
+		if got, want := comps[i].IsLoop, reach[a.Index][a.Index]; got != want {
+			t.Errorf("%s: component of block %d has IsLoop=%t, want %t", name, a.Index, got, want)
+		}
+		for _, b := range g.Blocks {
+			if !b.Live {
+				continue
+			}
+			j := position[b]
+			mutual := a == b || reach[a.Index][b.Index] && reach[b.Index][a.Index]
+			if (i == j) != mutual {
+				t.Errorf("%s: blocks %d and %d: same component = %t, mutually reachable = %t", name, a.Index, b.Index, i == j, mutual)
+			}
+			if i != j && reach[a.Index][b.Index] && i > j {
+				t.Errorf("%s: component of block %d follows that of block %d, which it reaches", name, a.Index, b.Index)
+			}
+		}
+	}
+	if len(comps) > 0 && comps[0].Blocks[0] != g.Blocks[0] {
+		t.Errorf("%s: first component does not contain the entry block", name)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements convenience constructors for CFGs of source code.
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// FromSource parses src as a Go source file named "input.go" and
+// returns the CFG of the function named funcName, built using the
+// mayReturn predicate (see New), along with the file set of the
+// parsed file. It is a convenience for tests and small programs.
+//
+// If src does not begin with a package clause, it is parsed as the
+// declarations of a file of package p; line numbers within it are
+// unaffected. funcName is the name of a function (F) or of a method
+// (T.M or (*T).M); the name of a method alone (M) suffices if no
+// function is so named and no other type has a method of that name.
+// The errors returned for an unknown or ambiguous name list the
+// available functions.
+func FromSource(src, funcName string, mayReturn func(*ast.CallExpr) bool) (*CFG, *token.FileSet, error) {
+	return fromSource("input.go", []byte(src), funcName, mayReturn)
+}
+
+// FromFile is like FromSource, but reads the source from the named file.
+func FromFile(filename, funcName string, mayReturn func(*ast.CallExpr) bool) (*CFG, *token.FileSet, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fromSource(filename, src, funcName, mayReturn)
+}
+
+func fromSource(filename string, src []byte, funcName string, mayReturn func(*ast.CallExpr) bool) (*CFG, *token.FileSet, error) {
+	fset := token.NewFileSet()
+	if !hasPackageClause(src) {
+		// A package clause terminated by a semicolon, on the same
+		// line, preserves the line numbers of src.
+		src = append([]byte("package p; "), src...)
+	}
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	decl, err := lookupFunc(f, funcName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return New(decl.Body, mayReturn), fset, nil
+}
+
+// hasPackageClause reports whether the first token of src, after any
+// comments, is the package keyword.
+func hasPackageClause(src []byte) bool {
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	s.Init(fset.AddFile("", -1, len(src)), src, nil, 0)
+	_, tok, _ := s.Scan()
+	return tok == token.PACKAGE
+}
+
+// lookupFunc returns the declaration of the function or method with a
+// body in f named name; see FromSource.
+func lookupFunc(f *ast.File, name string) (*ast.FuncDecl, error) {
+	// Accept (*T).M and (T).M for T.M.
+	if strings.HasPrefix(name, "(") {
+		if i := strings.Index(name, ")."); i > 0 {
+			name = strings.TrimPrefix(name[1:i], "*") + name[i+1:]
+		}
+	}
+	var (
+		names   []string
+		methods []string
+		found   = make(map[string]*ast.FuncDecl)
+	)
+	for _, decl := range f.Decls {
+		decl, ok := decl.(*ast.FuncDecl)
+		if !ok || decl.Body == nil {
+			continue
+		}
+		qualified := decl.Name.Name
+		if decl.Recv != nil && len(decl.Recv.List) > 0 {
+			qualified = recvTypeName(decl.Recv.List[0].Type) + "." + qualified
+			if decl.Name.Name == name {
+				methods = append(methods, qualified)
+			}
+		}
+		names = append(names, qualified)
+		found[qualified] = decl
+	}
+	if decl := found[name]; decl != nil {
+		return decl, nil
+	}
+	sort.Strings(names)
+	switch len(methods) {
+	case 0:
+		if len(names) == 0 {
+			return nil, fmt.Errorf("function %s not found; there are no functions", name)
+		}
+		return nil, fmt.Errorf("function %s not found; available: %s", name, strings.Join(names, ", "))
+	case 1:
+		return found[methods[0]], nil
+	default:
+		sort.Strings(methods)
+		return nil, fmt.Errorf("method name %s is ambiguous: use Type.Method syntax to choose one of %s", name, strings.Join(methods, ", "))
+	}
+}
+
+// recvTypeName returns the name of the named type of a method
+// receiver of type T or *T, or "?" if there is none.
+func recvTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return "?"
+		}
+	}
+}
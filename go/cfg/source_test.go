@@ -0,0 +1,95 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFromSource(t *testing.T) {
+	const src = `package p
+
+type T int
+type U int
+
+func f() { a() }
+
+func (T) M() { b() }
+func (*T) N() { c() }
+func (U) M() { d() }
+`
+	for _, test := range []struct {
+		name string
+		want string // first node of entry block, or error
+	}{
+		{"f", "a()"},
+		{"T.M", "b()"},
+		{"(T).M", "b()"},
+		{"T.N", "c()"},
+		{"(*T).N", "c()"},
+		{"N", "c()"},
+		{"U.M", "d()"},
+		{"M", "input.go: method name M is ambiguous: use Type.Method syntax to choose one of T.M, U.M"},
+		{"g", "input.go: function g not found; available: T.M, T.N, U.M, f"},
+	} {
+		g, fset, err := FromSource(src, test.name, mayReturn)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = formatNode(fset, g.Blocks[0].Nodes[0])
+		}
+		if got != test.want {
+			t.Errorf("FromSource(%q) = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// A source without a package clause is wrapped, preserving positions.
+	g, fset, err := FromSource("// A comment.\nfunc f() {\n\ta()\n}\n", "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fset.Position(g.Blocks[0].Nodes[0].Pos()).String(), "input.go:3:2"; got != want {
+		t.Errorf("position of a() = %s, want %s", got, want)
+	}
+
+	for _, test := range []struct{ src, want string }{
+		{"func f() {", "parsing input.go: input.go:1:22: expected '}', found 'EOF'"},
+		{"var x = 1", "input.go: function f not found; there are no functions"},
+	} {
+		if _, _, err := FromSource(test.src, "f", mayReturn); err == nil || err.Error() != test.want {
+			t.Errorf("FromSource(%q) returned error %v, want %s", test.src, err, test.want)
+		}
+	}
+}
+
+func TestFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "x.go")
+	if err := ioutil.WriteFile(filename, []byte("package p\n\nfunc f() { a() }\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	g, fset, err := FromFile(filename, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.Blocks[0].Name(fset), "entry@x.go:3"; got != want {
+		t.Errorf("entry block is %s, want %s", got, want)
+	}
+	if _, _, err := FromFile(filename, "g", mayReturn); err == nil || !strings.Contains(err.Error(), "x.go: function g not found; available: f") {
+		t.Errorf("FromFile(g) returned error %v", err)
+	}
+	if _, _, err := FromFile(filepath.Join(dir, "y.go"), "f", mayReturn); err == nil {
+		t.Errorf("FromFile of missing file succeeded")
+	}
+}
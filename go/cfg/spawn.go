@@ -0,0 +1,61 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the recording of go and defer statements.
+
+import "go/ast"
+
+// A SpawnKind identifies the statement of a SpawnEdge.
+type SpawnKind uint8
+
+const (
+	SpawnGo    SpawnKind = iota // Stmt is an *ast.GoStmt
+	SpawnDefer                  // Stmt is an *ast.DeferStmt
+)
+
+func (kind SpawnKind) String() string {
+	return [...]string{
+		SpawnGo:    "Go",
+		SpawnDefer: "Defer",
+	}[kind]
+}
+
+// A SpawnEdge records a go or defer statement, which calls a function
+// outside the ordinary flow of control: in a new goroutine, or when
+// the function returns. No edge of the graph leads from the statement
+// to the body of the called function.
+type SpawnEdge struct {
+	FromBlock *Block    // block containing the statement (even if filtered out of its Nodes)
+	Stmt      ast.Stmt  // *ast.GoStmt or *ast.DeferStmt
+	Kind      SpawnKind // kind of Stmt
+	Callee    *CFG      // CFG of the called function literal, or nil if the callee is not a literal
+}
+
+// Spawns returns the go and defer statements of the function, in
+// source order, if the CFG was built with Options.Spawns; otherwise
+// it returns nil. Statements in unreachable code are included (see
+// FromBlock.Live); those in function literals are not, but those of
+// spawned literals appear in the Spawns of their CFGs.
+func (g *CFG) Spawns() []SpawnEdge {
+	return g.spawns
+}
+
+// spawn records a go or defer statement with the given call.
+func (b *builder) spawn(s ast.Stmt, kind SpawnKind, call *ast.CallExpr) {
+	if b.spawnOpts == nil {
+		return
+	}
+	var callee *CFG
+	if lit, ok := unparen(call.Fun).(*ast.FuncLit); ok {
+		callee = Build(lit.Body, *b.spawnOpts)
+	}
+	b.cfg.spawns = append(b.cfg.spawns, SpawnEdge{
+		FromBlock: b.current,
+		Stmt:      s,
+		Kind:      kind,
+		Callee:    callee,
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestSpawns(t *testing.T) {
+	const src = `package p
+
+func f(x bool) {
+	go func() {
+		if x {
+			a()
+		}
+		defer func() { b() }()
+	}()
+	if x {
+		defer (func() { c() })()
+		return
+	}
+	go worker(x)
+	defer close()
+	return
+	go dead()
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", src, parser.Mode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := f.Decls[0].(*ast.FuncDecl).Body
+
+	if spawns := New(body, mayReturn).Spawns(); spawns != nil {
+		t.Errorf("Spawns without Options.Spawns = %v, want nil", spawns)
+	}
+
+	g := Build(body, Options{MayReturn: mayReturn, Spawns: true})
+	var got []string
+	var describe func(indent string, g *CFG)
+	describe = func(indent string, g *CFG) {
+		for _, s := range g.Spawns() {
+			if s.FromBlock != g.Blocks[s.FromBlock.Index] {
+				t.Errorf("spawn %s: FromBlock does not belong to CFG", formatNode(fset, s.Stmt))
+			}
+			if s.FromBlock.Live && g.BlockOf(s.Stmt) != s.FromBlock {
+				t.Errorf("spawn %s: FromBlock is not the block of the statement", formatNode(fset, s.Stmt))
+			}
+			callee := "nil"
+			if s.Callee != nil {
+				callee = fmt.Sprintf("%d blocks", len(s.Callee.Blocks))
+			}
+			got = append(got, fmt.Sprintf("%s%s %s live=%t callee=%s",
+				indent, s.Kind, strings.Fields(formatNode(fset, s.Stmt))[1], s.FromBlock.Live, callee))
+			if s.Callee != nil {
+				describe(indent+"\t", s.Callee)
+			}
+		}
+	}
+	describe("", g)
+	want := []string{
+		"Go func() live=true callee=3 blocks",
+		"\tDefer func() live=true callee=1 blocks",
+		"Defer (func() live=true callee=1 blocks",
+		"Go worker(x) live=true callee=nil",
+		"Defer close() live=true callee=nil",
+		"Go dead() live=false callee=nil",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Spawns:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Spawns add no edges to the graph.
+	if got, want := g.Format(fset), New(body, mayReturn).Format(fset); got != want {
+		t.Errorf("CFG with Spawns:\n%s\nwant:\n%s", got, want)
+	}
+
+	clone := g.Clone()
+	for i, s := range clone.Spawns() {
+		if s.FromBlock != clone.Blocks[s.FromBlock.Index] {
+			t.Errorf("clone spawn %d: FromBlock is an original block", i)
+		}
+		if s.Callee != nil && s.Callee == g.Spawns()[i].Callee {
+			t.Errorf("clone spawn %d: Callee is shared", i)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements statistics about the construction of a CFG.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuildStats holds statistics about the construction of a CFG by
+// Build, to help find the constructs responsible when construction
+// is slow; see Options.Stats.
+type BuildStats struct {
+	Blocks   map[BlockKind]int // number of blocks of each kind, including unreachable ones
+	Edges    map[EdgeKind]int  // number of edges of each kind, including those of unreachable blocks
+	MaxDepth int               // maximum nesting depth of statements, counting the function body as 1
+	Labels   int               // number of entries in the builder's table of labels
+	Duration time.Duration     // wall time spent in Build
+}
+
+// String returns a one-line summary of the statistics, suitable for
+// logging, such as:
+//
+//	3 blocks (Body 1, IfDone 1, IfThen 1), 3 edges (CondFalse 1, CondTrue 1, Unconditional 1), depth 3, 0 labels, 5µs
+//
+// The counts of each kind are listed in order of kind name.
+func (s *BuildStats) String() string {
+	var blocks, edges []string
+	nblocks, nedges := 0, 0
+	for kind, n := range s.Blocks {
+		blocks = append(blocks, fmt.Sprintf("%s %d", kind, n))
+		nblocks += n
+	}
+	for kind, n := range s.Edges {
+		edges = append(edges, fmt.Sprintf("%s %d", kind, n))
+		nedges += n
+	}
+	sort.Strings(blocks)
+	sort.Strings(edges)
+	return fmt.Sprintf("%d blocks (%s), %d edges (%s), depth %d, %d labels, %s",
+		nblocks, strings.Join(blocks, ", "),
+		nedges, strings.Join(edges, ", "),
+		s.MaxDepth, s.Labels, s.Duration)
+}
+
+// recordStats fills in stats once the construction of g is complete.
+func (g *CFG) recordStats(stats *BuildStats, maxDepth, labels int, start time.Time) {
+	*stats = BuildStats{
+		Blocks:   make(map[BlockKind]int),
+		Edges:    make(map[EdgeKind]int),
+		MaxDepth: maxDepth,
+		Labels:   labels,
+	}
+	for _, b := range g.Blocks {
+		stats.Blocks[b.Kind]++
+		for i := range b.Succs {
+			stats.Edges[edgeKind(b, i)]++
+		}
+	}
+	stats.Duration = time.Since(start)
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+const statsSrc = `package p
+
+func f(x bool, s []int, ch chan int) {
+	if x {
+		a()
+	}
+	for range s {
+		switch {
+		case x:
+			select {
+			case <-ch:
+			default:
+			}
+		}
+	}
+loop:
+	for x {
+		break loop
+	}
+	return
+}
+`
+
+func TestBuildStats(t *testing.T) {
+	g, fset, err := FromSource(statsSrc, "f", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := g.Blocks[0].Stmt.(*ast.BlockStmt)
+	var stats BuildStats
+	Build(body, Options{MayReturn: mayReturn, Stats: &stats})
+	if stats.Duration <= 0 {
+		t.Errorf("Duration = %v, want > 0", stats.Duration)
+	}
+	stats.Duration = 0
+	const want = "" +
+		"19 blocks (Body 1, ForBody 1, ForDone 1, ForLoop 1, IfDone 1, IfThen 1, Label 1, " +
+		"RangeBody 1, RangeDone 1, RangeLoop 1, SelectAfterCase 1, SelectCaseBody 2, SelectDone 1, " +
+		"SwitchCaseBody 1, SwitchDone 1, SwitchNextCase 1, Unreachable 2), " +
+		"22 edges (CondFalse 2, CondTrue 2, RangeBody 1, RangeDone 1, SelectCase 1, SelectNext 1, " +
+		"SwitchCase 1, SwitchNext 1, Unconditional 12), depth 6, 1 labels, 0s"
+	if got := stats.String(); got != want {
+		t.Errorf("stats:\n%s\nwant:\n%s", got, want)
+		t.Logf("CFG:\n%s", g.Format(fset))
+	}
+
+	// A nil body.
+	Build(nil, Options{Stats: &stats})
+	stats.Duration = 0
+	if got, want := stats.String(), "1 blocks (Body 1), 0 edges (), depth 0, 0 labels, 0s"; got != want {
+		t.Errorf("stats of nil body: %s, want %s", got, want)
+	}
+}
+
+func BenchmarkBuildStats(b *testing.B) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "input.go", statsSrc, parser.Mode(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := f.Decls[0].(*ast.FuncDecl).Body
+	b.Run("nil", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Build(body, Options{MayReturn: mayReturn})
+		}
+	})
+	b.Run("stats", func(b *testing.B) {
+		var stats BuildStats
+		for i := 0; i < b.N; i++ {
+			Build(body, Options{MayReturn: mayReturn, Stats: &stats})
+		}
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/token"
+	"sort"
+)
+
+// A TerminalReason explains why a block has no successors.
+type TerminalReason uint8
+
+const (
+	TerminalInvalid TerminalReason = iota
+
+	TerminalReturn             // block ends with a ReturnStmt
+	TerminalFallOffEnd         // control falls off the end of the function body (implicit return)
+	TerminalPanic              // block ends with a call to the panic built-in
+	TerminalNoReturnCall       // block ends with another call for which mayReturn reported false
+	TerminalUndefinedLabelJump // block is the target of a branch with no valid destination
+	TerminalBlockForever       // block represents a select that can never proceed
+	TerminalNoBody             // function has no body (it is implemented externally)
+	TerminalPanicking          // block is the synthetic target of panic edges; the panic continues in the caller
+	TerminalRecovered          // block is the synthetic target of recovered panic edges; the function returns
+	TerminalInvalidBranch      // block is the target of a break or continue whose label is defined but not a valid destination
+	TerminalUnreachable        // block follows the last case of a select with no default case, which no execution reaches
+)
+
+func (r TerminalReason) String() string {
+	return [...]string{
+		TerminalInvalid:            "Invalid",
+		TerminalReturn:             "Return",
+		TerminalFallOffEnd:         "FallOffEnd",
+		TerminalPanic:              "Panic",
+		TerminalNoReturnCall:       "NoReturnCall",
+		TerminalUndefinedLabelJump: "UndefinedLabelJump",
+		TerminalBlockForever:       "BlockForever",
+		TerminalNoBody:             "NoBody",
+		TerminalPanicking:          "Panicking",
+		TerminalRecovered:          "Recovered",
+		TerminalInvalidBranch:      "InvalidBranch",
+		TerminalUnreachable:        "Unreachable",
+	}[r]
+}
+
+// A TerminalBlock describes a block without successors, other than
+// the edge to the exit block of a CFG that has one (see
+// Options.ExitBlock), and why control does not leave it.
+type TerminalBlock struct {
+	Block  *Block
+	Reason TerminalReason
+
+	// Node is the node responsible for the termination:
+	// the (possibly implicit) *ast.ReturnStmt for TerminalReturn
+	// and TerminalFallOffEnd; the *ast.ExprStmt of the call for
+	// TerminalPanic and TerminalNoReturnCall; the *ast.BranchStmt
+	// for TerminalUndefinedLabelJump and TerminalInvalidBranch;
+	// the *ast.SelectStmt for TerminalBlockForever and
+	// TerminalUnreachable; and nil for
+	// TerminalNoBody, TerminalPanicking, and TerminalRecovered.
+	Node ast.Node
+
+	// Call is the call expression for TerminalPanic and
+	// TerminalNoReturnCall, and nil otherwise.
+	Call *ast.CallExpr
+
+	Pos token.Pos // position of Node, or token.NoPos
+}
+
+// TerminalBlocks returns, in increasing order of Index, a description
+// of each live block of g that has no successors, other than panic
+// edges (see Options.MayPanic) and the edge to the exit block (see
+// Options.ExitBlock), which is not itself reported.
+//
+// A select statement with no default case is represented as a chain
+// of tests that ends, after its last case, in a block without
+// successors for the path on which no case is chosen. That path is
+// impossible, since such a select blocks until a case can proceed, so
+// the block is reported as TerminalUnreachable; only the block of an
+// empty select, which blocks forever, is reported as
+// TerminalBlockForever.
+//
+// When panics are modeled, the synthetic KindPanic and KindRecover
+// blocks are reported too, as TerminalPanicking and TerminalRecovered.
+func (g *CFG) TerminalBlocks() []TerminalBlock {
+	var res []TerminalBlock
+	for _, t := range g.terminals {
+		if t.Block.Live && t.Block.exits() {
+			res = append(res, t)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Block.Index < res[j].Block.Index })
+	return res
+}
+
+// terminate records that block b has no successors, for the reason
+// given. For a call, n is the ExprStmt of the call.
+func (b *builder) terminate(block *Block, reason TerminalReason, n ast.Node) {
+	t := TerminalBlock{Block: block, Reason: reason, Node: n}
+	if n != nil {
+		t.Pos = n.Pos()
+	}
+	if s, ok := n.(*ast.ExprStmt); ok {
+		t.Call, _ = s.X.(*ast.CallExpr)
+	}
+	b.cfg.terminals = append(b.cfg.terminals, t)
+}
+
+// isPanic reports whether call is syntactically a call to the panic
+// built-in. (Without type information, a local function named panic
+// is indistinguishable from it.)
+func isPanic(call *ast.CallExpr) bool {
+	id, ok := call.Fun.(*ast.Ident)
+	return ok && id.Name == "panic"
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const termSrc = `package main
+
+import "log"
+
+func ret(x bool) {
+	if x {
+		return
+	}
+	live()
+}
+
+func panics() {
+	panic("oops")
+}
+
+func fatal() {
+	log.Fatal("oops")
+}
+
+func undefinedGoto() {
+	goto missing
+}
+
+func undefinedBreak() {
+	break
+}
+
+func empty() {
+	select {}
+}
+
+func noDefault(ch chan int) {
+	select {
+	case <-ch:
+	}
+}
+
+func infinite() {
+	for {
+	}
+}
+`
+
+func TestTerminalBlocks(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"ret", "if.then:Return@7 if.done:FallOffEnd@10"},
+		{"panics", "entry:Panic@13(panic)"},
+		{"fatal", "entry:NoReturnCall@17(log.Fatal)"},
+		{"undefinedGoto", "missing:UndefinedLabelJump@21"},
+		{"undefinedBreak", "undefined.branch:UndefinedLabelJump@25"},
+		{"empty", "select.forever:BlockForever@29"},
+		{"noDefault", "select.done:FallOffEnd@36 select.next:Unreachable@33"},
+		{"infinite", ""},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "term.go", termSrc, parser.Mode(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var g *CFG
+		for _, decl := range f.Decls {
+			if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name == test.name {
+				g = New(decl.Body, mayReturn)
+			}
+		}
+		var got []string
+		for _, term := range g.TerminalBlocks() {
+			s := fmt.Sprintf("%s:%s@%d", term.Block.name(), term.Reason, fset.Position(term.Pos).Line)
+			if term.Call != nil {
+				s += "(" + formatNode(fset, term.Call.Fun) + ")"
+			}
+			if !term.Block.Live || len(term.Block.Succs) > 0 {
+				t.Errorf("%s: %s is not a live terminal block", test.name, term.Block)
+			}
+			got = append(got, s)
+		}
+		if got := strings.Join(got, " "); got != test.want {
+			t.Errorf("%s: got terminal blocks %q, want %q", test.name, got, test.want)
+		}
+
+		// Every live block without successors is classified.
+		n := 0
+		for _, b := range g.Blocks {
+			if b.Live && len(b.Succs) == 0 {
+				n++
+			}
+		}
+		if n != len(got) {
+			t.Errorf("%s: %d live blocks without successors, but %d terminal blocks", test.name, n, len(got))
+		}
+	}
+}
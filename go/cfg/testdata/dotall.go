@@ -0,0 +1,18 @@
+package p
+
+type T struct{ next *T }
+
+func (t *T) Len() int {
+	n := 0
+	for ; t != nil; t = t.next {
+		n++
+	}
+	return n
+}
+
+func first(list []*T) *T {
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
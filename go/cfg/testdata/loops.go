@@ -0,0 +1,27 @@
+package p
+
+func nested(x bool) {
+	for x {
+		a()
+		for x {
+			if x {
+				break
+			}
+			b()
+		}
+		c()
+	}
+	return
+	d()
+}
+
+func irreducible(x bool) {
+	if x {
+		goto L
+	}
+	for x {
+		a()
+	L:
+		b()
+	}
+}
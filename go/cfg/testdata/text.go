@@ -0,0 +1,51 @@
+package p
+
+// constructs exercises the statements that shape a CFG, for the
+// golden file of the text format.
+func constructs(x int, list []string, ch chan int, v interface{}) (s string) {
+	defer func() {
+		recover()
+	}()
+	if y := x * 2; y > x {
+		s = "tab\there"
+	} else if x < 0 {
+		return "negative"
+	}
+	for i := 0; i < x; i++ {
+		if i == 3 {
+			continue
+		}
+		s += "!"
+	}
+	for _, e := range list {
+		switch e {
+		case "a", "b":
+			fallthrough
+		case "c":
+			break
+		default:
+			s += e
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		x = v
+	case nil:
+	}
+	select {
+	case n := <-ch:
+		x = n
+	case ch <- x:
+	default:
+	}
+L:
+	for {
+		if x > 0 {
+			break L
+		}
+		goto L
+	}
+	var a, b = x, `raw "quoted"`
+	_, _ = a, b
+	panic("done")
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements the canonical text format of a CFG.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// TextVersion is the version of the text format written by
+// MarshalText. It is incremented whenever the format, or the text
+// written for the CFG of a given function, changes.
+const TextVersion = 1
+
+// A Skeleton is the shape of a CFG, as recorded by its text format:
+// the blocks with their kinds, liveness, and successors, and the
+// positions and renderings of their nodes, but no syntax trees. It is
+// sufficient for comparing the structure of CFGs, for example those
+// built by different versions of this package.
+type Skeleton struct {
+	Version int // of the text format
+	Blocks  []SkeletonBlock
+}
+
+// A SkeletonBlock describes a block of a CFG; see Skeleton.
+type SkeletonBlock struct {
+	Index int
+	Kind  BlockKind
+	Live  bool
+	Succs []int // indices of successors
+	Nodes []SkeletonNode
+}
+
+// A SkeletonNode describes a node of a block; see Skeleton.
+type SkeletonNode struct {
+	Start, End int    // byte offsets of the node's extent within its file
+	Text       string // the node formatted by go/format
+}
+
+// MarshalText returns the canonical text format of g, in which the
+// positions of nodes are expressed as offsets within the files of
+// fset. Unlike Format, the text format is specified, and versioned by
+// TextVersion, so that it may be used by golden tests and compared
+// across tools; UnmarshalText parses it.
+//
+// The format consists of a header line, "cfg v" followed by the
+// version, and then one line per block, in order of index:
+//
+//	index kind live|dead succs=i,j,... [start:end "text"]...
+//
+// where kind is the String of the block's Kind, the successor list
+// may be empty, and each node is described by the offsets of its
+// start and end and its text, formatted by go/format and quoted as
+// if by strconv.Quote, which places it on a single line. Fields are
+// separated by single spaces, and lines are terminated by newlines.
+//
+// MarshalText returns an error if a node lacks a valid position.
+func (g *CFG) MarshalText(fset *token.FileSet) ([]byte, error) {
+	s := &Skeleton{Version: TextVersion}
+	for _, b := range g.Blocks {
+		sb := SkeletonBlock{
+			Index: int(b.Index),
+			Kind:  b.Kind,
+			Live:  b.Live,
+			Succs: make([]int, len(b.Succs)),
+		}
+		for i, succ := range b.Succs {
+			sb.Succs[i] = int(succ.Index)
+		}
+		for _, n := range b.Nodes {
+			if !n.Pos().IsValid() || !n.End().IsValid() {
+				return nil, fmt.Errorf("cfg: block %d: node %s has no position", b.Index, formatNodeLine(fset, n))
+			}
+			sb.Nodes = append(sb.Nodes, SkeletonNode{
+				Start: fset.Position(n.Pos()).Offset,
+				End:   fset.Position(n.End()).Offset,
+				Text:  printNode(fset, n),
+			})
+		}
+		s.Blocks = append(s.Blocks, sb)
+	}
+	return s.MarshalText()
+}
+
+// MarshalText returns the text format of s, as described at
+// CFG.MarshalText. It returns an error if s.Version is not
+// TextVersion, the only version it can write.
+func (s *Skeleton) MarshalText() ([]byte, error) {
+	if s.Version != TextVersion {
+		return nil, fmt.Errorf("cfg: cannot write text format version %d", s.Version)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "cfg v%d\n", s.Version)
+	for _, b := range s.Blocks {
+		live := "dead"
+		if b.Live {
+			live = "live"
+		}
+		fmt.Fprintf(&buf, "%d %s %s succs=", b.Index, b.Kind, live)
+		for i, succ := range b.Succs {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprint(&buf, succ)
+		}
+		for _, n := range b.Nodes {
+			fmt.Fprintf(&buf, " [%d:%d %s]", n.Start, n.End, strconv.Quote(n.Text))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText parses the text format of a CFG, as written by
+// CFG.MarshalText, and returns its skeleton. It reports an error if
+// data is not well formed, or if its version is not TextVersion.
+func UnmarshalText(data []byte) (*Skeleton, error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1) // a node may be long
+	if !sc.Scan() {
+		return nil, fmt.Errorf("cfg: text format lacks header")
+	}
+	var s Skeleton
+	if _, err := fmt.Sscanf(sc.Text(), "cfg v%d", &s.Version); err != nil || sc.Text() != fmt.Sprintf("cfg v%d", s.Version) {
+		return nil, fmt.Errorf("cfg: invalid text format header %q", sc.Text())
+	}
+	if s.Version != TextVersion {
+		return nil, fmt.Errorf("cfg: unsupported text format version %d (want %d)", s.Version, TextVersion)
+	}
+	for line := 2; sc.Scan(); line++ {
+		b, err := parseSkeletonBlock(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("cfg: text format line %d: %v", line, err)
+		}
+		if b.Index != len(s.Blocks) {
+			return nil, fmt.Errorf("cfg: text format line %d: block %d out of order", line, b.Index)
+		}
+		s.Blocks = append(s.Blocks, b)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, b := range s.Blocks {
+		for _, succ := range b.Succs {
+			if succ < 0 || succ >= len(s.Blocks) {
+				return nil, fmt.Errorf("cfg: text format: block %d has invalid successor %d", b.Index, succ)
+			}
+		}
+	}
+	return &s, nil
+}
+
+// parseSkeletonBlock parses the line of a block in the text format.
+func parseSkeletonBlock(line string) (SkeletonBlock, error) {
+	var b SkeletonBlock
+	fields := strings.SplitN(line, " ", 5)
+	if len(fields) < 4 {
+		return b, fmt.Errorf("too few fields")
+	}
+	var err error
+	if b.Index, err = strconv.Atoi(fields[0]); err != nil {
+		return b, fmt.Errorf("invalid index %q", fields[0])
+	}
+	if b.Kind, err = parseBlockKind(fields[1]); err != nil {
+		return b, err
+	}
+	switch fields[2] {
+	case "live":
+		b.Live = true
+	case "dead":
+	default:
+		return b, fmt.Errorf("invalid liveness %q", fields[2])
+	}
+	if !strings.HasPrefix(fields[3], "succs=") {
+		return b, fmt.Errorf("invalid successors %q", fields[3])
+	}
+	if list := strings.TrimPrefix(fields[3], "succs="); list != "" {
+		for _, f := range strings.Split(list, ",") {
+			succ, err := strconv.Atoi(f)
+			if err != nil {
+				return b, fmt.Errorf("invalid successor %q", f)
+			}
+			b.Succs = append(b.Succs, succ)
+		}
+	}
+	if len(fields) == 5 {
+		rest := fields[4]
+		for {
+			var n SkeletonNode
+			if n, rest, err = parseSkeletonNode(rest); err != nil {
+				return b, err
+			}
+			b.Nodes = append(b.Nodes, n)
+			if rest == "" {
+				break
+			}
+			if rest[0] != ' ' {
+				return b, fmt.Errorf("missing space after node")
+			}
+			rest = rest[1:]
+		}
+	}
+	return b, nil
+}
+
+// parseSkeletonNode parses the node descriptor at the start of s,
+// [start:end "text"], and returns the rest of s.
+func parseSkeletonNode(s string) (SkeletonNode, string, error) {
+	var n SkeletonNode
+	i := strings.Index(s, " ")
+	if !strings.HasPrefix(s, "[") || i < 0 {
+		return n, "", fmt.Errorf("invalid node %q", s)
+	}
+	if _, err := fmt.Sscanf(s[1:i], "%d:%d", &n.Start, &n.End); err != nil || s[1:i] != fmt.Sprintf("%d:%d", n.Start, n.End) {
+		return n, "", fmt.Errorf("invalid node extent %q", s[1:i])
+	}
+	s = s[i+1:]
+
+	// Find the end of the quoted text, skipping escaped characters.
+	if !strings.HasPrefix(s, `"`) {
+		return n, "", fmt.Errorf("node text is not quoted")
+	}
+	end := -1
+	for j := 1; j < len(s); j++ {
+		if s[j] == '\\' {
+			j++
+		} else if s[j] == '"' {
+			end = j + 1
+			break
+		}
+	}
+	if end < 0 || end >= len(s) || s[end] != ']' {
+		return n, "", fmt.Errorf("unterminated node text")
+	}
+	text, err := strconv.Unquote(s[:end])
+	if err != nil {
+		return n, "", fmt.Errorf("invalid node text %s", s[:end])
+	}
+	n.Text = text
+	return n, s[end+1:], nil
+}
+
+// parseBlockKind returns the BlockKind whose String is name.
+func parseBlockKind(name string) (BlockKind, error) {
+	for kind := KindInvalid; kind <= KindUndefinedBranch; kind++ {
+		if kind.String() == name {
+			return kind, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown block kind %q", name)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg_test
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/cfg/cfgtest"
+)
+
+// TestTextGolden checks the text format against a frozen golden file.
+// A change to the format, or to the CFG built for the function, must
+// be accompanied by a new TextVersion, and the golden file updated
+// with -update.
+func TestTextGolden(t *testing.T) {
+	g, fset, err := cfg.FromFile(filepath.Join("testdata", "text.go"), "constructs", cfgtest.MayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := g.MarshalText(fset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", fmt.Sprintf("text_v%d.golden", cfg.TextVersion))
+	cfgtest.Golden(t, golden, data, *update)
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	for _, name := range []string{"constructs"} {
+		g, fset, err := cfg.FromFile(filepath.Join("testdata", "text.go"), name, cfgtest.MayReturn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := g.MarshalText(fset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := cfg.UnmarshalText(data)
+		if err != nil {
+			t.Fatalf("%s: UnmarshalText failed: %v\n%s", name, err, data)
+		}
+		if got, err := s.MarshalText(); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: Skeleton.MarshalText = %s, %v; want original:\n%s", name, got, err, data)
+		}
+		if want := skeleton(fset, g); !reflect.DeepEqual(s, want) {
+			t.Errorf("%s: UnmarshalText = %+v, want %+v", name, s, want)
+		}
+	}
+}
+
+// skeleton returns the skeleton of g, as computed from the CFG.
+func skeleton(fset *token.FileSet, g *cfg.CFG) *cfg.Skeleton {
+	s := &cfg.Skeleton{Version: cfg.TextVersion}
+	for _, b := range g.Blocks {
+		sb := cfg.SkeletonBlock{Index: int(b.Index), Kind: b.Kind, Live: b.Live}
+		for _, succ := range b.Succs {
+			sb.Succs = append(sb.Succs, int(succ.Index))
+		}
+		for _, n := range b.Nodes {
+			var text bytes.Buffer
+			format.Node(&text, fset, n)
+			sb.Nodes = append(sb.Nodes, cfg.SkeletonNode{
+				Start: fset.Position(n.Pos()).Offset,
+				End:   fset.Position(n.End()).Offset,
+				Text:  text.String(),
+			})
+		}
+		s.Blocks = append(s.Blocks, sb)
+	}
+	return s
+}
+
+func TestUnmarshalTextErrors(t *testing.T) {
+	for _, test := range []struct {
+		data, err string
+	}{
+		{"", "text format lacks header"},
+		{"cfg v1x\n", `invalid text format header "cfg v1x"`},
+		{"cfg v2\n", "unsupported text format version 2 (want 1)"},
+		{"cfg v1\n0 Body live\n", "line 2: too few fields"},
+		{"cfg v1\n0 Bogus live succs=\n", `line 2: unknown block kind "Bogus"`},
+		{"cfg v1\n0 Body alive succs=\n", `line 2: invalid liveness "alive"`},
+		{"cfg v1\n1 Body live succs=\n", "line 2: block 1 out of order"},
+		{"cfg v1\n0 Body live succs=1\n", "block 0 has invalid successor 1"},
+		{"cfg v1\n0 Body live succs= [1:2 \"x]\n", "line 2: unterminated node text"},
+		{"cfg v1\n0 Body live succs= [1-2 \"x\"]\n", `line 2: invalid node extent "1-2"`},
+		{"cfg v1\n0 Body live succs= [1:2 \"x\"][3:4 \"y\"]\n", "line 2: missing space after node"},
+	} {
+		_, err := cfg.UnmarshalText([]byte(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("UnmarshalText(%q): got error %v, want %q", test.data, err, test.err)
+		}
+	}
+	// An empty successor list and no nodes are valid.
+	s, err := cfg.UnmarshalText([]byte("cfg v1\n0 Body live succs=\n"))
+	if err != nil || len(s.Blocks) != 1 || s.Blocks[0].Succs != nil || !s.Blocks[0].Live {
+		t.Errorf("UnmarshalText(minimal) = %+v, %v", s, err)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+// This file implements static estimation of branch probabilities.
+
+import (
+	"go/ast"
+	"go/token"
+	"math"
+)
+
+// A Heuristic is a set of static branch prediction heuristics,
+// used by EstimateWeights.
+type Heuristic uint8
+
+// The heuristics, after Ball and Larus, "Branch Prediction for Free"
+// (PLDI 1993), as adapted to syntax by this package. Each applies to
+// a block with two successors (other than panic edges) and predicts,
+// with a fixed probability, which of them is taken.
+const (
+	// HeuristicLoop predicts that a branch stays within the
+	// innermost loop containing its block, with probability 0.88,
+	// if exactly one of its successors is within the loop. It
+	// favors the bodies of loops over their exits, and their
+	// continuation over breaks and early returns.
+	HeuristicLoop Heuristic = 1 << iota
+
+	// HeuristicNoReturn predicts that a branch to a successor all
+	// of whose paths lead to a call to panic, or to another call
+	// that does not return, is taken with probability only 0.02.
+	HeuristicNoReturn
+
+	// HeuristicReturn predicts that a branch to a successor that
+	// leads, through blocks with a single successor, to a return
+	// statement, is taken with probability only 0.28, if the other
+	// successor does not.
+	HeuristicReturn
+
+	// HeuristicPointer predicts that a comparison with nil, as the
+	// condition of a branch, reports inequality with probability
+	// 0.6.
+	HeuristicPointer
+
+	// AllHeuristics is the set of all heuristics.
+	AllHeuristics = HeuristicLoop | HeuristicNoReturn | HeuristicReturn | HeuristicPointer
+)
+
+// Probabilities of the heuristics.
+const (
+	probLoop     = 0.88
+	probNoReturn = 0.02
+	probReturn   = 0.28
+	probPointer  = 0.6
+)
+
+// WeightOptions controls the estimation of branch probabilities by
+// EstimateWeights.
+type WeightOptions struct {
+	// Disabled is the set of heuristics not to apply.
+	// By default, all heuristics apply.
+	Disabled Heuristic
+}
+
+// EstimateWeights returns an estimate of the probability of each edge
+// of the live blocks of g being taken when control leaves its source
+// block, in the absence of profile information.
+//
+// The probabilities of the edges leaving each block sum to one. Panic
+// edges (see Options.MayPanic) are exceptional and have probability
+// zero. The edges from a block with a single other successor have
+// probability one. Those from a block with two are predicted by the
+// applicable heuristics of the Heuristic constants, starting from even
+// odds: when several apply, their predictions p and q for a successor
+// are combined into pq / (pq + (1-p)(1-q)), following Wu and Larus,
+// "Static Branch Frequency and Program Profile Analysis" (MICRO 1994).
+// Each heuristic may be disabled by opts, so that the estimates can
+// be explained in terms of those that apply.
+//
+// Edges are identified by their blocks, so two edges between the same
+// pair of blocks, such as those of an if statement with an empty
+// body, share a single entry whose probability is the sum of theirs.
+func (g *CFG) EstimateWeights(opts WeightOptions) map[Edge]float64 {
+	enabled := AllHeuristics &^ opts.Disabled
+
+	var loops []*Loop
+	if enabled&HeuristicLoop != 0 {
+		for _, l := range g.Loops() {
+			if !l.Irreducible {
+				loops = append(loops, l)
+			}
+		}
+	}
+	innermost := func(b *Block) *Loop {
+		var res *Loop
+		for _, l := range loops {
+			if l.Contains(b) && (res == nil || len(l.Blocks) < len(res.Blocks)) {
+				res = l
+			}
+		}
+		return res
+	}
+	var doomed map[*Block]bool
+	if enabled&HeuristicNoReturn != 0 {
+		doomed = g.doomedBlocks()
+	}
+	var returns map[*Block]bool // blocks ending with a return statement
+	if enabled&HeuristicReturn != 0 {
+		returns = make(map[*Block]bool)
+		for _, t := range g.TerminalBlocks() {
+			if t.Reason == TerminalReturn {
+				returns[t.Block] = true
+			}
+		}
+	}
+
+	weights := make(map[Edge]float64)
+	for _, b := range g.Blocks {
+		if !b.Live {
+			continue
+		}
+		succs := normalSuccs(b)
+		for _, s := range b.Succs[len(succs):] {
+			weights[Edge{b, s}] = 0
+		}
+		switch len(succs) {
+		case 0:
+			continue
+		case 1:
+			weights[Edge{b, succs[0]}] = 1
+			continue
+		}
+
+		// p is the probability of taking the first successor.
+		p := 0.5
+		combine := func(q float64) {
+			p = p * q / (p*q + (1-p)*(1-q))
+		}
+		if l := innermost(b); l != nil {
+			if in0, in1 := l.Contains(succs[0]), l.Contains(succs[1]); in0 != in1 {
+				if in0 {
+					combine(probLoop)
+				} else {
+					combine(1 - probLoop)
+				}
+			}
+		}
+		if doomed != nil && doomed[succs[0]] != doomed[succs[1]] {
+			if doomed[succs[0]] {
+				combine(probNoReturn)
+			} else {
+				combine(1 - probNoReturn)
+			}
+		}
+		if returns != nil {
+			if r0, r1 := leadsTo(succs[0], returns), leadsTo(succs[1], returns); r0 != r1 {
+				if r0 {
+					combine(probReturn)
+				} else {
+					combine(1 - probReturn)
+				}
+			}
+		}
+		if enabled&HeuristicPointer != 0 && len(b.Nodes) > 0 {
+			if cond, ok := b.Nodes[len(b.Nodes)-1].(*ast.BinaryExpr); ok && (isNil(cond.X) || isNil(cond.Y)) {
+				switch cond.Op {
+				case token.EQL:
+					combine(1 - probPointer)
+				case token.NEQ:
+					combine(probPointer)
+				}
+			}
+		}
+		weights[Edge{b, succs[0]}] += p
+		weights[Edge{b, succs[1]}] += 1 - p
+	}
+	return weights
+}
+
+// normalSuccs returns the successors of b other than panic edges.
+func normalSuccs(b *Block) []*Block {
+	for i, s := range b.Succs {
+		if s.Kind == KindPanic || s.Kind == KindRecover {
+			return b.Succs[:i] // panic edges come last
+		}
+	}
+	return b.Succs
+}
+
+// doomedBlocks returns the set of live blocks of g all of whose paths
+// lead to a call that does not return, such as a call to panic.
+func (g *CFG) doomedBlocks() map[*Block]bool {
+	doomed := make(map[*Block]bool)
+	for _, t := range g.TerminalBlocks() {
+		if t.Reason == TerminalPanic || t.Reason == TerminalNoReturnCall {
+			doomed[t.Block] = true
+		}
+	}
+	// Iterate to the least fixed point, so that infinite loops
+	// are not doomed.
+	for changed := true; changed; {
+		changed = false
+		for _, b := range g.Blocks {
+			succs := normalSuccs(b)
+			if !b.Live || doomed[b] || len(succs) == 0 {
+				continue
+			}
+			all := true
+			for _, s := range succs {
+				all = all && doomed[s]
+			}
+			if all {
+				doomed[b] = true
+				changed = true
+			}
+		}
+	}
+	return doomed
+}
+
+// leadsTo reports whether b, or a block reached from it through
+// blocks with a single successor, is in the set.
+func leadsTo(b *Block, set map[*Block]bool) bool {
+	seen := make(map[*Block]bool)
+	for !seen[b] {
+		if set[b] {
+			return true
+		}
+		seen[b] = true
+		succs := normalSuccs(b)
+		if len(succs) != 1 {
+			break
+		}
+		b = succs[0]
+	}
+	return false
+}
+
+func isNil(e ast.Expr) bool {
+	id, ok := unparen(e).(*ast.Ident)
+	return ok && id.Name == "nil"
+}
+
+// BlockFrequencies returns the estimated frequency of execution of
+// each live block of g, relative to one execution of the function,
+// given the probabilities of its edges, as computed by
+// EstimateWeights: the entry block has frequency one, and each other
+// block the sum of the frequencies of its predecessors weighted by the
+// probabilities of their edges to it.
+//
+// Frequencies are computed iteratively, to within a relative error of
+// about 1e-9, and at most 1000 passes over the blocks; the frequencies
+// of the blocks of a loop that is predicted never to exit (with
+// probability one) are therefore bounded only by the number of passes.
+func (g *CFG) BlockFrequencies(weights map[Edge]float64) map[*Block]float64 {
+	order := g.ReversePostorder()
+	freq := make(map[*Block]float64, len(order))
+	for round := 0; round < 1000; round++ {
+		delta := 0.0
+		for _, b := range order {
+			f := 0.0
+			if b == g.Blocks[0] {
+				f = 1
+			}
+			seen := make(map[*Block]bool)
+			for _, p := range b.Preds {
+				if p.Live && !seen[p] {
+					seen[p] = true
+					f += freq[p] * weights[Edge{p, b}]
+				}
+			}
+			if d := math.Abs(f-freq[b]) / math.Max(f, 1); d > delta {
+				delta = d
+			}
+			freq[b] = f
+		}
+		if delta < 1e-9 {
+			break
+		}
+	}
+	return freq
+}
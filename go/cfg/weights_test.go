@@ -0,0 +1,126 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cfg
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const weightsSrc = `package p
+
+func search(x bool) {
+	for i := 0; i < n; i++ {
+		if x {
+			return
+		}
+	}
+	done()
+}
+
+func check(p *T) {
+	if p == nil {
+		panic("nil")
+	}
+	use(p)
+}
+`
+
+// formatWeights returns the weights of edges, one per line.
+func formatWeights(fset *token.FileSet, weights map[Edge]float64) string {
+	var lines []string
+	for e, w := range weights {
+		lines = append(lines, fmt.Sprintf("%d %s -> %d %s: %.4f", e.From.Index, e.From.Name(fset), e.To.Index, e.To.Name(fset), w))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestEstimateWeights(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		disabled Heuristic
+		want     string
+	}{
+		{"search", 0, `
+0 entry@input.go:3 -> 1 for.init@input.go:4: 1.0000
+1 for.init@input.go:4 -> 4 for.loop@input.go:4: 1.0000
+2 for.body@input.go:4 -> 6 if.then@input.go:5: 0.0504
+2 for.body@input.go:4 -> 7 if.done@input.go:5: 0.9496
+4 for.loop@input.go:4 -> 2 for.body@input.go:4: 0.8800
+4 for.loop@input.go:4 -> 3 for.done@input.go:4: 0.1200
+5 for.post@input.go:4 -> 4 for.loop@input.go:4: 1.0000
+7 if.done@input.go:5 -> 5 for.post@input.go:4: 1.0000`},
+		{"search", HeuristicReturn, `
+0 entry@input.go:3 -> 1 for.init@input.go:4: 1.0000
+1 for.init@input.go:4 -> 4 for.loop@input.go:4: 1.0000
+2 for.body@input.go:4 -> 6 if.then@input.go:5: 0.1200
+2 for.body@input.go:4 -> 7 if.done@input.go:5: 0.8800
+4 for.loop@input.go:4 -> 2 for.body@input.go:4: 0.8800
+4 for.loop@input.go:4 -> 3 for.done@input.go:4: 0.1200
+5 for.post@input.go:4 -> 4 for.loop@input.go:4: 1.0000
+7 if.done@input.go:5 -> 5 for.post@input.go:4: 1.0000`},
+		{"search", AllHeuristics, `
+0 entry@input.go:3 -> 1 for.init@input.go:4: 1.0000
+1 for.init@input.go:4 -> 4 for.loop@input.go:4: 1.0000
+2 for.body@input.go:4 -> 6 if.then@input.go:5: 0.5000
+2 for.body@input.go:4 -> 7 if.done@input.go:5: 0.5000
+4 for.loop@input.go:4 -> 2 for.body@input.go:4: 0.5000
+4 for.loop@input.go:4 -> 3 for.done@input.go:4: 0.5000
+5 for.post@input.go:4 -> 4 for.loop@input.go:4: 1.0000
+7 if.done@input.go:5 -> 5 for.post@input.go:4: 1.0000`},
+		{"check", 0, `
+0 entry@input.go:12 -> 1 if.then@input.go:13: 0.0134
+0 entry@input.go:12 -> 2 if.done@input.go:13: 0.9866`},
+		{"check", HeuristicNoReturn, `
+0 entry@input.go:12 -> 1 if.then@input.go:13: 0.4000
+0 entry@input.go:12 -> 2 if.done@input.go:13: 0.6000`},
+	} {
+		g, fset, err := FromSource(weightsSrc, test.name, mayReturn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		weights := g.EstimateWeights(WeightOptions{Disabled: test.disabled})
+		if got, want := formatWeights(fset, weights), test.want[1:]; got != want {
+			t.Errorf("%s, disabled %b: got weights\n%s\nwant\n%s", test.name, test.disabled, got, want)
+		}
+	}
+}
+
+func TestBlockFrequencies(t *testing.T) {
+	g, _, err := FromSource(weightsSrc, "search", mayReturn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weights := g.EstimateWeights(WeightOptions{})
+	freq := g.BlockFrequencies(weights)
+
+	// The loop header runs once, then again after each iteration
+	// that neither exits the loop nor returns.
+	stay := weights[Edge{g.Blocks[4], g.Blocks[2]}] * weights[Edge{g.Blocks[2], g.Blocks[7]}]
+	header := 1 / (1 - stay)
+	for _, test := range []struct {
+		block int
+		want  float64
+	}{
+		{0, 1},
+		{4, header},
+		{2, header * 0.88},
+		{3, header * 0.12},
+		{6, header * 0.88 * weights[Edge{g.Blocks[2], g.Blocks[6]}]},
+	} {
+		if got := freq[g.Blocks[test.block]]; math.Abs(got-test.want) > 1e-6 {
+			t.Errorf("frequency of block %d = %g, want %g", test.block, got, test.want)
+		}
+	}
+	// The function exits once, by return or after the loop.
+	if got := freq[g.Blocks[3]] + freq[g.Blocks[6]]; math.Abs(got-1) > 1e-6 {
+		t.Errorf("frequency of exits = %g, want 1", got)
+	}
+}
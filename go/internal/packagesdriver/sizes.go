@@ -76,6 +76,15 @@ func GetSizes(ctx context.Context, buildFlags, env []string, gocmdRunner *gocomm
 }
 
 func GetSizesGolist(ctx context.Context, buildFlags, env []string, gocmdRunner *gocommand.Runner, dir string) (types.Sizes, error) {
+	return GetSizesGolistFunc(ctx, buildFlags, env, gocmdRunner.RunRaw, dir)
+}
+
+// A RunFunc runs a go command invocation, as gocommand.Runner.RunRaw does.
+type RunFunc func(ctx context.Context, inv gocommand.Invocation) (stdout, stderr *bytes.Buffer, friendlyErr, rawErr error)
+
+// GetSizesGolistFunc is like GetSizesGolist, but runs the go commands
+// with run.
+func GetSizesGolistFunc(ctx context.Context, buildFlags, env []string, run RunFunc, dir string) (types.Sizes, error) {
 	inv := gocommand.Invocation{
 		Verb:       "list",
 		Args:       []string{"-f", "{{context.GOARCH}} {{context.Compiler}}", "--", "unsafe"},
@@ -83,7 +92,7 @@ func GetSizesGolist(ctx context.Context, buildFlags, env []string, gocmdRunner *
 		BuildFlags: buildFlags,
 		WorkingDir: dir,
 	}
-	stdout, stderr, friendlyErr, rawErr := gocmdRunner.RunRaw(ctx, inv)
+	stdout, stderr, friendlyErr, rawErr := run(ctx, inv)
 	var goarch, compiler string
 	if rawErr != nil {
 		if strings.Contains(rawErr.Error(), "cannot find main module") {
@@ -95,7 +104,7 @@ func GetSizesGolist(ctx context.Context, buildFlags, env []string, gocmdRunner *
 				Env:        env,
 				WorkingDir: dir,
 			}
-			envout, enverr := gocmdRunner.Run(ctx, inv)
+			envout, _, enverr, _ := run(ctx, inv)
 			if enverr != nil {
 				return nil, enverr
 			}
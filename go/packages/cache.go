@@ -0,0 +1,473 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+// This file implements the saving and restoring of package graphs,
+// and the cache of Config.Cache.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheVersion is the version of the format of the entries of
+// Config.Cache, which is part of their keys.
+const cacheVersion = 1
+
+// A savedGraph is the JSON form of a package graph written by Save
+// and in the entries of Config.Cache.
+type savedGraph struct {
+	// Env holds the go env variables resolved when the graph was
+	// loaded, for entries of Config.Cache.
+	Env map[string]string `json:",omitempty"`
+
+	Sizes    *types.StdSizes `json:",omitempty"`
+	Roots    []string
+	Packages []*savedPackage
+
+	// GoEnv, GoVersion and OverlayTrace are those of the driver's
+	// response, if it reported them.
+	GoEnv        map[string]string `json:",omitempty"`
+	GoVersion    int               `json:",omitempty"`
+	OverlayTrace []OverlayDecision `json:",omitempty"`
+
+	// Files and Dirs record the state of the files and directories
+	// on which the graph depends; see stale.
+	Files []*fileStamp `json:",omitempty"`
+	Dirs  []*dirStamp  `json:",omitempty"`
+}
+
+// A savedPackage is a Package in its JSON form, with the fields that
+// MarshalJSON omits.
+type savedPackage struct {
+	Package *Package
+	Module  *Module `json:",omitempty"`
+	ForTest string  `json:",omitempty"`
+}
+
+// A fileStamp records the state of a file.
+type fileStamp struct {
+	Path    string
+	Missing bool   `json:",omitempty"`
+	Size    int64  `json:",omitempty"`
+	ModTime int64  `json:",omitempty"` // in nanoseconds since the Unix epoch
+	Hash    string `json:",omitempty"` // hex SHA-256 of the contents
+}
+
+// A dirStamp records the names of the source files in a directory.
+type dirStamp struct {
+	Path  string
+	Names []string `json:",omitempty"`
+}
+
+// Save writes the graph of the packages pkgs and of their
+// dependencies to w, in a form that Restore reads back. Only the
+// fields that precede type checking are saved: those of NeedName,
+// NeedFiles, NeedCompiledGoFiles, NeedImports, NeedDeps,
+// NeedExportsFile, NeedTypesSizes, NeedModule, NeedEmbedFiles,
+// NeedEmbedPatterns, and NeedDepsErrors. Save also records the state of the files that the
+// graph depends on, so that Restore can tell whether it is out of date.
+func Save(w io.Writer, pkgs []*Package) error {
+	g := &savedGraph{}
+	var all []*Package
+	Visit(pkgs, nil, func(pkg *Package) {
+		all = append(all, pkg)
+		if g.Sizes == nil {
+			g.Sizes, _ = pkg.TypesSizes.(*types.StdSizes)
+		}
+	})
+	for _, pkg := range pkgs {
+		g.Roots = append(g.Roots, pkg.ID)
+	}
+	g.addPackages(all)
+	files, dirs := graphInputs(all, nil)
+	g.stamp(files, dirs, time.Time{})
+	return json.NewEncoder(w).Encode(g)
+}
+
+// Restore reads a package graph written by Save from r, and returns
+// the packages passed to Save, whose Imports are connected to the
+// restored dependencies. It returns an error if any of the files that
+// the graph depends on has changed since it was saved.
+func Restore(r io.Reader) ([]*Package, error) {
+	var g savedGraph
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, fmt.Errorf("packages: reading saved graph: %v", err)
+	}
+	if path := g.stale(); path != "" {
+		return nil, fmt.Errorf("packages: saved graph is out of date: %s has changed", path)
+	}
+	byID := make(map[string]*Package)
+	for _, pkg := range g.packages() {
+		if g.Sizes != nil {
+			pkg.TypesSizes = g.Sizes
+		}
+		byID[pkg.ID] = pkg
+	}
+	for _, pkg := range byID {
+		for path, stub := range pkg.Imports {
+			imp, ok := byID[stub.ID]
+			if !ok {
+				return nil, fmt.Errorf("packages: saved graph is missing %s, imported by %s", stub.ID, pkg.ID)
+			}
+			pkg.Imports[path] = imp
+		}
+	}
+	var roots []*Package
+	for _, id := range g.Roots {
+		pkg, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("packages: saved graph is missing its root %s", id)
+		}
+		roots = append(roots, pkg)
+	}
+	return roots, nil
+}
+
+func (g *savedGraph) addPackages(pkgs []*Package) {
+	for _, pkg := range pkgs {
+		g.Packages = append(g.Packages, &savedPackage{
+			Package: pkg,
+			Module:  pkg.Module,
+			ForTest: pkg.forTest,
+		})
+	}
+}
+
+// packages returns the packages of g, as a driver returns them: their
+// Imports are stubs that only have their ID set.
+func (g *savedGraph) packages() []*Package {
+	pkgs := make([]*Package, 0, len(g.Packages))
+	for _, sp := range g.Packages {
+		pkg := sp.Package
+		if pkg == nil {
+			pkg = &Package{}
+		}
+		pkg.Module = sp.Module
+		pkg.forTest = sp.ForTest
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// graphInputs returns the files and directories on which the graph of
+// pkgs depends: the files of the packages and the other source files
+// in their directories, the go.mod and go.sum files of their modules
+// and of the main module named by env, if not nil, and the go.env
+// configuration file and go command that env identifies. The files
+// that the build system generates as it loads the packages, their
+// ExportFile and CompiledGoFiles outside their directories, map to
+// false.
+func graphInputs(pkgs []*Package, env map[string]string) (files, dirs map[string]bool) {
+	files = make(map[string]bool)
+	dirs = make(map[string]bool)
+	addModFile := func(gomod string) {
+		if gomod != "" && gomod != os.DevNull {
+			dir := filepath.Dir(gomod)
+			files[gomod] = true
+			files[filepath.Join(dir, "go.sum")] = true
+			files[filepath.Join(dir, "vendor", "modules.txt")] = true
+		}
+	}
+	for _, pkg := range pkgs {
+		for _, list := range [][]string{pkg.GoFiles, pkg.OtherFiles, pkg.IgnoredFiles, pkg.EmbedFiles} {
+			for _, filename := range list {
+				files[filename] = true
+				dirs[filepath.Dir(filename)] = true
+			}
+		}
+		for _, filename := range pkg.CompiledGoFiles {
+			if _, ok := files[filename]; !ok {
+				files[filename] = false
+			}
+		}
+		if pkg.ExportFile != "" {
+			files[pkg.ExportFile] = false
+		}
+		if pkg.Module != nil {
+			addModFile(pkg.Module.GoMod)
+		}
+	}
+	if env != nil {
+		addModFile(env["GOMOD"])
+		if gowork := env["GOWORK"]; gowork != "" && gowork != "off" {
+			files[gowork] = true
+			files[gowork+".sum"] = true
+		}
+		if goenv := env["GOENV"]; goenv != "" && goenv != "off" {
+			files[goenv] = true
+		}
+		if gocmd, err := exec.LookPath("go"); err == nil {
+			files[gocmd] = true
+		}
+	}
+	return files, dirs
+}
+
+// stamp records in g the state of the files and directories returned
+// by graphInputs. The other source files in the directories are
+// stamped too. It reports false if one of the files that is not
+// generated was modified after the time since, if not zero, as that
+// may be after the graph was loaded from it.
+func (g *savedGraph) stamp(files, dirs map[string]bool, since time.Time) bool {
+	for dir := range dirs {
+		names := sourceFileNames(dir)
+		for _, name := range names {
+			files[filepath.Join(dir, name)] = true
+		}
+		g.Dirs = append(g.Dirs, &dirStamp{Path: dir, Names: names})
+	}
+	sort.Slice(g.Dirs, func(i, j int) bool { return g.Dirs[i].Path < g.Dirs[j].Path })
+
+	for filename, source := range files {
+		st := newFileStamp(filename)
+		if source && !since.IsZero() && st.ModTime >= since.UnixNano() {
+			return false
+		}
+		g.Files = append(g.Files, st)
+	}
+	sort.Slice(g.Files, func(i, j int) bool { return g.Files[i].Path < g.Files[j].Path })
+	return true
+}
+
+// stale returns the name of a file or directory that has changed since
+// g was stamped, or "" if there is none. A file whose modification
+// time changed but whose contents did not has not changed.
+func (g *savedGraph) stale() string {
+	for _, old := range g.Dirs {
+		names := sourceFileNames(old.Path)
+		if len(names) != len(old.Names) {
+			return old.Path
+		}
+		for i := range names {
+			if names[i] != old.Names[i] {
+				return old.Path
+			}
+		}
+	}
+	for _, old := range g.Files {
+		fi, err := os.Stat(old.Path)
+		switch {
+		case err != nil || old.Missing:
+			if err == nil || !old.Missing {
+				return old.Path
+			}
+		case fi.Size() != old.Size:
+			return old.Path
+		case fi.ModTime().UnixNano() != old.ModTime:
+			if newFileStamp(old.Path).Hash != old.Hash {
+				return old.Path
+			}
+		}
+	}
+	return ""
+}
+
+func newFileStamp(filename string) *fileStamp {
+	st := &fileStamp{Path: filename}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		st.Missing = true
+		return st
+	}
+	st.Size, st.ModTime = fi.Size(), fi.ModTime().UnixNano()
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		st.Missing = true
+		return st
+	}
+	h := sha256.Sum256(contents)
+	st.Hash = hex.EncodeToString(h[:])
+	return st
+}
+
+// sourceExts are the extensions of the files that the go command may
+// build into a package.
+var sourceExts = map[string]bool{
+	".go": true, ".c": true, ".h": true, ".s": true, ".S": true,
+	".cc": true, ".cpp": true, ".cxx": true, ".hh": true, ".hpp": true, ".hxx": true,
+	".f": true, ".F": true, ".for": true, ".f90": true, ".m": true,
+	".swig": true, ".swigcxx": true, ".syso": true,
+}
+
+// sourceFileNames returns the sorted names of the source files in dir,
+// or nil if it cannot be read.
+func sourceFileNames(dir string) []string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && sourceExts[filepath.Ext(fi.Name())] {
+			names = append(names, fi.Name())
+		}
+	}
+	return names
+}
+
+// cachingDriver is a driver that uses the entries of Config.Cache, if
+// it is set, or updates them with the responses of defaultDriver.
+// Problems with the cache are logged, not reported to the caller.
+func cachingDriver(cfg *Config, patterns ...string) (*driverResponse, error) {
+	if cfg.Cache == "" {
+		return defaultDriver(cfg, patterns...)
+	}
+	filename := filepath.Join(cfg.Cache, cacheKey(cfg, patterns)+".json")
+	// An entry recorded by a Load that did not ask for the environment
+	// cannot answer a LoadWithEnv.
+	if response := readCacheEntry(filename); response != nil && (!cfg.reportEnv || response.GoEnv != nil) {
+		return response, nil
+	}
+	start := time.Now()
+	response, err := defaultDriver(cfg, patterns...)
+	if err != nil || cfg.Context != nil && cfg.Context.Err() != nil {
+		return response, err
+	}
+	if err := writeCacheEntry(cfg, filename, response, start); err != nil {
+		cfg.Logf("not caching the packages: %v", err)
+	}
+	return response, nil
+}
+
+// cacheKey returns the key of the cache entry for a load of patterns
+// with cfg: a digest of the parts of cfg that a driver depends on
+// other than the files on disk, which are checked by the entry's
+// stamps.
+func cacheKey(cfg *Config, patterns []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "version %d\n", cacheVersion)
+	fmt.Fprintf(h, "patterns %q\n", patterns)
+	fmt.Fprintf(h, "mode %d tests %t\n", cfg.Mode, cfg.Tests)
+	fmt.Fprintf(h, "dir %q\n", cfg.Dir)
+	fmt.Fprintf(h, "buildflags %q\n", cfg.BuildFlags)
+
+	// The go command sees the variables of cfg.Env, which override
+	// those of the process, as in gocommand.Invocation.
+	env := make(map[string]string)
+	for _, kv := range append(os.Environ(), cfg.Env...) {
+		if i := strings.IndexByte(kv, '='); i > 0 && cacheKeyVar(kv[:i]) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "env %s=%q\n", name, env[name])
+	}
+
+	overlay := cfg.overlayFilenames()
+	sort.Strings(overlay)
+	for _, filename := range overlay {
+		contents, _ := cfg.overlayContents(filename)
+		fmt.Fprintf(h, "overlay %q %x\n", filename, sha256.Sum256(contents))
+	}
+	deleted := append([]string(nil), cfg.DeletedFiles...)
+	sort.Strings(deleted)
+	fmt.Fprintf(h, "deleted %q\n", deleted)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheKeyVar reports whether the environment variable name may
+// affect the go command, such as GOOS, GOARCH, or GOFLAGS.
+func cacheKeyVar(name string) bool {
+	switch name {
+	case "PATH", "HOME", "XDG_CONFIG_HOME", "CC", "CXX", "AR", "PKG_CONFIG":
+		return true
+	}
+	return strings.HasPrefix(name, "GO") || strings.HasPrefix(name, "CGO_")
+}
+
+// readCacheEntry returns the response recorded in the cache entry
+// filename, or nil if there is none or it is out of date.
+func readCacheEntry(filename string) *driverResponse {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	var g savedGraph
+	if err := json.Unmarshal(data, &g); err != nil || g.stale() != "" {
+		return nil
+	}
+	return &driverResponse{
+		Sizes:        g.Sizes,
+		Roots:        g.Roots,
+		Packages:     g.packages(),
+		GoEnv:        g.GoEnv,
+		GoVersion:    g.GoVersion,
+		OverlayTrace: g.OverlayTrace,
+	}
+}
+
+// writeCacheEntry records response, which was loaded with cfg from
+// the time start, in the cache entry filename. A response in which a
+// package could not be found is not recorded, as it may depend on the
+// state of the module cache or of the network.
+func writeCacheEntry(cfg *Config, filename string, response *driverResponse, start time.Time) error {
+	for _, pkg := range response.Packages {
+		if len(pkg.GoFiles) == 0 && len(pkg.CompiledGoFiles) == 0 && len(pkg.Errors) > 0 {
+			return fmt.Errorf("package %s has errors", pkg.ID)
+		}
+	}
+	state := &golistState{cfg: cfg}
+	b, err := state.invokeGo("env", "-json", "GOOS", "GOARCH", "GOMOD", "GOWORK", "GOENV", "GOVERSION")
+	if err != nil {
+		return err
+	}
+	g := &savedGraph{
+		Sizes:        response.Sizes,
+		Roots:        response.Roots,
+		GoEnv:        response.GoEnv,
+		GoVersion:    response.GoVersion,
+		OverlayTrace: response.OverlayTrace,
+	}
+	if err := json.NewDecoder(b).Decode(&g.Env); err != nil {
+		return err
+	}
+	g.addPackages(response.Packages)
+	files, dirs := graphInputs(response.Packages, g.Env)
+	if !g.stamp(files, dirs, start) {
+		return fmt.Errorf("files changed during the load")
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(g); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.Cache, 0777); err != nil {
+		return err
+	}
+	// Write the entry atomically, for concurrent loads.
+	f, err := ioutil.TempFile(cfg.Cache, "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+// describeGraph returns a description of the IDs, files, and import
+// edges of the graph of pkgs.
+func describeGraph(pkgs []*packages.Package) string {
+	var out strings.Builder
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		var files, imports []string
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		for path, imp := range p.Imports {
+			imports = append(imports, path+":"+imp.ID)
+		}
+		sort.Strings(imports)
+		fmt.Fprintf(&out, "%s %v %v %v\n", p.ID, files, imports, p.Errors)
+	})
+	return out.String()
+}
+
+func TestCache(t *testing.T) { packagestest.TestAll(t, testCache) }
+func testCache(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"b/b.go": "package b\n",
+			"c/c.go": "package c\n",
+		},
+	}})
+	defer exported.Cleanup()
+	cache, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+	listed := 0
+	exported.Config.Logf = func(format string, args ...interface{}) {
+		if strings.Contains(fmt.Sprintf(format, args...), "[go list") {
+			listed++
+		}
+	}
+	bfile := exported.File("golang.org/fake", "b/b.go")
+
+	load := func(step string, wantCached bool) {
+		t.Helper()
+		cfg := *exported.Config
+		want, err := packages.Load(&cfg, "golang.org/fake/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Cache = cache
+		listed = 0
+		got, err := packages.Load(&cfg, "golang.org/fake/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached := listed == 0; cached != wantCached {
+			t.Errorf("%s: load used the cache: %t, want %t", step, cached, wantCached)
+		}
+		if describeGraph(got) != describeGraph(want) {
+			t.Errorf("%s: got graph\n%s\nwant\n%s", step, describeGraph(got), describeGraph(want))
+		}
+	}
+	load("first load", false)
+	load("second load", true)
+	if err := ioutil.WriteFile(bfile, []byte("package b\n\nimport _ \"golang.org/fake/c\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	load("after changing an import", false)
+	load("after changing an import, again", true)
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(bfile), "b2.go"), []byte("package b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	load("after adding a file", false)
+	exported.Config.Overlay = map[string][]byte{bfile: []byte("package b\n")}
+	load("with an overlay", false)
+	load("with an overlay, again", true)
+	exported.Config.BuildFlags = []string{"-tags=foo"}
+	load("with build flags", false)
+}
+
+func TestSaveRestore(t *testing.T) { packagestest.TestAll(t, testSaveRestore) }
+func testSaveRestore(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"b/b.go": "package b\n\nimport _ \"fmt\"\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule
+	initial, err := packages.Load(exported.Config, "golang.org/fake/...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := packages.Save(&buf, initial); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	restored, err := packages.Restore(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := describeGraph(restored), describeGraph(initial); got != want {
+		t.Errorf("restored graph\n%s\nwant\n%s", got, want)
+	}
+	for i := range initial {
+		if !reflect.DeepEqual(restored[i].Module, initial[i].Module) {
+			t.Errorf("restored module of %s is %+v, want %+v", initial[i].ID, restored[i].Module, initial[i].Module)
+		}
+	}
+
+	// Touching a file without changing it does not invalidate the graph.
+	bfile := exported.File("golang.org/fake", "b/b.go")
+	if err := ioutil.WriteFile(bfile, []byte("package b\n\nimport _ \"fmt\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := packages.Restore(bytes.NewReader(saved)); err != nil {
+		t.Errorf("after touching a file: %v", err)
+	}
+	if err := ioutil.WriteFile(bfile, []byte("package b\n\nimport _ \"os\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := packages.Restore(bytes.NewReader(saved)); err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("after changing a file: got error %v, want the graph to be out of date", err)
+	}
+}
@@ -173,9 +173,13 @@ Overlays: The Overlay field in the Config allows providing alternate contents
 for Go source files, by providing a mapping from file path to contents.
 go/packages will pull in new imports added in overlay files when go/packages
 is run in LoadImports mode or greater.
-Overlay support for the go list driver isn't complete yet: if the file doesn't
-exist on disk, it will only be recognized in an overlay if it is a non-test file
-and the package would be reported even without the overlay.
+With a go command from Go 1.16 or later, the go list driver passes overlays
+to it, using its -overlay flag. Otherwise, overlay support for the go list
+driver isn't complete: if the file doesn't exist on disk, it will only be
+recognized in an overlay if it is a non-test file and the package would be
+reported even without the overlay.
+Similarly, the DeletedFiles field allows treating files as deleted before the
+deletion is saved to disk.
 
 Questions & Tasks
 
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 
 	"golang.org/x/tools/go/packages"
 )
@@ -32,3 +34,54 @@ func Example() {
 		fmt.Println(pkg.ID, pkg.GoFiles)
 	}
 }
+
+// ExampleConfig_noGoCommand demonstrates how to load and type-check a
+// module whose files exist only in the overlay, without the go command.
+func ExampleConfig_noGoCommand() {
+	dir := filepath.Join(os.TempDir(), "nonexistent", "hello")
+	cfg := &packages.Config{
+		Mode:        packages.NeedName | packages.NeedImports | packages.NeedSyntax | packages.NeedTypes,
+		NoGoCommand: true,
+		RootDirs:    map[string]string{dir: "example.com/hello"},
+		Overlay: map[string][]byte{
+			filepath.Join(dir, "greet", "greet.go"): []byte(`package greet
+
+const Greeting = "hello"
+`),
+			filepath.Join(dir, "shout", "shout.go"): []byte(`package shout
+
+import "example.com/hello/greet"
+
+func Shout() string { return greet.Greeting + "!" }
+`),
+			filepath.Join(dir, "main.go"): []byte(`package main
+
+import "example.com/hello/shout"
+
+var message = shout.Shout()
+
+func main() { println(message) }
+`),
+		},
+	}
+	pkgs, err := packages.Load(cfg, "example.com/hello/...")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load: %v\n", err)
+		os.Exit(1)
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		os.Exit(1)
+	}
+	for _, pkg := range pkgs {
+		var imports []string
+		for path := range pkg.Imports {
+			imports = append(imports, path)
+		}
+		sort.Strings(imports)
+		fmt.Println(pkg.ID, imports, pkg.Types.Scope().Names())
+	}
+	// Output:
+	// example.com/hello [example.com/hello/shout] [main message]
+	// example.com/hello/greet [] [Greeting]
+	// example.com/hello/shout [example.com/hello/greet] [Shout]
+}
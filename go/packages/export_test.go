@@ -0,0 +1,18 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+// SetLegacyOverlay sets whether the go list driver processes overlays
+// itself even if the go command could, and returns a function that
+// restores the previous setting.
+func SetLegacyOverlay(legacy bool) (restore func()) {
+	old := legacyOverlay
+	legacyOverlay = legacy
+	return func() { legacyOverlay = old }
+}
+
+// LegacyOverlay reports whether the go list driver processes overlays
+// itself even if the go command could.
+func LegacyOverlay() bool { return legacyOverlay }
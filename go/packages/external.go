@@ -40,6 +40,8 @@ type driverRequest struct {
 	// Overlay maps file paths (relative to the driver's working directory) to the byte contents
 	// of overlay files.
 	Overlay map[string][]byte `json:"overlay"`
+	// DeletedFiles lists the paths of files that the driver should treat as deleted.
+	DeletedFiles []string `json:"deleted_files"`
 }
 
 // findExternalDriver returns the file path of a tool that supplies
@@ -66,11 +68,12 @@ func findExternalDriver(cfg *Config) driver {
 	}
 	return func(cfg *Config, words ...string) (*driverResponse, error) {
 		req, err := json.Marshal(driverRequest{
-			Mode:       cfg.Mode,
-			Env:        cfg.Env,
-			BuildFlags: cfg.BuildFlags,
-			Tests:      cfg.Tests,
-			Overlay:    cfg.Overlay,
+			Mode:         cfg.Mode,
+			Env:          cfg.Env,
+			BuildFlags:   cfg.BuildFlags,
+			Tests:        cfg.Tests,
+			Overlay:      cfg.overlayMap(),
+			DeletedFiles: cfg.DeletedFiles,
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode message to driver tool: %v", err)
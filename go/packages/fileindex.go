@@ -0,0 +1,72 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A FileIndex maps the files of a package graph to the packages that
+// contain them. It is safe for concurrent use.
+type FileIndex struct {
+	// byBase maps the lower-case base name of each file to the
+	// files with that name and their packages.
+	byBase map[string][]fileOwner
+}
+
+type fileOwner struct {
+	filename string // cleaned
+	pkg      *Package
+}
+
+// NewFileIndex returns an index of the GoFiles, CompiledGoFiles, and
+// OtherFiles of the packages in the import graph whose roots are pkgs.
+func NewFileIndex(pkgs []*Package) *FileIndex {
+	index := &FileIndex{byBase: make(map[string][]fileOwner)}
+	Visit(pkgs, nil, func(pkg *Package) {
+		for _, list := range [][]string{pkg.GoFiles, pkg.CompiledGoFiles, pkg.OtherFiles} {
+			for _, filename := range list {
+				filename = filepath.Clean(filename)
+				base := strings.ToLower(filepath.Base(filename))
+				index.byBase[base] = append(index.byBase[base], fileOwner{filename, pkg})
+			}
+		}
+	})
+	return index
+}
+
+// Owners returns the packages of the index that contain the file
+// filename, ordered by ID, such that a package precedes its test
+// variants. A relative filename is resolved against the current
+// directory. As when the loader matches the files of an Overlay, a
+// file is the same as one of a package if their paths are equal or if
+// they have the same base name, up to case, and denote the same file
+// on disk, as through a symbolic link or on a file system that ignores
+// case. A file that exists only in an overlay is matched by its path.
+func (index *FileIndex) Owners(filename string) []*Package {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	filename = filepath.Clean(filename)
+	var owners []*Package
+	seen := make(map[*Package]bool)
+	for _, o := range index.byBase[strings.ToLower(filepath.Base(filename))] {
+		if !seen[o.pkg] && sameFile(o.filename, filename) {
+			seen[o.pkg] = true
+			owners = append(owners, o.pkg)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].ID < owners[j].ID })
+	return owners
+}
+
+// FileOwners returns the packages in the import graph whose roots are
+// pkgs that contain the file filename, as does the Owners method of
+// NewFileIndex(pkgs). To look up several files, build the index once.
+func FileOwners(pkgs []*Package, filename string) []*Package {
+	return NewFileIndex(pkgs).Owners(filename)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+func TestFileIndex(t *testing.T) { packagestest.TestAll(t, testFileIndex) }
+func testFileIndex(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"a/a_test.go": "package a\n",
+			"a/x_test.go": "package a_test\n",
+			"b/b.go":      "package b\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps
+	exported.Config.Tests = true
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "..", "b", "new.go"): []byte("package b\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := packages.NewFileIndex(initial)
+
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{filepath.Join(dir, "a.go"), "[golang.org/fake/a golang.org/fake/a [golang.org/fake/a.test]]"},
+		{filepath.Join(dir, "a_test.go"), "[golang.org/fake/a [golang.org/fake/a.test]]"},
+		{filepath.Join(dir, "x_test.go"), "[golang.org/fake/a_test [golang.org/fake/a.test]]"},
+		{filepath.Join(dir, "..", "b", ".", "b.go"), "[golang.org/fake/b]"}, // a dependency
+		{filepath.Join(dir, "..", "b", "new.go"), "[golang.org/fake/b]"},    // only in the overlay
+		{filepath.Join(dir, "missing.go"), "[]"},
+	}
+	if runtime.GOOS != "windows" {
+		tmp, err := ioutil.TempDir("", "fileindex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		link := filepath.Join(tmp, "link")
+		if err := os.Symlink(dir, link); err != nil {
+			t.Fatal(err)
+		}
+		tests = append(tests, struct{ filename, want string }{
+			filepath.Join(link, "a_test.go"), "[golang.org/fake/a [golang.org/fake/a.test]]",
+		})
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(index.Owners(test.filename)); got != test.want {
+			t.Errorf("Owners(%s) = %s, want %s", test.filename, got, test.want)
+		}
+		if got := fmt.Sprint(packages.FileOwners(initial, test.filename)); got != test.want {
+			t.Errorf("FileOwners(%s) = %s, want %s", test.filename, got, test.want)
+		}
+	}
+}
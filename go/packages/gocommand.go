@@ -0,0 +1,125 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"golang.org/x/tools/internal/gocommand"
+)
+
+// A GoCommandRunner runs the go commands of the go list driver; see
+// Config.GoCommandRunner.
+//
+// Run runs the go command that inv describes, and returns its standard
+// output and standard error, which may be nil if they are empty. If the
+// command could not be run, or was stopped because ctx was done, the
+// error says so; if it ran and failed, the error must have an
+// ExitCode() int method that returns its exit status, as the
+// *exec.ExitError of a go command that the driver ran itself has, and
+// the outputs are still used, as those of go list -e are. Run may be
+// called from multiple goroutines at once.
+type GoCommandRunner interface {
+	Run(ctx context.Context, inv Invocation) (stdout, stderr io.Reader, err error)
+}
+
+// An Invocation describes a run of the go command.
+type Invocation struct {
+	// Verb is the go command to run, such as "list" or "env", and Args
+	// are its arguments, which follow the BuildFlags, except for the
+	// verb "env", which takes none.
+	Verb       string
+	Args       []string
+	BuildFlags []string
+
+	// Env lists the variables of the Config, which override those of
+	// the process in the environment of the go command.
+	Env []string
+
+	// Dir is the directory in which to run the go command, or "" for
+	// the current directory.
+	Dir string
+
+	// Overlay is the -overlay file among the Args, if any: a JSON file
+	// that the driver writes, whose name differs from load to load.
+	Overlay string
+}
+
+// execRunner is the GoCommandRunner of a Config that has none: it runs
+// the go command of the PATH.
+type execRunner struct {
+	runner           *gocommand.Runner
+	logf             func(format string, args ...interface{})
+	killProcessGroup bool
+}
+
+func (r *execRunner) Run(ctx context.Context, inv Invocation) (io.Reader, io.Reader, error) {
+	stdout, stderr, _, err := r.runner.RunRaw(ctx, gocommand.Invocation{
+		Verb:             inv.Verb,
+		Args:             inv.Args,
+		BuildFlags:       inv.BuildFlags,
+		Env:              inv.Env,
+		WorkingDir:       inv.Dir,
+		Logf:             r.logf,
+		KillProcessGroup: r.killProcessGroup,
+	})
+	return stdout, stderr, err
+}
+
+// goCommandRunner returns the GoCommandRunner of cfg, or an execRunner
+// if it has none.
+func (cfg *Config) goCommandRunner() GoCommandRunner {
+	if cfg.GoCommandRunner != nil {
+		return cfg.GoCommandRunner
+	}
+	runner := cfg.gocmdRunner
+	if runner == nil {
+		runner = &gocommand.Runner{}
+	}
+	return &execRunner{
+		runner:           runner,
+		logf:             cfg.Logf,
+		killProcessGroup: cfg.GoCommandTimeout > 0,
+	}
+}
+
+// runGo runs inv with the GoCommandRunner of state, and returns its
+// outputs.
+func (state *golistState) runGo(ctx context.Context, inv Invocation) (stdout, stderr *bytes.Buffer, err error) {
+	out, errOut, err := state.cfg.goCommandRunner().Run(ctx, inv)
+	return readOutput(out), readOutput(errOut), err
+}
+
+// readOutput returns the contents of r, an output of a GoCommandRunner,
+// which may be nil.
+func readOutput(r io.Reader) *bytes.Buffer {
+	if b, ok := r.(*bytes.Buffer); ok {
+		return b
+	}
+	b := new(bytes.Buffer)
+	if r != nil {
+		b.ReadFrom(r)
+	}
+	return b
+}
+
+// runSizes runs inv, a go command by which packagesdriver determines
+// the sizes of types, with the GoCommandRunner of state, and returns
+// the outputs and errors as gocommand.Runner.RunRaw does.
+func (state *golistState) runSizes(ctx context.Context, inv gocommand.Invocation) (stdout, stderr *bytes.Buffer, friendlyErr, rawErr error) {
+	stdout, stderr, rawErr = state.runGo(ctx, Invocation{
+		Verb:       inv.Verb,
+		Args:       inv.Args,
+		BuildFlags: inv.BuildFlags,
+		Env:        inv.Env,
+		Dir:        inv.WorkingDir,
+	})
+	if rawErr != nil {
+		friendlyErr = gocommand.FriendlyError(ctx, rawErr, stderr)
+	}
+	return stdout, stderr, friendlyErr, rawErr
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+// A recording is the outcome of a go command that a recorder ran.
+type recording struct {
+	stdout, stderr []byte
+	code           int // exit status
+}
+
+// An exitError is the error of a replayed go command that failed.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// A recorder is a GoCommandRunner that runs the go command and records
+// its outputs, or, once replay is set, replays them instead.
+type recorder struct {
+	mu         sync.Mutex
+	replay     bool
+	recordings map[string]recording
+	keys       []string // in the order of the runs
+}
+
+func (r *recorder) Run(ctx context.Context, inv packages.Invocation) (io.Reader, io.Reader, error) {
+	key, err := invocationKey(inv)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, key)
+	if r.replay {
+		rec, ok := r.recordings[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("no recording of %s", key)
+		}
+		if rec.code != 0 {
+			err = exitError(rec.code)
+		}
+		return bytes.NewReader(rec.stdout), bytes.NewReader(rec.stderr), err
+	}
+	args := []string{inv.Verb}
+	if inv.Verb != "env" {
+		args = append(args, inv.BuildFlags...)
+	}
+	cmd := exec.CommandContext(ctx, "go", append(args, inv.Args...)...)
+	cmd.Env = append(os.Environ(), inv.Env...)
+	cmd.Dir = inv.Dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	rec := recording{stdout: stdout.Bytes(), stderr: stderr.Bytes()}
+	if ee, ok := err.(*exec.ExitError); ok {
+		rec.code = ee.ExitCode()
+	} else if err != nil {
+		return nil, nil, err
+	}
+	r.recordings[key] = rec
+	return &stdout, &stderr, err
+}
+
+// invocationKey returns the key of the recording of inv, in which the
+// -overlay file, whose name and replacement files differ from load to
+// load, is replaced by the files it replaces and their contents.
+func invocationKey(inv packages.Invocation) (string, error) {
+	args := append([]string{inv.Verb}, inv.BuildFlags...)
+	for _, arg := range inv.Args {
+		if inv.Overlay == "" || arg != "-overlay="+inv.Overlay {
+			args = append(args, arg)
+			continue
+		}
+		data, err := ioutil.ReadFile(inv.Overlay)
+		if err != nil {
+			return "", err
+		}
+		var overlay struct{ Replace map[string]string }
+		if err := json.Unmarshal(data, &overlay); err != nil {
+			return "", err
+		}
+		var files []string
+		for file, replacement := range overlay.Replace {
+			contents, err := ioutil.ReadFile(replacement)
+			if replacement != "" && err != nil {
+				return "", err
+			}
+			files = append(files, fmt.Sprintf("%s=%q", file, contents))
+		}
+		sort.Strings(files)
+		args = append(args, "-overlay="+strings.Join(files, ","))
+	}
+	return inv.Dir + ": go " + strings.Join(args, " "), nil
+}
+
+// TestGoCommandRunner checks that the loader runs all its go commands
+// with the GoCommandRunner, by replaying those of a load without a go
+// command.
+func TestGoCommandRunner(t *testing.T) { forEachOverlayMode(t, testGoCommandRunner) }
+func testGoCommandRunner(t *testing.T) {
+	exported := packagestest.Export(t, packagestest.Modules, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"b/b.go": "package b\n",
+			"c/c.go": "package c\n",
+		}}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports |
+		packages.NeedDeps | packages.NeedModule | packages.NeedTypesSizes
+	exported.Config.Overlay = map[string][]byte{
+		// A new import, which the driver loads after the overlay
+		// unless the go command applies it.
+		filepath.Join(dir, "a", "a.go"): []byte("package a\n\nimport (\n\t_ \"golang.org/fake/b\"\n\t_ \"golang.org/fake/c\"\n)\n"),
+		// A new package, for whose path the driver lists the modules.
+		filepath.Join(dir, "d", "d.go"): []byte("package d\n"),
+	}
+	r := &recorder{recordings: make(map[string]recording)}
+	exported.Config.GoCommandRunner = r
+	load := func() string {
+		initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		graph, all := importGraph(initial)
+		if p := all["golang.org/fake/a"]; p == nil || p.TypesSizes == nil {
+			t.Errorf("golang.org/fake/a has no sizes")
+		}
+		return graph
+	}
+	recorded := load()
+	wants := []string{"go env ", "{{context.GOARCH}} {{context.Compiler}}"}
+	if !nativeOverlay() {
+		// The driver lists the modules, and the package imported by
+		// the overlay.
+		wants = append(wants, "go list -m -json", "-- golang.org/fake/c")
+	}
+	for _, want := range wants {
+		var found bool
+		for _, key := range r.keys {
+			found = found || strings.Contains(key, want)
+		}
+		if !found {
+			t.Errorf("no recorded go command contains %q: %v", want, r.keys)
+		}
+	}
+
+	// Without a go command in the PATH, the load replays the go
+	// commands that it ran before.
+	empty, err := ioutil.TempDir("", "nogo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", empty)
+	if _, err := exec.LookPath("go"); err == nil {
+		t.Fatal("found a go command in an empty PATH")
+	}
+	r.replay, r.keys = true, nil
+	if replayed := load(); replayed != recorded {
+		t.Errorf("replayed graph:\n%s\nwant:\n%s", replayed, recorded)
+	}
+	if len(r.keys) == 0 {
+		t.Error("no go command was replayed")
+	}
+}
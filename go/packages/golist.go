@@ -9,21 +9,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go/token"
 	"go/types"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"golang.org/x/tools/go/internal/packagesdriver"
-	"golang.org/x/tools/internal/gocommand"
 	"golang.org/x/xerrors"
 )
 
@@ -41,6 +45,10 @@ type responseDeduper struct {
 	seenRoots    map[string]bool
 	seenPackages map[string]*Package
 	dr           *driverResponse
+
+	// overlayImports holds the import paths that the overlay added
+	// to each package; see breakOverlayImportCycles.
+	overlayImports map[*Package][]string
 }
 
 func newDeduper() *responseDeduper {
@@ -69,6 +77,15 @@ func (r *responseDeduper) addPackage(p *Package) {
 	r.dr.Packages = append(r.dr.Packages, p)
 }
 
+// addOverlayImport records that the overlay added the import path imp
+// to the Imports of p.
+func (r *responseDeduper) addOverlayImport(p *Package, imp string) {
+	if r.overlayImports == nil {
+		r.overlayImports = make(map[*Package][]string)
+	}
+	r.overlayImports[p] = append(r.overlayImports[p], imp)
+}
+
 func (r *responseDeduper) addRoot(id string) {
 	if r.seenRoots[id] {
 		return
@@ -91,27 +108,51 @@ type golistState struct {
 
 	// vendorDirs caches the (non)existence of vendor directories.
 	vendorDirs map[string]bool
+
+	overlayOnce  sync.Once
+	overlayError error
+	overlayDir   string // temporary directory holding overlay
+	overlay      string // the file passed to the go command's -overlay flag, if any
+
+	headerMu sync.Mutex
+	fset     *token.FileSet            // see fileSet
+	headers  map[string]*overlayHeader // keyed by file name; see parseHeader
+
+	dirsMu    sync.Mutex
+	canonDirs map[string]string // see canonicalDir
+	foldCase  map[string]bool   // keyed by volume name; see caseInsensitive
+
+	overlayTraced bool              // whether processGolistOverlay has made its first pass
+	overlayTrace  []OverlayDecision // see recordOverlay
 }
 
 // getEnv returns Go environment variables. Only specific variables are
 // populated -- computing all of them is slow.
 func (state *golistState) getEnv() (map[string]string, error) {
 	state.envOnce.Do(func() {
-		var b *bytes.Buffer
-		b, state.goEnvError = state.invokeGo("env", "-json", "GOMOD", "GOPATH")
-		if state.goEnvError != nil {
-			return
-		}
-
-		state.goEnv = make(map[string]string)
-		decoder := json.NewDecoder(b)
-		if state.goEnvError = decoder.Decode(&state.goEnv); state.goEnvError != nil {
-			return
+		if s := state.cfg.session; s != nil {
+			state.goEnv, state.goEnvError = s.getEnv(state.loadEnv)
+		} else {
+			state.goEnv, state.goEnvError = state.loadEnv()
 		}
 	})
 	return state.goEnv, state.goEnvError
 }
 
+// loadEnv runs go env to compute the variables returned by getEnv.
+func (state *golistState) loadEnv() (map[string]string, error) {
+	b, err := state.invokeGo("env", "-json", "GOMOD", "GOPATH", "GOVERSION", "GOWORK", "GOOS", "GOARCH", "CGO_ENABLED",
+		"GOROOT", "GOFLAGS", "GO111MODULE")
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string)
+	if err := json.NewDecoder(b).Decode(&env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
 // mustGetEnv is a convenience function that can be used if getEnv has already succeeded.
 func (state *golistState) mustGetEnv() map[string]string {
 	env, err := state.getEnv()
@@ -135,6 +176,13 @@ func goListDriver(cfg *Config, patterns ...string) (*driverResponse, error) {
 
 	response := newDeduper()
 
+	state := &golistState{
+		cfg:        cfg,
+		ctx:        ctx,
+		vendorDirs: map[string]bool{},
+	}
+	defer state.removeOverlayFile()
+
 	// Fill in response.Sizes asynchronously if necessary.
 	var sizeserr error
 	var sizeswg sync.WaitGroup
@@ -142,19 +190,13 @@ func goListDriver(cfg *Config, patterns ...string) (*driverResponse, error) {
 		sizeswg.Add(1)
 		go func() {
 			var sizes types.Sizes
-			sizes, sizeserr = packagesdriver.GetSizesGolist(ctx, cfg.BuildFlags, cfg.Env, cfg.gocmdRunner, cfg.Dir)
+			sizes, sizeserr = packagesdriver.GetSizesGolistFunc(ctx, cfg.BuildFlags, cfg.Env, state.runSizes, cfg.Dir)
 			// types.SizesFor always returns nil or a *types.StdSizes.
 			response.dr.Sizes, _ = sizes.(*types.StdSizes)
 			sizeswg.Done()
 		}()
 	}
 
-	state := &golistState{
-		cfg:        cfg,
-		ctx:        ctx,
-		vendorDirs: map[string]bool{},
-	}
-
 	// Determine files requested in contains patterns
 	var containFiles []string
 	restPatterns := make([]string, 0, len(patterns))
@@ -169,7 +211,7 @@ extractQueries:
 			query, value := pattern[:eqidx], pattern[eqidx+len("="):]
 			switch query {
 			case "file":
-				containFiles = append(containFiles, value)
+				containFiles = append(containFiles, cfg.overlayQuery(value))
 			case "pattern":
 				restPatterns = append(restPatterns, value)
 			case "": // not a reserved query
@@ -204,10 +246,23 @@ extractQueries:
 		}
 	}
 
-	modifiedPkgs, needPkgs, err := state.processGolistOverlay(response)
+	// Merge the packages that the queries reported more than once, so
+	// that the overlay is applied to only one copy of each.
+	response.mergeDuplicates()
+
+	// Unless the go command has applied the overlay, patch the
+	// response to reflect it.
+	var modifiedPkgs, needPkgs []string
+	native, err := state.nativeOverlay()
 	if err != nil {
 		return nil, err
 	}
+	if !native {
+		modifiedPkgs, needPkgs, err = state.processGolistOverlay(response)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var containsCandidates []string
 	if len(containFiles) > 0 {
@@ -217,6 +272,11 @@ extractQueries:
 	if err := state.addNeededOverlayPackages(response, needPkgs); err != nil {
 		return nil, err
 	}
+	breakOverlayImportCycles(response)
+	if cfg.Mode&NeedDepsErrors != 0 {
+		addOverlayDepsErrors(response)
+	}
+	markOverlayPackages(response, state.cfg)
 	// Check candidate packages for containFiles.
 	if len(containFiles) > 0 {
 		for _, id := range containsCandidates {
@@ -247,6 +307,19 @@ extractQueries:
 	if sizeserr != nil {
 		return nil, sizeserr
 	}
+	if cfg.reportEnv {
+		env, err := state.getEnv()
+		if err != nil {
+			return nil, err
+		}
+		// The environment may be shared with other loads of a Session.
+		response.dr.GoEnv = make(map[string]string, len(env))
+		for k, v := range env {
+			response.dr.GoEnv[k] = v
+		}
+		response.dr.GoVersion, _ = goMinorVersion(env["GOVERSION"])
+		response.dr.OverlayTrace = state.overlayTrace
+	}
 	return response.dr, nil
 }
 
@@ -254,12 +327,34 @@ func (state *golistState) addNeededOverlayPackages(response *responseDeduper, pk
 	if len(pkgs) == 0 {
 		return nil
 	}
-	dr, err := state.createDriverResponse(pkgs...)
+	batches, err := state.batchNeededPackages(pkgs)
 	if err != nil {
 		return err
 	}
-	for _, pkg := range dr.Packages {
-		response.addPackage(pkg)
+	// Run go list for the batches concurrently, but add their packages
+	// to the response in order, so that it does not depend on which
+	// finishes first.
+	results := make([]*driverResponse, len(batches))
+	errs := make([]error, len(batches))
+	limit := make(chan struct{}, state.concurrency())
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			results[i], errs[i] = state.createDriverResponse(batch...)
+		}(i, batch)
+	}
+	wg.Wait()
+	for i := range batches {
+		if errs[i] != nil {
+			return xerrors.Errorf("loading packages needed by the overlay: %w", errs[i])
+		}
+		for _, pkg := range results[i].Packages {
+			response.addPackage(pkg)
+		}
 	}
 	_, needPkgs, err := state.processGolistOverlay(response)
 	if err != nil {
@@ -268,58 +363,210 @@ func (state *golistState) addNeededOverlayPackages(response *responseDeduper, pk
 	return state.addNeededOverlayPackages(response, needPkgs)
 }
 
+// concurrency returns the number of go commands that
+// addNeededOverlayPackages may run at once; see Config.Concurrency.
+func (state *golistState) concurrency() int {
+	if n := state.cfg.Concurrency; n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// batchNeededPackages splits the sorted package paths pkgs, to be
+// loaded by addNeededOverlayPackages, into batches for separate go list
+// commands. The packages of each module root, those of no root (as of
+// the standard library or of modules in the module cache), are
+// grouped, in order of the roots' paths; each group is split into as
+// many batches as may run at once.
+func (state *golistState) batchNeededPackages(pkgs []string) ([][]string, error) {
+	n := state.concurrency()
+	if n == 1 {
+		return [][]string{pkgs}, nil
+	}
+	roots, err := state.determineRootDirs()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for _, pkg := range pkgs {
+		var root string // the longest root path that contains pkg, or ""
+		for _, rpath := range roots {
+			if rpath != "" && len(rpath) > len(root) && (pkg == rpath || strings.HasPrefix(pkg, rpath+"/")) {
+				root = rpath
+			}
+		}
+		groups[root] = append(groups[root], pkg)
+	}
+	var keys []string
+	for root := range groups {
+		keys = append(keys, root)
+	}
+	sort.Strings(keys)
+
+	var batches [][]string
+	for _, root := range keys {
+		group := groups[root]
+		size := (len(group) + n - 1) / n
+		for len(group) > 0 {
+			if size > len(group) {
+				size = len(group)
+			}
+			batches = append(batches, group[:size])
+			group = group[size:]
+		}
+	}
+	return batches, nil
+}
+
+// runContainsQueries adds to the response the packages of the
+// directories of the files of the queries, with those that have the
+// files as roots. It lists all the directories with one go command, and
+// then, one at a time, those for which that finds no package with
+// files, whose files may belong to ad-hoc packages.
 func (state *golistState) runContainsQueries(response *responseDeduper, queries []string) error {
+	var dirs []string
+	queriesOf := make(map[string][]string) // by directory
 	for _, query := range queries {
-		// TODO(matloob): Do only one query per directory.
-		fdir := filepath.Dir(query)
 		// Pass absolute path of directory to go list so that it knows to treat it as a directory,
 		// not a package path.
-		pattern, err := filepath.Abs(fdir)
+		pattern, err := filepath.Abs(filepath.Dir(query))
 		if err != nil {
 			return fmt.Errorf("could not determine absolute path of file= query path %q: %v", query, err)
 		}
+		if _, ok := queriesOf[pattern]; !ok {
+			dirs = append(dirs, pattern)
+		}
+		queriesOf[pattern] = append(queriesOf[pattern], query)
+	}
+
+	alone := dirs
+	if len(dirs) > 1 {
+		// If the go command fails, as it may for a directory that
+		// does not exist, list the directories one at a time.
+		if dirResponse, err := state.createDriverResponse(dirs...); err == nil {
+			found := dirsWithRoots(dirResponse, dirs)
+			alone = nil
+			for _, dir := range dirs {
+				if !found[dir] {
+					alone = append(alone, dir)
+				}
+			}
+			if len(found) > 0 {
+				foundQueries := make(map[string][]string, len(found))
+				for dir := range found {
+					foundQueries[dir] = queriesOf[dir]
+				}
+				addContainsRoots(response, dirResponse, foundQueries)
+			}
+		}
+	}
+
+	for _, pattern := range alone {
 		dirResponse, err := state.createDriverResponse(pattern)
 
 		// If there was an error loading the package, or the package is returned
-		// with errors, try to load the file as an ad-hoc package.
+		// with errors, try to load each file as an ad-hoc package.
 		// Usually the error will appear in a returned package, but may not if we're
 		// in module mode and the ad-hoc is located outside a module.
 		if err != nil || len(dirResponse.Packages) == 1 && len(dirResponse.Packages[0].GoFiles) == 0 &&
 			len(dirResponse.Packages[0].Errors) == 1 {
-			var queryErr error
-			if dirResponse, queryErr = state.adhocPackage(pattern, query); queryErr != nil {
-				return err // return the original error
+			for _, query := range queriesOf[pattern] {
+				adhocResponse, queryErr := state.adhocPackage(pattern, query)
+				if queryErr != nil {
+					return err // return the original error
+				}
+				addContainsRoots(response, adhocResponse, map[string][]string{pattern: {query}})
 			}
+			continue
 		}
-		isRoot := make(map[string]bool, len(dirResponse.Roots))
-		for _, root := range dirResponse.Roots {
-			isRoot[root] = true
+		addContainsRoots(response, dirResponse, map[string][]string{pattern: queriesOf[pattern]})
+	}
+	return nil
+}
+
+// dirsWithRoots returns the directories among dirs that have a root
+// package of dr with Go files.
+func dirsWithRoots(dr *driverResponse, dirs []string) map[string]bool {
+	byReal := make(map[string]string, len(dirs))
+	for _, dir := range dirs {
+		byReal[realDir(dir)] = dir
+	}
+	isRoot := make(map[string]bool, len(dr.Roots))
+	for _, root := range dr.Roots {
+		isRoot[root] = true
+	}
+	found := make(map[string]bool)
+	for _, pkg := range dr.Packages {
+		if !isRoot[pkg.ID] || len(pkg.GoFiles) == 0 {
+			continue
 		}
-		for _, pkg := range dirResponse.Packages {
-			// Add any new packages to the main set
-			// We don't bother to filter packages that will be dropped by the changes of roots,
-			// that will happen anyway during graph construction outside this function.
-			// Over-reporting packages is not a problem.
-			response.addPackage(pkg)
-			// if the package was not a root one, it cannot have the file
-			if !isRoot[pkg.ID] {
-				continue
-			}
-			for _, pkgFile := range pkg.GoFiles {
+		if dir, ok := byReal[realDir(filepath.Dir(pkg.GoFiles[0]))]; ok {
+			found[dir] = true
+		}
+	}
+	return found
+}
+
+// addContainsRoots adds the packages of dr to the response, and as
+// roots those root packages of dr that have one of the files of the
+// queries of their directory, by which queriesOf maps them. If
+// queriesOf has one directory, that of every package is taken to be
+// it, as for a response that lists only it.
+func addContainsRoots(response *responseDeduper, dr *driverResponse, queriesOf map[string][]string) {
+	var only []string
+	byReal := make(map[string]string, len(queriesOf))
+	for dir, queries := range queriesOf {
+		only = queries
+		byReal[realDir(dir)] = dir
+	}
+	response.distinguishAdHoc(dr)
+	isRoot := make(map[string]bool, len(dr.Roots))
+	for _, root := range dr.Roots {
+		isRoot[root] = true
+	}
+	for _, pkg := range dr.Packages {
+		// Add any new packages to the main set
+		// We don't bother to filter packages that will be dropped by the changes of roots,
+		// that will happen anyway during graph construction outside this function.
+		// Over-reporting packages is not a problem.
+		response.addPackage(pkg)
+		// if the package was not a root one, it cannot have the file
+		if !isRoot[pkg.ID] || len(pkg.GoFiles) == 0 {
+			continue
+		}
+		queries := only
+		if len(queriesOf) > 1 {
+			queries = queriesOf[byReal[realDir(filepath.Dir(pkg.GoFiles[0]))]]
+		}
+	files:
+		for _, pkgFile := range pkg.GoFiles {
+			for _, query := range queries {
 				if filepath.Base(query) == filepath.Base(pkgFile) {
 					response.addRoot(pkg.ID)
-					break
+					break files
 				}
 			}
 		}
 	}
-	return nil
 }
 
 // adhocPackage attempts to load or construct an ad-hoc package for a given
 // query, if the original call to the driver produced inadequate results.
+// If the file of the query is in the overlay, the package also has the
+// other files of the overlay in its directory, pattern, that declare the
+// same package, as if they were named on the command line together.
 func (state *golistState) adhocPackage(pattern, query string) (*driverResponse, error) {
-	response, err := state.createDriverResponse(query)
+	files := []string{query}
+	native, err := state.nativeOverlay()
+	if err != nil {
+		return nil, err
+	}
+	if native {
+		// The go command reads the files from the overlay; otherwise
+		// processGolistOverlay adds them to the package.
+		files = append(files, state.adhocOverlayFiles(pattern, query)...)
+	}
+	response, err := state.createDriverResponse(files...)
 	if err != nil {
 		return nil, err
 	}
@@ -346,11 +593,25 @@ func (state *golistState) adhocPackage(pattern, query string) (*driverResponse,
 			if len(response.Packages[0].GoFiles) == 0 {
 				filename := filepath.Join(pattern, filepath.Base(query)) // avoid recomputing abspath
 				// TODO(matloob): check if the file is outside of a root dir?
-				for path := range state.cfg.Overlay {
-					if path == filename {
-						response.Packages[0].Errors = nil
-						response.Packages[0].GoFiles = []string{path}
-						response.Packages[0].CompiledGoFiles = []string{path}
+				if contents, ok := state.cfg.overlayContents(filename); ok {
+					// In GOPATH mode, go list reports the file as
+					// an import path that it cannot find.
+					if pkg := response.Packages[0]; pkg.ID != "command-line-arguments" {
+						for i, root := range response.Roots {
+							if root == pkg.ID {
+								response.Roots[i] = "command-line-arguments"
+							}
+						}
+						pkg.ID = "command-line-arguments"
+						pkg.PkgPath = "command-line-arguments"
+					}
+					response.Packages[0].Errors = nil
+					response.Packages[0].GoFiles = []string{filename}
+					response.Packages[0].CompiledGoFiles = []string{filename}
+					// With its name, processGolistOverlay adds only
+					// the files of the same package to it.
+					if name, err := state.extractPackageName(filename, contents); err == nil {
+						response.Packages[0].Name = name
 					}
 				}
 			}
@@ -359,37 +620,237 @@ func (state *golistState) adhocPackage(pattern, query string) (*driverResponse,
 	return response, nil
 }
 
+// adhocOverlayFiles returns the files of the overlay in the directory
+// dir, other than the file of the query, that declare the same package
+// as it, in sorted order. Test files are not included, as go list does
+// not make them part of an ad-hoc package.
+func (state *golistState) adhocOverlayFiles(dir, query string) []string {
+	filename := filepath.Join(dir, filepath.Base(query))
+	contents, ok := state.cfg.overlayContents(filename)
+	if !ok {
+		return nil
+	}
+	name, err := state.extractPackageName(filename, contents)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, path := range state.cfg.overlayFilenames() {
+		if path == filename || filepath.Dir(path) != dir || !strings.HasSuffix(path, ".go") ||
+			strings.HasSuffix(path, "_test.go") || state.isDeleted(path) {
+			continue
+		}
+		contents, _ := state.cfg.overlayContents(path)
+		if n, err := state.extractPackageName(path, contents); err == nil && n == name {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// isAdHoc reports whether p is an ad-hoc package, made of files named
+// on the command line rather than of a package directory.
+func isAdHoc(p *Package) bool {
+	return p.ID == "command-line-arguments" || strings.HasPrefix(p.ID, "command-line-arguments (")
+}
+
+// distinguishAdHoc gives the ad-hoc packages of the response and of dr,
+// which is to be added to it, distinct IDs if there are ad-hoc packages
+// of more than one directory, which go list would each report as
+// command-line-arguments. Each then has the ID
+// "command-line-arguments (dir)", which does not depend on the order
+// of the queries.
+func (r *responseDeduper) distinguishAdHoc(dr *driverResponse) {
+	var adhoc []*Package
+	dirs := make(map[string]bool)
+	for _, pkgs := range [][]*Package{r.dr.Packages, dr.Packages} {
+		for _, p := range pkgs {
+			if isAdHoc(p) && len(p.GoFiles) > 0 {
+				adhoc = append(adhoc, p)
+				dirs[filepath.Dir(p.GoFiles[0])] = true
+			}
+		}
+	}
+	if len(dirs) < 2 {
+		return
+	}
+	for _, p := range adhoc {
+		id := fmt.Sprintf("command-line-arguments (%s)", filepath.Dir(p.GoFiles[0]))
+		if p.ID == id {
+			continue
+		}
+		old := p.ID
+		p.ID = id
+		if r.seenPackages[old] == p {
+			delete(r.seenPackages, old)
+			r.seenPackages[id] = p
+			if r.seenRoots[old] {
+				delete(r.seenRoots, old)
+				r.seenRoots[id] = true
+				for i, root := range r.dr.Roots {
+					if root == old {
+						r.dr.Roots[i] = id
+					}
+				}
+			}
+			continue
+		}
+		for i, root := range dr.Roots {
+			if root == old {
+				dr.Roots[i] = id
+			}
+		}
+	}
+}
+
+// mergeDuplicates merges the packages of the response that are the same
+// package reported under different IDs, as by a query that names one of
+// its files, which go list reports as command-line-arguments, and by a
+// query that names its directory or import path, or by queries whose IDs
+// differ only in their path separators. The surviving package, which is
+// the one that is not ad-hoc or else the first, gets the files, errors
+// and imports of the others, and takes their place among the roots.
+func (r *responseDeduper) mergeDuplicates() {
+	type key struct{ dir, name string }
+	bySlashID := make(map[string]*Package)
+	byDir := make(map[key]*Package)
+	survivor := make(map[*Package]*Package)
+	for _, p := range r.dr.Packages {
+		if s := bySlashID[filepath.ToSlash(p.ID)]; s != nil {
+			survivor[p] = s
+			continue
+		}
+		bySlashID[filepath.ToSlash(p.ID)] = p
+		// Test variants share the directory and name of the package
+		// they test, but are distinct packages.
+		if isAdHoc(p) || strings.Contains(p.ID, " [") || len(p.GoFiles) == 0 {
+			continue
+		}
+		byDir[key{filepath.Dir(p.GoFiles[0]), p.Name}] = p
+	}
+	for _, p := range r.dr.Packages {
+		if !isAdHoc(p) || survivor[p] != nil || strings.Contains(p.ID, " [") || len(p.GoFiles) == 0 {
+			continue
+		}
+		if s := byDir[key{filepath.Dir(p.GoFiles[0]), p.Name}]; s != nil {
+			survivor[p] = s
+		}
+	}
+	if len(survivor) == 0 {
+		return
+	}
+
+	renamed := make(map[string]string)
+	pkgs := r.dr.Packages[:0]
+	for _, p := range r.dr.Packages {
+		s := survivor[p]
+		if s == nil {
+			pkgs = append(pkgs, p)
+			continue
+		}
+		s.GoFiles = mergeFiles(s.GoFiles, p.GoFiles)
+		s.CompiledGoFiles = mergeFiles(s.CompiledGoFiles, p.CompiledGoFiles)
+		s.OtherFiles = mergeFiles(s.OtherFiles, p.OtherFiles)
+		s.IgnoredFiles = mergeFiles(s.IgnoredFiles, p.IgnoredFiles)
+		s.EmbedPatterns = mergeStrings(s.EmbedPatterns, p.EmbedPatterns)
+		s.EmbedFiles = mergeFiles(s.EmbedFiles, p.EmbedFiles)
+	nextError:
+		for _, err := range p.Errors {
+			for _, e := range s.Errors {
+				if e == err {
+					continue nextError
+				}
+			}
+			s.Errors = append(s.Errors, err)
+		}
+		for path, imp := range p.Imports {
+			if s.Imports == nil {
+				s.Imports = make(map[string]*Package)
+			}
+			if s.Imports[path] == nil {
+				s.Imports[path] = imp
+			}
+		}
+		if s.Module == nil {
+			s.Module = p.Module
+		}
+		if p.ID != s.ID {
+			renamed[p.ID] = s.ID
+			// Later responses that report the package under the
+			// same ID add nothing to it.
+			r.seenPackages[p.ID] = s
+		}
+	}
+	r.dr.Packages = pkgs
+
+	for _, p := range r.dr.Packages {
+		for path, imp := range p.Imports {
+			if id, ok := renamed[imp.ID]; ok {
+				p.Imports[path] = &Package{ID: id}
+			}
+		}
+	}
+	roots := r.dr.Roots[:0]
+	r.seenRoots = make(map[string]bool)
+	for _, id := range r.dr.Roots {
+		if s, ok := renamed[id]; ok {
+			id = s
+		}
+		if !r.seenRoots[id] {
+			r.seenRoots[id] = true
+			roots = append(roots, id)
+		}
+	}
+	r.dr.Roots = roots
+}
+
+// mergeFiles returns the files of a followed by those of b that are not
+// among them.
+func mergeFiles(a, b []string) []string {
+	for _, f := range b {
+		if !containsFile(a, f) {
+			a = append(a, f)
+		}
+	}
+	return a
+}
+
 // Fields must match go list;
 // see $GOROOT/src/cmd/go/internal/load/pkg.go.
 type jsonPackage struct {
-	ImportPath      string
-	Dir             string
-	Name            string
-	Export          string
-	GoFiles         []string
-	CompiledGoFiles []string
-	CFiles          []string
-	CgoFiles        []string
-	CXXFiles        []string
-	MFiles          []string
-	HFiles          []string
-	FFiles          []string
-	SFiles          []string
-	SwigFiles       []string
-	SwigCXXFiles    []string
-	SysoFiles       []string
-	Imports         []string
-	ImportMap       map[string]string
-	Deps            []string
-	Module          *Module
-	TestGoFiles     []string
-	TestImports     []string
-	XTestGoFiles    []string
-	XTestImports    []string
-	ForTest         string // q in a "p [q.test]" package, else ""
-	DepOnly         bool
-
-	Error *jsonPackageError
+	ImportPath         string
+	Dir                string
+	Name               string
+	Export             string
+	GoFiles            []string
+	CompiledGoFiles    []string
+	CFiles             []string
+	CgoFiles           []string
+	CXXFiles           []string
+	MFiles             []string
+	HFiles             []string
+	FFiles             []string
+	SFiles             []string
+	SwigFiles          []string
+	SwigCXXFiles       []string
+	SysoFiles          []string
+	Imports            []string
+	ImportMap          map[string]string
+	Module             *Module
+	IgnoredGoFiles     []string
+	IgnoredOtherFiles  []string
+	EmbedPatterns      []string
+	EmbedFiles         []string
+	TestEmbedPatterns  []string
+	TestEmbedFiles     []string
+	XTestEmbedPatterns []string
+	XTestEmbedFiles    []string
+	ForTest            string // q in a "p [q.test]" package, else ""
+	DepOnly            bool
+
+	Error      *jsonPackageError
+	DepsErrors []*jsonPackageError
 }
 
 type jsonPackageError struct {
@@ -402,6 +863,95 @@ func otherFiles(p *jsonPackage) [][]string {
 	return [][]string{p.CFiles, p.CXXFiles, p.MFiles, p.HFiles, p.FFiles, p.SFiles, p.SwigFiles, p.SwigCXXFiles, p.SysoFiles}
 }
 
+// embeds returns the embed patterns and the absolute paths of the
+// embedded files of the package p of go list, whose package path is
+// pkgPath. go list reports the files, but not the patterns, of the test
+// files of a test variant among its own, and the patterns of an x test,
+// xtestPatterns, among those of the package under test, if it was
+// listed before it.
+func embeds(p *jsonPackage, pkgPath string, xtestPatterns []string) (patterns, files []string) {
+	patterns = append([]string(nil), p.EmbedPatterns...)
+	files = append([]string(nil), p.EmbedFiles...)
+	switch {
+	case p.ForTest == "":
+	case pkgPath == p.ForTest:
+		patterns = mergeStrings(patterns, p.TestEmbedPatterns)
+		files = mergeStrings(files, p.TestEmbedFiles)
+	case pkgPath == p.ForTest+"_test":
+		patterns = mergeStrings(patterns, p.XTestEmbedPatterns)
+		files = mergeStrings(files, p.XTestEmbedFiles)
+		patterns = mergeStrings(patterns, xtestPatterns)
+	}
+	return patterns, absJoin(p.Dir, files)
+}
+
+// mergeStrings returns the strings of a followed by those of b that are
+// not among them.
+func mergeStrings(a, b []string) []string {
+	for _, s := range b {
+		if !containsString(a, s) {
+			a = append(a, s)
+		}
+	}
+	return a
+}
+
+// An interner shares the strings, modules and import stubs that the
+// packages of a go list response have in common, such as the paths of
+// the files of a package and of its test variants, or the IDs of the
+// packages that many import, so that the response holds one copy of
+// each. The stubs are not modified; an import is resolved by replacing
+// its stub.
+type interner struct {
+	strings map[string]string
+	modules map[string]*Module  // keyed by path and version, which go list reports once
+	stubs   map[string]*Package // keyed by ID
+}
+
+func newInterner() *interner {
+	return &interner{
+		strings: make(map[string]string),
+		modules: make(map[string]*Module),
+		stubs:   make(map[string]*Package),
+	}
+}
+
+func (in *interner) str(s string) string {
+	if t, ok := in.strings[s]; ok {
+		return t
+	}
+	in.strings[s] = s
+	return s
+}
+
+// strs interns the strings of list in place.
+func (in *interner) strs(list []string) {
+	for i, s := range list {
+		list[i] = in.str(s)
+	}
+}
+
+func (in *interner) module(m *Module) *Module {
+	if m == nil {
+		return nil
+	}
+	key := m.Path + "@" + m.Version
+	if n, ok := in.modules[key]; ok {
+		return n
+	}
+	in.modules[key] = m
+	return m
+}
+
+func (in *interner) stub(id string) *Package {
+	if p, ok := in.stubs[id]; ok {
+		return p
+	}
+	p := &Package{ID: in.str(id)}
+	in.stubs[id] = p
+	return p
+}
+
 // createDriverResponse uses the "go list" command to expand the pattern
 // words and return a response for the specified packages.
 func (state *golistState) createDriverResponse(words ...string) (*driverResponse, error) {
@@ -422,12 +972,21 @@ func (state *golistState) createDriverResponse(words ...string) (*driverResponse
 	if err != nil {
 		return nil, err
 	}
-	seen := make(map[string]*jsonPackage)
+	return state.decodeGoList(buf)
+}
+
+// decodeGoList returns the response for the JSON of the packages that
+// go list writes to r.
+func (state *golistState) decodeGoList(r io.Reader) (*driverResponse, error) {
+	// The JSON of each package is decoded and converted in turn, and
+	// only what later packages need of it is kept; see listedPackage.
+	seen := make(map[string]*listedPackage)
 	pkgs := make(map[string]*Package)
+	in := newInterner()
 	additionalErrors := make(map[string][]Error)
 	// Decode the JSON and convert it to Package form.
 	var response driverResponse
-	for dec := json.NewDecoder(buf); dec.More(); {
+	for dec := json.NewDecoder(r); dec.More(); {
 		p := new(jsonPackage)
 		if err := dec.Decode(p); err != nil {
 			return nil, fmt.Errorf("JSON decoding failed: %v", err)
@@ -464,6 +1023,7 @@ func (state *golistState) createDriverResponse(words ...string) (*driverResponse
 			}
 		}
 
+		pkg := state.convertPackage(p, seen, in)
 		if old, found := seen[p.ImportPath]; found {
 			// If one version of the package has an error, and the other doesn't, assume
 			// that this is a case where go list is reporting a fake dependency variant
@@ -485,7 +1045,7 @@ func (state *golistState) createDriverResponse(words ...string) (*driverResponse
 			// There should be exactly one version of a package that doesn't have an
 			// error.
 			if old.Error == nil && p.Error == nil {
-				if !reflect.DeepEqual(p, old) {
+				if !reflect.DeepEqual(pkg, pkgs[pkg.ID]) {
 					return nil, fmt.Errorf("internal error: go list gives conflicting information for package %v", p.ImportPath)
 				}
 				continue
@@ -506,7 +1066,7 @@ func (state *golistState) createDriverResponse(words ...string) (*driverResponse
 						return nil, fmt.Errorf(`internal error: go list gave a %q error with empty import stack`, errkind)
 					}
 					importingPkg := old.Error.ImportStack[len(old.Error.ImportStack)-1]
-					if importingPkg == old.ImportPath {
+					if importingPkg == p.ImportPath {
 						// Using an older version of Go which put this package itself on top of import
 						// stack, instead of the importer. Look for importer in second from top
 						// position.
@@ -531,173 +1091,244 @@ func (state *golistState) createDriverResponse(words ...string) (*driverResponse
 
 			// This package will replace the old one at the end of the loop.
 		}
-		seen[p.ImportPath] = p
-
-		pkg := &Package{
-			Name:            p.Name,
-			ID:              p.ImportPath,
-			GoFiles:         absJoin(p.Dir, p.GoFiles, p.CgoFiles),
-			CompiledGoFiles: absJoin(p.Dir, p.CompiledGoFiles),
-			OtherFiles:      absJoin(p.Dir, otherFiles(p)...),
-			forTest:         p.ForTest,
-			Module:          p.Module,
-		}
-
-		if (state.cfg.Mode&typecheckCgo) != 0 && len(p.CgoFiles) != 0 {
-			if len(p.CompiledGoFiles) > len(p.GoFiles) {
-				// We need the cgo definitions, which are in the first
-				// CompiledGoFile after the non-cgo ones. This is a hack but there
-				// isn't currently a better way to find it. We also need the pure
-				// Go files and unprocessed cgo files, all of which are already
-				// in pkg.GoFiles.
-				cgoTypes := p.CompiledGoFiles[len(p.GoFiles)]
-				pkg.CompiledGoFiles = append([]string{cgoTypes}, pkg.GoFiles...)
-			} else {
-				// golang/go#38990: go list silently fails to do cgo processing
-				pkg.CompiledGoFiles = nil
-				pkg.Errors = append(pkg.Errors, Error{
-					Msg:  "go list failed to return CompiledGoFiles; https://golang.org/issue/38990?",
-					Kind: ListError,
-				})
-			}
+		seen[p.ImportPath] = &listedPackage{
+			Error:              p.Error,
+			xtestEmbedPatterns: p.XTestEmbedPatterns,
 		}
-
-		// Work around https://golang.org/issue/28749:
-		// cmd/go puts assembly, C, and C++ files in CompiledGoFiles.
-		// Filter out any elements of CompiledGoFiles that are also in OtherFiles.
-		// We have to keep this workaround in place until go1.12 is a distant memory.
-		if len(pkg.OtherFiles) > 0 {
-			other := make(map[string]bool, len(pkg.OtherFiles))
-			for _, f := range pkg.OtherFiles {
-				other[f] = true
-			}
-
-			out := pkg.CompiledGoFiles[:0]
-			for _, f := range pkg.CompiledGoFiles {
-				if other[f] {
-					continue
-				}
-				out = append(out, f)
-			}
-			pkg.CompiledGoFiles = out
+		if !p.DepOnly {
+			response.Roots = append(response.Roots, pkg.ID)
 		}
+		pkgs[pkg.ID] = pkg
+	}
 
-		// Extract the PkgPath from the package's ID.
-		if i := strings.IndexByte(pkg.ID, ' '); i >= 0 {
-			pkg.PkgPath = pkg.ID[:i]
-		} else {
-			pkg.PkgPath = pkg.ID
+	for id, errs := range additionalErrors {
+		if p, ok := pkgs[id]; ok {
+			p.Errors = append(p.Errors, errs...)
 		}
+	}
+	for _, pkg := range pkgs {
+		response.Packages = append(response.Packages, pkg)
+	}
+	sort.Slice(response.Packages, func(i, j int) bool { return response.Packages[i].ID < response.Packages[j].ID })
 
-		if pkg.PkgPath == "unsafe" {
-			pkg.GoFiles = nil // ignore fake unsafe.go file
-		}
+	return &response, nil
+}
 
-		// Assume go list emits only absolute paths for Dir.
-		if p.Dir != "" && !filepath.IsAbs(p.Dir) {
-			log.Fatalf("internal error: go list returned non-absolute Package.Dir: %s", p.Dir)
-		}
+// A listedPackage is what decodeGoList keeps of a package of go list
+// once it has converted it: the error with which later packages of the
+// same path are compared, and the embed patterns of its x test, which
+// go list reports among its own.
+type listedPackage struct {
+	Error              *jsonPackageError
+	xtestEmbedPatterns []string
+}
+
+// convertPackage returns the Package of the package p of go list. It
+// drops the information that the Mode does not need, and shares the
+// strings, modules and import stubs that it has in common with the
+// other packages of the response through in.
+func (state *golistState) convertPackage(p *jsonPackage, seen map[string]*listedPackage, in *interner) *Package {
+	pkg := &Package{
+		Name:            p.Name,
+		ID:              in.str(p.ImportPath),
+		GoFiles:         absJoin(p.Dir, p.GoFiles, p.CgoFiles),
+		CompiledGoFiles: absJoin(p.Dir, p.CompiledGoFiles),
+		OtherFiles:      absJoin(p.Dir, otherFiles(p)...),
+		IgnoredFiles:    absJoin(p.Dir, p.IgnoredGoFiles, p.IgnoredOtherFiles),
+		forTest:         in.str(p.ForTest),
+		Module:          in.module(p.Module),
+	}
+	if p.Module != nil {
+		pkg.GoVersion = langVersion(p.Module.GoVersion)
+	}
 
-		if p.Export != "" && !filepath.IsAbs(p.Export) {
-			pkg.ExportFile = filepath.Join(p.Dir, p.Export)
+	if (state.cfg.Mode&typecheckCgo) != 0 && len(p.CgoFiles) != 0 {
+		if len(p.CompiledGoFiles) > len(p.GoFiles) {
+			// We need the cgo definitions, which are in the first
+			// CompiledGoFile after the non-cgo ones. This is a hack but there
+			// isn't currently a better way to find it. We also need the pure
+			// Go files and unprocessed cgo files, all of which are already
+			// in pkg.GoFiles.
+			cgoTypes := p.CompiledGoFiles[len(p.GoFiles)]
+			pkg.CompiledGoFiles = append([]string{cgoTypes}, pkg.GoFiles...)
 		} else {
-			pkg.ExportFile = p.Export
+			// golang/go#38990: go list silently fails to do cgo processing
+			pkg.CompiledGoFiles = nil
+			pkg.Errors = append(pkg.Errors, Error{
+				Msg:  "go list failed to return CompiledGoFiles; https://golang.org/issue/38990?",
+				Kind: ListError,
+			})
 		}
+	}
 
-		// imports
-		//
-		// Imports contains the IDs of all imported packages.
-		// ImportsMap records (path, ID) only where they differ.
-		ids := make(map[string]bool)
-		for _, id := range p.Imports {
-			ids[id] = true
-		}
-		pkg.Imports = make(map[string]*Package)
-		for path, id := range p.ImportMap {
-			pkg.Imports[path] = &Package{ID: id} // non-identity import
-			delete(ids, id)
-		}
-		for id := range ids {
-			if id == "C" {
+	// Work around https://golang.org/issue/28749:
+	// cmd/go puts assembly, C, and C++ files in CompiledGoFiles.
+	// Filter out any elements of CompiledGoFiles that are also in OtherFiles.
+	// We have to keep this workaround in place until go1.12 is a distant memory.
+	if len(pkg.OtherFiles) > 0 {
+		other := make(map[string]bool, len(pkg.OtherFiles))
+		for _, f := range pkg.OtherFiles {
+			other[f] = true
+		}
+
+		out := pkg.CompiledGoFiles[:0]
+		for _, f := range pkg.CompiledGoFiles {
+			if other[f] {
 				continue
 			}
-
-			pkg.Imports[id] = &Package{ID: id} // identity import
-		}
-		if !p.DepOnly {
-			response.Roots = append(response.Roots, pkg.ID)
+			out = append(out, f)
 		}
+		pkg.CompiledGoFiles = out
+	}
+	if state.cfg.Mode&NeedFiles == 0 {
+		pkg.OtherFiles, pkg.IgnoredFiles = nil, nil
+	}
+
+	// Extract the PkgPath from the package's ID.
+	if i := strings.IndexByte(pkg.ID, ' '); i >= 0 {
+		pkg.PkgPath = pkg.ID[:i]
+	} else {
+		pkg.PkgPath = pkg.ID
+	}
 
-		// Work around for pre-go.1.11 versions of go list.
-		// TODO(matloob): they should be handled by the fallback.
-		// Can we delete this?
-		if len(pkg.CompiledGoFiles) == 0 {
-			pkg.CompiledGoFiles = pkg.GoFiles
+	if state.cfg.Mode&(NeedEmbedFiles|NeedEmbedPatterns) != 0 {
+		var xtest []string
+		if q := seen[p.ForTest]; q != nil {
+			xtest = q.xtestEmbedPatterns
 		}
+		pkg.EmbedPatterns, pkg.EmbedFiles = embeds(p, pkg.PkgPath, xtest)
+	}
 
-		if p.Error != nil {
-			msg := strings.TrimSpace(p.Error.Err) // Trim to work around golang.org/issue/32363.
-			// Address golang.org/issue/35964 by appending import stack to error message.
-			if msg == "import cycle not allowed" && len(p.Error.ImportStack) != 0 {
-				msg += fmt.Sprintf(": import stack: %v", p.Error.ImportStack)
-			}
-			pkg.Errors = append(pkg.Errors, Error{
-				Pos:  p.Error.Pos,
-				Msg:  msg,
-				Kind: ListError,
-			})
+	if pkg.PkgPath == "unsafe" {
+		pkg.GoFiles = nil // ignore fake unsafe.go file
+	}
+
+	// Assume go list emits only absolute paths for Dir.
+	if p.Dir != "" && !filepath.IsAbs(p.Dir) {
+		log.Fatalf("internal error: go list returned non-absolute Package.Dir: %s", p.Dir)
+	}
+
+	if p.Export != "" && !filepath.IsAbs(p.Export) {
+		pkg.ExportFile = filepath.Join(p.Dir, p.Export)
+	} else {
+		pkg.ExportFile = p.Export
+	}
+
+	// imports
+	//
+	// Imports contains the IDs of all imported packages.
+	// ImportsMap records (path, ID) only where they differ.
+	ids := make(map[string]bool)
+	for _, id := range p.Imports {
+		ids[id] = true
+	}
+	pkg.Imports = make(map[string]*Package)
+	for path, id := range p.ImportMap {
+		pkg.Imports[in.str(path)] = in.stub(id) // non-identity import
+		delete(ids, id)
+	}
+	for id := range ids {
+		if id == "C" {
+			continue
 		}
 
-		pkgs[pkg.ID] = pkg
+		pkg.Imports[in.str(id)] = in.stub(id) // identity import
+	}
+	// Work around for pre-go.1.11 versions of go list.
+	// TODO(matloob): they should be handled by the fallback.
+	// Can we delete this?
+	if len(pkg.CompiledGoFiles) == 0 {
+		pkg.CompiledGoFiles = pkg.GoFiles
+	}
+	pkg.Name = in.str(pkg.Name)
+	for _, files := range [][]string{pkg.GoFiles, pkg.CompiledGoFiles, pkg.OtherFiles, pkg.IgnoredFiles, pkg.EmbedFiles} {
+		in.strs(files)
 	}
 
-	for id, errs := range additionalErrors {
-		if p, ok := pkgs[id]; ok {
-			p.Errors = append(p.Errors, errs...)
+	if p.Error != nil {
+		msg := strings.TrimSpace(p.Error.Err) // Trim to work around golang.org/issue/32363.
+		// Address golang.org/issue/35964 by appending import stack to error message.
+		if msg == "import cycle not allowed" && len(p.Error.ImportStack) != 0 {
+			msg += fmt.Sprintf(": import stack: %v", p.Error.ImportStack)
 		}
+		pkg.Errors = append(pkg.Errors, Error{
+			Pos:  p.Error.Pos,
+			Msg:  msg,
+			Kind: ListError,
+		})
 	}
-	for _, pkg := range pkgs {
-		response.Packages = append(response.Packages, pkg)
+	if state.cfg.Mode&NeedDepsErrors != 0 {
+		for _, err := range p.DepsErrors {
+			pkg.DepsErrors = append(pkg.DepsErrors, Error{
+				Pos:  err.Pos,
+				Msg:  strings.TrimSpace(err.Err),
+				Kind: ListError,
+			})
+		}
 	}
-	sort.Slice(response.Packages, func(i, j int) bool { return response.Packages[i].ID < response.Packages[j].ID })
 
-	return &response, nil
+	return pkg
 }
 
 // getPkgPath finds the package path of a directory if it's relative to a root directory.
 func (state *golistState) getPkgPath(dir string) (string, bool, error) {
-	absDir, err := filepath.Abs(dir)
+	rdir, rpath, err := state.getRoot(dir)
 	if err != nil {
 		return "", false, err
 	}
-	roots, err := state.determineRootDirs()
+	if rdir == "" {
+		return "", false, nil
+	}
+	absDir, err := filepath.Abs(dir)
 	if err != nil {
 		return "", false, err
 	}
+	r, ok := state.relToRoot(absDir, rdir)
+	if !ok {
+		return "", false, nil
+	}
+	if rpath != "" {
+		// We choose only one root even though the directory even it can belong in multiple modules
+		// or GOPATH entries. This is okay because we only need to work with absolute dirs when a
+		// file is missing from disk, for instance when gopls calls go/packages in an overlay.
+		// Once the file is saved, gopls, or the next invocation of the tool will get the correct
+		// result straight from golist.
+		return path.Join(rpath, filepath.ToSlash(r)), true, nil
+	}
+	return filepath.ToSlash(r), true, nil
+}
 
-	for rdir, rpath := range roots {
+// getRoot returns the root directory that contains the directory dir,
+// and the path of the root (see determineRootDirs), or "" if there is
+// none. Of the roots that contain the directory, either lexically or
+// once their symbolic links are resolved (see relToRoot), it chooses
+// the innermost, such as that of a module nested within another.
+func (state *golistState) getRoot(dir string) (rdir, rpath string, err error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	roots, err := state.determineRootDirs()
+	if err != nil {
+		return "", "", err
+	}
+	for d := range roots {
 		// Make sure that the directory is in the module,
 		// to avoid creating a path relative to another module.
-		if !strings.HasPrefix(absDir, rdir) {
-			continue
-		}
-		// TODO(matloob): This doesn't properly handle symlinks.
-		r, err := filepath.Rel(rdir, dir)
-		if err != nil {
-			continue
-		}
-		if rpath != "" {
-			// We choose only one root even though the directory even it can belong in multiple modules
-			// or GOPATH entries. This is okay because we only need to work with absolute dirs when a
-			// file is missing from disk, for instance when gopls calls go/packages in an overlay.
-			// Once the file is saved, gopls, or the next invocation of the tool will get the correct
-			// result straight from golist.
-			// TODO(matloob): Implement module tiebreaking?
-			return path.Join(rpath, filepath.ToSlash(r)), true, nil
+		if _, ok := state.relToRoot(absDir, d); ok && len(d) > len(rdir) {
+			rdir = d
 		}
-		return filepath.ToSlash(r), true, nil
 	}
-	return "", false, nil
+	return rdir, roots[rdir], nil
+}
+
+// inDir reports whether the directory dir is root or one of its
+// subdirectories. Both must be clean.
+func inDir(dir, root string) bool {
+	if !strings.HasPrefix(dir, root) {
+		return false
+	}
+	return len(dir) == len(root) || dir[len(root)] == filepath.Separator || strings.HasSuffix(root, string(filepath.Separator))
 }
 
 // absJoin absolutizes and flattens the lists of files.
@@ -731,30 +1362,85 @@ func golistargs(cfg *Config, words []string) []string {
 	return fullargs
 }
 
+// transientGoError matches the errors of a go command that ran at the
+// same time as another one that updated go.sum or held a lock on one of
+// the module files.
+var transientGoError = regexp.MustCompile(`(?m)^go: (updates to go\.sum needed|R?Lock .*: .*)`)
+
 // invokeGo returns the stdout of a go command invocation.
 func (state *golistState) invokeGo(verb string, args ...string) (*bytes.Buffer, error) {
 	cfg := state.cfg
 
-	inv := gocommand.Invocation{
+	// The go env command, which overlayFile runs, takes no -overlay flag.
+	var overlay string
+	if verb != "env" {
+		var err error
+		overlay, err = state.overlayFile()
+		if err != nil {
+			return nil, err
+		}
+		if overlay != "" {
+			args = append([]string{"-overlay=" + overlay}, args...)
+		}
+	}
+
+	inv := Invocation{
 		Verb:       verb,
 		Args:       args,
 		BuildFlags: cfg.BuildFlags,
 		Env:        cfg.Env,
-		Logf:       cfg.Logf,
-		WorkingDir: cfg.Dir,
+		Dir:        cfg.Dir,
+		Overlay:    overlay,
+	}
+	ctx := state.ctx
+	if ctx == nil {
+		ctx = cfg.Context
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, xerrors.Errorf("go %s not run: %w", verb, err)
 	}
-	gocmdRunner := cfg.gocmdRunner
-	if gocmdRunner == nil {
-		gocmdRunner = &gocommand.Runner{}
+	var stdout, stderr *bytes.Buffer
+	var err error
+	for retried := false; ; retried = true {
+		runCtx, cancel := ctx, context.CancelFunc(func() {})
+		if cfg.GoCommandTimeout > 0 {
+			runCtx, cancel = context.WithTimeout(ctx, cfg.GoCommandTimeout)
+		}
+		start := time.Now()
+		stdout, stderr, err = state.runGo(runCtx, inv)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			// The go command was killed, or not started, because the
+			// load was cancelled.
+			return nil, xerrors.Errorf("go %s interrupted: %w", verb, ctx.Err())
+		}
+		if err != nil && runCtx.Err() != nil {
+			return nil, xerrors.Errorf("go %s timed out after %v: %w",
+				strings.Join(append([]string{verb}, args...), " "), time.Since(start).Round(time.Millisecond), runCtx.Err())
+		}
+		// A go command that fails to update go.sum, or to lock a file,
+		// because another one is running at the same time, usually
+		// succeeds if run again.
+		if err == nil || retried || !transientGoError.MatchString(stderr.String()) {
+			break
+		}
 	}
-	stdout, stderr, _, err := gocmdRunner.RunRaw(cfg.Context, inv)
 	if err != nil {
 		// Check for 'go' executable not being found.
 		if ee, ok := err.(*exec.Error); ok && ee.Err == exec.ErrNotFound {
 			return nil, fmt.Errorf("'go list' driver requires 'go', but %s", exec.ErrNotFound)
 		}
 
-		exitErr, ok := err.(*exec.ExitError)
+		// A GoCommandRunner other than that of the go command reports
+		// the failure of a command it ran by an error that has the
+		// exit status, as an *exec.ExitError does.
+		_, ok := err.(*exec.ExitError)
+		if _, hasCode := err.(interface{ ExitCode() int }); hasCode {
+			ok = true
+		}
 		if !ok {
 			// Catastrophic error:
 			// - context cancellation
@@ -763,7 +1449,7 @@ func (state *golistState) invokeGo(verb string, args ...string) (*bytes.Buffer,
 
 		// Old go version?
 		if strings.Contains(stderr.String(), "flag provided but not defined") {
-			return nil, goTooOldError{fmt.Errorf("unsupported version of go: %s: %s", exitErr, stderr)}
+			return nil, goTooOldError{fmt.Errorf("unsupported version of go: %s: %s", err, stderr)}
 		}
 
 		// Related to #24854
@@ -787,10 +1473,12 @@ func (state *golistState) invokeGo(verb string, args ...string) (*bytes.Buffer,
 		if len(stderr.String()) > 0 && strings.HasPrefix(stderr.String(), "# ") {
 			msg := stderr.String()[len("# "):]
 			if strings.HasPrefix(strings.TrimLeftFunc(msg, isPkgPathRune), "\n") {
+				state.reportWarnings(verb, args, stderr)
 				return stdout, nil
 			}
 			// Treat pkg-config errors as a special case (golang.org/issue/36770).
 			if strings.HasPrefix(msg, "pkg-config") {
+				state.reportWarnings(verb, args, stderr)
 				return stdout, nil
 			}
 		}
@@ -876,12 +1564,49 @@ func (state *golistState) invokeGo(verb string, args ...string) (*bytes.Buffer,
 		// TODO(matloob): Remove these once we can depend on go list to exit with a zero status with -e even when
 		// packages don't exist or a build fails.
 		if !usesExportData(cfg) && !containsGoFile(args) {
-			return nil, fmt.Errorf("go %v: %s: %s", args, exitErr, stderr)
+			return nil, fmt.Errorf("go %v: %s: %s", args, err, stderr)
 		}
 	}
+	state.reportWarnings(verb, args, stderr)
 	return stdout, nil
 }
 
+// reportWarnings passes each line of the standard error of a go
+// command that did not fail to the Config's WarningHandler, if any.
+func (state *golistState) reportWarnings(verb string, args []string, stderr *bytes.Buffer) {
+	handler := state.cfg.WarningHandler
+	if handler == nil || stderr.Len() == 0 {
+		return
+	}
+	cmd := "go " + strings.Join(append([]string{verb}, args...), " ")
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		handler(DriverWarning{Cmd: cmd, Kind: warningKind(line), Text: line})
+	}
+}
+
+// warningKind classifies a line of the standard error of the go
+// command by the messages it is known to print.
+func warningKind(line string) WarningKind {
+	switch {
+	case strings.HasPrefix(line, "go: downloading go1"),
+		strings.HasPrefix(line, "go: switching to "),
+		strings.Contains(line, "toolchain"):
+		return ToolchainWarning
+	case strings.HasPrefix(line, "go: finding "),
+		strings.HasPrefix(line, "go: downloading "),
+		strings.HasPrefix(line, "go: extracting "),
+		strings.HasPrefix(line, "go: found "):
+		return ModuleWarning
+	case strings.Contains(line, "GOFLAGS"):
+		return FlagsWarning
+	}
+	return UnknownWarning
+}
+
 func containsGoFile(s []string) bool {
 	for _, f := range s {
 		if strings.HasSuffix(f, ".go") {
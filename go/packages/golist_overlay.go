@@ -1,35 +1,58 @@
 package packages
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"go/ast"
+	"go/build"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/xerrors"
 )
 
 // processGolistOverlay provides rudimentary support for adding
 // files that don't exist on disk to an overlay. The results can be
 // sometimes incorrect.
+// The IDs of the modified packages and the paths of the needed ones
+// are returned in sorted order, so that the go list invocations that
+// follow from them do not vary from run to run.
 // TODO(matloob): Handle unsupported cases, including the following:
 // - determining the correct package to add given a new import path
+// - creating the test main package of a test variant created by the overlay
 func (state *golistState) processGolistOverlay(response *responseDeduper) (modifiedPkgs, needPkgs []string, err error) {
 	havePkgs := make(map[string]string) // importPath -> non-test package ID
 	needPkgsSet := make(map[string]bool)
 	modifiedPkgsSet := make(map[string]bool)
+	movedFrom := make(map[*Package]map[string]bool) // files of each package that now belong to another
 
 	pkgOfDir := make(map[string][]*Package)
+	index := newDirIndex(response.dr.Packages)
+	index.sameDir = state.sameDir
 	for _, pkg := range response.dr.Packages {
 		// This is an approximation of import path to id. This can be
 		// wrong for tests, vendored packages, and a number of other cases.
 		havePkgs[pkg.PkgPath] = pkg.ID
+		// An ad-hoc package is not renamed after the package clauses
+		// of the other files in its directory.
 		x := commonDir(pkg.GoFiles)
-		if x != "" {
+		if x != "" && !isAdHoc(pkg) {
+			x = state.canonicalDir(x)
 			pkgOfDir[x] = append(pkgOfDir[x], pkg)
 		}
 	}
@@ -41,67 +64,172 @@ func (state *golistState) processGolistOverlay(response *responseDeduper) (modif
 	// potentially modifying the transitive set of dependencies).
 	var overlayAddsImports bool
 
+	// Overlay files that build constraints exclude belong to the
+	// IgnoredFiles of the packages in their directories.
+	ctxt := state.buildContext()
+
 	// If both a package and its test package are created by the overlay, we
 	// need the real package first. Process all non-test files before test
 	// files, and make the whole process deterministic while we're at it.
+	// The files other than Go files, which belong to the packages of the
+	// Go files, come last.
 	var overlayFiles []string
-	for opath := range state.cfg.Overlay {
-		overlayFiles = append(overlayFiles, opath)
+	overlayFiles = append(overlayFiles, state.cfg.overlayFilenames()...)
+	rank := func(filename string) int {
+		switch {
+		case strings.HasSuffix(filename, "_test.go"):
+			return 1
+		case strings.HasSuffix(filename, ".go"):
+			return 0
+		}
+		return 2
 	}
 	sort.Slice(overlayFiles, func(i, j int) bool {
-		iTest := strings.HasSuffix(overlayFiles[i], "_test.go")
-		jTest := strings.HasSuffix(overlayFiles[j], "_test.go")
-		if iTest != jTest {
-			return !iTest // non-tests are before tests.
+		if ri, rj := rank(overlayFiles[i]), rank(overlayFiles[j]); ri != rj {
+			return ri < rj
 		}
 		return overlayFiles[i] < overlayFiles[j]
 	})
+	// Only the first pass, on the packages that the go command
+	// reported, is traced; later ones add the packages imported by the
+	// overlay, whose files it has already matched.
+	trace := !state.overlayTraced && (state.cfg.reportEnv || state.cfg.OverlayDebug || debug)
+	state.overlayTraced = true
+
+	// The package that the overlay adds in a directory that has none
+	// receives all the files of the overlay for it when it is created
+	// or reclaimed, however many there are, and no file creates
+	// another.
+	newFiles := state.newPackageFiles(ctxt, index, overlayFiles)
+	newPkgs := make(map[string]*Package)
+	addedWith := make(map[string]bool) // files added with an earlier file of their new package
+
+	var decisions []*OverlayDecision
 	for _, opath := range overlayFiles {
-		contents := state.cfg.Overlay[opath]
+		d := &OverlayDecision{File: opath}
+		decisions = append(decisions, d)
+		if state.isDeleted(opath) {
+			d.Skipped = "deleted"
+			continue
+		}
+		if isModFile(opath) {
+			d.Skipped = "module file"
+			continue
+		}
+		if !strings.HasSuffix(opath, ".go") {
+			ids, added := state.addOtherFile(index, opath)
+			if len(ids) == 0 {
+				d.Skipped = "not in a package"
+			}
+			d.Packages = ids
+			for _, id := range added {
+				modifiedPkgsSet[id] = true
+			}
+			continue
+		}
+		contents, _ := state.cfg.overlayContents(opath)
 		base := filepath.Base(opath)
 		dir := filepath.Dir(opath)
 		var pkg *Package           // if opath belongs to both a package and its test variant, this will be the test variant
 		var testVariantOf *Package // if opath is a test file, this is the package it is testing
 		var fileExists bool
 		isTestFile := strings.HasSuffix(opath, "_test.go")
-		pkgName, ok := extractPackageName(opath, contents)
-		if !ok {
-			// Don't bother adding a file that doesn't even have a parsable package statement
-			// to the overlay.
+		pkgName, err := state.extractPackageName(opath, contents)
+		if err != nil {
+			// The file, which may be open in an editor, still belongs
+			// to the package in its directory: report the error there.
+			d.ParseError = err.Error()
+			ids, err := state.addUnparsableFile(response, index, opath, err)
+			if err != nil {
+				return nil, nil, err
+			}
+			d.Packages = ids
+			for _, id := range ids {
+				modifiedPkgsSet[id] = true
+			}
+			continue
+		}
+		if ignored, err := state.ignoredOverlayFile(ctxt, opath, contents); err != nil {
+			return nil, nil, err
+		} else if ignored {
+			d.Name = pkgName
+			d.Skipped = "excluded by build constraints"
+			for _, id := range state.ignoreFile(index, opath) {
+				modifiedPkgsSet[id] = true
+			}
 			continue
 		}
+		unignoreFile(index, opath)
+		d.Name = pkgName
+		d.DirMatch = len(index.lookup(dir)) > 0
 		// If all the overlay files belong to a different package, change the
 		// package name to that package.
-		maybeFixPackageName(pkgName, isTestFile, pkgOfDir[dir])
-	nextPackage:
-		for _, p := range response.dr.Packages {
-			if pkgName != p.Name && p.ID != "command-line-arguments" {
+		maybeFixPackageName(pkgName, isTestFile, pkgOfDir[state.canonicalDir(dir)])
+		// The file may belong to a package of another name, whose
+		// package clause the overlay changed.
+		var oldPkgs []*Package
+		for _, p := range index.lookup(dir) {
+			if p.Name == pkgName || p.Name == "" || isAdHoc(p) {
 				continue
 			}
 			for _, f := range p.GoFiles {
-				if !sameFile(filepath.Dir(f), dir) {
-					continue
-				}
-				// Make sure to capture information on the package's test variant, if needed.
-				if isTestFile && !hasTestFiles(p) {
-					// TODO(matloob): Are there packages other than the 'production' variant
-					// of a package that this can match? This shouldn't match the test main package
-					// because the file is generated in another directory.
-					testVariantOf = p
-					continue nextPackage
+				if sameFile(f, opath) {
+					oldPkgs = append(oldPkgs, p)
+					break
 				}
-				// We must have already seen the package of which this is a test variant.
-				if pkg != nil && p != pkg && pkg.PkgPath == p.PkgPath {
-					if hasTestFiles(p) {
-						testVariantOf = pkg
-					}
+			}
+		}
+		for _, p := range index.lookup(dir) {
+			// A package without a name is one whose files have no
+			// parsable package clause; see addUnparsableFile. An
+			// ad-hoc package keeps the file of which it was made.
+			if pkgName != p.Name && p.Name != "" && !(isAdHoc(p) && containsFile(p.GoFiles, opath)) {
+				continue
+			}
+			// Make sure to capture information on the package's test variant, if needed.
+			if isTestFile && !isTestVariant(p) {
+				// TODO(matloob): Are there packages other than the 'production' variant
+				// of a package that this can match? This shouldn't match the test main package
+				// because the file is generated in another directory.
+				testVariantOf = p
+				continue
+			}
+			// We must have already seen the package of which this is a test variant.
+			if pkg != nil && p != pkg && pkg.PkgPath == p.PkgPath {
+				if isTestVariant(p) {
+					testVariantOf = pkg
 				}
-				pkg = p
-				if filepath.Base(f) == base {
+			}
+			pkg = p
+			for _, f := range p.GoFiles {
+				if filepath.Base(f) == base && state.sameDir(filepath.Dir(f), dir) {
 					fileExists = true
 				}
 			}
 		}
+		if pkg != nil && pkg.Name == "" {
+			pkg.Name = pkgName
+		}
+		// go list reports a copy of the package for the tests of each
+		// package that it depends on, such as "b [a.test]", which
+		// must have the non-test files of the package too.
+		var copies []*Package
+		if pkg != nil && !isTestFile {
+			for _, p := range index.lookup(dir) {
+				if p != pkg && p.PkgPath == pkg.PkgPath && p.Name == pkg.Name && isTestVariant(p) {
+					copies = append(copies, p)
+				}
+			}
+		}
+		// The package may be one that an earlier file of the overlay
+		// added, though it could not be indexed, as when another
+		// package of the response has its ID.
+		key := newPackageKey(dir, pkgName, isTestFile)
+		var files []string // the files to add to pkg, if the file is not in it
+		if pkg == nil && newPkgs[key] != nil {
+			pkg = newPkgs[key]
+			fileExists = containsFile(pkg.GoFiles, opath)
+		}
 		// The overlay could have included an entirely new package.
 		if pkg == nil {
 			// Try to find the module or gopath dir the file is contained in.
@@ -111,25 +239,54 @@ func (state *golistState) processGolistOverlay(response *responseDeduper) (modif
 				return nil, nil, err
 			}
 			if !ok {
-				break
+				d.Skipped = "outside the root directories"
+				continue
 			}
 			isXTest := strings.HasSuffix(pkgName, "_test")
 			if isXTest {
 				pkgPath += "_test"
 			}
+			d.PkgPath, d.XTest = pkgPath, isXTest
 			id := pkgPath
 			if isTestFile && !isXTest {
 				id = fmt.Sprintf("%s [%s.test]", pkgPath, pkgPath)
 			}
+			if isTestFile && isXTest && state.cfg.Tests {
+				// As reported by go list -test, an x test is a test
+				// variant of the package it tests.
+				for _, p := range index.lookup(dir) {
+					if p.Name+"_test" == pkgName && !isTestVariant(p) {
+						testVariantOf = p
+						id = fmt.Sprintf("%s [%s.test]", pkgPath, p.PkgPath)
+						break
+					}
+				}
+			}
+			// The package of another directory may have the ID, as
+			// when two root directories give their new directories
+			// the same package path. Qualify the ID of this one,
+			// which would otherwise be merged with it.
+			var conflictDir string
+			if p := response.seenPackages[id]; p != nil && len(p.GoFiles) > 0 {
+				if other := commonDir(p.GoFiles); !state.sameDir(other, dir) {
+					q, err := state.idQualifier(dir, other)
+					if err != nil {
+						return nil, nil, err
+					}
+					id, conflictDir = qualifyID(id, q), other
+				}
+			}
 			// Try to reclaim a package with the same ID, if it exists in the response.
 			for _, p := range response.dr.Packages {
-				if reclaimPackage(p, id, opath, contents) {
+				if reclaimPackage(p, id, pkgName) {
 					pkg = p
+					d.Created = "reclaimed"
 					break
 				}
 			}
 			// Otherwise, create a new package.
 			if pkg == nil {
+				d.Created = "synthesized"
 				pkg = &Package{
 					PkgPath: pkgPath,
 					ID:      id,
@@ -137,59 +294,204 @@ func (state *golistState) processGolistOverlay(response *responseDeduper) (modif
 					Imports: make(map[string]*Package),
 				}
 				response.addPackage(pkg)
-				havePkgs[pkg.PkgPath] = id
-				// Add the production package's sources for a test variant.
-				if isTestFile && !isXTest && testVariantOf != nil {
-					pkg.GoFiles = append(pkg.GoFiles, testVariantOf.GoFiles...)
-					pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, testVariantOf.CompiledGoFiles...)
-					// Add the package under test and its imports to the test variant.
+				if response.seenPackages[id] == pkg {
+					index.addPackage(pkg)
+				}
+				if conflictDir != "" {
+					pkg.Errors = append(pkg.Errors, Error{
+						Msg:  fmt.Sprintf("package %s in %s has the path of the package in %s", pkgPath, dir, conflictDir),
+						Kind: ListError,
+					})
+				} else {
+					havePkgs[pkg.PkgPath] = id
+				}
+				if isTestFile && testVariantOf != nil {
 					pkg.forTest = testVariantOf.PkgPath
-					for k, v := range testVariantOf.Imports {
-						pkg.Imports[k] = &Package{ID: v.ID}
+					// Add the production package's sources and imports
+					// to an in-package test variant.
+					if !isXTest {
+						pkg.GoFiles = append(pkg.GoFiles, testVariantOf.GoFiles...)
+						pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, testVariantOf.CompiledGoFiles...)
+						pkg.EmbedPatterns = append(pkg.EmbedPatterns, testVariantOf.EmbedPatterns...)
+						pkg.EmbedFiles = append(pkg.EmbedFiles, testVariantOf.EmbedFiles...)
+						for k, v := range testVariantOf.Imports {
+							pkg.Imports[k] = &Package{ID: v.ID}
+						}
+					}
+					// go list -test would have reported the test variant
+					// of a root package as a root too, had the test file
+					// existed on disk.
+					if state.cfg.Tests && response.seenRoots[testVariantOf.ID] {
+						response.addRoot(id)
 					}
 				}
-				// TODO(rstambler): Handle forTest for x_tests.
 			}
+			if err := state.setModule(pkg, dir); err != nil {
+				return nil, nil, err
+			}
+			newPkgs[key] = pkg
+			files = newFiles[key]
+		}
+		if len(files) == 0 {
+			files = []string{opath}
+		}
+		d.Packages = []string{pkg.ID}
+		if testVariantOf != nil {
+			d.TestVariantOf = testVariantOf.ID
 		}
+		d.Existed = fileExists && !addedWith[opath]
 		if !fileExists {
-			pkg.GoFiles = append(pkg.GoFiles, opath)
-			// TODO(matloob): Adding the file to CompiledGoFiles can exhibit the wrong behavior
-			// if the file will be ignored due to its build tags.
-			pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, opath)
+			if len(pkg.GoFiles) == 0 && len(pkg.Errors) == 1 && isExcludedPackageError(pkg.Errors[0]) {
+				// The file is the first that the build constraints
+				// of the package do not exclude.
+				pkg.Errors = nil
+			}
+			for _, f := range files {
+				if f != opath && containsFile(pkg.GoFiles, f) {
+					continue
+				}
+				pkg.GoFiles = append(pkg.GoFiles, f)
+				pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, f)
+				index.addFile(pkg, f)
+				if f != opath {
+					addedWith[f] = true
+				}
+			}
 			modifiedPkgsSet[pkg.ID] = true
 		}
-		imports, err := extractImports(opath, contents)
+		for _, p := range copies {
+			d.Packages = append(d.Packages, p.ID)
+			if !containsFile(p.GoFiles, opath) {
+				p.GoFiles = append(p.GoFiles, opath)
+				p.CompiledGoFiles = append(p.CompiledGoFiles, opath)
+				modifiedPkgsSet[p.ID] = true
+				index.addFile(p, opath)
+			}
+		}
+		// Move the file out of its old packages, unless the package
+		// of the new name could not be added to the response, as when
+		// it would have the ID of one of them.
+		if response.seenPackages[pkg.ID] == pkg {
+			for _, p := range oldPkgs {
+				if movedFrom[p] == nil {
+					movedFrom[p] = make(map[string]bool)
+				}
+				for _, files := range [][]string{p.GoFiles, p.CompiledGoFiles} {
+					for _, f := range files {
+						if sameFile(f, opath) {
+							movedFrom[p][f] = true
+						}
+					}
+				}
+			}
+		}
+		imports, err := state.extractImports(opath, contents)
 		if err != nil {
 			// Let the parser or type checker report errors later.
 			continue
 		}
 		for _, imp := range imports {
-			// TODO(rstambler): If the package is an x test and the import has
-			// a test variant, make sure to replace it.
 			if _, found := pkg.Imports[imp]; found {
 				continue
 			}
 			overlayAddsImports = true
-			id, ok := havePkgs[imp]
+			d.Imports = append(d.Imports, imp)
+			// Resolve the import before consulting havePkgs: in GOPATH
+			// mode, a vendored copy takes precedence over a package
+			// with the same path elsewhere, even one in the response.
+			pkgPath, err := state.resolveImport(dir, imp)
+			if err != nil {
+				return nil, nil, err
+			}
+			id, ok := havePkgs[pkgPath]
 			if !ok {
-				var err error
-				id, err = state.resolveImport(dir, imp)
-				if err != nil {
-					return nil, nil, err
-				}
+				id = pkgPath
 			}
 			pkg.Imports[imp] = &Package{ID: id}
-			// Add dependencies to the non-test variant version of this package as well.
-			if testVariantOf != nil {
+			response.addOverlayImport(pkg, imp)
+			// Add dependencies to the non-test variant version of this package as well,
+			// unless they are those of a test file, which it does not contain.
+			if testVariantOf != nil && !isTestFile {
+				if _, found := testVariantOf.Imports[imp]; !found {
+					response.addOverlayImport(testVariantOf, imp)
+				}
 				testVariantOf.Imports[imp] = &Package{ID: id}
 			}
+			for _, p := range copies {
+				if _, found := p.Imports[imp]; !found {
+					response.addOverlayImport(p, imp)
+					p.Imports[imp] = &Package{ID: id}
+					modifiedPkgsSet[p.ID] = true
+				}
+			}
+		}
+	}
+
+	if trace {
+		for _, d := range decisions {
+			state.recordOverlay(*d)
+		}
+	}
+
+	// An x test imports the test variant of the package under test, if
+	// it has one, which a test file of the overlay may have created
+	// after the x test.
+	for _, pkg := range response.dr.Packages {
+		if pkg.forTest == "" || !strings.HasSuffix(pkg.Name, "_test") {
+			continue
+		}
+		v, ok := response.seenPackages[fmt.Sprintf("%s [%s.test]", pkg.forTest, pkg.forTest)]
+		if !ok {
+			continue
+		}
+		for imp, p := range pkg.Imports {
+			if p.ID == pkg.forTest {
+				pkg.Imports[imp] = &Package{ID: v.ID}
+				modifiedPkgsSet[pkg.ID] = true
+			}
+		}
+	}
+
+	// Remove the deleted files from the packages that contain them,
+	// and the files whose package clause the overlay changed from those
+	// of the old package.
+	for _, pkg := range response.dr.Packages {
+		moved := movedFrom[pkg]
+		if len(state.cfg.DeletedFiles) == 0 && len(moved) == 0 {
+			continue
+		}
+		if state.removeFiles(pkg, func(f string) bool { return moved[f] || state.isDeleted(f) }) {
+			modifiedPkgsSet[pkg.ID] = true
 		}
 	}
 
 	// toPkgPath guesses the package path given the id.
 	toPkgPath := func(sourceDir, id string) (string, error) {
 		if i := strings.IndexByte(id, ' '); i >= 0 {
-			return state.resolveImport(sourceDir, id[:i])
+			id = id[:i]
+		}
+		if isVendored(id) {
+			// The ID of a vendored package is already its package
+			// path, which must not be resolved again, unless no root
+			// directory has its directory: then the import path may
+			// name another copy.
+			// The packages of the vendor directory of the standard
+			// library are in no root directory.
+			dirs, err := state.pkgDirs(id)
+			if err != nil {
+				return "", err
+			}
+			gone := len(dirs) > 0 && !strings.HasPrefix(id, "vendor/")
+			for _, dir := range dirs {
+				if state.isDir(dir) {
+					gone = false
+					break
+				}
+			}
+			if !gone {
+				return id, nil
+			}
+			id = vendorlessPath(id)
 		}
 		return state.resolveImport(sourceDir, id)
 	}
@@ -216,14 +518,150 @@ func (state *golistState) processGolistOverlay(response *responseDeduper) (modif
 		for pkg := range needPkgsSet {
 			needPkgs = append(needPkgs, pkg)
 		}
+		sort.Strings(needPkgs)
 	}
 	modifiedPkgs = make([]string, 0, len(modifiedPkgsSet))
 	for pkg := range modifiedPkgsSet {
 		modifiedPkgs = append(modifiedPkgs, pkg)
 	}
+	sort.Strings(modifiedPkgs)
 	return modifiedPkgs, needPkgs, err
 }
 
+// newPackageFiles groups the Go files of the overlay, given in the
+// order in which processGolistOverlay adds them, by the package that
+// they would add in a directory that has no packages in index, under
+// the keys of newPackageKey. The files that the overlay deletes, that
+// build constraints exclude, or whose package clause cannot be parsed
+// are left out, as they add no package of that name.
+func (state *golistState) newPackageFiles(ctxt *build.Context, index *dirIndex, files []string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, opath := range files {
+		if state.isDeleted(opath) || isModFile(opath) || !strings.HasSuffix(opath, ".go") {
+			continue
+		}
+		dir := filepath.Dir(opath)
+		if len(index.lookup(dir)) > 0 {
+			continue
+		}
+		contents, _ := state.cfg.overlayContents(opath)
+		name, err := state.extractPackageName(opath, contents)
+		if err != nil {
+			continue
+		}
+		if ignored, err := state.ignoredOverlayFile(ctxt, opath, contents); err != nil || ignored {
+			continue
+		}
+		key := newPackageKey(dir, name, strings.HasSuffix(opath, "_test.go"))
+		groups[key] = append(groups[key], opath)
+	}
+	return groups
+}
+
+// newPackageKey returns the key under which newPackageFiles groups the
+// files of the package of the given name in dir, or of its test
+// variant if the files are test files.
+func newPackageKey(dir, name string, test bool) string {
+	return fmt.Sprintf("%s\x00%s\x00%t", dir, name, test)
+}
+
+// addOverlayDepsErrors adds to the DepsErrors of the packages of
+// response an error for each import added by the overlay whose package
+// could not be loaded: one that is missing from the response, or that
+// has errors and no Go files, as go list reports a package that it
+// cannot find.
+func addOverlayDepsErrors(response *responseDeduper) {
+	for pkg, imports := range response.overlayImports {
+		imports = append([]string(nil), imports...)
+		sort.Strings(imports)
+		for _, imp := range imports {
+			ipkg, ok := pkg.Imports[imp]
+			if !ok {
+				continue // removed by breakOverlayImportCycles
+			}
+			msg := fmt.Sprintf("could not load package %s, imported by the overlay", ipkg.ID)
+			if p := response.seenPackages[ipkg.ID]; p != nil {
+				if len(p.GoFiles) > 0 || len(p.Errors) == 0 {
+					continue
+				}
+				msg += ": " + p.Errors[0].Msg
+			}
+			pkg.DepsErrors = append(pkg.DepsErrors, Error{Msg: msg, Kind: ListError})
+		}
+	}
+}
+
+// breakOverlayImportCycles removes from the packages of response each
+// import added by the overlay that creates an import cycle, and reports
+// the cycle as an error of the importing package, so that the import
+// graph is acyclic, as that of go list is.
+func breakOverlayImportCycles(response *responseDeduper) {
+	var pkgs []*Package
+	for pkg := range response.overlayImports {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].ID < pkgs[j].ID })
+
+	// pathTo returns the IDs of a path of imports from the package
+	// with the ID from to that with the ID to, or nil if none exists.
+	pathTo := func(from, to string) []string {
+		seen := make(map[string]bool)
+		var stack []string
+		var visit func(id string) bool
+		visit = func(id string) bool {
+			stack = append(stack, id)
+			if id == to {
+				return true
+			}
+			if pkg := response.seenPackages[id]; pkg != nil && !seen[id] {
+				seen[id] = true
+				var paths []string
+				for path := range pkg.Imports {
+					paths = append(paths, path)
+				}
+				sort.Strings(paths)
+				for _, path := range paths {
+					if visit(pkg.Imports[path].ID) {
+						return true
+					}
+				}
+			}
+			stack = stack[:len(stack)-1]
+			return false
+		}
+		if visit(from) {
+			return stack
+		}
+		return nil
+	}
+
+	for _, pkg := range pkgs {
+		imports := append([]string(nil), response.overlayImports[pkg]...)
+		sort.Strings(imports)
+		for _, imp := range imports {
+			ipkg, ok := pkg.Imports[imp]
+			if !ok {
+				continue
+			}
+			cycle := pathTo(ipkg.ID, pkg.ID)
+			if cycle == nil {
+				continue
+			}
+			cycle = append([]string{pkg.ID}, cycle...)
+			for i, id := range cycle {
+				if p := response.seenPackages[id]; p != nil && p.PkgPath != "" {
+					cycle[i] = p.PkgPath
+				}
+			}
+			delete(pkg.Imports, imp)
+			pkg.Errors = append(pkg.Errors, Error{
+				Kind: ListError,
+				Msg:  "import cycle not allowed: " + strings.Join(cycle, " -> "),
+			})
+		}
+	}
+}
+
 // resolveImport finds the the ID of a package given its import path.
 // In particular, it will find the right vendored copy when in GOPATH mode.
 func (state *golistState) resolveImport(sourceDir, importPath string) (string, error) {
@@ -240,14 +678,13 @@ func (state *golistState) resolveImport(sourceDir, importPath string) (string, e
 		vendorDir := filepath.Join(searchDir, "vendor")
 		exists, ok := state.vendorDirs[vendorDir]
 		if !ok {
-			info, err := os.Stat(vendorDir)
-			exists = err == nil && info.IsDir()
+			exists = state.isDir(vendorDir)
 			state.vendorDirs[vendorDir] = exists
 		}
 
 		if exists {
 			vendoredPath := filepath.Join(vendorDir, importPath)
-			if info, err := os.Stat(vendoredPath); err == nil && info.IsDir() {
+			if state.isDir(vendoredPath) {
 				// We should probably check for .go files here, but shame on anyone who fools us.
 				path, ok, err := state.getPkgPath(vendoredPath)
 				if err != nil {
@@ -270,136 +707,1361 @@ func (state *golistState) resolveImport(sourceDir, importPath string) (string, e
 	return importPath, nil
 }
 
-func hasTestFiles(p *Package) bool {
-	for _, f := range p.GoFiles {
-		if strings.HasSuffix(f, "_test.go") {
+// isDir reports whether dir is a directory on disk, or one in which the
+// overlay has files that it does not delete, so that the go command
+// would find the vendored packages that only the overlay has.
+func (state *golistState) isDir(dir string) bool {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return true
+	}
+	for _, filename := range state.cfg.overlayFilenames() {
+		if !state.isDeleted(filename) && strings.HasPrefix(filename, dir+string(filepath.Separator)) {
 			return true
 		}
 	}
 	return false
 }
 
-// determineRootDirs returns a mapping from absolute directories that could
-// contain code to their corresponding import path prefixes.
-func (state *golistState) determineRootDirs() (map[string]string, error) {
-	env, err := state.getEnv()
+// pkgDirs returns the directories in which the root directories that
+// contain the package path pkgPath would have its package, as for each
+// GOPATH entry; see determineRootDirs.
+func (state *golistState) pkgDirs(pkgPath string) ([]string, error) {
+	roots, err := state.determineRootDirs()
 	if err != nil {
 		return nil, err
 	}
-	if env["GOMOD"] != "" {
-		state.rootsOnce.Do(func() {
-			state.rootDirs, state.rootDirsError = state.determineRootDirsModules()
-		})
-	} else {
-		state.rootsOnce.Do(func() {
-			state.rootDirs, state.rootDirsError = state.determineRootDirsGOPATH()
-		})
+	var dirs []string
+	for rdir, rpath := range roots {
+		switch {
+		case rpath == pkgPath:
+			dirs = append(dirs, rdir)
+		case rpath == "" || strings.HasPrefix(pkgPath, rpath+"/"):
+			rel := strings.TrimPrefix(pkgPath[len(rpath):], "/")
+			dirs = append(dirs, filepath.Join(rdir, filepath.FromSlash(rel)))
+		}
 	}
-	return state.rootDirs, state.rootDirsError
+	sort.Strings(dirs)
+	return dirs, nil
 }
 
-func (state *golistState) determineRootDirsModules() (map[string]string, error) {
-	// This will only return the root directory for the main module.
-	// For now we only support overlays in main modules.
-	// Editing files in the module cache isn't a great idea, so we don't
-	// plan to ever support that, but editing files in replaced modules
-	// is something we may want to support. To do that, we'll want to
-	// do a go list -m to determine the replaced module's module path and
-	// directory, and then a go list -m {{with .Replace}}{{.Dir}}{{end}} <replaced module's path>
-	// from the main module to determine if that module is actually a replacement.
-	// See bcmills's comment here: https://github.com/golang/go/issues/37629#issuecomment-594179751
-	// for more information.
-	out, err := state.invokeGo("list", "-m", "-json")
-	if err != nil {
-		return nil, err
+// vendorlessPath returns the import path of the package of a vendor
+// directory whose package path is pkgPath.
+func vendorlessPath(pkgPath string) string {
+	if i := strings.LastIndex(pkgPath, "/vendor/"); i >= 0 {
+		return pkgPath[i+len("/vendor/"):]
 	}
-	m := map[string]string{}
-	type jsonMod struct{ Path, Dir string }
-	for dec := json.NewDecoder(out); dec.More(); {
-		mod := new(jsonMod)
-		if err := dec.Decode(mod); err != nil {
-			return nil, err
+	return strings.TrimPrefix(pkgPath, "vendor/")
+}
+
+// isDeleted reports whether filename is one of the files deleted by
+// Config.DeletedFiles.
+func (state *golistState) isDeleted(filename string) bool {
+	for _, f := range state.cfg.DeletedFiles {
+		if sameFile(f, filename) {
+			return true
 		}
-		if mod.Dir != "" && mod.Path != "" {
-			// This is a valid module; add it to the map.
-			absDir, err := filepath.Abs(mod.Dir)
-			if err != nil {
-				return nil, err
+	}
+	return false
+}
+
+// buildContext returns the context in which go list would match the
+// files of the overlay against their build constraints, as far as the
+// target, the -tags of the BuildFlags, and the version of the go
+// command determine it.
+func (state *golistState) buildContext() *build.Context {
+	ctxt := build.Default
+	if env, err := state.getEnv(); err == nil {
+		if env["GOOS"] != "" {
+			ctxt.GOOS = env["GOOS"]
+		}
+		if env["GOARCH"] != "" {
+			ctxt.GOARCH = env["GOARCH"]
+		}
+		if v, ok := env["CGO_ENABLED"]; ok {
+			ctxt.CgoEnabled = v == "1"
+		}
+		if minor, ok := goMinorVersion(env["GOVERSION"]); ok {
+			ctxt.ReleaseTags = nil
+			for i := 1; i <= minor; i++ {
+				ctxt.ReleaseTags = append(ctxt.ReleaseTags, fmt.Sprintf("go1.%d", i))
 			}
-			m[absDir] = mod.Path
 		}
 	}
-	return m, nil
+	ctxt.BuildTags = buildTags(state.cfg.BuildFlags)
+	return &ctxt
 }
 
-func (state *golistState) determineRootDirsGOPATH() (map[string]string, error) {
-	m := map[string]string{}
-	for _, dir := range filepath.SplitList(state.mustGetEnv()["GOPATH"]) {
-		absDir, err := filepath.Abs(dir)
-		if err != nil {
-			return nil, err
+// buildTags returns the tags set by the -tags flags of flags, which
+// separate them by commas or, formerly, by spaces.
+func buildTags(flags []string) []string {
+	var tags []string
+	for i := 0; i < len(flags); i++ {
+		flag := strings.TrimPrefix(flags[i], "-")
+		var value string
+		switch {
+		case strings.HasPrefix(flag, "-tags=") || strings.HasPrefix(flag, "tags="):
+			value = flag[strings.Index(flag, "=")+1:]
+		case (flag == "-tags" || flag == "tags") && i+1 < len(flags):
+			i++
+			value = flags[i]
+		default:
+			continue
 		}
-		m[filepath.Join(absDir, "src")] = ""
+		// As for the go command, a later flag overrides an earlier one.
+		tags = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
 	}
-	return m, nil
+	return tags
 }
 
-func extractImports(filename string, contents []byte) ([]string, error) {
-	f, err := parser.ParseFile(token.NewFileSet(), filename, contents, parser.ImportsOnly) // TODO(matloob): reuse fileset?
-	if err != nil {
-		return nil, err
+// ignoredOverlayFile reports whether ctxt excludes the Go file opath,
+// with the given contents, by its build constraints or its name. A file
+// whose name go list ignores altogether, beginning with "_" or ".", or
+// that is not a Go file, is not reported.
+func (state *golistState) ignoredOverlayFile(ctxt *build.Context, opath string, contents []byte) (bool, error) {
+	base := filepath.Base(opath)
+	if !strings.HasSuffix(base, ".go") || strings.HasPrefix(base, "_") || strings.HasPrefix(base, ".") {
+		return false, nil
 	}
-	var res []string
-	for _, imp := range f.Imports {
-		quotedPath := imp.Path.Value
-		path, err := strconv.Unquote(quotedPath)
-		if err != nil {
-			return nil, err
+	match := *ctxt
+	match.OpenFile = func(path string) (io.ReadCloser, error) {
+		if path != opath {
+			return os.Open(path)
 		}
-		res = append(res, path)
+		return ioutil.NopCloser(bytes.NewReader(contents)), nil
 	}
-	return res, nil
+	match.JoinPath = filepath.Join
+	ok, err := match.MatchFile(filepath.Dir(opath), base)
+	if err != nil {
+		// The file cannot be read far enough to find its
+		// constraints; it is reported with the package it is in.
+		return false, nil
+	}
+	return !ok, nil
 }
 
-// reclaimPackage attempts to reuse a package that failed to load in an overlay.
-//
-// If the package has errors and has no Name, GoFiles, or Imports,
-// then it's possible that it doesn't yet exist on disk.
-func reclaimPackage(pkg *Package, id string, filename string, contents []byte) bool {
-	// TODO(rstambler): Check the message of the actual error?
-	// It differs between $GOPATH and module mode.
-	if pkg.ID != id {
-		return false
-	}
-	if len(pkg.Errors) != 1 {
-		return false
+// ignoreFile moves the overlay file opath, which build constraints
+// exclude, into the IgnoredFiles of the packages in its directory other
+// than x tests, which go list reports without the ignored files, and
+// returns the IDs of those from which it removed a Go file.
+func (state *golistState) ignoreFile(index *dirIndex, opath string) []string {
+	var ids []string
+	dir := filepath.Dir(opath)
+	for _, p := range index.lookup(dir) {
+		if strings.HasSuffix(p.Name, "_test") {
+			continue
+		}
+		removed := state.removeFiles(p, func(f string) bool { return sameFile(f, opath) })
+		if removed {
+			ids = append(ids, p.ID)
+			if len(p.GoFiles) == 0 && len(p.Errors) > 0 {
+				last := &p.Errors[len(p.Errors)-1]
+				last.Msg = fmt.Sprintf("build constraints exclude all Go files in %s", dir)
+			}
+		}
+		if !containsFile(p.IgnoredFiles, opath) {
+			p.IgnoredFiles = append(p.IgnoredFiles, opath)
+		}
 	}
-	if pkg.Name != "" || pkg.ExportFile != "" {
-		return false
+	return ids
+}
+
+// unignoreFile removes the overlay file opath, which build constraints
+// do not exclude, from the IgnoredFiles of the packages in its
+// directory, as it belongs to their Go files.
+func unignoreFile(index *dirIndex, opath string) {
+	for _, p := range index.lookup(filepath.Dir(opath)) {
+		var kept []string
+		for _, f := range p.IgnoredFiles {
+			if !sameFile(f, opath) {
+				kept = append(kept, f)
+			}
+		}
+		p.IgnoredFiles = kept
 	}
-	if len(pkg.GoFiles) > 0 || len(pkg.CompiledGoFiles) > 0 || len(pkg.OtherFiles) > 0 {
-		return false
+}
+
+// otherFileExts lists the extensions of the files other than Go files
+// that go list reports among the source files of a package, and that
+// Package.OtherFiles holds.
+var otherFileExts = map[string]bool{
+	".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".m": true,
+	".h": true, ".hh": true, ".hpp": true, ".hxx": true,
+	".f": true, ".F": true, ".for": true, ".f90": true,
+	".s": true, ".S": true, ".sx": true,
+	".swig": true, ".swigcxx": true, ".syso": true,
+}
+
+// addOtherFile adds the overlay file opath, which is not a Go file, to
+// the packages that would contain it. A file that an embed pattern of a
+// package in its directory, or in one above it, matches belongs to the
+// EmbedFiles of that package; a source file of another language, such
+// as an assembly file, belongs to the OtherFiles of the packages in its
+// directory other than x tests and ad-hoc packages. It returns the IDs
+// of the packages that contain the file, and of those to which it was
+// added. A file of a directory without packages is ignored.
+func (state *golistState) addOtherFile(index *dirIndex, opath string) (ids, added []string) {
+	contains := func(p *Package, files *[]string) {
+		ids = append(ids, p.ID)
+		if !containsFile(*files, opath) {
+			*files = append(*files, opath)
+			added = append(added, p.ID)
+		}
 	}
-	if len(pkg.Imports) > 0 {
-		return false
+	dir := filepath.Dir(opath)
+	if otherFileExts[filepath.Ext(opath)] {
+		for _, p := range index.lookup(dir) {
+			if !strings.HasSuffix(p.Name, "_test") && !isAdHoc(p) {
+				contains(p, &p.OtherFiles)
+			}
+		}
 	}
-	pkgName, ok := extractPackageName(filename, contents)
-	if !ok {
-		return false
+	for d := dir; ; d = filepath.Dir(d) {
+		rel, err := filepath.Rel(d, opath)
+		if err != nil {
+			break
+		}
+		for _, p := range index.lookup(d) {
+			for _, pattern := range p.EmbedPatterns {
+				if embedMatches(pattern, filepath.ToSlash(rel)) {
+					contains(p, &p.EmbedFiles)
+					break
+				}
+			}
+		}
+		if filepath.Dir(d) == d {
+			break
+		}
 	}
-	pkg.Name = pkgName
-	pkg.Errors = nil
-	return true
+	return ids, added
 }
 
-func extractPackageName(filename string, contents []byte) (string, bool) {
-	// TODO(rstambler): Check the message of the actual error?
-	// It differs between $GOPATH and module mode.
-	f, err := parser.ParseFile(token.NewFileSet(), filename, contents, parser.PackageClauseOnly) // TODO(matloob): reuse fileset?
-	if err != nil {
-		return "", false
+// embedMatches reports whether the embed pattern of a package matches
+// the file whose slash-separated path relative to the directory of the
+// package is rel: either the file itself, or a directory that contains
+// it, in which case the file is embedded unless a name below that
+// directory begins with "." or "_" and the pattern lacks the prefix
+// "all:".
+func embedMatches(pattern, rel string) bool {
+	all := strings.HasPrefix(pattern, "all:")
+	pattern = strings.TrimPrefix(pattern, "all:")
+	for name := rel; ; {
+		if ok, _ := path.Match(pattern, name); ok {
+			if name == rel || all {
+				return true
+			}
+			for _, elem := range strings.Split(rel[len(name)+1:], "/") {
+				if strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") {
+					return false
+				}
+			}
+			return true
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// containsFile reports whether files contains the file filename.
+func containsFile(files []string, filename string) bool {
+	for _, f := range files {
+		if sameFile(f, filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcludedPackageError reports whether err is the error of go list
+// for a package all of whose files build constraints exclude.
+func isExcludedPackageError(err Error) bool {
+	return err.Pos == "" && strings.HasPrefix(err.Msg, "build constraints exclude all Go files in ")
+}
+
+// removeFiles removes the files for which isRemoved reports true from
+// pkg, and the imports that only they required. It reports whether it
+// removed any files.
+func (state *golistState) removeFiles(pkg *Package, isRemoved func(filename string) bool) bool {
+	if len(pkg.GoFiles) == 0 {
+		return false
+	}
+	dir := commonDir(pkg.GoFiles)
+	removed := false
+	remove := func(files []string) []string {
+		var kept []string
+		for _, f := range files {
+			if isRemoved(f) {
+				removed = true
+			} else {
+				kept = append(kept, f)
+			}
+		}
+		return kept
+	}
+	pkg.GoFiles = remove(pkg.GoFiles)
+	pkg.CompiledGoFiles = remove(pkg.CompiledGoFiles)
+	pkg.OtherFiles = remove(pkg.OtherFiles)
+	pkg.IgnoredFiles = remove(pkg.IgnoredFiles)
+	if !removed {
+		return false
+	}
+	if len(pkg.GoFiles) == 0 {
+		pkg.Imports = make(map[string]*Package)
+		pkg.Errors = append(pkg.Errors, Error{
+			Kind: ListError,
+			Msg:  fmt.Sprintf("no Go files in %s", dir),
+		})
+		return true
+	}
+
+	// Recompute the imports from the remaining files. If any of them
+	// cannot be read or parsed, or uses cgo, whose implicit imports
+	// appear in no file, keep the imports as they are.
+	needed := make(map[string]bool)
+	for _, files := range [][]string{pkg.GoFiles, pkg.CompiledGoFiles} {
+		for _, f := range files {
+			contents, ok := state.cfg.overlayContents(f)
+			if !ok {
+				var err error
+				if contents, err = ioutil.ReadFile(f); err != nil {
+					return true
+				}
+			}
+			imports, err := state.extractImports(f, contents)
+			if err != nil {
+				return true
+			}
+			for _, imp := range imports {
+				if imp == "C" {
+					return true
+				}
+				needed[imp] = true
+			}
+		}
+	}
+	for imp := range pkg.Imports {
+		if !needed[imp] {
+			delete(pkg.Imports, imp)
+		}
+	}
+	return true
+}
+
+// isVendored reports whether pkgPath is the path of a package in a
+// vendor directory.
+func isVendored(pkgPath string) bool {
+	return strings.HasPrefix(pkgPath, "vendor/") || strings.Contains(pkgPath, "/vendor/")
+}
+
+// A dirIndex maps each directory to the packages of a response that
+// have Go files, or ignored ones, in it, in the order in which they appear in the
+// response, so that processGolistOverlay need not scan the files of
+// every package for each overlay file.
+type dirIndex struct {
+	order map[*Package]int // position of each indexed package in the response
+	pkgs  map[string][]*Package
+
+	// sameDir, if not nil, reports whether two directories are the
+	// same for lookup; otherwise sameFile does.
+	sameDir func(x, y string) bool
+}
+
+func newDirIndex(pkgs []*Package) *dirIndex {
+	x := &dirIndex{
+		order: make(map[*Package]int, len(pkgs)),
+		pkgs:  make(map[string][]*Package, len(pkgs)),
+	}
+	for _, p := range pkgs {
+		x.addPackage(p)
+	}
+	return x
+}
+
+// addPackage indexes p, which must follow all packages already
+// indexed in the response.
+func (x *dirIndex) addPackage(p *Package) {
+	x.order[p] = len(x.order)
+	for _, files := range [][]string{p.GoFiles, p.IgnoredFiles} {
+		for _, f := range files {
+			x.addFile(p, f)
+		}
+	}
+}
+
+// addFile records that the indexed package p has the Go file f.
+func (x *dirIndex) addFile(p *Package, f string) {
+	pos, ok := x.order[p]
+	if !ok {
+		return // p is not in the response
+	}
+	dir := filepath.Dir(f)
+	list := x.pkgs[dir]
+	i := sort.Search(len(list), func(i int) bool { return x.order[list[i]] >= pos })
+	if i < len(list) && list[i] == p {
+		return
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = p
+	x.pkgs[dir] = list
+}
+
+// lookup returns the packages with Go files in dir, in response order.
+// If no package has files in a directory of that name, it falls back
+// to the directories that denote the same one, as through a symbolic
+// link.
+func (x *dirIndex) lookup(dir string) []*Package {
+	if list, ok := x.pkgs[dir]; ok {
+		return list
+	}
+	same := x.sameDir
+	if same == nil {
+		same = sameFile
+	}
+	var list []*Package
+	for d, pkgs := range x.pkgs {
+		if same(d, dir) {
+			list = append(list, pkgs...)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return x.order[list[i]] < x.order[list[j]] })
+	// A package with files in several such directories appears once.
+	var out []*Package
+	for i, p := range list {
+		if i == 0 || list[i-1] != p {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// canonicalDir returns the absolute directory dir with its symbolic
+// links resolved, as by filepath.EvalSymlinks. The part of dir that does
+// not exist, as the directory of a file that only the overlay has, is
+// joined to the resolved form of its nearest existing ancestor. The
+// results are cached for the duration of the load.
+func (state *golistState) canonicalDir(dir string) string {
+	state.dirsMu.Lock()
+	defer state.dirsMu.Unlock()
+	return state.canonicalDirLocked(dir)
+}
+
+func (state *golistState) canonicalDirLocked(dir string) string {
+	if c, ok := state.canonDirs[dir]; ok {
+		return c
+	}
+	c, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		c = dir
+		if parent := filepath.Dir(dir); parent != dir {
+			c = filepath.Join(state.canonicalDirLocked(parent), filepath.Base(dir))
+		}
+	}
+	if state.canonDirs == nil {
+		state.canonDirs = make(map[string]string)
+	}
+	state.canonDirs[dir] = c
+	return c
+}
+
+// caseInsensitive reports whether the file system of the volume of the
+// canonical directory dir ignores the case of file names, as those of
+// macOS and Windows usually do. It tests the nearest ancestor of dir
+// whose name has letters in it, and caches the result by volume.
+func (state *golistState) caseInsensitive(dir string) bool {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		return false
+	}
+	vol := filepath.VolumeName(dir)
+	state.dirsMu.Lock()
+	fold, ok := state.foldCase[vol]
+	state.dirsMu.Unlock()
+	if ok {
+		return fold
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		base := filepath.Base(d)
+		flipped := strings.ToUpper(base)
+		if flipped == base {
+			flipped = strings.ToLower(base)
+		}
+		if flipped == base {
+			continue
+		}
+		di, err := os.Stat(d)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(parent, flipped))
+		fold = err == nil && os.SameFile(di, fi)
+		break
+	}
+	state.dirsMu.Lock()
+	if state.foldCase == nil {
+		state.foldCase = make(map[string]bool)
+	}
+	state.foldCase[vol] = fold
+	state.dirsMu.Unlock()
+	return fold
+}
+
+// sameDir reports whether the absolute directories x and y are the
+// same, as when one is reached through a symbolic link or, on a file
+// system that ignores case, when they differ only in case. Either need
+// not exist.
+func (state *golistState) sameDir(x, y string) bool {
+	if x == y {
+		return true
+	}
+	cx, cy := state.canonicalDir(x), state.canonicalDir(y)
+	if cx == cy || strings.EqualFold(cx, cy) && state.caseInsensitive(cx) {
+		return true
+	}
+	return sameFile(x, y)
+}
+
+// relToRoot returns the path of the absolute directory dir relative to
+// the root directory root, if dir is root or one of its subdirectories,
+// either lexically or once both are canonical (see canonicalDir).
+func (state *golistState) relToRoot(dir, root string) (string, bool) {
+	if !inDir(dir, root) {
+		cdir, croot := state.canonicalDir(dir), state.canonicalDir(root)
+		if !inDir(cdir, croot) {
+			// The prefix of cdir that would be croot, up to case.
+			n := len(croot)
+			if len(cdir) < n || !strings.EqualFold(cdir[:n], croot) || !state.caseInsensitive(cdir) ||
+				!inDir(croot+cdir[n:], croot) {
+				return "", false
+			}
+			cdir = croot + cdir[n:]
+		}
+		dir, root = cdir, croot
+	}
+	r, err := filepath.Rel(root, dir)
+	return r, err == nil
+}
+
+// isTestVariant reports whether p is a test variant of a package, or
+// an x test, rather than the package itself: whether the driver reported
+// the package it is for, as go list does with ForTest, whether its ID
+// has the form "p [q.test]", or else whether it has test files among its
+// GoFiles or CompiledGoFiles. Build constraints may exclude all the test
+// files of a test variant, and cgo may leave them only in
+// CompiledGoFiles.
+func isTestVariant(p *Package) bool {
+	if p.forTest != "" {
+		return true
+	}
+	if strings.Contains(p.ID, " [") && strings.HasSuffix(p.ID, ".test]") {
+		return true
+	}
+	for _, files := range [][]string{p.GoFiles, p.CompiledGoFiles} {
+		for _, f := range files {
+			if strings.HasSuffix(f, "_test.go") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// determineRootDirs returns a mapping from absolute directories that could
+// contain code to their corresponding import path prefixes.
+func (state *golistState) determineRootDirs() (map[string]string, error) {
+	env, err := state.getEnv()
+	if err != nil {
+		return nil, err
+	}
+	load := state.determineRootDirsGOPATH
+	if env["GOMOD"] != "" {
+		load = state.determineRootDirsModules
+	}
+	state.rootsOnce.Do(func() {
+		if s := state.cfg.session; s != nil {
+			state.rootDirs, state.rootDirsError = s.getRootDirs(state.modFilesKey(), load)
+		} else {
+			state.rootDirs, state.rootDirsError = load()
+		}
+	})
+	return state.rootDirs, state.rootDirsError
+}
+
+// determineRootDirsModules returns the directories of the main modules
+// and of the modules that they replace by directories, mapped to their
+// module paths: for a replacement, the path of the replaced module, by
+// which the packages in its directory are imported. Overlays are not
+// supported in the module cache, whose files should not be edited.
+// See https://github.com/golang/go/issues/37629#issuecomment-594179751.
+func (state *golistState) determineRootDirsModules() (map[string]string, error) {
+	out, err := state.invokeGo("list", "-m", "-json")
+	if err != nil {
+		return nil, xerrors.Errorf("determining module root directories: %w", err)
+	}
+	m := map[string]string{}
+	var replaced []string
+	for dec := json.NewDecoder(out); dec.More(); {
+		mod := new(jsonModule)
+		if err := dec.Decode(mod); err != nil {
+			return nil, err
+		}
+		if mod.Dir != "" && mod.Path != "" {
+			// This is a valid module; add it to the map.
+			absDir, err := filepath.Abs(mod.Dir)
+			if err != nil {
+				return nil, err
+			}
+			m[absDir] = mod.Path
+			paths, err := state.addReplacedRootDirs(m, absDir, mod.GoMod)
+			if err != nil {
+				return nil, err
+			}
+			replaced = append(replaced, paths...)
+		}
+	}
+	if len(replaced) == 0 {
+		return m, nil
+	}
+
+	// The go command knows which replacements are in effect: those of
+	// a go.work file override those of the go.mod files, and one of a
+	// single version applies only if that version is required. A
+	// replacement that it does not report, as of a requirement that only
+	// the overlay adds to a go.mod file it cannot read, is kept as the
+	// go.mod file describes it.
+	out, err = state.invokeGo("list", append([]string{"-m", "-e", "-json"}, replaced...)...)
+	if err != nil {
+		return nil, xerrors.Errorf("determining replaced module directories: %w", err)
+	}
+	for dec := json.NewDecoder(out); dec.More(); {
+		mod := new(jsonModule)
+		if err := dec.Decode(mod); err != nil {
+			return nil, err
+		}
+		if mod.Replace == nil || mod.Replace.Dir == "" {
+			continue
+		}
+		absDir, err := filepath.Abs(mod.Replace.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for dir, path := range m {
+			if path == mod.Path && dir != absDir {
+				delete(m, dir)
+			}
+		}
+		m[absDir] = mod.Path
+	}
+	return m, nil
+}
+
+// A jsonModule is a module as go list -m -json reports it.
+type jsonModule struct {
+	Path, Dir, GoMod string
+	Replace          *struct{ Path, Dir string }
+}
+
+// workspaceDirs returns the absolute directories of the modules that
+// the go.work file of the workspace uses, as read through the overlay,
+// or nil if workspace mode is not in effect.
+func (state *golistState) workspaceDirs() ([]string, error) {
+	env, err := state.getEnv()
+	if err != nil {
+		return nil, err
+	}
+	gowork := env["GOWORK"]
+	if gowork == "" || gowork == "off" {
+		return nil, nil
+	}
+	data, err := state.readModFile(gowork)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, dir := range parseWorkUses(data) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(gowork), dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs, nil
+}
+
+// parseWorkUses returns the directories named by the use directives of
+// the go.work file data, such as
+//
+//	use ./a
+//	use (
+//		./b
+//		"./c d"
+//	)
+//
+// Malformed lines are ignored; the go command reports them.
+func parseWorkUses(data []byte) []string {
+	var dirs []string
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var arg string
+		switch {
+		case inBlock && fields[0] == ")":
+			inBlock = false
+			continue
+		case inBlock:
+			arg = strings.TrimSpace(line)
+		case fields[0] == "use" && len(fields) == 2 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == "use" && len(fields) >= 2:
+			arg = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "use"))
+		default:
+			continue
+		}
+		if strings.HasPrefix(arg, `"`) || strings.HasPrefix(arg, "`") {
+			unquoted, err := strconv.Unquote(arg)
+			if err != nil {
+				continue
+			}
+			arg = unquoted
+		} else if strings.ContainsAny(arg, " \t") {
+			continue
+		}
+		dirs = append(dirs, arg)
+	}
+	return dirs
+}
+
+// addReplacedRootDirs adds to m the directories of the modules that
+// the go.mod file gomod of the module in dir replaces by directories,
+// mapped to the paths of the replaced modules, which it returns. The
+// contents of gomod are those of the overlay, if it has them.
+func (state *golistState) addReplacedRootDirs(m map[string]string, dir, gomod string) ([]string, error) {
+	if gomod == "" {
+		return nil, nil
+	}
+	data, err := state.readModFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+	f, err := modfile.Parse(gomod, data, nil)
+	if err != nil {
+		// The go command is the judge of the file's validity.
+		return nil, nil
+	}
+	var paths []string
+	for _, r := range f.Replace {
+		if r.New.Version != "" {
+			continue // replaced by another module version
+		}
+		newDir := r.New.Path
+		if !filepath.IsAbs(newDir) {
+			newDir = filepath.Join(dir, newDir)
+		}
+		if _, ok := m[newDir]; !ok {
+			m[newDir] = r.Old.Path
+			paths = append(paths, r.Old.Path)
+		}
+	}
+	return paths, nil
+}
+
+// readModFile returns the contents of the go.mod file gomod, those of
+// the overlay if it has them.
+func (state *golistState) readModFile(gomod string) ([]byte, error) {
+	if data, ok := state.cfg.overlayContents(gomod); ok {
+		return data, nil
+	}
+	return ioutil.ReadFile(gomod)
+}
+
+// setModule sets the Module of pkg, a package that the overlay adds
+// in the directory dir, to the module whose root contains dir, if
+// modules are enabled and the Module was requested, and its GoVersion
+// to that of the module in any case. As that module is the main module
+// or a replacement of one of its requirements by a directory, or a
+// module of the go.work workspace, only its Path, Dir, GoMod, Main,
+// and GoVersion are set.
+func (state *golistState) setModule(pkg *Package, dir string) error {
+	if pkg.Module != nil {
+		return nil
+	}
+	env, err := state.getEnv()
+	if err != nil || env["GOMOD"] == "" {
+		return err
+	}
+	rdir, rpath, err := state.getRoot(dir)
+	if err != nil || rdir == "" || rpath == "" {
+		return err
+	}
+	gomod := filepath.Join(rdir, "go.mod")
+	mod := &Module{
+		Path:  rpath,
+		Dir:   rdir,
+		GoMod: gomod,
+		Main:  sameFile(gomod, env["GOMOD"]),
+	}
+	// The modules of a workspace are all main modules.
+	dirs, err := state.workspaceDirs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if dir == rdir {
+			mod.Main = true
+		}
+	}
+	if data, err := state.readModFile(gomod); err == nil {
+		mod.GoVersion = goDirective(gomod, data)
+	}
+	pkg.GoVersion = langVersion(mod.GoVersion)
+	if state.cfg.Mode&NeedModule != 0 {
+		pkg.Module = mod
+	}
+	return nil
+}
+
+// goDirective returns the version of the go directive of the go.mod
+// file gomod, with the given contents, or "" if it has none. The
+// version of a file that modfile cannot parse, as it does not know the
+// versions with a patch number of Go 1.21 and later, such as "1.21.0",
+// is read from the line of the directive.
+func goDirective(gomod string, data []byte) string {
+	if f, err := modfile.ParseLax(gomod, data, nil); err == nil {
+		if f.Go == nil {
+			return ""
+		}
+		return f.Go.Version
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "go" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// isModFile reports whether filename names a go.mod, go.sum, go.work,
+// or go.work.sum file.
+func isModFile(filename string) bool {
+	switch filepath.Base(filename) {
+	case "go.mod", "go.sum", "go.work", "go.work.sum":
+		return true
+	}
+	return false
+}
+
+// nativeOverlay reports whether the go command applies the overlay
+// and the deleted files of the Config itself, given its -overlay flag,
+// as it can since Go 1.16. Otherwise processGolistOverlay approximates
+// their effect on the response of go list, and only the go.mod and
+// go.sum files of the overlay, which that does not handle, are passed
+// to the go command.
+func (state *golistState) nativeOverlay() (bool, error) {
+	if legacyOverlay || !state.cfg.hasOverlay() && len(state.cfg.DeletedFiles) == 0 {
+		return false, nil
+	}
+	env, err := state.getEnv()
+	if err != nil {
+		return false, err
+	}
+	return goVersionAtLeast(env["GOVERSION"], 16), nil
+}
+
+// legacyOverlay, if set, makes nativeOverlay report false, so that the
+// overlay is processed by processGolistOverlay; see SetLegacyOverlay
+// in export_test.go.
+var legacyOverlay bool
+
+// overlayFile returns the name of a file to pass to the go command's
+// -overlay flag, which replaces the files on disk by those of
+// the overlay and deletes those of Config.DeletedFiles, or only
+// replaces the go.mod and go.sum files if the overlay is not native
+// (see nativeOverlay). It returns "" if there is nothing to pass or
+// the go command is too old to support the flag (before Go 1.16). It
+// writes the file, and the contents it refers to, which need not exist
+// on disk, on first use; see removeOverlayFile.
+func (state *golistState) overlayFile() (string, error) {
+	state.overlayOnce.Do(func() {
+		native, err := state.nativeOverlay()
+		if err != nil {
+			state.overlayError = err
+			return
+		}
+		var files []string
+		for _, filename := range state.cfg.overlayFilenames() {
+			if native || isModFile(filename) {
+				files = append(files, filename)
+			}
+		}
+		if len(files) == 0 && !native {
+			return
+		}
+		env, err := state.getEnv()
+		if err != nil {
+			state.overlayError = err
+			return
+		}
+		if !goVersionAtLeast(env["GOVERSION"], 16) {
+			return
+		}
+		sort.Strings(files)
+		state.overlayDir, state.overlayError = ioutil.TempDir("", "gopackages-overlay")
+		if state.overlayError != nil {
+			return
+		}
+		replace := make(map[string]string)
+		for i, filename := range files {
+			tmp := filepath.Join(state.overlayDir, fmt.Sprintf("%d.%s", i, filepath.Base(filename)))
+			if state.overlayError = state.cfg.writeOverlayFile(filename, tmp); state.overlayError != nil {
+				return
+			}
+			replace[filename] = tmp
+			for _, alias := range state.overlayAliases(env, filename) {
+				replace[alias] = tmp
+			}
+		}
+		if native {
+			// The go command treats a file replaced by "" as deleted.
+			for _, filename := range state.cfg.DeletedFiles {
+				if abs, err := filepath.Abs(filename); err == nil {
+					replace[abs] = ""
+					for _, alias := range state.overlayAliases(env, abs) {
+						replace[alias] = ""
+					}
+				}
+			}
+		}
+		data, err := json.Marshal(struct{ Replace map[string]string }{replace})
+		if err != nil {
+			state.overlayError = err
+			return
+		}
+		overlay := filepath.Join(state.overlayDir, "overlay.json")
+		if state.overlayError = ioutil.WriteFile(overlay, data, 0644); state.overlayError != nil {
+			return
+		}
+		state.overlay = overlay
+	})
+	return state.overlay, state.overlayError
+}
+
+// overlayAliases returns the other names of the file filename of the
+// overlay under which the go command may read it: those in the GOPATH
+// directories, the directory of the main module, and Config.Dir, if
+// filename is in one of them only once their symbolic links are
+// resolved. The go command, which matches the files of its -overlay
+// flag by name, would otherwise not find a file that the overlay names
+// by its real path but that lies under a root named through a link.
+func (state *golistState) overlayAliases(env map[string]string, filename string) []string {
+	var roots []string
+	for _, dir := range filepath.SplitList(env["GOPATH"]) {
+		roots = append(roots, filepath.Join(dir, "src"))
+	}
+	if gomod := env["GOMOD"]; gomod != "" && gomod != os.DevNull {
+		roots = append(roots, filepath.Dir(gomod))
+	}
+	if dir, err := filepath.Abs(state.cfg.Dir); err == nil {
+		roots = append(roots, dir)
+	}
+	dir := filepath.Dir(filename)
+	var aliases []string
+	for _, root := range roots {
+		if !filepath.IsAbs(root) || inDir(dir, root) {
+			continue
+		}
+		if rel, ok := state.relToRoot(dir, root); ok {
+			alias := filepath.Join(root, rel, filepath.Base(filename))
+			if alias != filename && !containsString(aliases, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	return aliases
+}
+
+// recordOverlay adds d to the trace of the overlay that the driver
+// reports, and logs it if Config.OverlayDebug or GOPACKAGESDEBUG is set.
+func (state *golistState) recordOverlay(d OverlayDecision) {
+	state.overlayTrace = append(state.overlayTrace, d)
+	if (state.cfg.OverlayDebug || debug) && state.cfg.Logf != nil {
+		b, _ := json.Marshal(d)
+		state.cfg.Logf("overlay: %s", b)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeOverlayFile removes the files written by overlayFile.
+func (state *golistState) removeOverlayFile() {
+	if state.overlayDir != "" {
+		os.RemoveAll(state.overlayDir)
+	}
+}
+
+// goVersionAtLeast reports whether version, the GOVERSION of the go
+// command, such as "go1.16.3", is that of Go 1.minor or later. A
+// development version is assumed to be recent; an empty one, as
+// reported by go commands that predate GOVERSION, is not.
+func goVersionAtLeast(version string, minor int) bool {
+	if strings.HasPrefix(version, "devel") {
+		return true
+	}
+	n, ok := goMinorVersion(version)
+	return ok && n >= minor
+}
+
+// goMinorVersion returns the minor version of a release of Go 1 named
+// by version, such as 16 for "go1.16.2".
+func goMinorVersion(version string) (int, bool) {
+	if !strings.HasPrefix(version, "go1.") {
+		return 0, false
+	}
+	v := strings.TrimPrefix(version, "go1.")
+	if i := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		v = v[:i]
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil
+}
+
+// langVersion returns the language version, such as "go1.21", of the
+// go directive version of a go.mod file, such as "1.21.0" or "1.21rc1",
+// or "" if it is not that of a release of Go 1.
+func langVersion(version string) string {
+	n, ok := goMinorVersion("go" + version)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("go1.%d", n)
+}
+
+func (state *golistState) determineRootDirsGOPATH() (map[string]string, error) {
+	m := map[string]string{}
+	for _, dir := range filepath.SplitList(state.mustGetEnv()["GOPATH"]) {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		m[filepath.Join(absDir, "src")] = ""
+	}
+	return m, nil
+}
+
+// An overlayHeader records the package clause and imports of a file,
+// as parseHeader parsed them from contents with the given hash.
+type overlayHeader struct {
+	hash [sha256.Size]byte
+	file *ast.File
+	err  error
+}
+
+// fileSet returns the FileSet into which the driver parses files: that
+// of the Config, into which the loader parses the syntax of the
+// packages, if it has one, so that the positions of either resolve
+// through it. state.headerMu must be held.
+func (state *golistState) fileSet() *token.FileSet {
+	if state.fset == nil {
+		state.fset = state.cfg.Fset
+		if state.fset == nil {
+			state.fset = token.NewFileSet()
+		}
+	}
+	return state.fset
+}
+
+// parseHeader returns the package clause and imports of the file
+// filename with the given contents, parsed into fileSet, and the error
+// of parsing them, if any. A file is parsed again only if its contents
+// change, so that each file is parsed once however many phases of the
+// driver need its package name or imports.
+func (state *golistState) parseHeader(filename string, contents []byte) (*ast.File, error) {
+	state.headerMu.Lock()
+	defer state.headerMu.Unlock()
+	hash := sha256.Sum256(contents)
+	if h, ok := state.headers[filename]; ok && h.hash == hash {
+		return h.file, h.err
+	}
+	f, err := parser.ParseFile(state.fileSet(), filename, contents, parser.ImportsOnly)
+	if state.headers == nil {
+		state.headers = make(map[string]*overlayHeader)
+	}
+	state.headers[filename] = &overlayHeader{hash, f, err}
+	return f, err
+}
+
+// extractImports returns the import paths of the file filename with
+// the given contents.
+func (state *golistState) extractImports(filename string, contents []byte) ([]string, error) {
+	f, err := state.parseHeader(filename, contents)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, imp := range f.Imports {
+		quotedPath := imp.Path.Value
+		path, err := strconv.Unquote(quotedPath)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, path)
+	}
+	return res, nil
+}
+
+// idQualifier returns the qualifier of the ID of a package that the
+// overlay adds in the directory dir, whose package path is that of the
+// package in the directory other: the module path of the root
+// directory of dir, if the root directory of other has another, or
+// else dir itself, as when both are in GOPATH.
+func (state *golistState) idQualifier(dir, other string) (string, error) {
+	_, rpath, err := state.getRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	_, otherPath, err := state.getRoot(other)
+	if err != nil {
+		return "", err
+	}
+	if rpath != "" && rpath != otherPath {
+		return rpath, nil
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir, nil
+}
+
+// qualifyID adds the qualifier q to the package path of the package ID
+// id, before the test it is a variant for, if any, as in "p (q)" or
+// "p (q) [p.test]". The package path remains the prefix of the ID up
+// to its first space.
+func qualifyID(id, q string) string {
+	if i := strings.Index(id, " ["); i >= 0 {
+		return fmt.Sprintf("%s (%s)%s", id[:i], q, id[i:])
+	}
+	return fmt.Sprintf("%s (%s)", id, q)
+}
+
+// reclaimPackage attempts to reuse a package that failed to load in an overlay.
+//
+// If the package has errors and has no Name, GoFiles, or Imports,
+// then it's possible that it doesn't yet exist on disk.
+func reclaimPackage(pkg *Package, id string, pkgName string) bool {
+	if !isPlaceholder(pkg, id) {
+		return false
+	}
+	pkg.Name = pkgName
+	pkg.Errors = nil
+	return true
+}
+
+// missingPackageErrors match the messages with which go list reports a
+// package whose directory does not exist or has no Go files, in GOPATH
+// mode and in module mode, across versions of the go command. Other
+// errors, such as that build constraints exclude all the files of the
+// directory, are genuine, and are not replaced by the overlay.
+var missingPackageErrors = []*regexp.Regexp{
+	regexp.MustCompile(`^no Go files in (\S.*)$`),
+	regexp.MustCompile(`^cannot find package "[^"]*" in any of:`),
+	regexp.MustCompile(`^cannot find package "[^"]*" in:`),
+	regexp.MustCompile(`^cannot find module providing package \S+`),
+	regexp.MustCompile(`^no required module provides package \S+`),
+	regexp.MustCompile(`^stat \S+: directory not found$`),
+}
+
+// isMissingPackageError reports whether err is the error of go list
+// for a package that does not exist on disk.
+func isMissingPackageError(err Error) bool {
+	if err.Pos != "" {
+		return false
+	}
+	for _, re := range missingPackageErrors {
+		m := re.FindStringSubmatch(err.Msg)
+		if m == nil {
+			continue
+		}
+		// The go command reports "no Go files in" with a directory,
+		// but also, for instance, "no Go files in directory owned by
+		// another module".
+		if len(m) > 1 && !filepath.IsAbs(m[1]) {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// isPlaceholder reports whether pkg is the package that go list
+// reports, with an error, for a directory with no Go files, and that
+// has the given id.
+func isPlaceholder(pkg *Package, id string) bool {
+	if pkg.ID != id {
+		return false
+	}
+	if len(pkg.Errors) != 1 || !isMissingPackageError(pkg.Errors[0]) {
+		return false
+	}
+	if pkg.Name != "" || pkg.ExportFile != "" {
+		return false
+	}
+	if len(pkg.GoFiles) > 0 || len(pkg.CompiledGoFiles) > 0 || len(pkg.OtherFiles) > 0 {
+		return false
+	}
+	return len(pkg.Imports) == 0
+}
+
+// markOverlayPackages sets FromOverlay for each package of the
+// response all of whose Go files are files of overlay that do not
+// exist on disk.
+func markOverlayPackages(response *responseDeduper, cfg *Config) {
+	if !cfg.hasOverlay() {
+		return
+	}
+	for _, pkg := range response.dr.Packages {
+		pkg.FromOverlay = len(pkg.GoFiles) > 0
+		for _, filename := range pkg.GoFiles {
+			if !cfg.inOverlay(filename) {
+				pkg.FromOverlay = false
+				break
+			}
+			if _, err := os.Stat(filename); err == nil {
+				pkg.FromOverlay = false
+				break
+			}
+		}
+	}
+}
+
+// addUnparsableFile adds the overlay file opath, whose package clause
+// could not be parsed, to the packages in its directory that would
+// contain it, along with the parse error err; it returns their IDs.
+// A non-test file belongs to every package in the directory other than
+// an x test; a test file belongs to the test variants, or, if there
+// are none, to the package itself. If there is no package in the
+// directory, it adds a package, without a name, with only that file.
+//
+// The file is not added to CompiledGoFiles, as it cannot be compiled.
+func (state *golistState) addUnparsableFile(response *responseDeduper, index *dirIndex, opath string, err error) ([]string, error) {
+	dir := filepath.Dir(opath)
+	isTestFile := strings.HasSuffix(opath, "_test.go")
+	var pkgs, variants []*Package
+	for _, p := range index.lookup(dir) {
+		switch {
+		case strings.HasSuffix(p.Name, "_test"):
+			// An x test.
+		case isTestVariant(p):
+			variants = append(variants, p)
+			if !isTestFile {
+				pkgs = append(pkgs, p)
+			}
+		default:
+			pkgs = append(pkgs, p)
+		}
+	}
+	if isTestFile && len(variants) > 0 {
+		pkgs = variants
+	}
+	if len(pkgs) == 0 {
+		pkgPath, ok, err := state.getPkgPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+		var pkg *Package
+		for _, p := range response.dr.Packages {
+			if isPlaceholder(p, pkgPath) {
+				pkg = p
+				pkg.Errors = nil
+				break
+			}
+		}
+		if pkg == nil {
+			pkg = &Package{
+				ID:      pkgPath,
+				PkgPath: pkgPath,
+				Imports: make(map[string]*Package),
+			}
+			response.addPackage(pkg)
+			if response.seenPackages[pkg.ID] != pkg {
+				return nil, nil
+			}
+			index.addPackage(pkg)
+		}
+		if err := state.setModule(pkg, dir); err != nil {
+			return nil, err
+		}
+		pkgs = []*Package{pkg}
+	}
+
+	errs := parseErrors(err)
+	var ids []string
+	for _, p := range pkgs {
+		fileExists := false
+		for _, f := range p.GoFiles {
+			if sameFile(f, opath) {
+				fileExists = true
+			}
+		}
+		if !fileExists {
+			p.GoFiles = append(p.GoFiles, opath)
+			index.addFile(p, opath)
+		}
+		p.Errors = append(p.Errors, errs...)
+		ids = append(ids, p.ID)
+	}
+	return ids, nil
+}
+
+// parseErrors converts an error returned by the parser into Errors.
+func parseErrors(err error) []Error {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		return []Error{{Pos: "-", Msg: err.Error(), Kind: ParseError}}
+	}
+	var errs []Error
+	for _, err := range list {
+		errs = append(errs, Error{
+			Pos:  err.Pos.String(),
+			Msg:  err.Msg,
+			Kind: ParseError,
+		})
+	}
+	return errs
+}
+
+// extractPackageName returns the package name of the file filename
+// with the given contents. Errors in its imports are ignored.
+func (state *golistState) extractPackageName(filename string, contents []byte) (string, error) {
+	f, err := state.parseHeader(filename, contents)
+	if f != nil && f.Name != nil && f.Name.Name != "" {
+		// The parser stops at an invalid package clause, so any
+		// error is in the imports.
+		return f.Name.Name, nil
 	}
-	return f.Name.Name, true
+	return "", err
 }
 
 func commonDir(a []string) string {
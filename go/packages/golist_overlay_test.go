@@ -0,0 +1,589 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// BenchmarkProcessGolistOverlay measures the matching of overlay files
+// to the packages of a large response.
+func BenchmarkProcessGolistOverlay(b *testing.B) {
+	const npkgs, noverlays = 10000, 50
+	root := filepath.FromSlash("/nonexistent/src")
+	var pkgs []*Package
+	for i := 0; i < npkgs; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("p%d", i))
+		files := []string{filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")}
+		pkgs = append(pkgs, &Package{
+			ID:              fmt.Sprintf("example.com/p%d", i),
+			Name:            fmt.Sprintf("p%d", i%10), // names recur across directories
+			PkgPath:         fmt.Sprintf("example.com/p%d", i),
+			GoFiles:         files,
+			CompiledGoFiles: files,
+			Imports:         map[string]*Package{},
+		})
+	}
+	overlay := make(map[string][]byte)
+	for i := 0; i < noverlays; i++ {
+		p := pkgs[i*npkgs/noverlays]
+		overlay[p.GoFiles[0]] = []byte("package " + p.Name + "\n")
+	}
+	state := &golistState{
+		cfg:        &Config{Overlay: overlay},
+		vendorDirs: map[string]bool{},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response := newDeduper()
+		response.addAll(&driverResponse{Packages: pkgs})
+		if _, _, err := state.processGolistOverlay(response); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestProcessGolistOverlayDeterministic checks that the packages
+// modified and needed by an overlay are reported in the same order
+// every time.
+func TestProcessGolistOverlayDeterministic(t *testing.T) {
+	root := filepath.FromSlash("/nonexistent/src")
+	newResponse := func() *responseDeduper {
+		response := newDeduper()
+		for i := 0; i < 10; i++ {
+			dir := filepath.Join(root, fmt.Sprintf("p%d", i))
+			files := []string{filepath.Join(dir, "a.go")}
+			response.addPackage(&Package{
+				ID:              fmt.Sprintf("example.com/p%d", i),
+				Name:            fmt.Sprintf("p%d", i),
+				PkgPath:         fmt.Sprintf("example.com/p%d", i),
+				GoFiles:         files,
+				CompiledGoFiles: files,
+				Imports:         map[string]*Package{},
+			})
+		}
+		return response
+	}
+	overlay := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		src := fmt.Sprintf("package p%d\n\nimport (\n", i)
+		for j := 0; j < 5; j++ {
+			src += fmt.Sprintf("\t_ \"example.com/new%d\"\n", 5*i+j)
+		}
+		src += ")\n"
+		// Modify one file of the package and add another.
+		dir := filepath.Join(root, fmt.Sprintf("p%d", i))
+		overlay[filepath.Join(dir, "a.go")] = []byte(src)
+		overlay[filepath.Join(dir, "b.go")] = []byte(fmt.Sprintf("package p%d\n", i))
+	}
+	state := &golistState{
+		cfg:        &Config{Overlay: overlay},
+		vendorDirs: map[string]bool{},
+	}
+	// Resolve imports as in module mode, without running go env.
+	state.envOnce.Do(func() {
+		state.goEnv = map[string]string{"GOMOD": filepath.Join(root, "go.mod")}
+	})
+
+	var wantModified, wantNeed []string
+	for i := 0; i < 10; i++ {
+		modified, need, err := state.processGolistOverlay(newResponse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if len(modified) != 10 || len(need) != 50 {
+				t.Fatalf("got %d modified and %d needed packages, want 10 and 50", len(modified), len(need))
+			}
+			wantModified, wantNeed = modified, need
+			continue
+		}
+		if !reflect.DeepEqual(modified, wantModified) {
+			t.Errorf("run %d: modified packages %v, want %v", i, modified, wantModified)
+		}
+		if !reflect.DeepEqual(need, wantNeed) {
+			t.Errorf("run %d: needed packages %v, want %v", i, need, wantNeed)
+		}
+	}
+}
+
+func TestAbsOverlayPath(t *testing.T) {
+	for _, test := range []struct {
+		dir, filename string
+		windows       bool
+		want          string // or "error"
+	}{
+		{"/w", "a/a.go", false, "/w/a/a.go"},
+		{"/w", "./a/../b/./b.go", false, "/w/b/b.go"},
+		{"/w", "/x//y/../z.go", false, "/x/z.go"},
+		{"", "a.go", false, "error"},
+		{`C:\w`, `a/b\c.go`, true, `C:\w\a\b\c.go`},
+		{`c:\w`, `.\a\..\b/b.go`, true, `C:\w\b\b.go`},
+		{`C:\w`, `d:/x\y.go`, true, `D:\x\y.go`},
+		{`C:\w`, `\x/y.go`, true, `C:\x\y.go`},
+		{`C:\w`, `c:a.go`, true, `C:\w\a.go`},
+		{`C:\w`, `D:a.go`, true, "error"},
+		{`\\host\share\w`, `a\..\b.go`, true, `\\host\share\w\b.go`},
+		{`C:\w`, `//host/share/x\y.go`, true, `\\host\share\x\y.go`},
+		{"", `C:\x.go`, true, `C:\x.go`},
+		{"", `x.go`, true, "error"},
+	} {
+		got, err := absOverlayPath(test.dir, test.filename, test.windows)
+		if err != nil {
+			got = "error"
+		}
+		if got != test.want {
+			t.Errorf("absOverlayPath(%q, %q, %t) = %q, %v; want %q", test.dir, test.filename, test.windows, got, err, test.want)
+		}
+	}
+}
+
+// TestOverlayFile checks the file that the go command is given by its
+// -overlay flag, which must replace files that need not exist on disk
+// and be removed afterwards.
+func TestOverlayFile(t *testing.T) {
+	root, err := filepath.Abs(filepath.FromSlash("/nonexistent/src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gomod, newFile, deleted := filepath.Join(root, "go.mod"), filepath.Join(root, "a", "new.go"), filepath.Join(root, "a", "a.go")
+	for _, legacy := range []bool{false, true} {
+		state := &golistState{cfg: &Config{
+			Overlay: map[string][]byte{
+				gomod:   []byte("module example.com\n"),
+				newFile: []byte("package a\n"),
+			},
+			DeletedFiles: []string{deleted},
+		}}
+		state.envOnce.Do(func() {
+			state.goEnv = map[string]string{"GOVERSION": "go1.16"}
+		})
+		legacyOverlay = legacy
+		overlay, err := state.overlayFile()
+		legacyOverlay = false
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(overlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed struct{ Replace map[string]string }
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for filename, tmp := range parsed.Replace {
+			got[filename] = "deleted"
+			if tmp != "" {
+				contents, err := ioutil.ReadFile(tmp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[filename] = string(contents)
+			}
+		}
+		want := map[string]string{gomod: "module example.com\n"}
+		if !legacy {
+			want[newFile] = "package a\n"
+			want[deleted] = "deleted"
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("legacy=%t: overlay file replaces %v, want %v", legacy, got, want)
+		}
+
+		state.removeOverlayFile()
+		if _, err := os.Stat(filepath.Dir(overlay)); !os.IsNotExist(err) {
+			t.Errorf("legacy=%t: after removeOverlayFile, got %v, want the overlay directory to be removed", legacy, err)
+		}
+	}
+}
+
+// BenchmarkOverlayHeaders measures the parsing of the package clauses
+// and imports of a few hundred overlay files, each of which adds an
+// import to a package of the response.
+func BenchmarkOverlayHeaders(b *testing.B) {
+	const n = 300
+	root := filepath.FromSlash("/nonexistent/src")
+	var pkgs []*Package
+	overlay := make(map[string][]byte)
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("p%d", i))
+		files := []string{filepath.Join(dir, "a.go")}
+		pkgs = append(pkgs, &Package{
+			ID:              fmt.Sprintf("example.com/p%d", i),
+			Name:            fmt.Sprintf("p%d", i),
+			PkgPath:         fmt.Sprintf("example.com/p%d", i),
+			GoFiles:         files,
+			CompiledGoFiles: files,
+			Imports:         map[string]*Package{},
+		})
+		overlay[files[0]] = []byte(fmt.Sprintf("package p%d\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc F() { fmt.Println(os.Args) }\n", i))
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		state := &golistState{
+			cfg:        &Config{Overlay: overlay},
+			vendorDirs: map[string]bool{},
+		}
+		state.envOnce.Do(func() {
+			state.goEnv = map[string]string{"GOMOD": filepath.Join(root, "go.mod")}
+		})
+		response := newDeduper()
+		response.addAll(&driverResponse{Packages: pkgs})
+		if _, _, err := state.processGolistOverlay(response); err != nil {
+			b.Fatal(err)
+		}
+		for _, p := range pkgs {
+			p.Imports = map[string]*Package{}
+		}
+	}
+}
+
+// TestParseHeader checks that the package clause and imports of an
+// overlay file are parsed once, into the FileSet of the Config, so that
+// the positions of their syntax and of their errors resolve through it.
+func TestParseHeader(t *testing.T) {
+	fset := token.NewFileSet()
+	state := &golistState{cfg: &Config{Fset: fset}}
+	filename := filepath.Join(filepath.FromSlash("/nonexistent/src"), "a", "a.go")
+	contents := []byte("package a\n\nimport (\n\t\"fmt\"\n\t\"os\n)\n")
+
+	if name, err := state.extractPackageName(filename, contents); name != "a" || err != nil {
+		t.Errorf("extractPackageName = %q, %v; want a and no error", name, err)
+	}
+	_, err := state.extractImports(filename, contents)
+	list, ok := err.(scanner.ErrorList)
+	if !ok || len(list) == 0 {
+		t.Fatalf("extractImports returned error %v, want a scanner.ErrorList", err)
+	}
+	f, _ := state.parseHeader(filename, contents)
+	if again, _ := state.parseHeader(filename, contents); again != f {
+		t.Error("the file was parsed again with the same contents")
+	}
+
+	if got, want := fset.Position(f.Imports[0].Path.Pos()).String(), filename+":4:2"; got != want {
+		t.Errorf("position of the first import = %s, want %s", got, want)
+	}
+	tf := fset.File(f.Package)
+	if tf == nil {
+		t.Fatal("the file is not in the FileSet of the Config")
+	}
+	if got, want := fset.Position(tf.Pos(list[0].Pos.Offset)), list[0].Pos; got != want {
+		t.Errorf("position of the error through the FileSet = %v, want %v", got, want)
+	}
+
+	if changed, _ := state.parseHeader(filename, []byte("package b\n")); changed == f || changed.Name.Name != "b" {
+		t.Errorf("after changing the contents, got package %s, want b, parsed again", changed.Name.Name)
+	}
+}
+
+func TestReclaimPackage(t *testing.T) {
+	dir := filepath.Join(filepath.FromSlash("/nonexistent/src"), "x", "nope")
+	tests := []struct {
+		msg     string
+		pos     string
+		reclaim bool
+	}{
+		// GOPATH mode.
+		{msg: `cannot find package "x/nope" in any of:` + "\n\t/usr/lib/go/src/x/nope (from $GOROOT)", reclaim: true},
+		{msg: "no Go files in " + dir, reclaim: true},
+		// Module mode.
+		{msg: "cannot find module providing package example.com/x/nope: module example.com/x/nope: not found", reclaim: true},
+		{msg: "no required module provides package example.com/x/nope; to add it:\n\tgo get example.com/x/nope", reclaim: true},
+		{msg: "stat " + dir + ": directory not found", reclaim: true},
+		// Genuine errors.
+		{msg: "build constraints exclude all Go files in " + dir},
+		{msg: "no Go files in directory owned by another module"},
+		{msg: "no Go files in " + dir, pos: filepath.Join(dir, "a.go") + ":1:1"},
+		{msg: "import cycle not allowed"},
+	}
+	for _, test := range tests {
+		pkg := &Package{
+			ID:     "x/nope",
+			Errors: []Error{{Pos: test.pos, Msg: test.msg, Kind: ListError}},
+		}
+		if got := reclaimPackage(pkg, "x/nope", "nope"); got != test.reclaim {
+			t.Errorf("reclaimPackage with error %q at %q = %t, want %t", test.msg, test.pos, got, test.reclaim)
+			continue
+		}
+		if test.reclaim {
+			if pkg.Name != "nope" || len(pkg.Errors) != 0 {
+				t.Errorf("reclaimed package with error %q has name %q and errors %v, want nope and none", test.msg, pkg.Name, pkg.Errors)
+			}
+		} else if pkg.Name != "" || len(pkg.Errors) != 1 || pkg.Errors[0].Msg != test.msg {
+			t.Errorf("package with error %q was changed to name %q and errors %v", test.msg, pkg.Name, pkg.Errors)
+		}
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	for _, test := range []struct {
+		flags []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"-tags=a,b"}, []string{"a", "b"}},
+		{[]string{"--tags", "a b"}, []string{"a", "b"}},
+		{[]string{"-tags=a", "-mod=mod", "-tags=b"}, []string{"b"}},
+		{[]string{"-tags="}, nil},
+		{[]string{"-x", "-tags"}, nil},
+	} {
+		if got := buildTags(test.flags); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("buildTags(%q) = %q, want %q", test.flags, got, test.want)
+		}
+	}
+}
+
+// TestOverlayTestVariantWithoutTestFiles checks that a test file added
+// by an overlay goes to the test variant of its package even if none of
+// the test files of the variant are among its GoFiles, as when build
+// constraints exclude them, so that only its ForTest or its ID tells it
+// from the package itself.
+func TestOverlayTestVariantWithoutTestFiles(t *testing.T) {
+	dir := filepath.Join(filepath.FromSlash("/nonexistent/src"), "p")
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b_test.go")
+	for _, forTest := range []string{"example.com/p", ""} {
+		prod := &Package{
+			ID:              "example.com/p",
+			Name:            "p",
+			PkgPath:         "example.com/p",
+			GoFiles:         []string{a},
+			CompiledGoFiles: []string{a},
+			Imports:         map[string]*Package{},
+		}
+		variant := &Package{
+			ID:              "example.com/p [example.com/p.test]",
+			Name:            "p",
+			PkgPath:         "example.com/p",
+			GoFiles:         []string{a},
+			CompiledGoFiles: []string{a},
+			Imports:         map[string]*Package{},
+			forTest:         forTest,
+		}
+		state := &golistState{
+			cfg:        &Config{Overlay: map[string][]byte{b: []byte("package p\n")}},
+			vendorDirs: map[string]bool{},
+		}
+		response := newDeduper()
+		response.addAll(&driverResponse{Packages: []*Package{variant, prod}})
+		if _, _, err := state.processGolistOverlay(response); err != nil {
+			t.Fatal(err)
+		}
+		if !containsFile(variant.GoFiles, b) || containsFile(prod.GoFiles, b) {
+			t.Errorf("with ForTest %q, the test file went to %v of the package and %v of the variant, want only the variant", forTest, prod.GoFiles, variant.GoFiles)
+		}
+	}
+}
+
+func TestIsTestVariant(t *testing.T) {
+	for _, test := range []struct {
+		pkg  *Package
+		want bool
+	}{
+		{&Package{ID: "p", GoFiles: []string{"a.go"}}, false},
+		{&Package{ID: "p.test", GoFiles: []string{"_testmain.go"}}, false},
+		{&Package{ID: "p [p.test]", GoFiles: []string{"a.go"}}, true},
+		{&Package{ID: "p_test [p.test]", GoFiles: []string{"x_test.go"}}, true},
+		{&Package{ID: "q", GoFiles: []string{"a.go"}, forTest: "p"}, true},
+		{&Package{ID: "p", GoFiles: []string{"a.go", "a_test.go"}}, true},
+		{&Package{ID: "p", CompiledGoFiles: []string{"a_test.go"}}, true},
+	} {
+		if got := isTestVariant(test.pkg); got != test.want {
+			t.Errorf("isTestVariant(ID %q, GoFiles %v, CompiledGoFiles %v, ForTest %q) = %t, want %t",
+				test.pkg.ID, test.pkg.GoFiles, test.pkg.CompiledGoFiles, test.pkg.forTest, got, test.want)
+		}
+	}
+}
+
+// TestOverlayIntermediateTestVariant checks that a file and the import
+// that an overlay adds to a package are added to the copy of the
+// package that go list reports for the tests of another, too, whichever
+// of them comes first.
+func TestOverlayIntermediateTestVariant(t *testing.T) {
+	root := filepath.FromSlash("/nonexistent/src")
+	a, b := filepath.Join(root, "a", "a.go"), filepath.Join(root, "b", "b.go")
+	b2 := filepath.Join(root, "b", "b2.go")
+	for _, copyFirst := range []bool{false, true} {
+		newPkg := func(id, name, pkgPath, forTest string, files []string, imports map[string]*Package) *Package {
+			return &Package{
+				ID:              id,
+				Name:            name,
+				PkgPath:         pkgPath,
+				GoFiles:         files,
+				CompiledGoFiles: files,
+				Imports:         imports,
+				forTest:         forTest,
+			}
+		}
+		b := []*Package{
+			newPkg("example.com/b", "b", "example.com/b", "", []string{b}, map[string]*Package{
+				"example.com/a": {ID: "example.com/a"},
+			}),
+			newPkg("example.com/b [example.com/a.test]", "b", "example.com/b", "example.com/a", []string{b}, map[string]*Package{
+				"example.com/a": {ID: "example.com/a [example.com/a.test]"},
+			}),
+		}
+		if copyFirst {
+			b[0], b[1] = b[1], b[0]
+		}
+		pkgs := append([]*Package{
+			newPkg("example.com/a", "a", "example.com/a", "", []string{a}, map[string]*Package{}),
+			newPkg("example.com/a [example.com/a.test]", "a", "example.com/a", "example.com/a", []string{a}, map[string]*Package{}),
+			newPkg("example.com/a_test [example.com/a.test]", "a_test", "example.com/a_test", "example.com/a",
+				[]string{filepath.Join(root, "a", "x_test.go")}, map[string]*Package{
+					"example.com/a": {ID: "example.com/a [example.com/a.test]"},
+					"example.com/b": {ID: "example.com/b [example.com/a.test]"},
+				}),
+		}, b...)
+		state := &golistState{
+			cfg:        &Config{Overlay: map[string][]byte{b2: []byte("package b\n\nimport \"example.com/c\"\n")}},
+			vendorDirs: map[string]bool{},
+		}
+		response := newDeduper()
+		response.addAll(&driverResponse{Packages: pkgs})
+		modified, _, err := state.processGolistOverlay(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		variant := response.seenPackages["example.com/b [example.com/a.test]"]
+		if !containsFile(variant.GoFiles, b2) {
+			t.Errorf("copy first %t: %s has files %v, want %s too", copyFirst, variant.ID, variant.GoFiles, b2)
+		}
+		if _, ok := variant.Imports["example.com/c"]; !ok {
+			t.Errorf("copy first %t: %s has imports %v, want example.com/c too", copyFirst, variant.ID, variant.Imports)
+		}
+		var found bool
+		for _, id := range modified {
+			found = found || id == variant.ID
+		}
+		if !found {
+			t.Errorf("copy first %t: modified packages %v lack %s", copyFirst, modified, variant.ID)
+		}
+	}
+}
+
+func TestOverlayOtherFile(t *testing.T) {
+	root := filepath.FromSlash("/nonexistent/src")
+	a := filepath.Join(root, "a", "a.go")
+	asm := filepath.Join(root, "a", "a_amd64.s")
+	pkgs := []*Package{
+		{ID: "example.com/a", Name: "a", PkgPath: "example.com/a", GoFiles: []string{a}, CompiledGoFiles: []string{a},
+			EmbedPatterns: []string{"static"}, Imports: map[string]*Package{}},
+		{ID: "example.com/a [example.com/a.test]", Name: "a", PkgPath: "example.com/a", GoFiles: []string{a}, CompiledGoFiles: []string{a},
+			Imports: map[string]*Package{}, forTest: "example.com/a"},
+	}
+	state := &golistState{
+		cfg: &Config{Overlay: map[string][]byte{
+			asm: []byte("TEXT ·f(SB),0,$0\n"),
+			filepath.Join(root, "a", "static", "x.css"):       []byte("body {}"),
+			filepath.Join(root, "a", "static", "_x.css"):      []byte("body {}"),
+			filepath.Join(root, "unknown", "unknown_amd64.s"): []byte("TEXT ·g(SB),0,$0\n"),
+		}},
+		vendorDirs: map[string]bool{},
+	}
+	response := newDeduper()
+	response.addAll(&driverResponse{Packages: pkgs})
+	modified, _, err := state.processGolistOverlay(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/a", "example.com/a [example.com/a.test]"}; !reflect.DeepEqual(modified, want) {
+		t.Errorf("got modified packages %v, want %v", modified, want)
+	}
+	for _, p := range pkgs {
+		if want := []string{asm}; !reflect.DeepEqual(p.OtherFiles, want) {
+			t.Errorf("%s has other files %v, want %v", p.ID, p.OtherFiles, want)
+		}
+	}
+	if want := []string{filepath.Join(root, "a", "static", "x.css")}; !reflect.DeepEqual(pkgs[0].EmbedFiles, want) {
+		t.Errorf("%s embeds %v, want %v", pkgs[0].ID, pkgs[0].EmbedFiles, want)
+	}
+}
+
+func TestEmbedMatches(t *testing.T) {
+	for _, test := range []struct {
+		pattern, rel string
+		want         bool
+	}{
+		{"x.txt", "x.txt", true},
+		{"*.txt", "x.txt", true},
+		{"*.txt", "d/x.txt", false},
+		{"d", "d/x.txt", true},
+		{"d", "d/e/x.txt", true},
+		{"d", "d/.x.txt", false},
+		{"d", "d/_e/x.txt", false},
+		{"all:d", "d/_e/x.txt", true},
+		{"d/.x.txt", "d/.x.txt", true},
+		{"e", "d/x.txt", false},
+	} {
+		if got := embedMatches(test.pattern, test.rel); got != test.want {
+			t.Errorf("embedMatches(%q, %q) = %t, want %t", test.pattern, test.rel, got, test.want)
+		}
+	}
+}
+
+func TestOverlayReclaimedPackageFiles(t *testing.T) {
+	root := filepath.FromSlash("/nonexistent/src")
+	dir := filepath.Join(root, "n")
+	files := []string{filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go"), filepath.Join(dir, "c.go")}
+	overlay := make(map[string][]byte)
+	for _, f := range files {
+		overlay[f] = []byte("package n\n")
+	}
+	placeholder := &Package{
+		ID:      "example.com/n",
+		PkgPath: "example.com/n",
+		Errors:  []Error{{Msg: `cannot find package "example.com/n" in any of:`, Kind: ListError}},
+		Imports: map[string]*Package{},
+	}
+	state := &golistState{
+		cfg:        &Config{Overlay: overlay, OverlayDebug: true},
+		vendorDirs: map[string]bool{},
+		rootDirs:   map[string]string{root: "example.com"},
+	}
+	state.rootsOnce.Do(func() {})
+	state.envOnce.Do(func() {})
+	state.goEnv = map[string]string{}
+	response := newDeduper()
+	response.addAll(&driverResponse{Packages: []*Package{placeholder}})
+	modified, _, err := state.processGolistOverlay(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.dr.Packages) != 1 {
+		var ids []string
+		for _, p := range response.dr.Packages {
+			ids = append(ids, fmt.Sprintf("%s %v", p.ID, p.GoFiles))
+		}
+		t.Fatalf("got packages %v, want only the reclaimed one", ids)
+	}
+	if !reflect.DeepEqual(placeholder.GoFiles, files) || !reflect.DeepEqual(placeholder.CompiledGoFiles, files) {
+		t.Errorf("reclaimed package has files %v and compiled files %v, want %v", placeholder.GoFiles, placeholder.CompiledGoFiles, files)
+	}
+	if placeholder.Name != "n" || len(placeholder.Errors) > 0 {
+		t.Errorf("reclaimed package has name %q and errors %v, want n and none", placeholder.Name, placeholder.Errors)
+	}
+	if want := []string{"example.com/n"}; !reflect.DeepEqual(modified, want) {
+		t.Errorf("got modified packages %v, want %v", modified, want)
+	}
+	for i, d := range state.overlayTrace {
+		created := ""
+		if i == 0 {
+			created = "reclaimed"
+		}
+		if d.Existed || d.Created != created || !reflect.DeepEqual(d.Packages, []string{"example.com/n"}) {
+			t.Errorf("file %s: got existed %t, created %q, packages %v; want false, %q, [example.com/n]", d.File, d.Existed, d.Created, d.Packages, created)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// goListOutput returns the JSON that go list -deps -test writes for
+// npkgs packages of a module, each of which imports the five before it
+// and has an in-package test variant.
+func goListOutput(npkgs int) []byte {
+	root := filepath.FromSlash("/nonexistent/src/example.com")
+	mod := &Module{Path: "example.com", Dir: root, GoMod: filepath.Join(root, "go.mod"), Main: true}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := 0; i < npkgs; i++ {
+		pkgPath := fmt.Sprintf("example.com/p%d", i)
+		p := map[string]interface{}{
+			"ImportPath":     pkgPath,
+			"Dir":            filepath.Join(root, fmt.Sprintf("p%d", i)),
+			"Name":           fmt.Sprintf("p%d", i),
+			"GoFiles":        []string{"a.go", "b.go", "c.go"},
+			"IgnoredGoFiles": []string{"d_windows.go"},
+			"EmbedPatterns":  []string{"testdata"},
+			"EmbedFiles":     []string{"testdata/x.txt"},
+			"TestGoFiles":    []string{"a_test.go"},
+			"TestImports":    []string{"testing"},
+			"Module":         mod,
+		}
+		var imports, deps []string
+		for j := i - 5; j < i; j++ {
+			if j >= 0 {
+				imports = append(imports, fmt.Sprintf("example.com/p%d", j))
+			}
+		}
+		for j := 0; j < i && j < 50; j++ {
+			deps = append(deps, fmt.Sprintf("example.com/p%d", j))
+		}
+		p["Imports"], p["Deps"] = imports, deps
+		if err := enc.Encode(p); err != nil {
+			panic(err)
+		}
+		p["ImportPath"] = fmt.Sprintf("%s [%s.test]", pkgPath, pkgPath)
+		p["ForTest"] = pkgPath
+		p["GoFiles"] = []string{"a.go", "b.go", "c.go", "a_test.go"}
+		p["Imports"] = append(imports, "testing")
+		if err := enc.Encode(p); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkDecodeGoList measures the decoding of the output of go list
+// for a large module.
+func BenchmarkDecodeGoList(b *testing.B) {
+	data := goListOutput(25000) // 50000 packages, with the test variants
+	state := &golistState{cfg: &Config{Mode: NeedName | NeedFiles | NeedImports | NeedDeps}}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response, err := state.decodeGoList(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(response.Packages) != 50000 {
+			b.Fatalf("got %d packages, want 50000", len(response.Packages))
+		}
+	}
+}
+
+// TestDecodeGoList checks that decoding the output of go list keeps
+// only what the Mode needs, shares what packages have in common, and
+// leaves every package to the overlay.
+func TestDecodeGoList(t *testing.T) {
+	data := goListOutput(10)
+	for _, test := range []struct {
+		mode                  LoadMode
+		wantIgnored, wantEmbs bool
+	}{
+		{NeedName | NeedFiles | NeedImports, true, false},
+		{NeedName | NeedImports | NeedEmbedFiles, false, true},
+	} {
+		state := &golistState{cfg: &Config{Mode: test.mode}}
+		response, err := state.decodeGoList(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Packages) != 20 {
+			t.Fatalf("%v: got %d packages, want 20", test.mode, len(response.Packages))
+		}
+		pkgs := make(map[string]*Package)
+		for _, p := range response.Packages {
+			pkgs[p.ID] = p
+			if got := len(p.IgnoredFiles) > 0; got != test.wantIgnored {
+				t.Errorf("%v: package %s has IgnoredFiles %v", test.mode, p.ID, p.IgnoredFiles)
+			}
+			if got := len(p.EmbedFiles) > 0; got != test.wantEmbs {
+				t.Errorf("%v: package %s has EmbedFiles %v", test.mode, p.ID, p.EmbedFiles)
+			}
+		}
+		p5, p6 := pkgs["example.com/p5"], pkgs["example.com/p6"]
+		if p5.Module == nil || p5.Module != p6.Module {
+			t.Errorf("%v: packages have modules %p and %p, want the same", test.mode, p5.Module, p6.Module)
+		}
+		if p5.Imports["example.com/p4"] != p6.Imports["example.com/p4"] {
+			t.Errorf("%v: packages import distinct stubs of example.com/p4", test.mode)
+		}
+
+		// The overlay is matched to packages after all of them have
+		// been decoded: a new file belongs to the test variant, which
+		// contains the files of its package.
+		filename := filepath.Join(filepath.Dir(p5.GoFiles[0]), "new.go")
+		state.cfg.Overlay = map[string][]byte{filename: []byte("package p5\n")}
+		state.vendorDirs = map[string]bool{}
+		dedup := newDeduper()
+		dedup.addAll(response)
+		if _, _, err := state.processGolistOverlay(dedup); err != nil {
+			t.Fatal(err)
+		}
+		if p := dedup.seenPackages["example.com/p5 [example.com/p5.test]"]; p == nil || !containsFile(p.GoFiles, filename) {
+			t.Errorf("%v: the test variant of example.com/p5 does not have the file of the overlay", test.mode)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"sort"
+	"strings"
+)
+
+// An ImportGraph is the reverse of an import graph: it maps each of its
+// packages to those that import it, such as to find the packages that a
+// change to some packages affects. Packages are identified by their IDs.
+type ImportGraph struct {
+	byID      map[string]*Package
+	order     map[string]int      // index of each package in the postorder of Visit
+	importers map[string][]string // direct importers, in order
+	variants  map[string][]string // test variants of each package, in order
+}
+
+// NewImportGraph returns the reverse of the import graph whose roots
+// are all, which includes the packages that they import.
+func NewImportGraph(all []*Package) *ImportGraph {
+	roots := make([]*Package, len(all))
+	copy(roots, all)
+	sort.Slice(roots, func(i, j int) bool { return roots[i].ID < roots[j].ID })
+
+	g := &ImportGraph{
+		byID:      make(map[string]*Package),
+		order:     make(map[string]int),
+		importers: make(map[string][]string),
+		variants:  make(map[string][]string),
+	}
+	var pkgs []*Package
+	Visit(roots, nil, func(pkg *Package) {
+		if _, ok := g.byID[pkg.ID]; !ok {
+			g.byID[pkg.ID] = pkg
+			g.order[pkg.ID] = len(pkgs)
+			pkgs = append(pkgs, pkg)
+		}
+	})
+	// The postorder puts the packages in topological order, imports
+	// first, which the lists of importers and variants keep.
+	for _, pkg := range pkgs {
+		seen := make(map[string]bool, len(pkg.Imports))
+		for _, imp := range pkg.Imports {
+			if !seen[imp.ID] {
+				seen[imp.ID] = true
+				g.importers[imp.ID] = append(g.importers[imp.ID], pkg.ID)
+			}
+		}
+		if id := testVariantOf(pkg.ID); id != pkg.ID {
+			g.variants[id] = append(g.variants[id], pkg.ID)
+		}
+	}
+	return g
+}
+
+// Importers returns the packages of the graph that import pkg directly,
+// in topological order, imports first. A package that imports a test
+// variant of pkg, such as "b [a.test]" for b, which is compiled from
+// the same files, is an importer of pkg too, but not the other way
+// around.
+func (g *ImportGraph) Importers(pkg *Package) []*Package {
+	return g.packages(g.importerIDs(pkg.ID))
+}
+
+// TransitiveImporters returns the packages of the graph that import one
+// of pkgs, directly or indirectly, as Importers reports them, in
+// topological order, imports first. One of pkgs is among them only if it
+// imports another, as in a cycle.
+func (g *ImportGraph) TransitiveImporters(pkgs ...*Package) []*Package {
+	seen := make(map[string]bool)
+	var ids []string
+	var queue []string
+	for _, pkg := range pkgs {
+		queue = append(queue, pkg.ID)
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, importer := range g.importerIDs(id) {
+			if !seen[importer] {
+				seen[importer] = true
+				ids = append(ids, importer)
+				queue = append(queue, importer)
+			}
+		}
+	}
+	g.sort(ids)
+	return g.packages(ids)
+}
+
+// ReverseDeps returns the packages of the import graph whose roots are
+// all that import one of targets, directly or indirectly, in
+// topological order, imports first. It is shorthand for
+// NewImportGraph(all).TransitiveImporters(targets...).
+func ReverseDeps(all []*Package, targets ...*Package) []*Package {
+	return NewImportGraph(all).TransitiveImporters(targets...)
+}
+
+// importerIDs returns the IDs of the importers of the package id and,
+// unless it is a test variant, of its test variants, in order.
+func (g *ImportGraph) importerIDs(id string) []string {
+	variants := g.variants[id]
+	if len(variants) == 0 {
+		return g.importers[id]
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, v := range append([]string{id}, variants...) {
+		for _, importer := range g.importers[v] {
+			if !seen[importer] {
+				seen[importer] = true
+				ids = append(ids, importer)
+			}
+		}
+	}
+	g.sort(ids)
+	return ids
+}
+
+// sort sorts the IDs of packages of the graph in topological order.
+func (g *ImportGraph) sort(ids []string) {
+	sort.Slice(ids, func(i, j int) bool { return g.order[ids[i]] < g.order[ids[j]] })
+}
+
+// packages returns the packages of the graph with the given IDs.
+func (g *ImportGraph) packages(ids []string) []*Package {
+	pkgs := make([]*Package, len(ids))
+	for i, id := range ids {
+		pkgs[i] = g.byID[id]
+	}
+	return pkgs
+}
+
+// testVariantOf returns the ID of the package of which the package id
+// is a test variant, such as "b" for "b [a.test]", or id itself if it
+// is not one. The suffix of a variant of Config.Variants is kept.
+func testVariantOf(id string) string {
+	for i := strings.Index(id, " ["); i >= 0; {
+		j := strings.IndexByte(id[i:], ']')
+		if j < 0 {
+			break
+		}
+		if strings.HasSuffix(id[i:i+j], ".test") {
+			return id[:i] + id[i+j+1:]
+		}
+		k := strings.Index(id[i+j:], " [")
+		if k < 0 {
+			break
+		}
+		i += j + k
+	}
+	return id
+}
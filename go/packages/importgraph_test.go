@@ -0,0 +1,119 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// graphOf returns the packages of the import graph whose edges are
+// given by ID, with each import keyed by the first word of its ID.
+func graphOf(ids []string, edges [][2]string) map[string]*packages.Package {
+	pkgs := make(map[string]*packages.Package)
+	for _, id := range ids {
+		pkgs[id] = &packages.Package{ID: id, PkgPath: strings.Fields(id)[0], Imports: make(map[string]*packages.Package)}
+	}
+	for _, edge := range edges {
+		from, to := pkgs[edge[0]], pkgs[edge[1]]
+		from.Imports[to.PkgPath] = to
+	}
+	return pkgs
+}
+
+func TestImportGraph(t *testing.T) {
+	// A diamond, a -> b, c -> d, under top, and the test of d, whose
+	// variant "d [d.test]" the external test d_test imports.
+	pkgs := graphOf(
+		[]string{"top", "a", "b", "c", "d", "d [d.test]", "d_test [d.test]", "d.test"},
+		[][2]string{
+			{"top", "a"}, {"a", "b"}, {"a", "c"}, {"b", "d"}, {"c", "d"},
+			{"d_test [d.test]", "d [d.test]"},
+			{"d.test", "d [d.test]"}, {"d.test", "d_test [d.test]"},
+		})
+	var all []*packages.Package
+	for _, pkg := range pkgs {
+		all = append(all, pkg)
+	}
+	g := packages.NewImportGraph(all)
+
+	ids := func(pkgs []*packages.Package) []string {
+		ids := []string{}
+		for _, pkg := range pkgs {
+			ids = append(ids, pkg.ID)
+		}
+		return ids
+	}
+	for _, test := range []struct {
+		pkg        string
+		importers  []string
+		transitive []string
+	}{
+		{
+			pkg:        "d",
+			importers:  []string{"b", "c", "d_test [d.test]", "d.test"},
+			transitive: []string{"b", "c", "a", "d_test [d.test]", "d.test", "top"},
+		},
+		{
+			// The importers of a test variant are not those of the
+			// package.
+			pkg:        "d [d.test]",
+			importers:  []string{"d_test [d.test]", "d.test"},
+			transitive: []string{"d_test [d.test]", "d.test"},
+		},
+		{
+			pkg:        "b",
+			importers:  []string{"a"},
+			transitive: []string{"a", "top"},
+		},
+		{
+			pkg:        "top",
+			importers:  []string{},
+			transitive: []string{},
+		},
+	} {
+		pkg := pkgs[test.pkg]
+		if got := ids(g.Importers(pkg)); !reflect.DeepEqual(got, test.importers) {
+			t.Errorf("Importers(%s) = %v, want %v", test.pkg, got, test.importers)
+		}
+		if got := ids(g.TransitiveImporters(pkg)); !reflect.DeepEqual(got, test.transitive) {
+			t.Errorf("TransitiveImporters(%s) = %v, want %v", test.pkg, got, test.transitive)
+		}
+	}
+
+	// A target that imports another is among the results, and each
+	// result is reported once.
+	got := ids(packages.ReverseDeps(all, pkgs["c"], pkgs["b"], pkgs["a"]))
+	if want := []string{"a", "top"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReverseDeps(c, b, a) = %v, want %v", got, want)
+	}
+}
+
+func BenchmarkImportGraph(b *testing.B) {
+	// Each package p<i> imports p<i-1>, p<i/2>, and p<i/3>.
+	const n = 3000
+	var ids []string
+	var edges [][2]string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("p%d", i))
+		for _, j := range []int{i - 1, i / 2, i / 3} {
+			if j >= 0 && j < i {
+				edges = append(edges, [2]string{ids[i], ids[j]})
+			}
+		}
+	}
+	pkgs := graphOf(ids, edges)
+	all := []*packages.Package{pkgs[ids[n-1]]}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got := len(packages.ReverseDeps(all, pkgs["p0"])); got != n-1 {
+			b.Fatalf("p0 has %d reverse dependencies, want %d", got, n-1)
+		}
+	}
+}
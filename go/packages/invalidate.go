@@ -0,0 +1,213 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Invalidate reports which packages must be loaded again after the
+// files changedFiles have changed, given the packages prev of an
+// earlier load and their dependencies, without running the go command.
+// The contents of a changed file are those of the overlay, if it has
+// them, or else those on disk; a changed file that is in neither has
+// been deleted.
+//
+// As the loader does for the files of an Overlay, Invalidate matches
+// each changed file to the packages of its directory, including their
+// test variants, by its package clause, and its imports to the
+// packages of prev. It returns, in sorted order, the IDs of the
+// packages of prev that the changes affect, either directly or through
+// their imports, and the IDs or package paths of the packages that are
+// not in prev but that the changes add, such as the package of a new
+// directory or a newly imported package. The packages of prev must
+// have been loaded with at least NeedName, NeedFiles and NeedImports;
+// if they lack the information that Invalidate needs, every package is
+// reported as dirty.
+//
+// Invalidate does not modify the packages of prev.
+func Invalidate(prev []*Package, changedFiles []string, overlay map[string][]byte) (dirty, added []string) {
+	// processGolistOverlay modifies the packages of the response, so
+	// it processes copies of them.
+	var old []*Package
+	tests := false
+	response := newDeduper()
+	Visit(prev, nil, func(p *Package) {
+		old = append(old, p)
+		c := *p
+		c.GoFiles = append([]string(nil), p.GoFiles...)
+		c.CompiledGoFiles = append([]string(nil), p.CompiledGoFiles...)
+		c.OtherFiles = append([]string(nil), p.OtherFiles...)
+		c.IgnoredFiles = append([]string(nil), p.IgnoredFiles...)
+		c.EmbedPatterns = append([]string(nil), p.EmbedPatterns...)
+		c.EmbedFiles = append([]string(nil), p.EmbedFiles...)
+		c.Errors = append([]Error(nil), p.Errors...)
+		c.Imports = make(map[string]*Package, len(p.Imports))
+		for path, imp := range p.Imports {
+			c.Imports[path] = &Package{ID: imp.ID}
+		}
+		response.addPackage(&c)
+		if p.forTest != "" || strings.Contains(p.ID, " [") {
+			tests = true
+		}
+	})
+
+	// The changed files are the overlay of the processing, except for
+	// those that have been deleted.
+	cfg := &Config{
+		Mode:    NeedName | NeedFiles | NeedImports,
+		Tests:   tests,
+		Overlay: make(map[string][]byte),
+	}
+	for _, filename := range changedFiles {
+		if abs, err := filepath.Abs(filename); err == nil {
+			filename = abs
+		}
+		if contents, ok := overlay[filename]; ok {
+			cfg.Overlay[filename] = contents
+		} else if contents, err := ioutil.ReadFile(filename); err == nil {
+			cfg.Overlay[filename] = contents
+		} else {
+			cfg.DeletedFiles = append(cfg.DeletedFiles, filename)
+		}
+	}
+	state := &golistState{
+		cfg:        cfg,
+		vendorDirs: map[string]bool{},
+	}
+	state.envOnce.Do(func() {
+		state.goEnv = map[string]string{}
+	})
+	state.rootsOnce.Do(func() {
+		state.rootDirs = inferRootDirs(old)
+	})
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, p := range old {
+		ids = append(ids, p.ID)
+		seen[p.ID] = true
+	}
+	modified, needed, err := state.processGolistOverlay(response)
+	if err != nil {
+		sort.Strings(ids)
+		return ids, nil
+	}
+
+	dirtySet := make(map[string]bool)
+	for _, id := range modified {
+		if seen[id] {
+			dirtySet[id] = true
+		}
+	}
+	// A package whose file has changed is dirty even if it has the
+	// same files and imports as before.
+	for _, p := range old {
+		for _, files := range [][]string{p.GoFiles, p.CompiledGoFiles, p.OtherFiles, p.IgnoredFiles} {
+			for _, filename := range changedFiles {
+				if abs, err := filepath.Abs(filename); err == nil {
+					filename = abs
+				}
+				if containsFile(files, filename) {
+					dirtySet[p.ID] = true
+				}
+			}
+		}
+	}
+	// The overlay processing may add a new non-test file to only the
+	// test variant of its package, but it belongs to both.
+	for _, p := range response.dr.Packages {
+		if !dirtySet[p.ID] || p.forTest == "" || p.PkgPath != p.forTest || !seen[p.forTest] {
+			continue
+		}
+		for _, f := range p.GoFiles {
+			if _, ok := cfg.Overlay[f]; ok && !strings.HasSuffix(f, "_test.go") {
+				dirtySet[p.forTest] = true
+			}
+		}
+	}
+	// So are the test variants of a dirty package, which contain its
+	// files, and the packages that import a dirty one.
+	importers := make(map[string][]string)
+	for _, p := range response.dr.Packages {
+		for _, imp := range p.Imports {
+			importers[imp.ID] = append(importers[imp.ID], p.ID)
+		}
+	}
+	var queue []string
+	for id := range dirtySet {
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		var affected []string
+		affected = append(affected, importers[id]...)
+		if p := response.seenPackages[id]; p != nil && p.forTest == "" {
+			for _, q := range response.dr.Packages {
+				if q.forTest == p.PkgPath && q.PkgPath == p.PkgPath {
+					affected = append(affected, q.ID)
+				}
+			}
+		}
+		for _, a := range affected {
+			if seen[a] && !dirtySet[a] {
+				dirtySet[a] = true
+				queue = append(queue, a)
+			}
+		}
+	}
+	for id := range dirtySet {
+		dirty = append(dirty, id)
+	}
+	sort.Strings(dirty)
+
+	addedSet := make(map[string]bool)
+	for _, p := range response.dr.Packages {
+		if !seen[p.ID] {
+			addedSet[p.ID] = true
+		}
+	}
+	for _, pkgPath := range needed {
+		if !seen[pkgPath] {
+			addedSet[pkgPath] = true
+		}
+	}
+	for id := range addedSet {
+		added = append(added, id)
+	}
+	sort.Strings(added)
+	return dirty, added
+}
+
+// inferRootDirs returns the root directories, as determineRootDirs
+// would, that the directories and package paths of pkgs imply: the
+// directory of each package, mapped to its path, and each of its parent
+// directories whose base name is the last element of the path of the
+// directory below it, mapped to the rest of that path.
+func inferRootDirs(pkgs []*Package) map[string]string {
+	roots := make(map[string]string)
+	for _, p := range pkgs {
+		dir := commonDir(p.GoFiles)
+		if dir == "" || p.forTest != "" || isAdHoc(p) || strings.HasSuffix(p.PkgPath, "_test") {
+			continue
+		}
+		for pkgPath := p.PkgPath; pkgPath != "." && pkgPath != ""; {
+			if _, ok := roots[dir]; ok {
+				break
+			}
+			roots[dir] = pkgPath
+			if filepath.Base(dir) != path.Base(pkgPath) {
+				break
+			}
+			dir, pkgPath = filepath.Dir(dir), path.Dir(pkgPath)
+		}
+	}
+	return roots
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+func TestInvalidate(t *testing.T) { packagestest.TestAll(t, testInvalidate) }
+func testInvalidate(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"b/b.go":      "package b\n",
+			"b/b_test.go": "package b\n",
+			"c/c.go":      "package c\n",
+			"e/e.go":      "package e\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+	exported.Config.Tests = true
+	prev, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/b", "golang.org/fake/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := func() string {
+		var files []string
+		packages.Visit(prev, nil, func(pkg *packages.Package) {
+			files = append(files, fmt.Sprint(pkg.ID, pkg.GoFiles, len(pkg.Imports)))
+		})
+		return fmt.Sprint(files)
+	}
+	before := files()
+
+	for _, test := range []struct {
+		name      string
+		filename  string
+		contents  string // if empty, the file is read from disk
+		wantDirty string
+		wantAdded string
+	}{{
+		name:      "changed file",
+		filename:  "b/b.go",
+		wantDirty: "[golang.org/fake/a golang.org/fake/b golang.org/fake/b [golang.org/fake/b.test] golang.org/fake/b.test]",
+		wantAdded: "[]",
+	}, {
+		name:      "changed test file",
+		filename:  "b/b_test.go",
+		contents:  "package b\n\nfunc TestB() {}\n",
+		wantDirty: "[golang.org/fake/b [golang.org/fake/b.test] golang.org/fake/b.test]",
+		wantAdded: "[]",
+	}, {
+		name:      "new file in a package",
+		filename:  "c/new.go",
+		contents:  "package c\n\nimport _ \"golang.org/fake/e\"\n",
+		wantDirty: "[golang.org/fake/c]",
+		wantAdded: "[golang.org/fake/e]",
+	}, {
+		name:      "new file in a tested package",
+		filename:  "b/new.go",
+		contents:  "package b\n",
+		wantDirty: "[golang.org/fake/a golang.org/fake/b golang.org/fake/b [golang.org/fake/b.test] golang.org/fake/b.test]",
+		wantAdded: "[]",
+	}, {
+		name:      "new file of a new package",
+		filename:  "d/d.go",
+		contents:  "package d\n\nimport _ \"golang.org/fake/c\"\n",
+		wantDirty: "[]",
+		wantAdded: "[golang.org/fake/d]",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, test.filename)
+			var overlay map[string][]byte
+			if test.contents != "" {
+				overlay = map[string][]byte{filename: []byte(test.contents)}
+			}
+			dirty, added := packages.Invalidate(prev, []string{filename}, overlay)
+			if got := fmt.Sprint(dirty); got != test.wantDirty {
+				t.Errorf("got dirty %s, want %s", got, test.wantDirty)
+			}
+			if got := fmt.Sprint(added); got != test.wantAdded {
+				t.Errorf("got added %s, want %s", got, test.wantAdded)
+			}
+		})
+	}
+	if after := files(); after != before {
+		t.Errorf("Invalidate modified the packages: got %s, want %s", after, before)
+	}
+}
@@ -20,6 +20,10 @@ var allModes = []LoadMode{
 	NeedSyntax,
 	NeedTypesInfo,
 	NeedTypesSizes,
+	NeedModule,
+	NeedEmbedFiles,
+	NeedEmbedPatterns,
+	NeedDepsErrors,
 }
 
 var modeStrings = []string{
@@ -33,6 +37,10 @@ var modeStrings = []string{
 	"NeedSyntax",
 	"NeedTypesInfo",
 	"NeedTypesSizes",
+	"NeedModule",
+	"NeedEmbedFiles",
+	"NeedEmbedPatterns",
+	"NeedDepsErrors",
 }
 
 func (mod LoadMode) String() string {
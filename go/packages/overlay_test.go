@@ -2,18 +2,55 @@ package packages_test
 
 import (
 	"fmt"
+	"go/ast"
+	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 
 	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/go/packages/packagestest"
+	"golang.org/x/tools/internal/testenv"
 )
 
 const commonMode = packages.NeedName | packages.NeedFiles |
 	packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedSyntax
 
-func TestOverlayChangesPackage(t *testing.T) {
+// forEachOverlayMode runs f in a subtest "native", in which the go
+// command applies overlays if it supports the -overlay flag, and in a
+// subtest "legacy", in which the go list driver processes them itself.
+func forEachOverlayMode(t *testing.T, f func(t *testing.T)) {
+	for _, legacy := range []bool{false, true} {
+		name := "native"
+		if legacy {
+			name = "legacy"
+		}
+		t.Run(name, func(t *testing.T) {
+			defer packages.SetLegacyOverlay(legacy)()
+			f(t)
+		})
+	}
+}
+
+// testAllOverlayModes runs f for each exporter in each overlay mode;
+// see forEachOverlayMode.
+func testAllOverlayModes(t *testing.T, f func(*testing.T, packagestest.Exporter)) {
+	forEachOverlayMode(t, func(t *testing.T) { packagestest.TestAll(t, f) })
+}
+
+// nativeOverlay reports whether the go command applies overlays in the
+// current overlay mode.
+func nativeOverlay() bool {
+	return !packages.LegacyOverlay() && testenv.Go1Point() >= 16
+}
+
+func TestOverlayChangesPackage(t *testing.T) { forEachOverlayMode(t, testOverlayChangesPackage) }
+func testOverlayChangesPackage(t *testing.T) {
 	log.SetFlags(log.Lshortfile)
 	exported := packagestest.Export(t, packagestest.GOPATH, []packagestest.Module{{
 		Name: "fake",
@@ -41,6 +78,9 @@ func TestOverlayChangesPackage(t *testing.T) {
 	log.SetFlags(0)
 }
 func TestOverlayChangesBothPackages(t *testing.T) {
+	forEachOverlayMode(t, testOverlayChangesBothPackages)
+}
+func testOverlayChangesBothPackages(t *testing.T) {
 	log.SetFlags(log.Lshortfile)
 	exported := packagestest.Export(t, packagestest.GOPATH, []packagestest.Module{{
 		Name: "fake",
@@ -85,6 +125,9 @@ func TestOverlayChangesBothPackages(t *testing.T) {
 }
 
 func TestOverlayChangesTestPackage(t *testing.T) {
+	forEachOverlayMode(t, testOverlayChangesTestPackage)
+}
+func testOverlayChangesTestPackage(t *testing.T) {
 	log.SetFlags(log.Lshortfile)
 	exported := packagestest.Export(t, packagestest.GOPATH, []packagestest.Module{{
 		Name: "fake",
@@ -114,6 +157,11 @@ func TestOverlayChangesTestPackage(t *testing.T) {
 		{"fake [fake.test]", "foox", 1},
 		{"fake.test", "main", 1},
 	}
+	if nativeOverlay() {
+		// The go command names a package without non-test files
+		// after its test files, as they are in the overlay.
+		want[0].name = "foox"
+	}
 	for i := 0; i < 3; i++ {
 		if ok := checkPkg(t, initial[i], want[i].id, want[i].name, want[i].count); !ok {
 			t.Errorf("got {%s %s %d}, expected %v", initial[i].ID,
@@ -127,7 +175,7 @@ func TestOverlayChangesTestPackage(t *testing.T) {
 }
 
 func TestOverlayXTests(t *testing.T) {
-	packagestest.TestAll(t, testOverlayXTests)
+	testAllOverlayModes(t, testOverlayXTests)
 }
 func testOverlayXTests(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{{
@@ -188,6 +236,649 @@ func TestHello(t *testing.T) {
 
 }
 
+// TestOverlayNewXTest checks that an x test that the overlay adds
+// imports the package under test, or its test variant if it has one,
+// whether the package is on disk or also added by the overlay.
+func TestOverlayNewXTest(t *testing.T) { testAllOverlayModes(t, testOverlayNewXTest) }
+func testOverlayNewXTest(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n",
+			"b/b.go":      "package b\n",
+			"b/b_test.go": "package b\n",
+			"c/c.go":      "package c\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+	exported.Config.Tests = true
+	xtest := func(pkg string) []byte {
+		return []byte(fmt.Sprintf("package %s_test\n\nimport \"golang.org/fake/%s\"\n", pkg, pkg))
+	}
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "a", "a_x_test.go"): xtest("a"),
+		filepath.Join(dir, "b", "b_x_test.go"): xtest("b"),
+		// The in-package test follows the x test.
+		filepath.Join(dir, "c", "a_test.go"): xtest("c"),
+		filepath.Join(dir, "c", "z_test.go"): []byte("package c\n"),
+		// The package under test is not on disk.
+		filepath.Join(dir, "d", "d.go"):        []byte("package d\n"),
+		filepath.Join(dir, "d", "d_x_test.go"): xtest("d"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/b", "golang.org/fake/c", "golang.org/fake/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, p := range initial {
+		if !strings.HasSuffix(p.Name, "_test") {
+			continue
+		}
+		for path, imp := range p.Imports {
+			got[p.ID] = fmt.Sprintf("%s: %s with %d files", path, imp.ID, len(imp.GoFiles))
+		}
+	}
+	want := map[string]string{
+		"golang.org/fake/a_test [golang.org/fake/a.test]": "golang.org/fake/a: golang.org/fake/a with 1 files",
+		"golang.org/fake/b_test [golang.org/fake/b.test]": "golang.org/fake/b: golang.org/fake/b [golang.org/fake/b.test] with 2 files",
+		"golang.org/fake/c_test [golang.org/fake/c.test]": "golang.org/fake/c: golang.org/fake/c [golang.org/fake/c.test] with 2 files",
+		"golang.org/fake/d_test [golang.org/fake/d.test]": "golang.org/fake/d: golang.org/fake/d with 1 files",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got imports of the x tests\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestOverlayDuplicatePackages(t *testing.T) {
+	testAllOverlayModes(t, testOverlayDuplicatePackages)
+}
+func testOverlayDuplicatePackages(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":  "package a\n",
+			"c/c.txt": "",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	aFile := filepath.Join(dir, "a", "a.go")
+	cFile := filepath.Join(dir, "c", "c.go")
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "a", "new.go"): []byte("package a\n\nfunc F() {}\n"),
+		cFile:                             []byte("package c\n\nfunc F() {}\n"),
+	}
+	// Each pair of patterns names the same package twice: as a file,
+	// which go list reports as an ad-hoc package, and by a query for
+	// the file.
+	for _, file := range []string{aFile, cFile} {
+		initial, err := packages.Load(exported.Config, file, "file="+file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var owners []string
+		packages.Visit(initial, nil, func(pkg *packages.Package) {
+			for _, f := range pkg.GoFiles {
+				if f == file {
+					owners = append(owners, pkg.ID)
+				}
+			}
+		})
+		if len(owners) != 1 {
+			t.Errorf("loading %s twice: got the file in packages %v, want it once in one package", file, owners)
+		}
+	}
+}
+
+func TestOverlaySymlinkedGOPATH(t *testing.T) {
+	forEachOverlayMode(t, testOverlaySymlinkedGOPATH)
+}
+func testOverlaySymlinkedGOPATH(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links requires privileges on windows")
+	}
+	testenv.NeedsTool(t, "go")
+	tmp, err := ioutil.TempDir("", "symlinkedgopath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// The go command reports the files of the GOPATH, which is a link,
+	// by their paths in it, but an editor reports the real paths of the
+	// files of the overlay.
+	real := filepath.Join(tmp, "real")
+	link := filepath.Join(tmp, "link")
+	realDir := filepath.Join(real, "src", "golang.org", "fake")
+	if err := os.MkdirAll(filepath.Join(realDir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(realDir, "a", "a.go"), []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &packages.Config{
+		Mode: commonMode,
+		Dir:  filepath.Join(link, "src", "golang.org", "fake"),
+		Env:  append(os.Environ(), "GOPATH="+link, "GO111MODULE=off", "GOFLAGS="),
+		Overlay: map[string][]byte{
+			// A new file of a package on disk.
+			filepath.Join(realDir, "a", "new.go"): []byte("package a\n\nfunc F() {}\n"),
+			// The file of a new package.
+			filepath.Join(realDir, "b", "b.go"): []byte("package b\n\nfunc G() {}\n"),
+		},
+	}
+	initial, err := packages.Load(cfg, "golang.org/fake/a", "golang.org/fake/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		id    string
+		files []string
+		decl  string
+	}{
+		{"golang.org/fake/a", []string{"a.go", "new.go"}, "F"},
+		{"golang.org/fake/b", []string{"b.go"}, "G"},
+	} {
+		if i >= len(initial) {
+			t.Errorf("got %d packages, want %s", len(initial), want.id)
+			continue
+		}
+		pkg := initial[i]
+		var files []string
+		for _, f := range pkg.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		if pkg.ID != want.id || !reflect.DeepEqual(files, want.files) || len(pkg.Errors) > 0 {
+			t.Errorf("got package %s with files %v and errors %v, want %s with files %v", pkg.ID, files, pkg.Errors, want.id, want.files)
+			continue
+		}
+		// The loader parses the files of the overlay, whichever of
+		// their names the package has.
+		var decls []string
+		for _, f := range pkg.Syntax {
+			for _, d := range f.Decls {
+				if fn, ok := d.(*ast.FuncDecl); ok {
+					decls = append(decls, fn.Name.Name)
+				}
+			}
+		}
+		if fmt.Sprint(decls) != fmt.Sprint([]string{want.decl}) {
+			t.Errorf("package %s declares %v, want [%s]", pkg.ID, decls, want.decl)
+		}
+	}
+}
+
+// Test that an overlay adding the first test file of a package, which
+// has only benchmarks or examples, creates the test variant of the
+// package, without changing the package itself.
+func TestOverlayNewTestVariant(t *testing.T) {
+	testAllOverlayModes(t, testOverlayNewTestVariant)
+}
+func testOverlayNewTestVariant(t *testing.T, exporter packagestest.Exporter) {
+	for _, test := range []struct {
+		name, file, contents, imp string
+	}{
+		{"benchmark", "a_bench_test.go", "package a\n\nimport \"testing\"\n\nfunc BenchmarkA(b *testing.B) { A() }\n", "testing"},
+		{"example", "example_test.go", "package a\n\nimport \"fmt\"\n\nfunc ExampleA() {\n\tfmt.Println(A())\n\t// Output: a\n}\n", "fmt"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exported := packagestest.Export(t, exporter, []packagestest.Module{{
+				Name: "golang.org/fake",
+				Files: map[string]interface{}{
+					"a/a.go": "package a\n\nfunc A() string { return \"a\" }\n",
+				},
+			}})
+			defer exported.Cleanup()
+			dir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+			filename := filepath.Join(dir, test.file)
+			exported.Config.Mode = commonMode
+			exported.Config.Tests = true
+			exported.Config.Overlay = map[string][]byte{
+				filename: []byte(test.contents),
+			}
+
+			initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, p := range initial {
+				ids = append(ids, p.ID)
+			}
+			const variant = "golang.org/fake/a [golang.org/fake/a.test]"
+			want := []string{"golang.org/fake/a", variant}
+			if nativeOverlay() {
+				// The go command also reports the test main package.
+				want = append(want, "golang.org/fake/a.test")
+			}
+			if !reflect.DeepEqual(ids, want) {
+				t.Fatalf("got %v, expected %v", ids, want)
+			}
+			if a := initial[0]; len(a.GoFiles) != 1 || a.Imports[test.imp] != nil {
+				t.Errorf("golang.org/fake/a: got files %v and imports %v, expected the package on disk", a.GoFiles, a.Imports)
+			}
+			if a := initial[1]; len(a.GoFiles) != 2 || a.GoFiles[1] != filename || a.Imports[test.imp] == nil {
+				t.Errorf("%s: got files %v and imports %v, expected a.go and %s, importing %s", variant, a.GoFiles, a.Imports, test.file, test.imp)
+			}
+
+			// A file query also finds the new test variant.
+			initial, err = packages.Load(exported.Config, "file="+filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(initial) != 1 || initial[0].ID != variant {
+				t.Errorf("file=%s: got %v, expected [%s]", test.file, initial, variant)
+			}
+		})
+	}
+}
+
+func TestOverlayDeletedFiles(t *testing.T) {
+	testAllOverlayModes(t, testOverlayDeletedFiles)
+}
+func testOverlayDeletedFiles(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n\nimport \"golang.org/fake/b\"\n\nfunc A() { b.B() }\n",
+			"a/a2.go":     "package a\n\nfunc A2() {}\n",
+			"a/a_test.go": "package a\n\nimport _ \"golang.org/fake/c\"\n",
+			"b/b.go":      "package b\n\nfunc B() {}\n",
+			"c/c.go":      "package c\n",
+			"d/d.go":      "package d\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports
+	exported.Config.Tests = true
+
+	noFiles := "no Go files in " + filepath.Dir(exported.File("golang.org/fake", "d/d.go"))
+	if nativeOverlay() && exporter == packagestest.Modules {
+		// The go command looks for the package in other modules.
+		noFiles = "cannot find module providing package golang.org/fake/d"
+	}
+
+	// describe returns the compiled files, imports, and the first
+	// clause of the error messages of each package other than test
+	// main packages.
+	describe := func(pkgs []*packages.Package) map[string]string {
+		res := make(map[string]string)
+		for _, p := range pkgs {
+			if strings.HasSuffix(p.ID, ".test") {
+				continue // the test main package
+			}
+			var files, imports []string
+			for _, f := range p.CompiledGoFiles {
+				files = append(files, filepath.Base(f))
+			}
+			for imp := range p.Imports {
+				imports = append(imports, imp)
+			}
+			sort.Strings(imports)
+			res[p.ID] = fmt.Sprintf("%v %v", files, imports)
+			for _, err := range p.Errors {
+				res[p.ID] += " " + strings.SplitN(err.Msg, ": ", 2)[0]
+			}
+		}
+		return res
+	}
+	for _, test := range []struct {
+		deleted string
+		pattern string
+		want    map[string]string
+		// native, if set, is the result if the go command
+		// applies the overlay, where it differs from want.
+		native map[string]string
+	}{
+		{"a/a.go", "golang.org/fake/a", map[string]string{
+			"golang.org/fake/a":                          "[a2.go] []",
+			"golang.org/fake/a [golang.org/fake/a.test]": "[a2.go a_test.go] [golang.org/fake/c]",
+		}, nil},
+		{"a/a_test.go", "golang.org/fake/a", map[string]string{
+			"golang.org/fake/a":                          "[a.go a2.go] [golang.org/fake/b]",
+			"golang.org/fake/a [golang.org/fake/a.test]": "[a.go a2.go] [golang.org/fake/b]",
+		}, map[string]string{
+			// Without test files, there is no test variant.
+			"golang.org/fake/a": "[a.go a2.go] [golang.org/fake/b]",
+		}},
+		{"d/d.go", "golang.org/fake/d", map[string]string{
+			"golang.org/fake/d": "[] [] " + noFiles,
+		}, nil},
+	} {
+		exported.Config.DeletedFiles = []string{exported.File("golang.org/fake", test.deleted)}
+		initial, err := packages.Load(exported.Config, test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.want
+		if nativeOverlay() && test.native != nil {
+			want = test.native
+		}
+		got := describe(initial)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("deleting %s: got %v, want %v", test.deleted, got, want)
+		}
+	}
+}
+
+func TestOverlayUnparsableFile(t *testing.T) {
+	testAllOverlayModes(t, testOverlayUnparsableFile)
+}
+func testOverlayUnparsableFile(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nfunc A() {}\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedSyntax
+	adir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+	edir := filepath.Join(filepath.Dir(adir), "e")
+
+	for _, test := range []struct {
+		name, file, pattern string
+		wantFiles           []string
+	}{
+		{"new file", filepath.Join(adir, "b.go"), "golang.org/fake/a", []string{"a.go", "b.go"}},
+		{"existing file", filepath.Join(adir, "a.go"), "golang.org/fake/a", []string{"a.go"}},
+		{"new directory", filepath.Join(edir, "e.go"), "golang.org/fake/e", []string{"e.go"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exported.Config.Overlay = map[string][]byte{
+				test.file: []byte("pakage a\n"),
+			}
+			initial, err := packages.Load(exported.Config, test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(initial) != 1 {
+				t.Fatalf("got %d packages, want 1", len(initial))
+			}
+			pkg := initial[0]
+			var files []string
+			for _, f := range pkg.GoFiles {
+				files = append(files, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(files, test.wantFiles) {
+				t.Errorf("GoFiles = %v, want %v", files, test.wantFiles)
+			}
+			want := packages.Error{
+				Pos:  test.file + ":1:1",
+				Msg:  "expected 'package', found pakage",
+				Kind: packages.ParseError,
+			}
+			// The go command, if it applies the overlay, also
+			// reports the error, as it does for a file on disk.
+			var errs []packages.Error
+			for _, err := range pkg.Errors {
+				if err.Kind != packages.ListError || !nativeOverlay() {
+					errs = append(errs, err)
+				}
+			}
+			if !reflect.DeepEqual(errs, []packages.Error{want}) {
+				t.Errorf("Errors = %v, want [%v]", pkg.Errors, want)
+			}
+		})
+	}
+}
+
+func TestOverlayPackageClauseChange(t *testing.T) {
+	testAllOverlayModes(t, testOverlayPackageClauseChange)
+}
+func testOverlayPackageClauseChange(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n",
+			"a/a_test.go": "package a\n",
+			"a/x_test.go": "package a_test\n\nimport _ \"golang.org/fake/b\"\n",
+			"a/y_test.go": "package a_test\n",
+			"b/b.go":      "package b\n",
+			"c/c.go":      "package c\n",
+			"c/c_test.go": "package c\n\nimport _ \"golang.org/fake/b\"\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports
+	exported.Config.Tests = true
+
+	// describe returns the name, compiled files, and imports of each
+	// package other than test main packages.
+	describe := func(pkgs []*packages.Package) map[string]string {
+		res := make(map[string]string)
+		for _, p := range pkgs {
+			if strings.HasSuffix(p.ID, ".test") {
+				continue // the test main package
+			}
+			var files, imports []string
+			for _, f := range p.CompiledGoFiles {
+				files = append(files, filepath.Base(f))
+			}
+			for imp := range p.Imports {
+				imports = append(imports, imp)
+			}
+			sort.Strings(imports)
+			res[p.ID] = fmt.Sprintf("%s %v %v", p.Name, files, imports)
+			for _, err := range p.Errors {
+				res[p.ID] += " " + err.Msg
+			}
+		}
+		return res
+	}
+	for _, test := range []struct {
+		name     string
+		file     string
+		contents string
+		pattern  string
+		want     map[string]string
+		// native, if set, is the result if the go command
+		// applies the overlay, where it differs from want.
+		native map[string]string
+	}{
+		{"sibling package", "a/x_test.go", "package a\n\nimport _ \"golang.org/fake/b\"\n", "golang.org/fake/a", map[string]string{
+			"golang.org/fake/a":                               "a [a.go] []",
+			"golang.org/fake/a [golang.org/fake/a.test]":      "a [a.go a_test.go x_test.go] [golang.org/fake/b]",
+			"golang.org/fake/a_test [golang.org/fake/a.test]": "a_test [y_test.go] []",
+		}, nil},
+		{"new package", "c/c_test.go", "package c_test\n\nimport _ \"golang.org/fake/b\"\n", "golang.org/fake/c", map[string]string{
+			"golang.org/fake/c":                               "c [c.go] []",
+			"golang.org/fake/c [golang.org/fake/c.test]":      "c [c.go] []",
+			"golang.org/fake/c_test [golang.org/fake/c.test]": "c_test [c_test.go] [golang.org/fake/b]",
+		}, map[string]string{
+			// Without in-package test files, the external test
+			// imports the package itself, not a test variant.
+			"golang.org/fake/c": "c [c.go] []",
+			"golang.org/fake/c_test [golang.org/fake/c.test]": "c_test [c_test.go] [golang.org/fake/b]",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exported.Config.Overlay = map[string][]byte{
+				exported.File("golang.org/fake", test.file): []byte(test.contents),
+			}
+			initial, err := packages.Load(exported.Config, test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.want
+			if nativeOverlay() && test.native != nil {
+				want = test.native
+			}
+			if got := describe(initial); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestOverlayFirstTestFile(t *testing.T) {
+	testAllOverlayModes(t, testOverlayFirstTestFile)
+}
+func testOverlayFirstTestFile(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"b/b.go": "package b\n",
+			"c/c.go": "package c\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports
+	exported.Config.Tests = true
+	testFile := filepath.Join(filepath.Dir(exported.File("golang.org/fake", "a/a.go")), "a_test.go")
+
+	for _, test := range []struct {
+		name, contents string
+		want           map[string]string // package ID -> files and imports
+	}{
+		{"in-package test", "package a\n\nimport _ \"golang.org/fake/c\"\n", map[string]string{
+			"golang.org/fake/a":                          "[a.go] [golang.org/fake/b]",
+			"golang.org/fake/a [golang.org/fake/a.test]": "[a.go a_test.go] [golang.org/fake/b golang.org/fake/c]",
+		}},
+		{"external test", "package a_test\n\nimport _ \"golang.org/fake/a\"\n", map[string]string{
+			"golang.org/fake/a": "[a.go] [golang.org/fake/b]",
+			"golang.org/fake/a_test [golang.org/fake/a.test]": "[a_test.go] [golang.org/fake/a]",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exported.Config.Overlay = map[string][]byte{testFile: []byte(test.contents)}
+			initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for _, p := range initial {
+				if strings.HasSuffix(p.ID, ".test") {
+					continue // the test main package
+				}
+				var files, imports []string
+				for _, f := range p.CompiledGoFiles {
+					files = append(files, filepath.Base(f))
+				}
+				for path, imp := range p.Imports {
+					if imp.ID != path {
+						path += ":" + imp.ID
+					}
+					imports = append(imports, path)
+				}
+				sort.Strings(imports)
+				got[p.ID] = fmt.Sprintf("%v %v", files, imports)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestOverlayGoModReplace checks that a replace directive added to
+// go.mod by an overlay is seen by the go command, and that the
+// replacement module's directory becomes a root in which an overlay may
+// add a package.
+func TestOverlayGoModReplace(t *testing.T) { forEachOverlayMode(t, testOverlayGoModReplace) }
+func testOverlayGoModReplace(t *testing.T) {
+	exported := packagestest.Export(t, packagestest.Modules, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":         "package a\n",
+			"dep/go.mod":     "module example.com/dep\n",
+			"dep/dep.go":     "package dep\n",
+			"dep/sub/sub.go": "package sub\n",
+		},
+	}})
+	defer exported.Cleanup()
+	aDir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+	mainDir := filepath.Dir(aDir)
+	gomod := filepath.Join(mainDir, "go.mod")
+	contents, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports
+	// The go command cannot update a go.mod file that is overlaid.
+	exported.Config.Env = append(exported.Config.Env, "GOFLAGS=-mod=readonly")
+	exported.Config.Overlay = map[string][]byte{
+		gomod:                       append(contents, "\nrequire example.com/dep v0.0.0\n\nreplace example.com/dep => ./dep\n"...),
+		filepath.Join(aDir, "a.go"): []byte("package a\n\nimport _ \"example.com/dep/sub\"\n"),
+		// A package in a new directory of the replacement module.
+		filepath.Join(mainDir, "dep", "extra", "extra.go"): []byte("package extra\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "example.com/dep/extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initial) != 2 {
+		t.Fatalf("got %v, want [golang.org/fake/a example.com/dep/extra]", initial)
+	}
+	a, extra := initial[0], initial[1]
+	if sub := a.Imports["example.com/dep/sub"]; sub == nil || len(sub.Errors) > 0 || len(sub.GoFiles) != 1 {
+		t.Errorf("golang.org/fake/a: import of example.com/dep/sub is %+v, want the package in the replacement", sub)
+	}
+	if extra.ID != "example.com/dep/extra" || extra.Name != "extra" || len(extra.Errors) > 0 || len(extra.GoFiles) != 1 {
+		t.Errorf("got %+v with errors %v files %v, want the package example.com/dep/extra added by the overlay", extra, extra.Errors, extra.GoFiles)
+	}
+}
+
+// TestOverlayLocalReplace checks that a package that the overlay adds
+// to a module replaced by a directory outside the main module has the
+// path of the replaced module, so that the main module can import it.
+func TestOverlayLocalReplace(t *testing.T) { forEachOverlayMode(t, testOverlayLocalReplace) }
+func testOverlayLocalReplace(t *testing.T) {
+	exported := packagestest.Export(t, packagestest.Modules, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+		},
+	}})
+	defer exported.Cleanup()
+	aDir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+	mainDir := filepath.Dir(aDir)
+	depDir := filepath.Join(filepath.Dir(mainDir), "local", "dep")
+	if err := os.MkdirAll(depDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"go.mod": "module example.com/dep\n",
+		"dep.go": "package dep\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(depDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gomod := filepath.Join(mainDir, "go.mod")
+	contents, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+	// The go command cannot update a go.mod file that is overlaid.
+	exported.Config.Env = append(exported.Config.Env, "GOFLAGS=-mod=readonly")
+	exported.Config.Overlay = map[string][]byte{
+		gomod:                       append(contents, "\nrequire example.com/dep v0.0.0\n\nreplace example.com/dep => ../local/dep\n"...),
+		filepath.Join(aDir, "a.go"): []byte("package a\n\nimport (\n\t_ \"example.com/dep\"\n\t_ \"example.com/dep/extra\"\n)\n"),
+		filepath.Join(depDir, "extra", "extra.go"): []byte("package extra\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initial) != 1 {
+		t.Fatalf("got %v, want [golang.org/fake/a]", initial)
+	}
+	for _, path := range []string{"example.com/dep", "example.com/dep/extra"} {
+		imp := initial[0].Imports[path]
+		if imp == nil || imp.PkgPath != path || len(imp.Errors) > 0 || len(imp.GoFiles) != 1 {
+			t.Errorf("golang.org/fake/a: import of %s is %+v, want the package in %s", path, imp, depDir)
+		}
+	}
+}
+
 func checkPkg(t *testing.T, p *packages.Package, id, name string, syntax int) bool {
 	t.Helper()
 	if p.ID == id && p.Name == name && len(p.Syntax) == syntax {
@@ -195,3 +886,1011 @@ func checkPkg(t *testing.T, p *packages.Package, id, name string, syntax int) bo
 	}
 	return false
 }
+
+// exportNeededPackages exports a module with n packages that no
+// package imports on disk, and returns it with an overlay in which the
+// package golang.org/fake/a imports them all, so that they are loaded
+// by the queries that follow the first.
+func exportNeededPackages(t testing.TB, exporter packagestest.Exporter, n int) *packagestest.Exported {
+	files := map[string]interface{}{"a/a.go": "package a\n"}
+	src := "package a\n\nimport (\n"
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("p%d/p.go", i)] = fmt.Sprintf("package p%d\n", i)
+		src += fmt.Sprintf("\t_ \"golang.org/fake/p%d\"\n", i)
+	}
+	src += ")\n"
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name:  "golang.org/fake",
+		Files: files,
+	}})
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+	exported.Config.Overlay = map[string][]byte{
+		exported.File("golang.org/fake", "a/a.go"): []byte(src),
+	}
+	return exported
+}
+
+// TestOverlayNeededPackagesConcurrency checks that the packages needed
+// by an overlay are loaded identically however many queries may run at
+// once. Run it with -race.
+func TestOverlayNeededPackagesConcurrency(t *testing.T) {
+	packagestest.TestAll(t, testOverlayNeededPackagesConcurrency)
+}
+func testOverlayNeededPackagesConcurrency(t *testing.T, exporter packagestest.Exporter) {
+	// Only the go list driver loads the packages an overlay needs.
+	defer packages.SetLegacyOverlay(true)()
+	exported := exportNeededPackages(t, exporter, 20)
+	defer exported.Cleanup()
+
+	load := func(concurrency int) string {
+		t.Helper()
+		exported.Config.Concurrency = concurrency
+		initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		packages.Visit(initial, nil, func(p *packages.Package) {
+			var files, imports []string
+			for _, f := range p.GoFiles {
+				files = append(files, filepath.Base(f))
+			}
+			for path, imp := range p.Imports {
+				imports = append(imports, path+":"+imp.ID)
+			}
+			sort.Strings(imports)
+			fmt.Fprintf(&out, "%s %v %v %v\n", p.ID, files, imports, p.Errors)
+		})
+		return out.String()
+	}
+	want := load(1)
+	// Each imported package is listed, and imported by path and ID.
+	if n := strings.Count(want, "golang.org/fake/p"); n != 3*20 {
+		t.Fatalf("got %d references to the imported packages, want %d:\n%s", n, 3*20, want)
+	}
+	for i := 0; i < 5; i++ {
+		if got := load(4); got != want {
+			t.Errorf("run %d: loading with Concurrency 4 got\n%s\nwant\n%s", i, got, want)
+		}
+	}
+}
+
+// BenchmarkOverlayNeededPackages measures the loading of 200 packages
+// needed by an overlay, one query at a time and concurrently.
+func BenchmarkOverlayNeededPackages(b *testing.B) {
+	exported := exportNeededPackages(b, packagestest.Modules, 200)
+	defer exported.Cleanup()
+	defer packages.SetLegacyOverlay(true)()
+
+	for _, concurrency := range []int{1, 0} {
+		b.Run(fmt.Sprintf("Concurrency=%d", concurrency), func(b *testing.B) {
+			exported.Config.Concurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				if _, err := packages.Load(exported.Config, "golang.org/fake/a"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestOverlayTrace checks the trace of how the loader matches the
+// files of an overlay to packages.
+func TestOverlayTrace(t *testing.T) {
+	packagestest.TestAll(t, testOverlayTrace)
+}
+func testOverlayTrace(t *testing.T, exporter packagestest.Exporter) {
+	// The go command, which applies the overlay natively, does not
+	// trace it.
+	defer packages.SetLegacyOverlay(true)()
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+			"b/b.go": "package b\n",
+			"b/c.go": "package b\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	// No root directory gives a package path to a file outside the
+	// module; its name sorts it before the files of the module.
+	outside := filepath.Join(exported.Temp(), "a", "outside.go")
+	outsideRel, err := filepath.Rel(dir, outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideRel = filepath.ToSlash(outsideRel)
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports
+	exported.Config.Tests = true
+	exported.Config.Overlay = map[string][]byte{
+		outside:                                []byte("package outside\n"),
+		filepath.Join(dir, "a", "a.go"):        []byte("package a\n\nimport _ \"golang.org/fake/b\"\n"),
+		filepath.Join(dir, "a", "new.go"):      []byte("package a\n"),
+		filepath.Join(dir, "a", "broken.go"):   []byte("pakage a\n"),
+		filepath.Join(dir, "a", "a_test.go"):   []byte("package a\n"),
+		filepath.Join(dir, "a", "a_x_test.go"): []byte("package a_test\n\nimport _ \"golang.org/fake/a\"\n"),
+		filepath.Join(dir, "b", "c.go"):        []byte("package b\n"),
+		filepath.Join(dir, "d", "d.go"):        []byte("package d\n"),
+		filepath.Join(dir, "e", "e.go"):        []byte("package e\n"),
+	}
+	exported.Config.DeletedFiles = []string{filepath.Join(dir, "b", "c.go")}
+	var logged int
+	exported.Config.OverlayDebug = true
+	exported.Config.Logf = func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "overlay: ") {
+			logged++
+		}
+	}
+	result, err := packages.LoadWithEnv(exported.Config, "golang.org/fake/a", "golang.org/fake/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range result.Packages {
+		if p.PkgPath == "golang.org/fake/d" && !reflect.DeepEqual(p.GoFiles, []string{filepath.Join(dir, "d", "d.go")}) {
+			t.Errorf("%s: got GoFiles %v, want the file of the overlay", p, p.GoFiles)
+		}
+	}
+	got := make(map[string]packages.OverlayDecision)
+	var order []string
+	for _, d := range result.OverlayTrace {
+		rel, err := filepath.Rel(dir, d.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel = filepath.ToSlash(rel)
+		order = append(order, rel)
+		if d.ParseError != "" {
+			d.ParseError = "error"
+		}
+		d.File = ""
+		got[rel] = d
+	}
+	// The test files are matched after the others, once the packages
+	// they test have their files.
+	wantOrder := []string{outsideRel, "a/a.go", "a/broken.go", "a/new.go", "b/c.go", "d/d.go", "e/e.go", "a/a_test.go", "a/a_x_test.go"}
+	if !reflect.DeepEqual(order, wantOrder) {
+		t.Errorf("got trace of files %v, want %v", order, wantOrder)
+	}
+	if logged != len(wantOrder) {
+		t.Errorf("got %d logged decisions, want %d", logged, len(wantOrder))
+	}
+	for file, want := range map[string]packages.OverlayDecision{
+		// Skipping the file does not skip those after it.
+		outsideRel: {
+			Name:    "outside",
+			Skipped: "outside the root directories",
+		},
+		"a/a.go": {
+			Name:     "a",
+			DirMatch: true,
+			Packages: []string{"golang.org/fake/a"},
+			Existed:  true,
+			Imports:  []string{"golang.org/fake/b"},
+		},
+		"a/broken.go": {
+			ParseError: "error",
+			Packages:   []string{"golang.org/fake/a"},
+		},
+		"a/new.go": {
+			Name:     "a",
+			DirMatch: true,
+			Packages: []string{"golang.org/fake/a"},
+		},
+		"b/c.go": {
+			Skipped: "deleted",
+		},
+		// The go command reports the package of a pattern that it
+		// cannot find, but not one that no pattern names.
+		"d/d.go": {
+			Name:     "d",
+			Packages: []string{"golang.org/fake/d"},
+			Created:  "reclaimed",
+			PkgPath:  "golang.org/fake/d",
+		},
+		"e/e.go": {
+			Name:     "e",
+			Packages: []string{"golang.org/fake/e"},
+			Created:  "synthesized",
+			PkgPath:  "golang.org/fake/e",
+		},
+		"a/a_test.go": {
+			Name:          "a",
+			DirMatch:      true,
+			Packages:      []string{"golang.org/fake/a [golang.org/fake/a.test]"},
+			TestVariantOf: "golang.org/fake/a",
+			Created:       "synthesized",
+			PkgPath:       "golang.org/fake/a",
+		},
+		"a/a_x_test.go": {
+			Name:          "a_test",
+			DirMatch:      true,
+			Packages:      []string{"golang.org/fake/a_test [golang.org/fake/a.test]"},
+			TestVariantOf: "golang.org/fake/a",
+			Imports:       []string{"golang.org/fake/a"},
+			Created:       "synthesized",
+			PkgPath:       "golang.org/fake/a_test",
+			XTest:         true,
+		},
+	} {
+		if !reflect.DeepEqual(got[file], want) {
+			t.Errorf("%s: got decision %+v, want %+v", file, got[file], want)
+		}
+	}
+}
+
+// TestOverlayRelativeKeys checks that relative overlay keys are
+// resolved against Config.Dir.
+func TestOverlayRelativeKeys(t *testing.T) {
+	testAllOverlayModes(t, testOverlayRelativeKeys)
+}
+func testOverlayRelativeKeys(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+			"b/b.go": "package b\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports
+	exported.Config.Dir = filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join("a", ".", "a.go"):            []byte("package a\n\nimport _ \"golang.org/fake/b\"\n"),
+		filepath.Join("b", "..", "c", "c.go"):      []byte("package c\n"),
+		filepath.Join(exported.Config.Dir, "d.go"): []byte("package d\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, p := range initial {
+		var files, imports []string
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		for path := range p.Imports {
+			imports = append(imports, path)
+		}
+		got[p.ID] = fmt.Sprintf("%v %v %v", files, imports, p.Errors)
+	}
+	want := map[string]string{
+		"golang.org/fake/a": "[a.go] [golang.org/fake/b] []",
+		"golang.org/fake/c": "[c.go] [] []",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Keys that name the same file are rejected.
+	exported.Config.Overlay[filepath.Join(exported.Config.Dir, "a", "a.go")] = []byte("package a\n")
+	if _, err := packages.Load(exported.Config, "golang.org/fake/a"); err == nil || !strings.Contains(err.Error(), "ambiguous overlay") {
+		t.Errorf("with two keys for a.go: got error %v, want an ambiguous overlay", err)
+	}
+}
+
+// TestOverlayFromOverlay checks that only the packages whose Go files
+// all exist only in the overlay are reported as synthesized from it.
+func TestOverlayFromOverlay(t *testing.T) { testAllOverlayModes(t, testOverlayFromOverlay) }
+func testOverlayFromOverlay(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":     "package a\n",
+			"b/b.go":     "package b\n",
+			"c/notes.go": "// +build ignore\n\npackage c\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "a", "a.go"):     []byte("package a\n\nimport _ \"golang.org/fake/d\"\n"),
+		filepath.Join(dir, "b", "extra.go"): []byte("package b\n"),
+		filepath.Join(dir, "d", "d.go"):     []byte("package d\n"),
+		filepath.Join(dir, "d", "d2.go"):    []byte("package d\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/b", "golang.org/fake/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	packages.Visit(initial, nil, func(p *packages.Package) {
+		got[p.ID] = fmt.Sprintf("%t %d", p.FromOverlay, len(p.Errors))
+	})
+	want := map[string]string{
+		"golang.org/fake/a": "false 0", // changed, but on disk
+		"golang.org/fake/b": "false 0", // a file added to a package on disk
+		"golang.org/fake/c": "false 1", // build constraints exclude its files
+		"golang.org/fake/d": "true 0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got FromOverlay and number of errors %v, want %v", got, want)
+	}
+}
+
+// TestOverlayIgnoredFiles checks that the files that build constraints
+// exclude from a package, on disk or in the overlay, are its
+// IgnoredFiles.
+func TestOverlayIgnoredFiles(t *testing.T) { testAllOverlayModes(t, testOverlayIgnoredFiles) }
+func testOverlayIgnoredFiles(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n",
+			"a/tagged.go": "// +build tag\n\npackage a\n",
+			"b/b.go":      "package b\n",
+			"b/b2.go":     "package b\n",
+			"c/tagged.go": "// +build tag\n\npackage c\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "a", "ignored.go"): []byte("// +build ignore\n\npackage a\n"),
+		filepath.Join(dir, "b", "b2.go"):      []byte("// +build ignore\n\npackage b\n\nimport \"fmt\"\n"),
+		filepath.Join(dir, "c", "c.go"):       []byte("package c\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/b", "golang.org/fake/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := func(files []string) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, filepath.Base(f))
+		}
+		sort.Strings(names)
+		return names
+	}
+	got := make(map[string]string)
+	for _, p := range initial {
+		var imports []string
+		for path := range p.Imports {
+			imports = append(imports, path)
+		}
+		got[p.ID] = fmt.Sprintf("%v %v ignored=%v %v %v", base(p.GoFiles), base(p.CompiledGoFiles), base(p.IgnoredFiles), imports, p.Errors)
+	}
+	want := map[string]string{
+		"golang.org/fake/a": "[a.go] [a.go] ignored=[ignored.go tagged.go] [] []",
+		"golang.org/fake/b": "[b.go] [b.go] ignored=[b2.go] [] []", // not importing fmt
+		"golang.org/fake/c": "[c.go] [c.go] ignored=[tagged.go] [] []",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files\n%v\nwant\n%v", got, want)
+	}
+
+	// With the tag, the tagged files belong to the packages.
+	exported.Config.BuildFlags = []string{"-tags=tag"}
+	initial, err = packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprintf("%v ignored=%v", base(initial[0].GoFiles), base(initial[0].IgnoredFiles)), "[a.go tagged.go] ignored=[ignored.go]"; got != want {
+		t.Errorf("with -tags=tag, got files %s, want %s", got, want)
+	}
+}
+
+// TestOverlayModule checks that a package added by an overlay belongs
+// to the module whose directory contains it, in module mode.
+func TestOverlayModule(t *testing.T) { testAllOverlayModes(t, testOverlayModule) }
+func testOverlayModule(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":     "package a\n",
+			"dep/go.mod": "module example.com/dep\n\ngo 1.14\n",
+			"dep/dep.go": "package dep\n",
+		},
+	}})
+	defer exported.Cleanup()
+	mainDir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	depDir := filepath.Join(mainDir, "dep")
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedModule
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(mainDir, "b", "b.go"): []byte("package b\n"),
+	}
+	patterns := []string{"golang.org/fake/b"}
+	want := map[string]*packages.Module{"golang.org/fake/b": nil}
+	if exporter == packagestest.Modules {
+		gomod := filepath.Join(mainDir, "go.mod")
+		// The go command cannot update a go.mod file that is overlaid.
+		exported.Config.Env = append(exported.Config.Env, "GOFLAGS=-mod=readonly")
+		exported.Config.Overlay[gomod] = []byte("module golang.org/fake\n\ngo 1.13\n\nrequire example.com/dep v0.0.0\n\nreplace example.com/dep => ./dep\n")
+		exported.Config.Overlay[filepath.Join(depDir, "go.mod")] = []byte("module example.com/dep\n\ngo 1.15\n")
+		exported.Config.Overlay[filepath.Join(depDir, "extra", "extra.go")] = []byte("package extra\n")
+		patterns = append(patterns, "example.com/dep/extra")
+		want = map[string]*packages.Module{
+			"golang.org/fake/b": {Path: "golang.org/fake", Dir: mainDir, GoMod: gomod, Main: true, GoVersion: "1.13"},
+			"example.com/dep/extra": {
+				Path:      "example.com/dep",
+				Dir:       depDir,
+				GoMod:     filepath.Join(depDir, "go.mod"),
+				GoVersion: "1.15", // from the overlay
+			},
+		}
+		if nativeOverlay() {
+			// The go command also reports the requirement and
+			// replacement of the module.
+			dep := want["example.com/dep/extra"]
+			replace := *dep
+			replace.Path = "./dep"
+			dep.Version, dep.Replace = "v0.0.0", &replace
+		}
+	}
+	initial, err := packages.Load(exported.Config, patterns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*packages.Module)
+	for _, p := range initial {
+		if len(p.Errors) > 0 || len(p.GoFiles) != 1 {
+			t.Errorf("%s: got errors %v and files %v, want the package of the overlay", p.ID, p.Errors, p.GoFiles)
+		}
+		got[p.ID] = p.Module
+	}
+	if !reflect.DeepEqual(got, want) {
+		describe := func(mods map[string]*packages.Module) string {
+			var out []string
+			for id, m := range mods {
+				out = append(out, fmt.Sprintf("%s: %+v", id, m))
+				if m != nil {
+					out[len(out)-1] = fmt.Sprintf("%s: %+v", id, *m)
+				}
+			}
+			sort.Strings(out)
+			return strings.Join(out, "\n")
+		}
+		t.Errorf("got modules\n%s\nwant\n%s", describe(got), describe(want))
+	}
+}
+
+// TestOverlayImportCycle checks that an import added by an overlay
+// that creates an import cycle is reported and removed.
+func TestOverlayImportCycle(t *testing.T) { testAllOverlayModes(t, testOverlayImportCycle) }
+func testOverlayImportCycle(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nimport _ \"golang.org/fake/b\"\n",
+			"b/b.go": "package b\n",
+			"c/c.go": "package c\n\nimport _ \"golang.org/fake/d\"\n",
+			"d/d.go": "package d\n",
+			"e/e.go": "package e\n\nimport _ \"golang.org/fake/c\"\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+
+	for _, test := range []struct {
+		name, file, contents, pattern string
+		want                          map[string]string // package ID -> imports and errors
+		// native is the result if the go command applies the
+		// overlay, which reports the cycle on the root package.
+		native map[string]string
+	}{
+		{
+			"two packages", "b/b.go", "package b\n\nimport _ \"golang.org/fake/a\"\n", "golang.org/fake/a",
+			map[string]string{
+				"golang.org/fake/a": "[golang.org/fake/b] []",
+				"golang.org/fake/b": "[] [import cycle not allowed: golang.org/fake/b -> golang.org/fake/a -> golang.org/fake/b]",
+			},
+			map[string]string{
+				"golang.org/fake/a": "[golang.org/fake/b] [import cycle not allowed: import stack: [golang.org/fake/a golang.org/fake/b golang.org/fake/a]]",
+				"golang.org/fake/b": "[] []",
+			},
+		},
+		{
+			// d -> e -> c -> d, through the unmodified package e.
+			"longer cycle", "d/d.go", "package d\n\nimport _ \"golang.org/fake/e\"\n", "golang.org/fake/c",
+			map[string]string{
+				"golang.org/fake/c": "[golang.org/fake/d] []",
+				// Without the import, e is not a dependency.
+				"golang.org/fake/d": "[] [import cycle not allowed: golang.org/fake/d -> golang.org/fake/e -> golang.org/fake/c -> golang.org/fake/d]",
+			},
+			map[string]string{
+				"golang.org/fake/c": "[golang.org/fake/d] [import cycle not allowed: import stack: [golang.org/fake/c golang.org/fake/d golang.org/fake/e golang.org/fake/c]]",
+				"golang.org/fake/d": "[golang.org/fake/e] []",
+				"golang.org/fake/e": "[] []",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exported.Config.Overlay = map[string][]byte{
+				exported.File("golang.org/fake", test.file): []byte(test.contents),
+			}
+			initial, err := packages.Load(exported.Config, test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			packages.Visit(initial, nil, func(p *packages.Package) {
+				var imports, errs []string
+				for path := range p.Imports {
+					imports = append(imports, path)
+				}
+				sort.Strings(imports)
+				for _, err := range p.Errors {
+					errs = append(errs, err.Msg)
+				}
+				got[p.ID] = fmt.Sprintf("%v %v", imports, errs)
+			})
+			want := test.want
+			if nativeOverlay() {
+				want = test.native
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestOverlayWorkspace checks that a package added by an overlay in a
+// go.work workspace takes its path from the innermost workspace module
+// that contains it, as the go.work file of the overlay lists them.
+func TestOverlayWorkspace(t *testing.T) { forEachOverlayMode(t, testOverlayWorkspace) }
+func testOverlayWorkspace(t *testing.T) {
+	testenv.NeedsGo1Point(t, 18)
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for filename, contents := range map[string]string{
+		"go.work":                  "go 1.18\n\nuse ./outer\n",
+		"outer/go.mod":             "module example.com/outer\n\ngo 1.18\n",
+		"outer/a/a.go":             "package a\n",
+		"outer/tools/go.mod":       "module example.com/tools\n\ngo 1.18\n",
+		"outer/tools/tools.go":     "package tools\n",
+		"outer/toolsextra/doc.txt": "not a module\n",
+	} {
+		filename = filepath.Join(dir, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedModule,
+		Dir:  dir,
+		Env:  append(os.Environ(), "GO111MODULE=on", "GOFLAGS=", "GOWORK="+filepath.Join(dir, "go.work"), "GOPROXY=off"),
+		Overlay: map[string][]byte{
+			// The overlay adds the nested module to the workspace.
+			filepath.Join(dir, "go.work"):                            []byte("go 1.18\n\nuse (\n\t./outer\n\t\"./outer/tools\" // nested\n)\n"),
+			filepath.Join(dir, "outer", "tools", "cmd", "x", "x.go"): []byte("package main\n"),
+			filepath.Join(dir, "outer", "toolsextra", "y", "y.go"):   []byte("package y\n"),
+		},
+	}
+	initial, err := packages.Load(cfg, "example.com/tools/cmd/x", "example.com/outer/toolsextra/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, p := range initial {
+		var files []string
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		got[p.ID] = fmt.Sprintf("%s %v %v", p.Name, files, p.Errors)
+		if p.Module != nil {
+			got[p.ID] += fmt.Sprintf(" %s main=%t", p.Module.Path, p.Module.Main)
+		}
+	}
+	want := map[string]string{
+		"example.com/tools/cmd/x":        "main [x.go] [] example.com/tools main=true",
+		"example.com/outer/toolsextra/y": "y [y.go] [] example.com/outer main=true",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestNoGoCommand checks that packages are constructed from the overlay
+// alone if Config.NoGoCommand is set, with test variants and stubs for
+// the imported packages that the overlay lacks.
+func TestNoGoCommand(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "nonexistent", "fake")
+	ran := 0
+	cfg := &packages.Config{
+		Mode:        packages.NeedName | packages.NeedFiles | packages.NeedImports,
+		Tests:       true,
+		Logf:        func(string, ...interface{}) { ran++ },
+		NoGoCommand: true,
+		RootDirs:    map[string]string{dir: "golang.org/fake", filepath.Join(dir, "nested"): "example.com/nested"},
+		Overlay: map[string][]byte{
+			filepath.Join(dir, "a", "a.go"):           []byte("package a\n\nimport (\n\t\"fmt\"\n\t\"unsafe\"\n\n\t\"golang.org/fake/b\"\n)\n"),
+			filepath.Join(dir, "a", "a_test.go"):      []byte("package a\n\nimport \"testing\"\n"),
+			filepath.Join(dir, "a", "x_test.go"):      []byte("package a_test\n\nimport \"golang.org/fake/a\"\n"),
+			filepath.Join(dir, "b", "b.go"):           []byte("package b\n\nimport \"example.com/nested/c\"\n"),
+			filepath.Join(dir, "nested", "c", "c.go"): []byte("package c\n"),
+			filepath.Join(dir, "..", "outside.go"):    []byte("package outside\n"),
+		},
+	}
+	initial, err := packages.Load(cfg, "golang.org/fake/a", "golang.org/fake/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran > 0 {
+		t.Errorf("the go command ran %d times, want none", ran)
+	}
+	var roots []string
+	for _, p := range initial {
+		roots = append(roots, p.ID)
+	}
+	wantRoots := []string{
+		"golang.org/fake/a",
+		"golang.org/fake/a [golang.org/fake/a.test]",
+		"golang.org/fake/a_test [golang.org/fake/a.test]",
+		"golang.org/fake/missing",
+	}
+	if !reflect.DeepEqual(roots, wantRoots) {
+		t.Errorf("got roots %v, want %v", roots, wantRoots)
+	}
+
+	got := make(map[string]string)
+	packages.Visit(initial, nil, func(p *packages.Package) {
+		var files, imports []string
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		for path, imp := range p.Imports {
+			imports = append(imports, path+":"+imp.ID)
+		}
+		sort.Strings(imports)
+		got[p.ID] = fmt.Sprintf("%s %v %v %v", p.Name, files, imports, p.Errors)
+		if p.FromOverlay != (len(p.GoFiles) > 0) {
+			t.Errorf("%s: FromOverlay = %t, want %t", p.ID, p.FromOverlay, len(p.GoFiles) > 0)
+		}
+	})
+	want := map[string]string{
+		"golang.org/fake/a":                               "a [a.go] [fmt:fmt golang.org/fake/b:golang.org/fake/b unsafe:unsafe] []",
+		"golang.org/fake/a [golang.org/fake/a.test]":      "a [a.go a_test.go] [fmt:fmt golang.org/fake/b:golang.org/fake/b testing:testing unsafe:unsafe] []",
+		"golang.org/fake/a_test [golang.org/fake/a.test]": "a_test [x_test.go] [golang.org/fake/a:golang.org/fake/a [golang.org/fake/a.test]] []",
+		"golang.org/fake/b":                               "b [b.go] [example.com/nested/c:example.com/nested/c] []",
+		"example.com/nested/c":                            "c [c.go] [] []",
+		"fmt":                                             "fmt [] [] [-: package fmt is not in the overlay]",
+		"testing":                                         "testing [] [] [-: package testing is not in the overlay]",
+		"unsafe":                                          "unsafe [] [] []",
+		"golang.org/fake/missing":                         " [] [] [-: package golang.org/fake/missing is not in the overlay]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got packages\n%v\nwant\n%v", got, want)
+	}
+}
+
+// TestOverlayCollidingPaths checks that the packages an overlay adds in
+// two workspace modules, whose paths are both guessed to be the same,
+// are loaded as distinct packages with stable IDs rather than merged.
+func TestOverlayCollidingPaths(t *testing.T) { forEachOverlayMode(t, testOverlayCollidingPaths) }
+func testOverlayCollidingPaths(t *testing.T) {
+	testenv.NeedsGo1Point(t, 18)
+	dir, err := ioutil.TempDir("", "colliding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for filename, contents := range map[string]string{
+		"go.work":      "go 1.18\n\nuse (\n\t./m\n\t./other\n)\n",
+		"m/go.mod":     "module example.com/m\n\ngo 1.18\n",
+		"m/m.go":       "package m\n",
+		"other/go.mod": "module example.com/m/internal\n\ngo 1.18\n",
+		"other/o.go":   "package internal\n",
+	} {
+		filename = filepath.Join(dir, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f1 := filepath.Join(dir, "m", "internal", "util", "u.go")
+	f2 := filepath.Join(dir, "other", "util", "u.go")
+	load := func() map[string]string {
+		cfg := &packages.Config{
+			Mode: packages.NeedName | packages.NeedFiles,
+			Dir:  dir,
+			Env:  append(os.Environ(), "GO111MODULE=on", "GOFLAGS=", "GOWORK="+filepath.Join(dir, "go.work"), "GOPROXY=off"),
+			Overlay: map[string][]byte{
+				f1: []byte("package util\n"),
+				f2: []byte("package util\n"),
+			},
+		}
+		initial, err := packages.Load(cfg, "file="+f1, "file="+f2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, p := range initial {
+			var files []string
+			for _, f := range p.GoFiles {
+				files = append(files, strings.TrimPrefix(filepath.ToSlash(f), filepath.ToSlash(dir)+"/"))
+			}
+			id := strings.Replace(p.ID, dir, "$DIR", 1)
+			got[id] = fmt.Sprintf("%s %v %d", p.PkgPath, files, len(p.Errors))
+		}
+		return got
+	}
+	got := load()
+	// The package in the second module is qualified by its module path
+	// and reports the collision.
+	want := map[string]string{
+		"example.com/m/internal/util":                          "example.com/m/internal/util [m/internal/util/u.go] 0",
+		"example.com/m/internal/util (example.com/m/internal)": "example.com/m/internal/util [other/util/u.go] 1",
+	}
+	if nativeOverlay() {
+		// The go command qualifies both by their directories.
+		want = map[string]string{
+			"command-line-arguments ($DIR/m/internal/util)": "command-line-arguments [m/internal/util/u.go] 0",
+			"command-line-arguments ($DIR/other/util)":      "command-line-arguments [other/util/u.go] 0",
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if again := load(); !reflect.DeepEqual(again, got) {
+		t.Errorf("second load got %v, want %v", again, got)
+	}
+}
+
+// TestOverlayFileQueries checks that a file= query for a file that is
+// only in the overlay, named as the keys of the overlay may be, loads
+// the package of its directory with it, or the package that the
+// overlay adds if the directory has none.
+func TestOverlayFileQueries(t *testing.T) { testAllOverlayModes(t, testOverlayFileQueries) }
+func testOverlayFileQueries(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":    "package a\n",
+			"e/doc.txt": "not a package\n",
+		}}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	rel, err := filepath.Rel(exported.Config.Dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		file  string // overlay key, relative to the module
+		query string // file= query, relative to Dir unless absolute
+		want  string
+	}{
+		{"a/new.go", filepath.Join(rel, "a", "new.go"), "golang.org/fake/a [a.go new.go]"},
+		{"e/e.go", filepath.Join(dir, "e", ".", "e.go"), "golang.org/fake/e [e.go]"},
+		{"n/n.go", filepath.Join(dir, "n", "..", "n", "n.go"), "golang.org/fake/n [n.go]"},
+		{"a/new_test.go", filepath.Join(rel, "a", "new_test.go"), "golang.org/fake/a [golang.org/fake/a.test] [a.go new_test.go]"},
+	} {
+		filename := filepath.Join(dir, filepath.FromSlash(test.file))
+		exported.Config.Mode = packages.NeedName | packages.NeedFiles
+		exported.Config.Tests = true
+		exported.Config.Overlay = map[string][]byte{
+			filename: []byte("package " + filepath.Base(filepath.Dir(filename)) + "\n"),
+		}
+		initial, err := packages.Load(exported.Config, "file="+test.query)
+		if err != nil {
+			t.Errorf("file=%s: %v", test.query, err)
+			continue
+		}
+		var got []string
+		for _, p := range initial {
+			var files []string
+			for _, f := range p.GoFiles {
+				files = append(files, filepath.Base(f))
+			}
+			got = append(got, fmt.Sprintf("%s %v", p.ID, files))
+			if len(p.Errors) > 0 {
+				t.Errorf("file=%s: package %s has errors %v", test.query, p.ID, p.Errors)
+			}
+		}
+		if len(got) != 1 || got[0] != test.want {
+			t.Errorf("file=%s: got %v, want [%s]", test.query, got, test.want)
+		}
+	}
+}
+
+// TestDepsErrors checks that the errors of the missing dependencies of
+// a package, including those of the imports that the overlay adds, are
+// among its DepsErrors, not its Errors, if NeedDepsErrors is set.
+func TestDepsErrors(t *testing.T) { testAllOverlayModes(t, testDepsErrors) }
+func testDepsErrors(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n\nimport _ \"example.com/missing/pkg\"\n",
+			"b/b.go": "package b\n\nimport _ \"golang.org/fake/a\"\n",
+			"c/c.go": "package c\n",
+		}}})
+	defer exported.Cleanup()
+	exported.Config.Overlay = map[string][]byte{
+		exported.File("golang.org/fake", "c/c.go"): []byte("package c\n\nimport _ \"golang.org/fake/nope\"\n"),
+	}
+	for _, mode := range []packages.LoadMode{0, packages.NeedDepsErrors} {
+		exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | mode
+		initial, err := packages.Load(exported.Config, "golang.org/fake/b", "golang.org/fake/c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, p := range initial {
+			var deps []string
+			for _, err := range p.DepsErrors {
+				for _, path := range []string{"example.com/missing/pkg", "golang.org/fake/nope"} {
+					if strings.Contains(err.Msg, path) {
+						deps = append(deps, path)
+					}
+				}
+			}
+			got[p.ID] = fmt.Sprintf("%d %v", len(p.Errors), deps)
+		}
+		want := map[string]string{
+			"golang.org/fake/b": "0 [example.com/missing/pkg]",
+			"golang.org/fake/c": "0 [golang.org/fake/nope]",
+		}
+		if mode == 0 {
+			want = map[string]string{
+				"golang.org/fake/b": "0 []",
+				"golang.org/fake/c": "0 []",
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", exported.Config.Mode, got, want)
+		}
+	}
+}
+
+// TestOverlayOtherFiles checks that an assembly file and a file that a
+// package embeds, added by the overlay, belong to the OtherFiles and
+// the EmbedFiles of the package, as they would on disk.
+func TestOverlayOtherFiles(t *testing.T) { testAllOverlayModes(t, testOverlayOtherFiles) }
+func testOverlayOtherFiles(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":          "package a\n\nimport _ \"embed\"\n\n//go:embed data/*.txt\nvar s string\n",
+			"a/data/keep.txt": "keep",
+		}}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedEmbedFiles
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "a_amd64.s"):         []byte("TEXT ·f(SB),0,$0\n"),
+		filepath.Join(dir, "data", "new.txt"):   []byte("new"),
+		filepath.Join(dir, "data", "other.dat"): []byte("not embedded"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initial) != 1 {
+		t.Fatalf("got %d packages, want 1", len(initial))
+	}
+	base := func(files []string) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, filepath.Base(f))
+		}
+		sort.Strings(names)
+		return names
+	}
+	p := initial[0]
+	if got, want := base(p.OtherFiles), []string{"a_amd64.s"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OtherFiles: got %v, want %v", got, want)
+	}
+	if got, want := base(p.EmbedFiles), []string{"keep.txt", "new.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EmbedFiles: got %v, want %v", got, want)
+	}
+}
+
+// TestOverlayVendoredImport checks that a package that the overlay
+// imports, and that only a vendor directory of the GOPATH project
+// has, is loaded as that of the vendor directory, once however its
+// importers resolve it.
+func TestOverlayVendoredImport(t *testing.T) {
+	forEachOverlayMode(t, func(t *testing.T) {
+		exported := packagestest.Export(t, packagestest.GOPATH, []packagestest.Module{{
+			Name: "golang.org/fake",
+			Files: map[string]interface{}{
+				"a/a.go":                    "package a\n",
+				"b/b.go":                    "package b\n\nimport _ \"example.com/v\"\n",
+				"vendor/example.com/v/v.go": "package v\n\nimport _ \"example.com/w\"\n",
+				"vendor/example.com/w/w.go": "package w\n",
+			}}})
+		defer exported.Cleanup()
+		exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+		dir := filepath.Dir(exported.File("golang.org/fake", "a/a.go"))
+		exported.Config.Overlay = map[string][]byte{
+			filepath.Join(dir, "a.go"): []byte("package a\n\nimport (\n\t_ \"example.com/n\"\n\t_ \"example.com/v\"\n\t_ \"example.com/w\"\n)\n"),
+			// A package that only the overlay has in the vendor directory.
+			filepath.Join(dir, "..", "vendor", "example.com", "n", "n.go"): []byte("package n\n"),
+		}
+		initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, all := importGraph(initial)
+		for id, p := range all {
+			if len(p.Errors) > 0 {
+				t.Errorf("%s has errors %v", id, p.Errors)
+			}
+		}
+		a := all["golang.org/fake/a"]
+		imports := []string{"example.com/v", "example.com/w"}
+		if !nativeOverlay() {
+			// The go command does not look for vendored packages in
+			// the directories that only the overlay has.
+			imports = append(imports, "example.com/n")
+		}
+		for _, imp := range imports {
+			want := "golang.org/fake/vendor/" + imp
+			if p := a.Imports[imp]; p == nil || p.ID != want || len(p.GoFiles) != 1 {
+				t.Errorf("golang.org/fake/a imports %s as %+v, want %s with its file", imp, p, want)
+			}
+		}
+		for id := range all {
+			if strings.HasPrefix(id, "example.com/") && !(nativeOverlay() && id == "example.com/n") {
+				t.Errorf("loaded %s, which only the vendor directory has", id)
+			}
+		}
+	})
+}
+
+// TestOverlayGoVersion checks that a package added by an overlay is
+// type checked with the language version of its module, as the go.mod
+// file of the overlay gives it.
+func TestOverlayGoVersion(t *testing.T) {
+	testenv.NeedsGo1Point(t, 21)
+	forEachOverlayMode(t, testOverlayGoVersion)
+}
+func testOverlayGoVersion(t *testing.T) {
+	exported := packagestest.Export(t, packagestest.Modules, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"go.mod": "module golang.org/fake\n\ngo 1.21\n",
+			"b/b.go": "package b\n",
+		}}})
+	defer exported.Cleanup()
+	mainDir := filepath.Dir(exported.File("golang.org/fake", "go.mod"))
+	for _, test := range []struct {
+		version string
+		wantErr string
+	}{
+		{"1.19", "requires go1.21"},
+		{"1.21", ""},
+		{"1.21.0", ""},
+	} {
+		exported.Config.Mode = packages.NeedName | packages.NeedTypes | packages.NeedSyntax | packages.NeedModule
+		exported.Config.Env = append(exported.Config.Env, "GOFLAGS=-mod=readonly")
+		exported.Config.Overlay = map[string][]byte{
+			filepath.Join(mainDir, "go.mod"):    []byte("module golang.org/fake\n\ngo " + test.version + "\n"),
+			filepath.Join(mainDir, "a", "a.go"): []byte("package a\n\nfunc F(m map[int]int) { clear(m) }\n"),
+		}
+		initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(initial) != 1 {
+			t.Fatalf("go %s: got %d packages, want 1", test.version, len(initial))
+		}
+		p := initial[0]
+		if want := "go" + test.version[:4]; p.GoVersion != want {
+			t.Errorf("go %s: got GoVersion %q, want %q", test.version, p.GoVersion, want)
+		}
+		// The go command, which applies the overlay itself, may
+		// report the error of the compiler too.
+		var found bool
+		for _, err := range p.Errors {
+			found = found || err.Kind == packages.TypeError && strings.Contains(err.Msg, test.wantErr)
+		}
+		if test.wantErr == "" && len(p.Errors) > 0 {
+			t.Errorf("go %s: got errors %v, want none", test.version, p.Errors)
+		} else if test.wantErr != "" && !found {
+			t.Errorf("go %s: got errors %v, want a type error containing %q", test.version, p.Errors, test.wantErr)
+		}
+	}
+}
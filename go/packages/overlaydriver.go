@@ -0,0 +1,164 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"fmt"
+	"go/types"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// overlayDriver is the driver used if Config.NoGoCommand is set. It
+// constructs the packages of the Overlay as processGolistOverlay adds
+// them to an empty response of go list, in GOPATH mode, taking their
+// package paths from Config.RootDirs instead of from the go command.
+func overlayDriver(cfg *Config, patterns ...string) (*driverResponse, error) {
+	roots := make(map[string]string)
+	for dir, pkgPath := range cfg.RootDirs {
+		roots[filepath.Clean(dir)] = pkgPath
+	}
+	// Only the files in the root directories belong to packages, and,
+	// as go list reports them, test files only if tests are requested.
+	overlay := make(map[string][]byte)
+	for _, filename := range cfg.overlayFilenames() {
+		if !cfg.Tests && strings.HasSuffix(filename, "_test.go") {
+			continue
+		}
+		for dir := range roots {
+			if inDir(filepath.Dir(filename), dir) {
+				overlay[filename], _ = cfg.overlayContents(filename)
+				break
+			}
+		}
+	}
+	pure := *cfg
+	pure.Overlay = overlay
+	pure.fsOverlay = nil
+	state := &golistState{
+		cfg:        &pure,
+		ctx:        cfg.Context,
+		vendorDirs: map[string]bool{},
+	}
+	state.envOnce.Do(func() {
+		state.goEnv = map[string]string{}
+	})
+	state.rootsOnce.Do(func() {
+		state.rootDirs = roots
+	})
+
+	response := newDeduper()
+	_, needPkgs, err := state.processGolistOverlay(response)
+	if err != nil {
+		return nil, err
+	}
+	breakOverlayImportCycles(response)
+	markOverlayPackages(response, &pure)
+
+	// The imported packages that are not in the overlay are stubs.
+	for _, pkgPath := range needPkgs {
+		stub := &Package{
+			ID:      pkgPath,
+			Name:    path.Base(pkgPath),
+			PkgPath: pkgPath,
+			Imports: map[string]*Package{},
+		}
+		if pkgPath != "unsafe" {
+			stub.Errors = append(stub.Errors, Error{
+				Msg:  fmt.Sprintf("package %s is not in the overlay", pkgPath),
+				Kind: ListError,
+			})
+		}
+		response.addPackage(stub)
+	}
+
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "=") {
+			return nil, fmt.Errorf("query %q is not supported without the go command", pattern)
+		}
+		match := matchPattern(pattern)
+		matched := false
+		for _, pkg := range response.dr.Packages {
+			// A test variant is a root if the package it tests is.
+			pkgPath := pkg.PkgPath
+			if pkg.forTest != "" {
+				pkgPath = pkg.forTest
+			}
+			if match(pkgPath) && len(pkg.GoFiles) > 0 {
+				response.addRoot(pkg.ID)
+				matched = true
+			}
+		}
+		if !matched && !strings.Contains(pattern, "...") {
+			// As go list -e does, report a package that cannot be
+			// found as a package with an error.
+			if response.seenPackages[pattern] == nil {
+				response.addPackage(&Package{
+					ID:      pattern,
+					PkgPath: pattern,
+					Imports: map[string]*Package{},
+					Errors: []Error{{
+						Msg:  fmt.Sprintf("package %s is not in the overlay", pattern),
+						Kind: ListError,
+					}},
+				})
+			}
+			response.addRoot(pattern)
+		}
+	}
+	sort.Slice(response.dr.Packages, func(i, j int) bool { return response.dr.Packages[i].ID < response.dr.Packages[j].ID })
+	sort.Strings(response.dr.Roots)
+	if cfg.reportEnv {
+		response.dr.OverlayTrace = state.overlayTrace
+	}
+
+	if cfg.Mode&(NeedTypes|NeedTypesSizes) != 0 {
+		goarch := runtime.GOARCH
+		for _, kv := range cfg.Env {
+			if strings.HasPrefix(kv, "GOARCH=") {
+				goarch = kv[len("GOARCH="):]
+			}
+		}
+		if response.dr.Sizes = stdSizes(goarch); response.dr.Sizes == nil {
+			return nil, fmt.Errorf("unknown GOARCH %q", goarch)
+		}
+	}
+	return response.dr, nil
+}
+
+// matchPattern returns a function that reports whether a package path
+// matches pattern, in which "..." matches any string, and a trailing
+// "/..." also matches the empty string, as it does for the go command.
+func matchPattern(pattern string) func(pkgPath string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	return regexp.MustCompile(`^` + re + `$`).MatchString
+}
+
+// stdSizes returns the sizes of the types of the gc compiler for goarch,
+// or nil if it is unknown.
+func stdSizes(goarch string) *types.StdSizes {
+	sizes := types.SizesFor("gc", goarch)
+	if sizes == nil {
+		return nil
+	}
+	if std, ok := sizes.(*types.StdSizes); ok {
+		return std
+	}
+	// Recent versions of go/types implement the sizes of gc by another
+	// type, whose word size and maximum alignment are those of uintptr
+	// and int64.
+	return &types.StdSizes{
+		WordSize: sizes.Sizeof(types.Typ[types.Uintptr]),
+		MaxAlign: sizes.Alignof(types.Typ[types.Int64]),
+	}
+}
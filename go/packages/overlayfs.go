@@ -0,0 +1,137 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// The methods of this file give access to the overlay of a Config,
+// which consists of the files of Overlay and those of OverlayFS, once
+// resolveOverlay has listed them. The contents of the files of
+// OverlayFS are read when they are needed, and not kept.
+
+// hasOverlay reports whether the overlay has any file.
+func (cfg *Config) hasOverlay() bool {
+	return len(cfg.Overlay) > 0 || len(cfg.fsOverlay) > 0
+}
+
+// overlayFilenames returns the absolute names of the files of the
+// overlay, in no particular order.
+func (cfg *Config) overlayFilenames() []string {
+	filenames := make([]string, 0, len(cfg.Overlay)+len(cfg.fsOverlay))
+	for filename := range cfg.Overlay {
+		filenames = append(filenames, filename)
+	}
+	for filename := range cfg.fsOverlay {
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+// inOverlay reports whether the overlay has the file filename, without
+// reading it.
+func (cfg *Config) inOverlay(filename string) bool {
+	if _, ok := cfg.Overlay[filename]; ok {
+		return true
+	}
+	_, ok := cfg.fsOverlay[filename]
+	return ok
+}
+
+// overlayQuery returns the file of the overlay that the path of a
+// file= query names, once resolved against Dir and cleaned as the keys
+// of Overlay are, or path itself if the overlay has no such file.
+func (cfg *Config) overlayQuery(path string) string {
+	if !cfg.hasOverlay() {
+		return path
+	}
+	dir := cfg.Dir
+	if !filepath.IsAbs(dir) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+	}
+	filename, err := absOverlayPath(dir, path, runtime.GOOS == "windows")
+	if err != nil || !cfg.inOverlay(filename) {
+		return path
+	}
+	return filename
+}
+
+// overlayContents returns the contents of the file filename of the
+// overlay, and whether the overlay has it. A file of OverlayFS that
+// cannot be read has no contents.
+func (cfg *Config) overlayContents(filename string) ([]byte, bool) {
+	if contents, ok := cfg.Overlay[filename]; ok {
+		return contents, true
+	}
+	name, ok := cfg.fsOverlay[filename]
+	if !ok {
+		return nil, false
+	}
+	contents, _ := readOverlayFS(cfg.OverlayFS, name)
+	return contents, true
+}
+
+// overlayMap returns the whole overlay as a map, as a driver request
+// carries it, reading every file of OverlayFS.
+func (cfg *Config) overlayMap() map[string][]byte {
+	if len(cfg.fsOverlay) == 0 {
+		return cfg.Overlay
+	}
+	overlay := make(map[string][]byte, len(cfg.Overlay)+len(cfg.fsOverlay))
+	for _, filename := range cfg.overlayFilenames() {
+		overlay[filename], _ = cfg.overlayContents(filename)
+	}
+	return overlay
+}
+
+// writeOverlayFile writes the contents of the file filename of the
+// overlay to the file tmp, copying those of a file of OverlayFS
+// without holding them in memory.
+func (cfg *Config) writeOverlayFile(filename, tmp string) error {
+	name, ok := cfg.fsOverlay[filename]
+	if !ok {
+		return ioutil.WriteFile(tmp, cfg.Overlay[filename], 0644)
+	}
+	r, err := openOverlayFS(cfg.OverlayFS, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// resolveOverlayFS sets the fsOverlay of cfg to the files of OverlayFS,
+// mapped from their absolute names, which are relative to the
+// directory root, to their names in OverlayFS, except for those that
+// Overlay already has.
+func (cfg *Config) resolveOverlayFS(root string) error {
+	names, err := walkOverlayFS(cfg.OverlayFS)
+	if err != nil {
+		return err
+	}
+	cfg.fsOverlay = make(map[string]string, len(names))
+	for _, name := range names {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		if _, ok := cfg.Overlay[filename]; !ok {
+			cfg.fsOverlay[filename] = name
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !go1.16
+
+package packages
+
+import (
+	"errors"
+	"io"
+)
+
+var errOverlayFS = errors.New("OverlayFS requires Go 1.16")
+
+func walkOverlayFS(fsys interface{}) ([]string, error) {
+	return nil, errOverlayFS
+}
+
+func readOverlayFS(fsys interface{}, name string) ([]byte, error) {
+	return nil, errOverlayFS
+}
+
+func openOverlayFS(fsys interface{}, name string) (io.ReadCloser, error) {
+	return nil, errOverlayFS
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package packages
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// walkOverlayFS returns the names of the regular files of fsys, the
+// OverlayFS of a Config, which must be an fs.FS.
+func walkOverlayFS(fsys interface{}) ([]string, error) {
+	f, ok := fsys.(fs.FS)
+	if !ok {
+		return nil, fmt.Errorf("OverlayFS of type %T is not an fs.FS", fsys)
+	}
+	var names []string
+	err := fs.WalkDir(f, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the files of OverlayFS: %v", err)
+	}
+	return names, nil
+}
+
+func readOverlayFS(fsys interface{}, name string) ([]byte, error) {
+	return fs.ReadFile(fsys.(fs.FS), name)
+}
+
+func openOverlayFS(fsys interface{}, name string) (io.ReadCloser, error) {
+	return fsys.(fs.FS).Open(name)
+}
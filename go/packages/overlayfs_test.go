@@ -0,0 +1,78 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.16
+
+package packages_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+// TestOverlayFS checks that the files of an OverlayFS replace those of
+// a package and add a package, and that those of Overlay take
+// precedence over them.
+func TestOverlayFS(t *testing.T) {
+	testAllOverlayModes(t, testOverlayFS)
+}
+func testOverlayFS(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+			"b/b.go": "package b\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedSyntax
+	exported.Config.OverlayFS = fstest.MapFS{
+		"a/a.go": {Data: []byte("package a\n\nimport _ \"golang.org/fake/b\"\n")},
+		"b/b.go": {Data: []byte("package b\n\nimport _ \"golang.org/fake/missing\"\n")},
+		"c/c.go": {Data: []byte("package c\n\nimport _ \"golang.org/fake/a\"\n")},
+	}
+	exported.Config.OverlayRoot = dir
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "b", "b.go"): []byte("package b\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	packages.Visit(initial, nil, func(p *packages.Package) {
+		var files, imports []string
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		for path := range p.Imports {
+			imports = append(imports, path)
+		}
+		sort.Strings(imports)
+		var parsed int
+		for _, f := range p.Syntax {
+			parsed += len(f.Imports)
+		}
+		if len(p.Errors) > 0 {
+			t.Errorf("package %s has errors %v", p.ID, p.Errors)
+		}
+		got[p.ID] = fmt.Sprintf("%v %v %d", files, imports, parsed)
+	})
+	want := map[string]string{
+		"golang.org/fake/a": "[a.go] [golang.org/fake/b] 1",
+		"golang.org/fake/b": "[b.go] [] 0",
+		"golang.org/fake/c": "[c.go] [golang.org/fake/a] 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got packages %v, want %v", got, want)
+	}
+}
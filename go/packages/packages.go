@@ -18,7 +18,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +30,7 @@ import (
 	"golang.org/x/tools/internal/gocommand"
 	"golang.org/x/tools/internal/packagesinternal"
 	"golang.org/x/tools/internal/typesinternal"
+	"golang.org/x/xerrors"
 )
 
 // A LoadMode controls the amount of detail to return when loading.
@@ -45,7 +49,7 @@ const (
 	// NeedName adds Name and PkgPath.
 	NeedName LoadMode = 1 << iota
 
-	// NeedFiles adds GoFiles and OtherFiles.
+	// NeedFiles adds GoFiles, OtherFiles, and IgnoredFiles.
 	NeedFiles
 
 	// NeedCompiledGoFiles adds CompiledGoFiles.
@@ -79,6 +83,15 @@ const (
 
 	// NeedModule adds Module.
 	NeedModule
+
+	// NeedEmbedFiles adds EmbedFiles.
+	NeedEmbedFiles
+
+	// NeedEmbedPatterns adds EmbedPatterns.
+	NeedEmbedPatterns
+
+	// NeedDepsErrors adds DepsErrors.
+	NeedDepsErrors
 )
 
 const (
@@ -111,17 +124,36 @@ type Config struct {
 	Mode LoadMode
 
 	// Context specifies the context for the load operation.
-	// If the context is cancelled, the loader may stop early
-	// and return an ErrCancelled error.
+	// If the context is cancelled, the loader stops early
+	// and returns an error; see Load.
 	// If Context is nil, the load cannot be cancelled.
 	Context context.Context
 
+	// GoCommandTimeout, if not zero, limits how long each run of the
+	// go command may take. A go command that runs longer is killed,
+	// with the processes it started, and the load fails with an error
+	// that names the command.
+	GoCommandTimeout time.Duration
+
+	// GoCommandRunner, if not nil, runs the go commands of the go list
+	// driver in place of the go command of the PATH, as a runner that
+	// records them, or that replays the outputs of recorded ones
+	// without a go command, would.
+	GoCommandRunner GoCommandRunner
+
 	// Logf is the logger for the config.
 	// If the user provides a logger, debug logging is enabled.
 	// If the GOPACKAGESDEBUG environment variable is set to true,
 	// but the logger is nil, default to log.Printf.
 	Logf func(format string, args ...interface{})
 
+	// WarningHandler, if not nil, is called with each line of output,
+	// such as a notice that a module is being looked up, that the build
+	// system's query tool prints without failing to report the
+	// packages, whether or not Logf is set. It may be called from
+	// multiple goroutines at once.
+	WarningHandler func(DriverWarning)
+
 	// Dir is the directory in which to run the build system's query tool
 	// that provides information about the packages.
 	// If Dir is empty, the tool is run in the current directory.
@@ -140,10 +172,39 @@ type Config struct {
 	// gocmdRunner guards go command calls from concurrency errors.
 	gocmdRunner *gocommand.Runner
 
+	// session, if set, is the Session whose Load is in progress.
+	session *Session
+
+	// reportEnv, if set, makes the driver report the environment of
+	// the go command in its response; see LoadWithEnv.
+	reportEnv bool
+
 	// BuildFlags is a list of command-line flags to be passed through to
 	// the build system's query tool.
 	BuildFlags []string
 
+	// Variants, if not empty, makes Load query the build system once
+	// for each of its elements, concurrently, with the variables of the
+	// element, such as GOOS, GOARCH, and GOFLAGS, added to Env, and
+	// return the packages of all the queries. The ID of each package
+	// is suffixed with the key of its variant, as in
+	// "example.com/p [linux/amd64]": the GOOS and GOARCH with which it
+	// was loaded, followed by any other variables of the element, in
+	// order, as in "linux/amd64,GOFLAGS=-tags=x". The variants share
+	// the Fset and the syntax trees of the files that they have in
+	// common; each is type checked with its own sizes. Load reports an
+	// error if two variants have the same key.
+	Variants []map[string]string
+
+	// LazyExportData, if set with NeedTypes, makes Load defer reading
+	// the export data of the packages that are not loaded from source
+	// until their types are needed: when a package that is type checked
+	// from source imports one, or when the LoadTypes method of one is
+	// called. The Types of such a package are an incomplete, empty
+	// package until then. The packages that match the patterns are
+	// loaded as they are without it.
+	LazyExportData bool
+
 	// Fset provides source position information for syntax trees and types.
 	// If Fset is nil, Load will use a new fileset, but preserve Fset's value.
 	Fset *token.FileSet
@@ -180,9 +241,109 @@ type Config struct {
 	// If the file with the given path already exists, the parser will use the
 	// alternative file contents provided by the map.
 	//
-	// Overlays provide incomplete support for when a given file doesn't
-	// already exist on disk. See the package doc above for more details.
+	// Relative paths are resolved against Dir, and all paths are
+	// cleaned; Load reports an error if two paths name the same file.
+	//
+	// If the go command is from Go 1.16 or later, the overlay, including
+	// any go.mod, go.sum, go.work, and go.work.sum files, is passed to
+	// it, using its -overlay flag, as are the DeletedFiles, and it treats
+	// the files as if they were on disk. Otherwise, overlays provide
+	// incomplete support for when a given file doesn't already exist on
+	// disk. See the package doc above for more details.
 	Overlay map[string][]byte
+
+	// OverlayFS, if not nil, is an io/fs.FS whose files are added to
+	// the Overlay, each under the name that joins the directory
+	// OverlayRoot to its slash-separated name in OverlayFS. The loader
+	// reads a file of OverlayFS only when it needs its contents, as to
+	// parse its package clause and imports, and passes it to the go
+	// command without holding it in memory. A file that Overlay also
+	// has is taken from Overlay. OverlayFS has type interface{} so that
+	// the package builds with versions of Go before 1.16, which lack
+	// io/fs; with them, Load reports an error if it is set.
+	OverlayFS interface{}
+
+	// OverlayRoot is the directory to which the root of OverlayFS
+	// corresponds. If it is relative, it is relative to Dir.
+	OverlayRoot string
+
+	// fsOverlay maps the absolute names of the files of OverlayFS to
+	// their names in it; see resolveOverlay.
+	fsOverlay map[string]string
+
+	// DeletedFiles lists the absolute paths of files to be treated as
+	// deleted, even though they still exist on disk, as when an editor
+	// has deleted a file but not yet saved the deletion. The files are
+	// removed from the packages that contain them, whose imports are
+	// recomputed from the remaining files; a package left without Go
+	// files reports an error. A file that is both deleted and in the
+	// Overlay is deleted.
+	DeletedFiles []string
+
+	// OverlayDebug, if set, makes the loader log, with Logf, how it
+	// matches each file of the Overlay to a package when the go command
+	// does not apply the overlay itself, as it does if GOPACKAGESDEBUG
+	// is set. See OverlayDecision.
+	OverlayDebug bool
+
+	// ParallelTypeCheck limits the number of packages that Load parses
+	// and type checks at once, each once the packages it imports have
+	// been. If zero, runtime.GOMAXPROCS(0) packages may be checked at
+	// once. The result does not depend on it.
+	ParallelTypeCheck int
+
+	// Concurrency limits the number of build system queries that may
+	// run at once to load the packages imported by the Overlay that
+	// the first query did not load, if the go command does not apply
+	// the Overlay itself. If zero, runtime.GOMAXPROCS(0)
+	// queries may run at once. The result does not depend on it.
+	Concurrency int
+
+	// Cache, if not empty, is a directory in which Load records the
+	// package graphs that the build system reports, before type
+	// checking, so that a later Load with the same patterns and
+	// Config may reuse them instead of querying the build system.
+	// Each entry is keyed by the patterns and by the fields of Config
+	// that affect the query, including the Overlay, the BuildFlags,
+	// and the variables of Env that the go command uses, such as GOOS
+	// and GOARCH. An entry is reused only if none of the files of its
+	// packages, the other source files in their directories, its
+	// go.mod and go.sum files, and the go command has changed since
+	// it was recorded; otherwise Load queries the build system again.
+	// Graphs in which a package could not be found are not recorded.
+	Cache string
+
+	// RewritePath, if non-nil, rewrites each file path reported in the
+	// returned packages: those of their GoFiles, CompiledGoFiles,
+	// OtherFiles, IgnoredFiles, EmbedFiles, and ExportFile, the file names in the Pos of their
+	// Errors, and the Dir and GoMod of their Module. A PathRewrite may
+	// be used to report paths as the -trimpath build flag does, so
+	// that they do not depend on the machine.
+	//
+	// Paths are rewritten once loading is complete. The other fields
+	// of Config, such as the keys of Overlay, refer to files by their
+	// actual paths, as do the positions recorded in Fset and in the
+	// Syntax and Types of the packages.
+	RewritePath func(path string) string
+
+	// NoGoCommand, if set, makes Load construct the packages from the
+	// files of the Overlay alone, without running the go command or an
+	// external driver, as for hermetic tests. A file belongs to the
+	// package of its directory, whose package path is derived from
+	// RootDirs; imports are resolved and test variants are created as
+	// they are for the files that an overlay adds in GOPATH mode. The
+	// patterns are package paths, which may contain "..." wildcards.
+	// Each imported package that is not in the overlay, such as one of
+	// the standard library, is a stub without files that reports an
+	// error, except for unsafe. Cache is not used.
+	NoGoCommand bool
+
+	// RootDirs maps absolute directories to the package paths of the
+	// packages in them, if NoGoCommand is set: the directory of a
+	// module maps to its module path, and a GOPATH entry's src
+	// directory maps to "". If the directory of a package is in more
+	// than one, the innermost applies.
+	RootDirs map[string]string
 }
 
 // driver is the type for functions that query the build system for the
@@ -201,6 +362,18 @@ type driverResponse struct {
 	// Sizes, if not nil, is the types.Sizes to use when type checking.
 	Sizes *types.StdSizes
 
+	// GoEnv, if not nil, holds the variables of go env with which the
+	// build system was queried; see LoadResult.
+	GoEnv map[string]string `json:",omitempty"`
+
+	// GoVersion is the minor version of the go command with which the
+	// build system was queried, such as 16 for Go 1.16, or 0 if unknown.
+	GoVersion int `json:",omitempty"`
+
+	// OverlayTrace, if not nil, records how the driver matched the
+	// files of the overlay to packages; see LoadResult.OverlayTrace.
+	OverlayTrace []OverlayDecision `json:",omitempty"`
+
 	// Roots is the set of package IDs that make up the root packages.
 	// We have to encode this separately because when we encode a single package
 	// we cannot know if it is one of the roots as that requires knowledge of the
@@ -229,14 +402,231 @@ type driverResponse struct {
 // return an error. Clients may need to handle such errors before
 // proceeding with further analysis. The PrintErrors function is
 // provided for convenient display of all errors.
+//
+// If Config.Context is cancelled during the load, any go command in
+// progress is killed, and Load returns no packages and an error that
+// wraps the context's error.
 func Load(cfg *Config, patterns ...string) ([]*Package, error) {
+	result, err := load(cfg, false, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	return result.Packages, nil
+}
+
+// LoadContaining loads the packages that contain the given files, such
+// as those that a change touches, as Load does for the patterns
+// "file=" + file. Relative files are relative to Config.Dir.
+//
+// LoadContaining returns the packages in the order of the first of the
+// files that each contains, including the test variants of a package if
+// Config.Tests is set, followed by any others that Load would return,
+// as for errors; and it returns the packages that contain each file,
+// keyed by the file as given. A file that no package contains, as one
+// that does not exist, has no packages. The go list driver lists the
+// directories of all the files with as few go commands as it can,
+// rather than once for each file.
+func LoadContaining(cfg *Config, files []string) ([]*Package, map[string][]*Package, error) {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+	dir := cfg.Dir
+	if !filepath.IsAbs(dir) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+	}
+	abs := make([]string, len(files))
+	patterns := make([]string, len(files))
+	for i, file := range files {
+		abs[i] = file
+		if !filepath.IsAbs(file) {
+			abs[i] = filepath.Join(dir, file)
+		}
+		patterns[i] = "file=" + abs[i]
+	}
+
+	// The files of the packages attribute the given files to them.
+	fcfg := *cfg
+	fcfg.Mode |= NeedFiles
+	pkgs, err := Load(&fcfg, patterns...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var roots []*Package
+	seen := make(map[*Package]bool)
+	byFile := make(map[string][]*Package, len(files))
+	for i, file := range files {
+		if _, ok := byFile[file]; ok {
+			continue
+		}
+		var in []*Package
+		for _, pkg := range pkgs {
+			for _, name := range pkg.GoFiles {
+				if sameFile(abs[i], name) {
+					in = append(in, pkg)
+					break
+				}
+			}
+		}
+		byFile[file] = in
+		for _, pkg := range in {
+			if !seen[pkg] {
+				seen[pkg] = true
+				roots = append(roots, pkg)
+			}
+		}
+	}
+
+	for _, pkg := range pkgs {
+		if !seen[pkg] {
+			roots = append(roots, pkg)
+		}
+	}
+
+	if cfg.Mode&NeedFiles == 0 {
+		Visit(pkgs, nil, func(pkg *Package) {
+			pkg.GoFiles = nil
+			pkg.OtherFiles = nil
+			pkg.IgnoredFiles = nil
+			pkg.FromOverlay = false
+		})
+	}
+	return roots, byFile, nil
+}
+
+// A LoadResult is the result of LoadWithEnv.
+type LoadResult struct {
+	// Packages are the packages that Load would return.
+	Packages []*Package
+
+	// Env holds the environment of the go command as the loader
+	// resolved it, from the files of go env, the process, and
+	// Config.Env, including GOMOD, GOPATH, GOROOT, GOFLAGS,
+	// GO111MODULE, GOWORK, and GOVERSION. It is nil if the packages
+	// were loaded without the go command, as with NoGoCommand or by an
+	// external driver that does not report it.
+	Env map[string]string
+
+	// GoVersion is the minor version of the go command, such as 16 for
+	// Go 1.16, or 0 if it is unknown.
+	GoVersion int
+
+	// OverlayTrace records how the loader matched each file of the
+	// Overlay to a package, in the order in which it processed them.
+	// It is empty if the go command applied the overlay itself.
+	OverlayTrace []OverlayDecision
+}
+
+// An OverlayDecision records how the loader matched a file of the
+// Overlay to a package, when the go command does not apply the overlay
+// itself; see Config.OverlayDebug and LoadResult.OverlayTrace. It
+// describes the first pass over the overlay, on the packages that the
+// go command reported, before the loader lists the packages that the
+// overlay needs in addition.
+type OverlayDecision struct {
+	// File is the name of the file of the overlay.
+	File string
+
+	// Name is the package name of its package clause.
+	Name string `json:",omitempty"`
+
+	// Skipped, if not empty, says why the file was not matched to a
+	// package: "deleted", "module file", "excluded by build
+	// constraints", "outside the root directories", when no root
+	// directory gives the path of a new package for it, or "not in a
+	// package", when no package contains a file that is not a Go file.
+	Skipped string `json:",omitempty"`
+
+	// ParseError, if not empty, is the error that prevented reading
+	// the package clause of the file, which then belongs to the
+	// packages of its directory.
+	ParseError string `json:",omitempty"`
+
+	// DirMatch reports whether some package has files in the
+	// directory of the file.
+	DirMatch bool `json:",omitempty"`
+
+	// Packages lists the IDs of the packages to which the file was
+	// added, or which already had it.
+	Packages []string `json:",omitempty"`
+
+	// TestVariantOf is the ID of the package of which the package of a
+	// test file is the test variant, if any.
+	TestVariantOf string `json:",omitempty"`
+
+	// Existed reports whether the package already had the file, as it
+	// does when the overlay replaces a file on disk.
+	Existed bool `json:",omitempty"`
+
+	// Imports lists the import paths that the file added to its
+	// package.
+	Imports []string `json:",omitempty"`
+
+	// Created says how the package of a file whose directory has no
+	// package of its name was found: "reclaimed", if the go command
+	// reported it as missing, or "synthesized", if the loader created
+	// it. PkgPath is the package path that the loader guessed for it
+	// from the root directory that contains the file, and XTest reports
+	// whether it is an x test, whose path has the "_test" suffix.
+	Created string `json:",omitempty"`
+	PkgPath string `json:",omitempty"`
+	XTest   bool   `json:",omitempty"`
+}
+
+// LoadWithEnv loads the Go packages named by the given patterns, as
+// does Load, and also returns the environment with which the go
+// command was run, so that a tool may report which GOFLAGS or module
+// it used. The environment is that of the go env command that the
+// loader runs in any case, or that a Session has cached, not of an
+// additional one.
+func LoadWithEnv(cfg *Config, patterns ...string) (*LoadResult, error) {
+	return load(cfg, true, patterns...)
+}
+
+// load implements Load and LoadWithEnv, reporting the environment of
+// the go command if reportEnv is set.
+func load(cfg *Config, reportEnv bool, patterns ...string) (*LoadResult, error) {
 	l := newLoader(cfg)
-	response, err := defaultDriver(&l.Config, patterns...)
+	l.reportEnv = reportEnv
+	if err := l.resolveOverlay(); err != nil {
+		return nil, err
+	}
+	if l.Fset == nil && l.Mode&(NeedTypes|NeedSyntax) != 0 {
+		// Create the FileSet now, so that the driver may parse files
+		// into it too.
+		l.Fset = token.NewFileSet()
+	}
+	driver := cachingDriver
+	if l.NoGoCommand {
+		driver = overlayDriver
+	}
+	var response *driverResponse
+	var err error
+	if len(l.Variants) > 0 {
+		response, err = l.loadVariants(driver, patterns)
+	} else {
+		response, err = driver(&l.Config, patterns...)
+	}
 	if err != nil {
 		return nil, err
 	}
 	l.sizes = response.Sizes
-	return l.refine(response.Roots, response.Packages...)
+	pkgs, err := l.refine(response.Roots, response.Packages...)
+	if err == nil && l.Context.Err() != nil {
+		// Do not return packages that were only partly loaded.
+		return nil, xerrors.Errorf("loading packages interrupted: %w", l.Context.Err())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &LoadResult{
+		Packages:     pkgs,
+		Env:          response.GoEnv,
+		GoVersion:    response.GoVersion,
+		OverlayTrace: response.OverlayTrace,
+	}, nil
 }
 
 // defaultDriver is a driver that implements go/packages' fallback behavior.
@@ -277,6 +667,13 @@ type Package struct {
 	// of the package, or while parsing or type-checking its files.
 	Errors []Error
 
+	// DepsErrors contains the errors of the dependencies of the
+	// package that the build system reported for it, such as that of
+	// an import that no module provides, and those of the imports
+	// added by the Overlay whose packages could not be loaded, which
+	// Errors does not include.
+	DepsErrors []Error
+
 	// GoFiles lists the absolute file paths of the package's Go source files.
 	GoFiles []string
 
@@ -289,6 +686,28 @@ type Package struct {
 	// including assembly, C, C++, Fortran, Objective-C, SWIG, and so on.
 	OtherFiles []string
 
+	// IgnoredFiles lists the absolute file paths of the source files
+	// in the package's directory that build constraints exclude from
+	// the package, so that a tool can report that a file is excluded
+	// instead of reporting nothing about it.
+	IgnoredFiles []string
+
+	// EmbedPatterns lists the patterns of the package's //go:embed
+	// directives, as they are written. The patterns of a test variant
+	// include those of its test files.
+	EmbedPatterns []string
+
+	// EmbedFiles lists the absolute file paths of the files that the
+	// package's //go:embed directives embed. The files of a test variant
+	// include those that its test files embed.
+	EmbedFiles []string
+
+	// FromOverlay reports whether the package was synthesized from the
+	// Overlay: all of its GoFiles are files of the Overlay that do not
+	// exist on disk, so that the build system found no such package.
+	// It is set along with GoFiles.
+	FromOverlay bool
+
 	// ExportFile is the absolute path to a file containing type
 	// information for the package as provided by the build system.
 	ExportFile string
@@ -328,8 +747,19 @@ type Package struct {
 	// forTest is the package under test, if any.
 	forTest string
 
+	// lazyTypes, if not nil, loads Types from the export data on the
+	// first call; see Config.LazyExportData.
+	lazyTypes func() (*types.Package, error)
+
 	// module is the module information for the package if it exists.
 	Module *Module
+
+	// GoVersion is the Go language version of the package, such as
+	// "go1.19", as given by the go directive of the go.mod file of its
+	// module, or "" if there is none, as for the standard library.
+	// The type checker accepts only the features of that version.
+	// It is set with Module.
+	GoVersion string
 }
 
 // Module provides module information for a package.
@@ -383,6 +813,26 @@ const (
 	TypeError
 )
 
+// A DriverWarning is a line of output, such as of the standard error
+// of the go command, that the build system's query tool printed while
+// reporting packages.
+type DriverWarning struct {
+	Cmd  string // the command that printed it, such as "go list -e -json ..."
+	Kind WarningKind
+	Text string // the line, without its newline
+}
+
+// WarningKind describes what a warning is about, as far as the driver
+// recognizes it.
+type WarningKind int
+
+const (
+	UnknownWarning   WarningKind = iota
+	ModuleWarning                // looking up or downloading modules
+	ToolchainWarning             // switching to or downloading another Go toolchain
+	FlagsWarning                 // problems with GOFLAGS
+)
+
 func (err Error) Error() string {
 	pos := err.Pos
 	if pos == "" {
@@ -401,10 +851,16 @@ type flatPackage struct {
 	Name            string            `json:",omitempty"`
 	PkgPath         string            `json:",omitempty"`
 	Errors          []Error           `json:",omitempty"`
+	DepsErrors      []Error           `json:",omitempty"`
 	GoFiles         []string          `json:",omitempty"`
 	CompiledGoFiles []string          `json:",omitempty"`
 	OtherFiles      []string          `json:",omitempty"`
+	IgnoredFiles    []string          `json:",omitempty"`
+	EmbedPatterns   []string          `json:",omitempty"`
+	EmbedFiles      []string          `json:",omitempty"`
+	FromOverlay     bool              `json:",omitempty"`
 	ExportFile      string            `json:",omitempty"`
+	GoVersion       string            `json:",omitempty"`
 	Imports         map[string]string `json:",omitempty"`
 }
 
@@ -423,10 +879,16 @@ func (p *Package) MarshalJSON() ([]byte, error) {
 		Name:            p.Name,
 		PkgPath:         p.PkgPath,
 		Errors:          p.Errors,
+		DepsErrors:      p.DepsErrors,
 		GoFiles:         p.GoFiles,
 		CompiledGoFiles: p.CompiledGoFiles,
 		OtherFiles:      p.OtherFiles,
+		IgnoredFiles:    p.IgnoredFiles,
+		EmbedPatterns:   p.EmbedPatterns,
+		EmbedFiles:      p.EmbedFiles,
+		FromOverlay:     p.FromOverlay,
 		ExportFile:      p.ExportFile,
+		GoVersion:       p.GoVersion,
 	}
 	if len(p.Imports) > 0 {
 		flat.Imports = make(map[string]string, len(p.Imports))
@@ -449,10 +911,16 @@ func (p *Package) UnmarshalJSON(b []byte) error {
 		Name:            flat.Name,
 		PkgPath:         flat.PkgPath,
 		Errors:          flat.Errors,
+		DepsErrors:      flat.DepsErrors,
 		GoFiles:         flat.GoFiles,
 		CompiledGoFiles: flat.CompiledGoFiles,
 		OtherFiles:      flat.OtherFiles,
+		IgnoredFiles:    flat.IgnoredFiles,
+		EmbedPatterns:   flat.EmbedPatterns,
+		EmbedFiles:      flat.EmbedFiles,
+		FromOverlay:     flat.FromOverlay,
 		ExportFile:      flat.ExportFile,
+		GoVersion:       flat.GoVersion,
 	}
 	if len(flat.Imports) > 0 {
 		p.Imports = make(map[string]*Package, len(flat.Imports))
@@ -465,15 +933,32 @@ func (p *Package) UnmarshalJSON(b []byte) error {
 
 func (p *Package) String() string { return p.ID }
 
+// LoadTypes returns the Types of the package. If Config.LazyExportData
+// deferred reading its export data, LoadTypes reads it on the first
+// call, and reports an error, on that call and later ones, if it cannot
+// be read. It may be called from multiple goroutines at once.
+func (p *Package) LoadTypes() (*types.Package, error) {
+	if p.lazyTypes == nil {
+		return p.Types, nil
+	}
+	return p.lazyTypes()
+}
+
 // loaderPackage augments Package with state used during the loading phase
 type loaderPackage struct {
 	*Package
 	importErrors map[string]error // maps each bad import to its error
-	loadOnce     sync.Once
-	color        uint8 // for cycle detection
-	needsrc      bool  // load from source (Mode >= LoadTypes)
-	needtypes    bool  // type information is either requested or depended on
-	initial      bool  // package was matched by a pattern
+	loadErr      error            // the panic while loading the package, if any
+	color        uint8            // for cycle detection
+	needsrc      bool             // load from source (Mode >= LoadTypes)
+	needtypes    bool             // type information is either requested or depended on
+	initial      bool             // package was matched by a pattern
+	sizes        types.Sizes
+
+	// exportOnce guards the lazy reading of the export data, and
+	// exportErr is its error; see loader.lazyLoad.
+	exportOnce sync.Once
+	exportErr  error
 }
 
 // loader holds the working state of a single call to load.
@@ -481,6 +966,7 @@ type loader struct {
 	pkgs map[string]*loaderPackage
 	Config
 	sizes        types.Sizes
+	variantSizes map[string]types.Sizes // sizes of each package of a variant, by ID; see loadVariants
 	parseCache   map[string]*parseValue
 	parseCacheMu sync.Mutex
 	exportMu     sync.Mutex // enforces mutual exclusion of exportdata operations
@@ -558,6 +1044,125 @@ func newLoader(cfg *Config) *loader {
 	return ld
 }
 
+// resolveOverlay replaces the Overlay of ld with a copy whose keys are
+// absolute and clean, as the paths reported by the build system are,
+// and lists the files of its OverlayFS. Relative keys, and a relative
+// OverlayRoot, are resolved against the Dir of ld. It reports an error
+// if a key cannot be resolved, or if two keys name the same file.
+func (ld *loader) resolveOverlay() error {
+	if err := ld.resolveOverlayMap(); err != nil {
+		return err
+	}
+	if ld.OverlayFS == nil {
+		return nil
+	}
+	root, err := absOverlayPath(ld.absDir(), ld.OverlayRoot, runtime.GOOS == "windows")
+	if err != nil {
+		return err
+	}
+	return ld.resolveOverlayFS(root)
+}
+
+// absDir returns the absolute form of the Dir of ld, or Dir itself if
+// it cannot be made absolute.
+func (ld *loader) absDir() string {
+	dir := ld.Dir
+	if dir != "" && !filepath.IsAbs(dir) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+	}
+	return dir
+}
+
+// resolveOverlayMap resolves the keys of the Overlay of ld; see
+// resolveOverlay.
+func (ld *loader) resolveOverlayMap() error {
+	if len(ld.Overlay) == 0 {
+		return nil
+	}
+	var keys []string
+	for key := range ld.Overlay {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dir := ld.absDir()
+	overlay := make(map[string][]byte, len(keys))
+	keyOf := make(map[string]string, len(keys))
+	for _, key := range keys {
+		filename, err := absOverlayPath(dir, key, runtime.GOOS == "windows")
+		if err != nil {
+			return err
+		}
+		if prev, ok := keyOf[filename]; ok {
+			return fmt.Errorf("ambiguous overlay: keys %q and %q both name %s", prev, key, filename)
+		}
+		keyOf[filename] = key
+		overlay[filename] = ld.Overlay[key]
+	}
+	ld.Overlay = overlay
+	return nil
+}
+
+// absOverlayPath returns the absolute and clean form of the overlay
+// key filename, resolving it against the absolute directory dir if it
+// is relative. If windows is set, filename and dir are Windows paths,
+// in which either separator may be used, the volume name of dir
+// applies to a filename that is rooted but has none, and the drive
+// letter is upper case.
+func absOverlayPath(dir, filename string, windows bool) (string, error) {
+	if !windows {
+		if !filepath.IsAbs(filename) {
+			if dir == "" {
+				return "", fmt.Errorf("overlay key %q is relative, but the directory is unknown", filename)
+			}
+			filename = filepath.Join(dir, filename)
+		}
+		return filepath.Clean(filename), nil
+	}
+
+	// Work with forward slashes, which path.Clean understands.
+	slashed := strings.Replace(filename, `\`, "/", -1)
+	dir = strings.Replace(dir, `\`, "/", -1)
+	vol, rest := windowsVolume(slashed)
+	dirVol, dirRest := windowsVolume(dir)
+	switch {
+	case vol != "" && strings.HasPrefix(rest, "/"):
+		// absolute
+	case dir == "":
+		return "", fmt.Errorf("overlay key %q is relative, but the directory is unknown", filename)
+	case vol == "" && strings.HasPrefix(rest, "/"):
+		vol = dirVol // rooted in the current volume
+	case vol == "" || strings.EqualFold(vol, dirVol):
+		vol, rest = dirVol, dirRest+"/"+rest
+	default:
+		// A path such as D:a.go is relative to the current
+		// directory of another drive, which is unknown.
+		return "", fmt.Errorf("overlay key %q is relative to the current directory of drive %s", filename, vol)
+	}
+	if len(vol) == 2 && vol[1] == ':' {
+		vol = strings.ToUpper(vol)
+	}
+	return strings.Replace(vol+path.Clean(rest), "/", `\`, -1), nil
+}
+
+// windowsVolume splits the slashed Windows path p into its volume name,
+// a drive letter and colon or a UNC \\host\share prefix, and the rest.
+func windowsVolume(p string) (vol, rest string) {
+	if len(p) >= 2 && p[1] == ':' && ('a' <= p[0] && p[0] <= 'z' || 'A' <= p[0] && p[0] <= 'Z') {
+		return p[:2], p[2:]
+	}
+	if strings.HasPrefix(p, "//") {
+		// //host/share/rest
+		parts := strings.SplitN(p[2:], "/", 3)
+		if len(parts) >= 2 && parts[0] != "" && parts[1] != "" {
+			vol = "//" + parts[0] + "/" + parts[1]
+			return vol, p[len(vol):]
+		}
+	}
+	return "", p
+}
+
 // refine connects the supplied packages into a graph and then adds type and
 // and syntax information as requested by the LoadMode.
 func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
@@ -576,7 +1181,7 @@ func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
 
 		// Overlays can invalidate export data.
 		// TODO(matloob): make this check fine-grained based on dependencies on overlaid files
-		exportDataInvalid := len(ld.Overlay) > 0 || pkg.ExportFile == "" && pkg.PkgPath != "unsafe"
+		exportDataInvalid := ld.hasOverlay() || len(ld.DeletedFiles) > 0 || pkg.ExportFile == "" && pkg.PkgPath != "unsafe"
 		// This package needs type information if the caller requested types and the package is
 		// either a root, or it's a non-root and the user requested dependencies ...
 		needtypes := (ld.Mode&NeedTypes|NeedTypesInfo != 0 && (rootIndex >= 0 || ld.Mode&NeedDeps != 0))
@@ -590,6 +1195,10 @@ func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
 			Package:   pkg,
 			needtypes: needtypes,
 			needsrc:   needsrc,
+			sizes:     ld.sizes,
+		}
+		if sizes, ok := ld.variantSizes[pkg.ID]; ok {
+			lpkg.sizes = sizes
 		}
 		ld.pkgs[lpkg.ID] = lpkg
 		if rootIndex >= 0 {
@@ -664,7 +1273,7 @@ func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
 			srcPkgs = append(srcPkgs, lpkg)
 		}
 		if ld.Mode&NeedTypesSizes != 0 {
-			lpkg.TypesSizes = ld.sizes
+			lpkg.TypesSizes = lpkg.sizes
 		}
 		stack = stack[:len(stack)-1] // pop
 		lpkg.color = black
@@ -696,15 +1305,7 @@ func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
 	// Load type data and syntax if needed, starting at
 	// the initial packages (roots of the import DAG).
 	if ld.Mode&NeedTypes != 0 || ld.Mode&NeedSyntax != 0 {
-		var wg sync.WaitGroup
-		for _, lpkg := range initial {
-			wg.Add(1)
-			go func(lpkg *loaderPackage) {
-				ld.loadRecursive(lpkg)
-				wg.Done()
-			}(lpkg)
-		}
-		wg.Wait()
+		ld.loadAll(initial)
 	}
 
 	result := make([]*Package, len(initial))
@@ -720,6 +1321,8 @@ func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
 		if ld.requestedMode&NeedFiles == 0 {
 			ld.pkgs[i].GoFiles = nil
 			ld.pkgs[i].OtherFiles = nil
+			ld.pkgs[i].IgnoredFiles = nil
+			ld.pkgs[i].FromOverlay = false
 		}
 		if ld.requestedMode&NeedCompiledGoFiles == 0 {
 			ld.pkgs[i].CompiledGoFiles = nil
@@ -746,31 +1349,104 @@ func (ld *loader) refine(roots []string, list ...*Package) ([]*Package, error) {
 		}
 		if ld.requestedMode&NeedModule == 0 {
 			ld.pkgs[i].Module = nil
+			ld.pkgs[i].GoVersion = ""
+		}
+		if ld.requestedMode&NeedEmbedFiles == 0 {
+			ld.pkgs[i].EmbedFiles = nil
+		}
+		if ld.requestedMode&NeedEmbedPatterns == 0 {
+			ld.pkgs[i].EmbedPatterns = nil
+		}
+		if ld.requestedMode&NeedDepsErrors == 0 {
+			ld.pkgs[i].DepsErrors = nil
+		}
+		if ld.RewritePath != nil {
+			rewritePaths(ld.pkgs[i].Package, ld.RewritePath)
 		}
 	}
 
 	return result, nil
 }
 
-// loadRecursive loads the specified package and its dependencies,
-// recursively, in parallel, in topological order.
-// It is atomic and idempotent.
+// loadAll loads the specified packages and their dependencies, in
+// topological order, on a pool of at most ParallelTypeCheck workers: a
+// package is ready to be loaded once all the packages it imports have
+// been. A panic while loading a package is reported as an error of the
+// package, whose importers then fail to import it.
 // Precondition: ld.Mode&NeedTypes.
-func (ld *loader) loadRecursive(lpkg *loaderPackage) {
-	lpkg.loadOnce.Do(func() {
-		// Load the direct dependencies, in parallel.
-		var wg sync.WaitGroup
+func (ld *loader) loadAll(initial []*loaderPackage) {
+	// Find the packages in topological order, and, for each, the
+	// number of imports not yet loaded and the packages that import it.
+	var order []*loaderPackage
+	pending := make(map[*loaderPackage]int)
+	importers := make(map[*loaderPackage][]*loaderPackage)
+	var visit func(lpkg *loaderPackage)
+	visit = func(lpkg *loaderPackage) {
+		if _, ok := pending[lpkg]; ok {
+			return
+		}
+		pending[lpkg] = 0
 		for _, ipkg := range lpkg.Imports {
 			imp := ld.pkgs[ipkg.ID]
-			wg.Add(1)
-			go func(imp *loaderPackage) {
-				ld.loadRecursive(imp)
-				wg.Done()
-			}(imp)
-		}
-		wg.Wait()
-		ld.loadPackage(lpkg)
-	})
+			visit(imp)
+			pending[lpkg]++
+			importers[imp] = append(importers[imp], lpkg)
+		}
+		order = append(order, lpkg)
+	}
+	for _, lpkg := range initial {
+		visit(lpkg)
+	}
+
+	n := ld.ParallelTypeCheck
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	// The queue holds every package at most once, so sends never block.
+	ready := make(chan *loaderPackage, len(order))
+	for _, lpkg := range order {
+		if pending[lpkg] == 0 {
+			ready <- lpkg
+		}
+	}
+	var (
+		mu   sync.Mutex
+		done int
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < n && i < len(order); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lpkg := range ready {
+				ld.loadPackageSafely(lpkg)
+				mu.Lock()
+				for _, p := range importers[lpkg] {
+					if pending[p]--; pending[p] == 0 {
+						ready <- p
+					}
+				}
+				if done++; done == len(order) {
+					close(ready)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// loadPackageSafely calls loadPackage, reporting a panic as an error of
+// the package.
+func (ld *loader) loadPackageSafely(lpkg *loaderPackage) {
+	defer func() {
+		if r := recover(); r != nil {
+			lpkg.loadErr = fmt.Errorf("internal error while loading %s: %v", lpkg.ID, r)
+			lpkg.Errors = append(lpkg.Errors, Error{Pos: "-", Msg: lpkg.loadErr.Error(), Kind: UnknownError})
+			lpkg.IllTyped = true
+		}
+	}()
+	ld.loadPackage(lpkg)
 }
 
 // loadPackage loads the specified package.
@@ -784,7 +1460,7 @@ func (ld *loader) loadPackage(lpkg *loaderPackage) {
 		lpkg.Fset = ld.Fset
 		lpkg.Syntax = []*ast.File{}
 		lpkg.TypesInfo = new(types.Info)
-		lpkg.TypesSizes = ld.sizes
+		lpkg.TypesSizes = lpkg.sizes
 		return
 	}
 
@@ -800,6 +1476,10 @@ func (ld *loader) loadPackage(lpkg *loaderPackage) {
 	// which would then require that such created packages be explicitly
 	// inserted back into the Import graph as a final step after export data loading.
 	// The Diamond test exercises this case.
+	if !lpkg.needsrc && ld.LazyExportData && !lpkg.initial {
+		lpkg.lazyTypes = func() (*types.Package, error) { return ld.lazyLoad(lpkg) }
+		return
+	}
 	if !lpkg.needtypes && !lpkg.needsrc {
 		return
 	}
@@ -854,7 +1534,19 @@ func (ld *loader) loadPackage(lpkg *loaderPackage) {
 			log.Printf("internal error: error %q (%T) without position", err, err)
 		}
 
-		lpkg.Errors = append(lpkg.Errors, errs...)
+	nextError:
+		for _, err := range errs {
+			// The driver may already have reported a parse error,
+			// as for an overlay file without a package clause.
+			if err.Kind == ParseError {
+				for _, e := range lpkg.Errors {
+					if e == err {
+						continue nextError
+					}
+				}
+			}
+			lpkg.Errors = append(lpkg.Errors, err)
+		}
 	}
 
 	if ld.Config.Mode&NeedTypes != 0 && len(lpkg.CompiledGoFiles) == 0 && lpkg.ExportFile != "" {
@@ -883,7 +1575,7 @@ func (ld *loader) loadPackage(lpkg *loaderPackage) {
 		Scopes:     make(map[ast.Node]*types.Scope),
 		Selections: make(map[*ast.SelectorExpr]*types.Selection),
 	}
-	lpkg.TypesSizes = ld.sizes
+	lpkg.TypesSizes = lpkg.sizes
 
 	importer := importerFunc(func(path string) (*types.Package, error) {
 		if path == "unsafe" {
@@ -906,6 +1598,12 @@ func (ld *loader) loadPackage(lpkg *loaderPackage) {
 		if ipkg.Types != nil && ipkg.Types.Complete() {
 			return ipkg.Types, nil
 		}
+		if err := ld.pkgs[ipkg.ID].loadErr; err != nil {
+			return nil, err
+		}
+		if ipkg.lazyTypes != nil {
+			return ipkg.lazyTypes()
+		}
 		log.Fatalf("internal error: package %q without types was imported from %q", path, lpkg)
 		panic("unreachable")
 	})
@@ -920,7 +1618,12 @@ func (ld *loader) loadPackage(lpkg *loaderPackage) {
 		IgnoreFuncBodies: ld.Mode&NeedDeps == 0 && !lpkg.initial,
 
 		Error: appendError,
-		Sizes: ld.sizes,
+		Sizes: lpkg.sizes,
+	}
+	if lpkg.GoVersion != "" {
+		// The go command of a Go release older than the type checker
+		// reports no newer version.
+		typesinternal.SetGoVersion(tc, lpkg.GoVersion)
 	}
 	if (ld.Mode & typecheckCgo) != 0 {
 		if !typesinternal.SetUsesCgo(tc) {
@@ -993,9 +1696,9 @@ func (ld *loader) parseFile(filename string) (*ast.File, error) {
 		ld.parseCacheMu.Unlock()
 
 		var src []byte
-		for f, contents := range ld.Config.Overlay {
+		for _, f := range ld.Config.overlayFilenames() {
 			if sameFile(f, filename) {
-				src = contents
+				src, _ = ld.Config.overlayContents(f)
 			}
 		}
 		var err error
@@ -1007,7 +1710,7 @@ func (ld *loader) parseFile(filename string) (*ast.File, error) {
 		if err != nil {
 			v.err = err
 		} else {
-			v.f, v.err = ld.ParseFile(ld.Fset, filename, src)
+			v.f, v.err = ld.callParseFile(filename, src)
 		}
 
 		close(v.ready)
@@ -1015,6 +1718,17 @@ func (ld *loader) parseFile(filename string) (*ast.File, error) {
 	return v.f, v.err
 }
 
+// callParseFile calls the ParseFile function of the Config, reporting
+// a panic as an error of the file.
+func (ld *loader) callParseFile(filename string, src []byte) (f *ast.File, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f, err = nil, Error{Pos: filename + ":1", Msg: fmt.Sprintf("ParseFile panicked: %v", r), Kind: ParseError}
+		}
+	}()
+	return ld.ParseFile(ld.Fset, filename, src)
+}
+
 // parseFiles reads and parses the Go source files and returns the ASTs
 // of the ones that could be at least partially parsed, along with a
 // list of I/O and parse errors encountered.
@@ -1077,15 +1791,33 @@ func sameFile(x, y string) bool {
 		return true
 	}
 	if strings.EqualFold(filepath.Base(x), filepath.Base(y)) { // (optimisation)
-		if xi, err := os.Stat(x); err == nil {
-			if yi, err := os.Stat(y); err == nil {
-				return os.SameFile(xi, yi)
-			}
+		xi, xerr := os.Stat(x)
+		yi, yerr := os.Stat(y)
+		if xerr == nil && yerr == nil {
+			return os.SameFile(xi, yi)
+		}
+		// Neither exists, as for a file that only the overlay has,
+		// but they may be names of the same file, in directories that
+		// are the same through a symbolic link.
+		if os.IsNotExist(xerr) && os.IsNotExist(yerr) && filepath.Base(x) == filepath.Base(y) {
+			return realDir(filepath.Dir(x)) == realDir(filepath.Dir(y))
 		}
 	}
 	return false
 }
 
+// realDir returns the directory dir with its symbolic links resolved,
+// as golistState.canonicalDir does, but without its cache.
+func realDir(dir string) string {
+	if c, err := filepath.EvalSymlinks(dir); err == nil {
+		return c
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		return filepath.Join(realDir(parent), filepath.Base(dir))
+	}
+	return dir
+}
+
 // loadFromExportData returns type information for the specified
 // package, loading it from an export data file on the first request.
 func (ld *loader) loadFromExportData(lpkg *loaderPackage) (*types.Package, error) {
@@ -1170,8 +1902,13 @@ func (ld *loader) loadFromExportData(lpkg *loaderPackage) (*types.Package, error
 		}
 	}
 	visit(lpkg.Imports)
+	// The view includes the package itself, whose empty types.Package
+	// loadPackage created, so that the export data completes the
+	// package to which those whose export data was read before it, as
+	// with LazyExportData, refer.
+	view[lpkg.PkgPath] = lpkg.Types
 
-	viewLen := len(view) + 1 // adding the self package
+	viewLen := len(view)
 	// Parse the export data.
 	// (May modify incomplete packages in view but not create new ones.)
 	tpkg, err := gcexportdata.Read(r, ld.Fset, view, lpkg.PkgPath)
@@ -1188,6 +1925,18 @@ func (ld *loader) loadFromExportData(lpkg *loaderPackage) (*types.Package, error
 	return tpkg, nil
 }
 
+// lazyLoad returns the type information of the package, reading its
+// export data on the first call; see Config.LazyExportData.
+func (ld *loader) lazyLoad(lpkg *loaderPackage) (*types.Package, error) {
+	lpkg.exportOnce.Do(func() {
+		_, lpkg.exportErr = ld.loadFromExportData(lpkg)
+	})
+	if lpkg.exportErr != nil {
+		return nil, lpkg.exportErr
+	}
+	return lpkg.Types, nil
+}
+
 // impliedLoadMode returns loadMode with its dependencies.
 func impliedLoadMode(loadMode LoadMode) LoadMode {
 	if loadMode&NeedTypesInfo != 0 && loadMode&NeedImports == 0 {
@@ -26,10 +26,12 @@ import (
 	"testing"
 	"time"
 
+	"golang.org/x/tools/go/gcexportdata"
 	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/go/packages/packagestest"
 	"golang.org/x/tools/internal/packagesinternal"
 	"golang.org/x/tools/internal/testenv"
+	"golang.org/x/xerrors"
 )
 
 // testCtx is canceled when the test binary is about to time out.
@@ -649,6 +651,172 @@ func testLoadTypesBits(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
+// TestLazyExportData checks that with LazyExportData the export data
+// of a dependency is read when a package type checked from source
+// imports it, or when its LoadTypes method is called, and that an
+// error reading it is reported by LoadTypes. So that the test does not
+// depend on the export data format of the go command, a fake driver
+// describes the packages, and the test writes the export data of the
+// dependencies itself.
+func TestLazyExportData(t *testing.T) { packagestest.TestAll(t, testLazyExportData) }
+func testLazyExportData(t *testing.T, exporter packagestest.Exporter) {
+	testenv.NeedsGoBuild(t)
+
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": `package a; import "golang.org/fake/b"; const A = "a" + b.B`,
+			"b/b.go": `package b; import "golang.org/fake/c"; const B = "b" + c.C`,
+			"c/c.go": `package c; const C = "c"`,
+			"driver/main.go": `package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The driver replies to any request with the response in the file
+// named by LAZY_RESPONSE.
+func main() {
+	ioutil.ReadAll(os.Stdin)
+	f, err := os.Open(os.Getenv("LAZY_RESPONSE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	io.Copy(os.Stdout, f)
+}
+`,
+		}}})
+	defer exported.Cleanup()
+
+	// Type check c and b from source, and write their export data in
+	// the form of an object file.
+	fset := token.NewFileSet()
+	tpkgs := make(map[string]*types.Package)
+	pkgs := make(map[string]*packages.Package)
+	for _, name := range []string{"c", "b"} {
+		path := "golang.org/fake/" + name
+		f, err := parser.ParseFile(fset, exported.File("golang.org/fake", name+"/"+name+".go"), nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := types.Config{Importer: importerFunc(func(path string) (*types.Package, error) { return tpkgs[path], nil })}
+		tpkg, err := conf.Check(path, fset, []*ast.File{f}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tpkgs[path] = tpkg
+		var buf bytes.Buffer
+		buf.WriteString("go object fake\n$$B\n")
+		if err := gcexportdata.Write(&buf, fset, tpkg); err != nil {
+			t.Fatal(err)
+		}
+		exportFile := filepath.Join(exported.Temp(), name+".a")
+		if err := ioutil.WriteFile(exportFile, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pkgs[path] = &packages.Package{ID: path, Name: name, PkgPath: path, ExportFile: exportFile}
+	}
+	aFile := exported.File("golang.org/fake", "a/a.go")
+	pkgs["golang.org/fake/a"] = &packages.Package{
+		ID:              "golang.org/fake/a",
+		Name:            "a",
+		PkgPath:         "golang.org/fake/a",
+		GoFiles:         []string{aFile},
+		CompiledGoFiles: []string{aFile},
+		Imports:         map[string]*packages.Package{"golang.org/fake/b": {ID: "golang.org/fake/b"}},
+	}
+	pkgs["golang.org/fake/b"].Imports = map[string]*packages.Package{"golang.org/fake/c": {ID: "golang.org/fake/c"}}
+
+	response, err := json.Marshal(struct {
+		Sizes    *types.StdSizes
+		Roots    []string
+		Packages []*packages.Package
+	}{
+		Sizes:    &types.StdSizes{WordSize: 8, MaxAlign: 8},
+		Roots:    []string{"golang.org/fake/a"},
+		Packages: []*packages.Package{pkgs["golang.org/fake/a"], pkgs["golang.org/fake/b"], pkgs["golang.org/fake/c"]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseFile := filepath.Join(exported.Temp(), "response.json")
+	if err := ioutil.WriteFile(responseFile, response, 0644); err != nil {
+		t.Fatal(err)
+	}
+	driverPath := filepath.Join(exported.Temp(), "lazy_driver.exe") // Add .exe because Windows expects it.
+	cmd := exec.Command("go", "build", "-o", driverPath, "golang.org/fake/driver")
+	cmd.Env = exported.Config.Env
+	cmd.Dir = exported.Config.Dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Log(string(b))
+		t.Fatal(err)
+	}
+
+	exported.Config.Env = append(append([]string{}, exported.Config.Env...),
+		"GOPACKAGESDRIVER="+driverPath, "LAZY_RESPONSE="+responseFile)
+	exported.Config.Mode = packages.NeedName | packages.NeedImports | packages.NeedExportsFile |
+		packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+	exported.Config.LazyExportData = true
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, all := importGraph(initial)
+	a, b, c := all["golang.org/fake/a"], all["golang.org/fake/b"], all["golang.org/fake/c"]
+	if len(a.Errors) > 0 {
+		t.Errorf("a has errors %v", a.Errors)
+	}
+	if !b.Types.Complete() {
+		t.Errorf("the types of b, which a imports, are incomplete")
+	}
+	if c.Types.Complete() {
+		t.Errorf("the types of c, which no package type checked from source imports, are complete")
+	}
+
+	// An error reading the export data is reported by each call.
+	c.ExportFile = filepath.Join(exported.Temp(), "missing.a")
+	for i := 0; i < 2; i++ {
+		if tpkg, err := c.LoadTypes(); err == nil {
+			t.Errorf("LoadTypes of c without export data returned %v without error", tpkg)
+		}
+	}
+}
+
+// An importerFunc is a types.Importer implemented by a function.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// BenchmarkLazyExportData measures the loading of the types of net/http
+// when only two of its dependencies are needed.
+func BenchmarkLazyExportData(b *testing.B) {
+	for _, lazy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("lazy=%t", lazy), func(b *testing.B) {
+			cfg := &packages.Config{
+				Mode:           packages.NeedName | packages.NeedImports | packages.NeedDeps | packages.NeedTypes,
+				LazyExportData: lazy,
+			}
+			for i := 0; i < b.N; i++ {
+				initial, err := packages.Load(cfg, "net/http")
+				if err != nil {
+					b.Fatal(err)
+				}
+				packages.Visit(initial, nil, func(p *packages.Package) {
+					if p.PkgPath == "io" || p.PkgPath == "net/url" {
+						if _, err := p.LoadTypes(); err != nil {
+							b.Error(err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
 func TestLoadSyntaxOK(t *testing.T) { packagestest.TestAll(t, testLoadSyntaxOK) }
 func testLoadSyntaxOK(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{{
@@ -886,7 +1054,120 @@ func testParseFileModifyAST(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
-func TestOverlay(t *testing.T) { packagestest.TestAll(t, testOverlay) }
+// TestParallelTypeCheck checks that the packages of a graph are type
+// checked in the order of their imports, with the same results, however
+// many may be checked at once. It is meant to be run with -race too.
+func TestParallelTypeCheck(t *testing.T) { packagestest.TestAll(t, testParallelTypeCheck) }
+func testParallelTypeCheck(t *testing.T, exporter packagestest.Exporter) {
+	const n = 40
+	files := make(map[string]interface{})
+	for i := 0; i < n; i++ {
+		// Package pi imports the packages whose numbers divide i.
+		src := fmt.Sprintf("package p%d\n\n", i)
+		var calls string
+		for j := 1; j < i; j++ {
+			if i%j == 0 {
+				src += fmt.Sprintf("import \"golang.org/fake/p%d\"\n", j)
+				calls += fmt.Sprintf("\tp%d.F()\n", j)
+			}
+		}
+		src += "\nfunc F() {\n" + calls + "}\n"
+		files[fmt.Sprintf("p%d/p.go", i)] = src
+	}
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{Name: "golang.org/fake", Files: files}})
+	defer exported.Cleanup()
+
+	var want map[string]string
+	for _, parallel := range []int{1, 2, 8, 0} {
+		exported.Config.Mode = packages.LoadAllSyntax
+		exported.Config.ParallelTypeCheck = parallel
+		initial, err := packages.Load(exported.Config, "golang.org/fake/...")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		packages.Visit(initial, nil, func(p *packages.Package) {
+			got[p.ID] = fmt.Sprintf("complete=%t illtyped=%t errors=%v uses=%d", p.Types.Complete(), p.IllTyped, p.Errors, len(p.TypesInfo.Uses))
+		})
+		if len(got) != n {
+			t.Errorf("ParallelTypeCheck=%d: got %d packages, want %d", parallel, len(got), n)
+		}
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("ParallelTypeCheck=%d: got %v, want %v", parallel, got, want)
+		}
+	}
+}
+
+// TestParallelTypeCheckPanic checks that a panic while loading a package
+// is reported as an error of the package, and of its importers, instead
+// of aborting the load.
+func TestParallelTypeCheckPanic(t *testing.T) { packagestest.TestAll(t, testParallelTypeCheckPanic) }
+func testParallelTypeCheckPanic(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": `package a; import ("golang.org/fake/b"; "golang.org/fake/c"); func A() { b.B(); c.C() }`,
+			"b/b.go": `package b; func B() {}`,
+			"c/c.go": `package c; func C() {}`,
+		}}})
+	defer exported.Cleanup()
+
+	exported.Config.Mode = packages.LoadAllSyntax
+	exported.Config.ParseFile = func(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+		switch filepath.Base(filepath.Dir(filename)) {
+		case "b":
+			panic("parsing b")
+		case "c":
+			// The type checker panics on a file without a name.
+			return &ast.File{}, nil
+		}
+		return parser.ParseFile(fset, filename, src, parser.AllErrors|parser.ParseComments)
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, all := importGraph(initial)
+	for id, want := range map[string]string{
+		"golang.org/fake/a": "could not import",
+		"golang.org/fake/b": "ParseFile panicked: parsing b",
+		"golang.org/fake/c": "internal error while loading golang.org/fake/c",
+	} {
+		p := all[id]
+		if !p.IllTyped {
+			t.Errorf("%s is not ill typed", id)
+		}
+		var found bool
+		for _, err := range p.Errors {
+			found = found || strings.Contains(err.Msg, want)
+		}
+		if !found {
+			t.Errorf("%s has errors %v, want one containing %q", id, p.Errors, want)
+		}
+	}
+}
+
+// BenchmarkParallelTypeCheck measures the type checking of the packages
+// of this module and their dependencies.
+func BenchmarkParallelTypeCheck(b *testing.B) {
+	for _, parallel := range []int{1, 0} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			cfg := &packages.Config{
+				Mode:              packages.LoadAllSyntax,
+				ParallelTypeCheck: parallel,
+			}
+			for i := 0; i < b.N; i++ {
+				if _, err := packages.Load(cfg, "golang.org/x/tools/go/..."); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOverlay(t *testing.T) { testAllOverlayModes(t, testOverlay) }
 func testOverlay(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{{
 		Name: "golang.org/fake",
@@ -954,7 +1235,7 @@ func testOverlay(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
-func TestOverlayDeps(t *testing.T) { packagestest.TestAll(t, testOverlayDeps) }
+func TestOverlayDeps(t *testing.T) { testAllOverlayModes(t, testOverlayDeps) }
 func testOverlayDeps(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{{
 		Name: "golang.org/fake",
@@ -1000,7 +1281,7 @@ func testOverlayDeps(t *testing.T, exporter packagestest.Exporter) {
 
 }
 
-func TestNewPackagesInOverlay(t *testing.T) { packagestest.TestAll(t, testNewPackagesInOverlay) }
+func TestNewPackagesInOverlay(t *testing.T) { testAllOverlayModes(t, testNewPackagesInOverlay) }
 func testNewPackagesInOverlay(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{
 		{
@@ -1104,7 +1385,7 @@ func testNewPackagesInOverlay(t *testing.T, exporter packagestest.Exporter) {
 
 // Test that we can create a package and its test package in an overlay.
 func TestOverlayNewPackageAndTest(t *testing.T) {
-	packagestest.TestAll(t, testOverlayNewPackageAndTest)
+	testAllOverlayModes(t, testOverlayNewPackageAndTest)
 }
 func testOverlayNewPackageAndTest(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{
@@ -1179,7 +1460,8 @@ const A = 1
 	}
 }
 
-func TestAdHocOverlays(t *testing.T) {
+func TestAdHocOverlays(t *testing.T) { forEachOverlayMode(t, testAdHocOverlays) }
+func testAdHocOverlays(t *testing.T) {
 	testenv.NeedsTool(t, "go")
 
 	// This test doesn't use packagestest because we are testing ad-hoc packages,
@@ -1232,9 +1514,85 @@ const A = 1
 	}
 }
 
+// TestAdHocOverlaysTwoFiles checks that an ad-hoc package made from a
+// file that exists only in the overlay includes the other files of
+// its package in the same directory of the overlay, and their imports,
+// and that the ad-hoc packages of two directories have distinct IDs.
+func TestAdHocOverlaysTwoFiles(t *testing.T) { forEachOverlayMode(t, testAdHocOverlaysTwoFiles) }
+func testAdHocOverlaysTwoFiles(t *testing.T) {
+	testenv.NeedsTool(t, "go")
+
+	tmp, err := ioutil.TempDir("", "testAdHocOverlaysTwoFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	filename := filepath.Join(tmp, "a.go")
+	overlay := map[string][]byte{
+		filename:                        []byte("package a\n\nconst A = 1\n"),
+		filepath.Join(tmp, "b.go"):      []byte("package a\n\nimport \"strconv\"\n\nvar B = strconv.Itoa(A)\n\n"),
+		filepath.Join(tmp, "x.go"):      []byte("package other\n"),
+		filepath.Join(tmp, "y", "y.go"): []byte("package a\n"),
+	}
+	for _, go111module := range []string{"off", "auto", "on"} {
+		t.Run("GO111MODULE="+go111module, func(t *testing.T) {
+			config := &packages.Config{
+				Dir:     tmp,
+				Env:     append(os.Environ(), "GOPACKAGESDRIVER=off", fmt.Sprintf("GO111MODULE=%s", go111module)),
+				Mode:    packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps,
+				Overlay: overlay,
+				Logf:    t.Logf,
+			}
+			initial, err := packages.Load(config, fmt.Sprintf("file=%s", filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(initial) != 1 {
+				t.Fatalf("got %v, want one ad-hoc package", initial)
+			}
+			a := initial[0]
+			var files []string
+			for _, f := range a.GoFiles {
+				files = append(files, filepath.Base(f))
+			}
+			if got, want := fmt.Sprint(files), "[a.go b.go]"; got != want {
+				t.Errorf("got GoFiles %s, want %s", got, want)
+			}
+			packages.Visit(initial, nil, func(p *packages.Package) {
+				for _, err := range p.Errors {
+					t.Errorf("%s: unexpected error %v", p.ID, err)
+				}
+			})
+			if imp := a.Imports["strconv"]; imp == nil || len(imp.GoFiles) == 0 || len(imp.Imports) == 0 {
+				t.Errorf("import of strconv is %v, want the package with its dependencies", imp)
+			}
+
+			// The ad-hoc packages of two directories are distinct.
+			initial, err = packages.Load(config, "file="+filename, "file="+filepath.Join(tmp, "y", "y.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, p := range initial {
+				ids = append(ids, p.ID)
+			}
+			sort.Strings(ids)
+			want := []string{
+				fmt.Sprintf("command-line-arguments (%s)", tmp),
+				fmt.Sprintf("command-line-arguments (%s)", filepath.Join(tmp, "y")),
+			}
+			if !reflect.DeepEqual(ids, want) {
+				t.Errorf("got IDs %v for the ad-hoc packages of two directories, want %v", ids, want)
+			}
+		})
+	}
+}
+
 // TestOverlayModFileChanges tests the behavior resulting from having files from
 // multiple modules in overlays.
-func TestOverlayModFileChanges(t *testing.T) {
+func TestOverlayModFileChanges(t *testing.T) { forEachOverlayMode(t, testOverlayModFileChanges) }
+func testOverlayModFileChanges(t *testing.T) {
 	testenv.NeedsTool(t, "go")
 
 	// Create two unrelated modules in a temporary directory.
@@ -1303,7 +1661,8 @@ func main() {}
 	}
 }
 
-func TestOverlayGOPATHVendoring(t *testing.T) {
+func TestOverlayGOPATHVendoring(t *testing.T) { forEachOverlayMode(t, testOverlayGOPATHVendoring) }
+func testOverlayGOPATHVendoring(t *testing.T) {
 	exported := packagestest.Export(t, packagestest.GOPATH, []packagestest.Module{{
 		Name: "golang.org/fake",
 		Files: map[string]interface{}{
@@ -1331,6 +1690,53 @@ func TestOverlayGOPATHVendoring(t *testing.T) {
 	}
 }
 
+// Test that an overlay importing a vendored package resolves the import
+// to the vendored copy, even if another package with the same import
+// path is loaded too.
+func TestOverlayGOPATHVendoringShadowed(t *testing.T) {
+	forEachOverlayMode(t, testOverlayGOPATHVendoringShadowed)
+}
+func testOverlayGOPATHVendoringShadowed(t *testing.T) {
+	exported := packagestest.Export(t, packagestest.GOPATH, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"vendor/vendor.com/foo/foo.go": `package foo`,
+			"user/user.go":                 `package user`,
+		},
+	}, {
+		Name: "vendor.com/foo",
+		Files: map[string]interface{}{
+			"foo.go": `package foo`,
+		},
+	}})
+	defer exported.Cleanup()
+
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+	exported.Config.Overlay = map[string][]byte{
+		exported.File("golang.org/fake", "user/user.go"): []byte(`package user; import "vendor.com/foo"`),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/user", "vendor.com/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := initial[0]
+	foo := user.Imports["vendor.com/foo"]
+	if foo == nil {
+		t.Fatalf("no import of vendor.com/foo for user, imports: %v", user.Imports)
+	}
+	if want := "golang.org/fake/vendor/vendor.com/foo"; foo.ID != want || foo.Name != "foo" {
+		t.Errorf("user imports %s (name %q), want %s", foo.ID, foo.Name, want)
+	}
+	if want := exported.File("golang.org/fake", "vendor/vendor.com/foo/foo.go"); len(foo.GoFiles) != 1 || foo.GoFiles[0] != want {
+		t.Errorf("vendored package has files %v, want [%s]", foo.GoFiles, want)
+	}
+	packages.Visit(initial, nil, func(pkg *packages.Package) {
+		for _, err := range pkg.Errors {
+			t.Errorf("%s: unexpected error: %v", pkg.ID, err)
+		}
+	})
+}
+
 func TestLoadAllSyntaxImportErrors(t *testing.T) {
 	packagestest.TestAll(t, testLoadAllSyntaxImportErrors)
 }
@@ -1521,7 +1927,7 @@ func testContains(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
-func TestContainsOverlay(t *testing.T) { packagestest.TestAll(t, testContainsOverlay) }
+func TestContainsOverlay(t *testing.T) { testAllOverlayModes(t, testContainsOverlay) }
 func testContainsOverlay(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{{
 		Name: "golang.org/fake",
@@ -1550,7 +1956,7 @@ func testContainsOverlay(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
-func TestContainsOverlayXTest(t *testing.T) { packagestest.TestAll(t, testContainsOverlayXTest) }
+func TestContainsOverlayXTest(t *testing.T) { testAllOverlayModes(t, testContainsOverlayXTest) }
 func testContainsOverlayXTest(t *testing.T, exporter packagestest.Exporter) {
 	exported := packagestest.Export(t, exporter, []packagestest.Module{{
 		Name: "golang.org/fake",
@@ -1571,10 +1977,10 @@ func testContainsOverlayXTest(t *testing.T, exporter packagestest.Exporter) {
 	graph, _ := importGraph(initial)
 	wantGraph := `
   golang.org/fake/b
-* golang.org/fake/b_test
+* golang.org/fake/b_test [golang.org/fake/b.test]
   golang.org/fake/c
   golang.org/fake/b -> golang.org/fake/c
-  golang.org/fake/b_test -> golang.org/fake/b
+  golang.org/fake/b_test [golang.org/fake/b.test] -> golang.org/fake/b
 `[1:]
 	if graph != wantGraph {
 		t.Errorf("wrong import graph: got <<%s>>, want <<%s>>", graph, wantGraph)
@@ -1654,6 +2060,134 @@ func testContainsFallbackSticks(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
+// TestLoadContaining checks that LoadContaining attributes each file,
+// from disk or the overlay, to its packages, and that it lists the
+// directory of several files once.
+func TestLoadContaining(t *testing.T) { testAllOverlayModes(t, testLoadContaining) }
+func testLoadContaining(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":      "package a\n",
+			"a/a_test.go": "package a\n",
+			"a/x_test.go": "package a_test\n\nimport _ \"golang.org/fake/a\"\n",
+			"b/b.go":      "package b\n",
+			"c/c.go":      "package c\n",
+		}}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Dir = dir
+	exported.Config.Mode = packages.NeedName
+	exported.Config.Tests = true
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "b", "b2.go"): []byte("package b\n"),
+	}
+	r := &recorder{recordings: make(map[string]recording)}
+	exported.Config.GoCommandRunner = r
+	files := []string{
+		filepath.Join("c", "c.go"),
+		filepath.Join(dir, "a", "a_test.go"),
+		filepath.Join(dir, "b", "b2.go"),
+		filepath.Join(dir, "a", "a.go"),
+		filepath.Join("a", "x_test.go"),
+	}
+	roots, byFile, err := packages.LoadContaining(exported.Config, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(pkgs []*packages.Package) string {
+		var ids []string
+		for _, pkg := range pkgs {
+			ids = append(ids, pkg.ID)
+		}
+		return strings.Join(ids, ", ")
+	}
+	wantRoots := "golang.org/fake/c, golang.org/fake/a [golang.org/fake/a.test], golang.org/fake/b, " +
+		"golang.org/fake/a, golang.org/fake/a_test [golang.org/fake/a.test]"
+	if got := ids(roots); got != wantRoots {
+		t.Errorf("roots: got %s, want %s", got, wantRoots)
+	}
+	for i, want := range []string{
+		"golang.org/fake/c",
+		"golang.org/fake/a [golang.org/fake/a.test]",
+		"golang.org/fake/b",
+		"golang.org/fake/a, golang.org/fake/a [golang.org/fake/a.test]",
+		"golang.org/fake/a_test [golang.org/fake/a.test]",
+	} {
+		if got := ids(byFile[files[i]]); got != want {
+			t.Errorf("packages of %s: got %s, want %s", files[i], got, want)
+		}
+	}
+	for _, pkg := range roots {
+		if pkg.GoFiles != nil {
+			t.Errorf("%s has GoFiles without NeedFiles", pkg.ID)
+		}
+	}
+
+	// The directory of the files of a is listed once.
+	aDir := filepath.Join(dir, "a")
+	var lists int
+	for _, key := range r.keys {
+		for _, arg := range strings.Fields(key) {
+			if arg == aDir {
+				lists++
+			}
+		}
+	}
+	if lists != 1 {
+		t.Errorf("the go command listed %s %d times, want once: %v", aDir, lists, r.keys)
+	}
+}
+
+// BenchmarkLoadContaining compares the go commands that LoadContaining
+// runs for the 500 files of 80 packages with those of loading the
+// packages of each file alone.
+func BenchmarkLoadContaining(b *testing.B) {
+	const npkgs, nfiles = 80, 500
+	files := make(map[string]interface{}, nfiles)
+	var names []string
+	for i := 0; i < nfiles; i++ {
+		name := fmt.Sprintf("p%d/f%d.go", i%npkgs, i)
+		files[name] = fmt.Sprintf("package p%d\n", i%npkgs)
+		names = append(names, name)
+	}
+	exported := packagestest.Export(b, packagestest.Modules, []packagestest.Module{{
+		Name:  "golang.org/fake",
+		Files: files,
+	}})
+	defer exported.Cleanup()
+	for i, name := range names {
+		names[i] = exported.File("golang.org/fake", name)
+	}
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles
+
+	for _, each := range []bool{false, true} {
+		name := "LoadContaining"
+		if each {
+			name = "LoadEach"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := &recorder{recordings: make(map[string]recording)}
+			exported.Config.GoCommandRunner = r
+			for i := 0; i < b.N; i++ {
+				if !each {
+					if _, _, err := packages.LoadContaining(exported.Config, names); err != nil {
+						b.Fatal(err)
+					}
+					continue
+				}
+				for _, name := range names {
+					if _, err := packages.Load(exported.Config, "file="+name); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(len(r.keys))/float64(b.N), "gocommands/op")
+		})
+	}
+}
+
 // Test that Load with no patterns is equivalent to loading "." via the golist
 // driver.
 func TestNoPatterns(t *testing.T) { packagestest.TestAll(t, testNoPatterns) }
@@ -2663,11 +3197,19 @@ func TestLoadModeStrings(t *testing.T) {
 			"LoadMode(NeedName|NeedFiles|NeedCompiledGoFiles|NeedImports|NeedDeps|NeedExportsFile|NeedTypes|NeedSyntax|NeedTypesInfo|NeedTypesSizes)",
 		},
 		{
-			packages.NeedName | 8192,
+			packages.NeedEmbedFiles | packages.NeedEmbedPatterns,
+			"LoadMode(NeedEmbedFiles|NeedEmbedPatterns)",
+		},
+		{
+			packages.NeedName | packages.NeedDepsErrors,
+			"LoadMode(NeedName|NeedDepsErrors)",
+		},
+		{
+			packages.NeedName | 1<<16,
 			"LoadMode(NeedName|Unknown)",
 		},
 		{
-			4096,
+			1 << 15,
 			"LoadMode(Unknown)",
 		},
 	}
@@ -2800,7 +3342,7 @@ func testIssue37529(t *testing.T, exporter packagestest.Exporter) {
 }
 
 // Tests golang/go#35973, fixed in Go 1.14.
-func TestInvalidFilesInOverlay(t *testing.T) { packagestest.TestAll(t, testInvalidFilesInOverlay) }
+func TestInvalidFilesInOverlay(t *testing.T) { testAllOverlayModes(t, testInvalidFilesInOverlay) }
 func testInvalidFilesInOverlay(t *testing.T, exporter packagestest.Exporter) {
 	testenv.NeedsGo1Point(t, 14)
 	exported := packagestest.Export(t, exporter, []packagestest.Module{
@@ -2981,6 +3523,431 @@ func testModule(t *testing.T, exporter packagestest.Exporter) {
 	}
 }
 
+func TestLoadCancel(t *testing.T) { packagestest.TestAll(t, testLoadCancel) }
+func testLoadCancel(t *testing.T, exporter packagestest.Exporter) {
+	// A large module, in which each package imports the previous one.
+	const n = 300
+	files := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		src := fmt.Sprintf("package p%d\n", i)
+		if i > 0 {
+			src += fmt.Sprintf("\nimport _ \"golang.org/fake/p%d\"\n", i-1)
+		}
+		files[fmt.Sprintf("p%d/p.go", i)] = src
+	}
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name:  "golang.org/fake",
+		Files: files,
+	}})
+	defer exported.Cleanup()
+
+	t.Run("after first command", func(t *testing.T) {
+		// The overlay adds an import of a package that is not yet
+		// loaded, so that other go commands must follow the first.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cfg := *exported.Config
+		cfg.Mode = packages.NeedName | packages.NeedImports
+		cfg.Context = ctx
+		cfg.Logf = func(string, ...interface{}) { cancel() }
+		cfg.Overlay = map[string][]byte{
+			exported.File("golang.org/fake", "p0/p.go"): []byte("package p0\n\nimport _ \"golang.org/fake/p1\"\n"),
+		}
+		pkgs, err := packages.Load(&cfg, "golang.org/fake/p0")
+		if !xerrors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want cancellation", err)
+		}
+		if pkgs != nil {
+			t.Errorf("got packages %v after cancellation, want none", pkgs)
+		}
+	})
+
+	t.Run("during load", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cfg := *exported.Config
+		cfg.Mode = packages.NeedName | packages.NeedImports | packages.NeedDeps | packages.NeedSyntax
+		cfg.Context = ctx
+		var cancelled time.Time
+		timer := time.AfterFunc(20*time.Millisecond, func() {
+			cancelled = time.Now()
+			cancel()
+		})
+		defer timer.Stop()
+		pkgs, err := packages.Load(&cfg, "golang.org/fake/...")
+		if err == nil {
+			t.Skip("load finished before it was cancelled")
+		}
+		if !xerrors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want cancellation", err)
+		}
+		if pkgs != nil {
+			t.Errorf("got %d packages after cancellation, want none", len(pkgs))
+		}
+		if d := time.Since(cancelled); d > 5*time.Second {
+			t.Errorf("load returned %v after it was cancelled", d)
+		}
+	})
+}
+
+// TestWarningHandler checks that the lines that the go command prints
+// to its standard error are reported as warnings if it succeeds, and
+// as part of the error if it fails, using a stub go command that
+// prints them.
+func TestWarningHandler(t *testing.T) { packagestest.TestAll(t, testWarningHandler) }
+func testWarningHandler(t *testing.T, exporter packagestest.Exporter) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub go command is a shell script")
+	}
+	testenv.NeedsTool(t, "go")
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+		},
+	}})
+	defer exported.Cleanup()
+	bin, err := ioutil.TempDir("", "stubgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(filepath.ListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	lines := []struct {
+		text string
+		kind packages.WarningKind
+	}{
+		{"go: finding module for package example.com/b", packages.ModuleWarning},
+		{"go: downloading go1.99.0 (linux/amd64)", packages.ToolchainWarning},
+		{"go: parsing $GOFLAGS: flag -x is ignored", packages.FlagsWarning},
+		{"something else", packages.UnknownWarning},
+	}
+	stub := func(exit string) {
+		t.Helper()
+		script := "#!/bin/sh\n"
+		for _, line := range lines {
+			script += fmt.Sprintf("echo '%s' >&2\n", line.text)
+		}
+		script += exit + "\n"
+		if err := ioutil.WriteFile(filepath.Join(bin, "go"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var warnings []packages.DriverWarning
+	cfg := *exported.Config
+	cfg.Mode = packages.NeedName
+	cfg.WarningHandler = func(w packages.DriverWarning) { warnings = append(warnings, w) }
+
+	stub(fmt.Sprintf("exec %s \"$@\"", goTool))
+	pkgs, err := packages.Load(&cfg, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || len(pkgs[0].Errors) > 0 {
+		t.Errorf("got packages %v, want golang.org/fake/a without errors", pkgs)
+	}
+	var listed []packages.DriverWarning
+	for _, w := range warnings {
+		if strings.HasPrefix(w.Cmd, "go list ") {
+			listed = append(listed, w)
+		}
+	}
+	if len(listed) != len(lines) {
+		t.Fatalf("got warnings %v from go list, want %d", listed, len(lines))
+	}
+	for i, w := range listed {
+		if w.Text != lines[i].text || w.Kind != lines[i].kind {
+			t.Errorf("warning %d = %q of kind %d, want %q of kind %d", i, w.Text, w.Kind, lines[i].text, lines[i].kind)
+		}
+	}
+
+	warnings = nil
+	stub("exit 1")
+	if _, err := packages.Load(&cfg, "golang.org/fake/a"); err == nil {
+		t.Error("load with a failing go command succeeded")
+	} else {
+		for _, line := range lines {
+			if !strings.Contains(err.Error(), line.text) {
+				t.Errorf("error %q does not contain the line %q of the standard error", err, line.text)
+			}
+		}
+	}
+	if len(warnings) > 0 {
+		t.Errorf("got warnings %v from a failing go command, want none", warnings)
+	}
+}
+
+func TestLoadWithEnv(t *testing.T) { packagestest.TestAll(t, testLoadWithEnv) }
+func testLoadWithEnv(t *testing.T, exporter packagestest.Exporter) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub go command is a shell script")
+	}
+	testenv.NeedsTool(t, "go")
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+		},
+	}})
+	defer exported.Cleanup()
+	bin, err := ioutil.TempDir("", "stubgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(filepath.ListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	// The stub go command reports a fixed environment, and counts the
+	// go env commands.
+	want := map[string]string{
+		"GOMOD":       "/stub/go.mod",
+		"GOPATH":      "/stub/gopath",
+		"GOROOT":      "/stub/goroot",
+		"GOFLAGS":     "-mod=mod",
+		"GO111MODULE": "on",
+		"GOWORK":      "",
+		"GOVERSION":   "go1.99.1",
+	}
+	env, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := filepath.Join(bin, "calls")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = env ]; then\n\techo >>%s\n\techo '%s'\n\texit 0\nfi\nexec %s \"$@\"\n", calls, env, goTool)
+	if err := ioutil.WriteFile(filepath.Join(bin, "go"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	envCalls := func() int {
+		data, _ := ioutil.ReadFile(calls)
+		os.Remove(calls)
+		return len(data)
+	}
+
+	cfg := *exported.Config
+	cfg.Mode = packages.NeedName
+	result, err := packages.LoadWithEnv(&cfg, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Packages) != 1 || result.Packages[0].ID != "golang.org/fake/a" {
+		t.Errorf("got packages %v, want golang.org/fake/a", result.Packages)
+	}
+	for name, value := range want {
+		if got, ok := result.Env[name]; !ok || got != value {
+			t.Errorf("Env[%s] = %q, want %q", name, got, value)
+		}
+	}
+	if result.GoVersion != 99 {
+		t.Errorf("GoVersion = %d, want 99", result.GoVersion)
+	}
+	if n := envCalls(); n != 1 {
+		t.Errorf("LoadWithEnv ran go env %d times, want once", n)
+	}
+
+	// A session runs go env once for all its loads.
+	session := packages.NewSession(&cfg)
+	for i := 0; i < 2; i++ {
+		result, err := session.LoadWithEnv("golang.org/fake/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Env["GOMOD"] != want["GOMOD"] || result.GoVersion != 99 {
+			t.Errorf("load %d of the session: got Env %v and GoVersion %d", i, result.Env, result.GoVersion)
+		}
+	}
+	if n := envCalls(); n != 1 {
+		t.Errorf("the loads of a session ran go env %d times, want once", n)
+	}
+}
+
+func TestGoCommandTimeout(t *testing.T) { packagestest.TestAll(t, testGoCommandTimeout) }
+func testGoCommandTimeout(t *testing.T, exporter packagestest.Exporter) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub go command is a shell script")
+	}
+	testenv.NeedsTool(t, "go")
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+		},
+	}})
+	defer exported.Cleanup()
+	bin, err := ioutil.TempDir("", "stubgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(filepath.ListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+	stub := func(script string) {
+		script = "#!/bin/sh\nif [ \"$1\" = list ]; then\n" + script + "fi\nexec " + goTool + " \"$@\"\n"
+		if err := ioutil.WriteFile(filepath.Join(bin, "go"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The go list command sleeps in a child process, which holds its
+	// output open until it is killed too.
+	stub("\tsleep 60\n")
+	cfg := *exported.Config
+	cfg.Mode = packages.NeedName
+	cfg.GoCommandTimeout = 200 * time.Millisecond
+	start := time.Now()
+	_, err = packages.Load(&cfg, "golang.org/fake/a")
+	if err == nil {
+		t.Fatal("Load succeeded, want a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("Load failed after %v, want soon after the timeout", elapsed)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "go list ") || !strings.Contains(msg, "golang.org/fake/a") || !strings.Contains(msg, "timed out after") {
+		t.Errorf("got error %q, want one that names the go list command and how long it ran", msg)
+	}
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want one that wraps context.DeadlineExceeded", err)
+	}
+
+	// A go list command that fails for a transient reason is run again,
+	// once.
+	marker := filepath.Join(bin, "failed")
+	stub(fmt.Sprintf("\tif [ ! -e %[1]s ]; then\n\t\ttouch %[1]s\n\t\techo 'go: updates to go.sum needed, disabled by -mod=readonly' >&2\n\t\texit 1\n\tfi\n", marker))
+	cfg.GoCommandTimeout = 0
+	initial, err := packages.Load(&cfg, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initial) != 1 || initial[0].ID != "golang.org/fake/a" {
+		t.Errorf("got packages %v, want golang.org/fake/a", initial)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	exported := packagestest.Export(t, packagestest.Modules, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+			"b/b.go": "package b\n\nfunc f() {\n",
+		},
+	}, {
+		Name: "golang.org/dep@v1.0.0",
+		Files: map[string]interface{}{
+			"d/d.go": "package d\n",
+		},
+	}})
+	defer exported.Cleanup()
+	aFile := exported.File("golang.org/fake", "a/a.go")
+	mainDir := filepath.Dir(filepath.Dir(aFile))
+	depFile := exported.File("golang.org/dep@v1.0.0", "d/d.go")
+	modCache := strings.TrimSuffix(depFile, filepath.Join("golang.org", "dep@v1.0.0", "d", "d.go"))
+	modCache = strings.TrimSuffix(modCache, string(filepath.Separator))
+
+	rewrite := packages.PathRewrite{
+		{Old: mainDir, New: "golang.org/fake"},
+		{Old: modCache, New: ""},
+	}
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+		packages.NeedImports | packages.NeedDeps | packages.NeedModule | packages.NeedSyntax
+	exported.Config.RewritePath = rewrite.Rewrite
+	// The overlay, whose key is the actual path of the file, adds an import.
+	exported.Config.Overlay = map[string][]byte{
+		aFile: []byte("package a\n\nimport _ \"golang.org/dep/d\"\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a", "golang.org/fake/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initial) != 2 {
+		t.Fatalf("got %v, expected [golang.org/fake/a golang.org/fake/b]", initial)
+	}
+	a, b := initial[0], initial[1]
+	d := a.Imports["golang.org/dep/d"]
+	if d == nil {
+		t.Fatalf("golang.org/fake/a: got imports %v, expected the import added by the overlay", a.Imports)
+	}
+
+	inverse := rewrite.Inverse()
+	for _, test := range []struct {
+		name, got, want, file string
+	}{
+		{"a.GoFiles", a.GoFiles[0], "golang.org/fake/a/a.go", aFile},
+		{"a.CompiledGoFiles", a.CompiledGoFiles[0], "golang.org/fake/a/a.go", aFile},
+		{"a.Module.Dir", a.Module.Dir, "golang.org/fake", mainDir},
+		{"a.Module.GoMod", a.Module.GoMod, "golang.org/fake/go.mod", filepath.Join(mainDir, "go.mod")},
+		{"d.GoFiles", d.GoFiles[0], "golang.org/dep@v1.0.0/d/d.go", depFile},
+		{"d.Module.Dir", d.Module.Dir, "golang.org/dep@v1.0.0", filepath.Dir(filepath.Dir(depFile))},
+	} {
+		want := filepath.FromSlash(test.want)
+		if test.got != want {
+			t.Errorf("%s = %q, want %q", test.name, test.got, want)
+		}
+		if got := inverse.Rewrite(test.got); got != test.file {
+			t.Errorf("inverse rewrite of %s = %q, want %q", test.name, got, test.file)
+		}
+	}
+
+	// The positions of errors name the rewritten files.
+	if len(b.Errors) == 0 {
+		t.Fatalf("golang.org/fake/b: got no errors, expected a syntax error")
+	}
+	for _, err := range b.Errors {
+		prefix := filepath.FromSlash("golang.org/fake/b/b.go:")
+		if !strings.HasPrefix(err.Pos, prefix) {
+			t.Errorf("error %v: got position %q, expected one in %s", err, err.Pos, prefix)
+		}
+	}
+}
+
+func TestPathRewrite(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses Unix paths")
+	}
+	rewrite := packages.PathRewrite{
+		{Old: "/home/user/hello", New: "example.com/hello"},
+		{Old: "/home/user/hello/vendor", New: "vendor"},
+		{Old: "/home/user/go/pkg/mod", New: ""},
+		{Old: "/", New: "root"},
+	}
+	for _, test := range []struct {
+		path, want string
+	}{
+		{"/home/user/hello/main.go", "example.com/hello/main.go"},
+		{"/home/user/hello", "example.com/hello"},
+		{"/home/user/hello/vendor/x/y.go", "vendor/x/y.go"},
+		{"/home/user/hellos/main.go", "root/home/user/hellos/main.go"},
+		{"/home/user/go/pkg/mod/golang.org/x/text@v0.3.2/a.go", "golang.org/x/text@v0.3.2/a.go"},
+		{"relative/a.go", "relative/a.go"},
+	} {
+		got := rewrite.Rewrite(test.path)
+		if got != test.want {
+			t.Errorf("Rewrite(%q) = %q, want %q", test.path, got, test.want)
+		}
+		if got != test.path {
+			if back := rewrite.Inverse().Rewrite(got); back != test.path {
+				t.Errorf("Inverse().Rewrite(%q) = %q, want %q", got, back, test.path)
+			}
+		}
+	}
+}
+
 func TestExternal_NotHandled(t *testing.T) {
 	packagestest.TestAll(t, testExternal_NotHandled)
 }
@@ -3067,6 +4034,94 @@ func main() {
 	}
 }
 
+func TestPrune(t *testing.T) {
+	// a -> b, c; b -> d; c -> d, e; d -> b (a cycle); e -> f; and the
+	// test variants of a: "a [a.test]" -> "b [a.test]" -> d.
+	pkgs := make(map[string]*packages.Package)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "a [a.test]", "b [a.test]"} {
+		pkgs[id] = &packages.Package{ID: id, Imports: make(map[string]*packages.Package)}
+	}
+	for _, edge := range [][2]string{
+		{"a", "b"}, {"a", "c"}, {"b", "d"}, {"c", "d"}, {"c", "e"}, {"d", "b"}, {"e", "f"},
+		{"a [a.test]", "b [a.test]"}, {"b [a.test]", "d"},
+	} {
+		from, to := pkgs[edge[0]], pkgs[edge[1]]
+		from.Imports[strings.Fields(to.ID)[0]] = to
+	}
+	edges := func(result []*packages.Package) []string {
+		var edges []string
+		for _, p := range result {
+			for path, imp := range p.Imports {
+				edge := fmt.Sprintf("%s -%s-> %s", p.ID, path, imp.ID)
+				if imp.Imports == nil {
+					edge += " (stub)"
+				}
+				edges = append(edges, edge)
+			}
+		}
+		sort.Strings(edges)
+		return edges
+	}
+	for _, test := range []struct {
+		roots []string
+		prune []string
+		ids   []string // in order
+		edges []string
+	}{
+		{
+			roots: []string{"a"},
+			ids:   []string{"a", "b", "d", "c", "e", "f"},
+			edges: []string{"a -b-> b", "a -c-> c", "b -d-> d", "c -d-> d", "c -e-> e", "d -b-> b", "e -f-> f"},
+		},
+		{
+			roots: []string{"a", "a [a.test]"},
+			prune: []string{"e"},
+			ids:   []string{"a", "b", "d", "c", "a [a.test]", "b [a.test]"},
+			edges: []string{"a -b-> b", "a -c-> c", "a [a.test] -b-> b [a.test]", "b -d-> d", "b [a.test] -d-> d", "c -d-> d", "c -e-> e (stub)", "d -b-> b"},
+		},
+		{
+			roots: []string{"c", "a"},
+			prune: []string{"d"},
+			ids:   []string{"c", "e", "f", "a", "b"},
+			edges: []string{"a -b-> b", "a -c-> c", "b -d-> d (stub)", "c -d-> d (stub)", "c -e-> e", "e -f-> f"},
+		},
+		{
+			roots: []string{"a"},
+			prune: []string{"a"},
+		},
+	} {
+		var roots []*packages.Package
+		for _, id := range test.roots {
+			roots = append(roots, pkgs[id])
+		}
+		result := packages.Prune(roots, func(p *packages.Package) bool {
+			for _, id := range test.prune {
+				if p.ID == id {
+					return false
+				}
+			}
+			return true
+		})
+		var ids []string
+		for _, p := range result {
+			ids = append(ids, p.ID)
+			if p == pkgs[p.ID] {
+				t.Errorf("Prune(%v) returned %s itself, not a copy", test.roots, p.ID)
+			}
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("Prune(%v) without %v: got packages %v, want %v", test.roots, test.prune, ids, test.ids)
+		}
+		if got := edges(result); !reflect.DeepEqual(got, test.edges) {
+			t.Errorf("Prune(%v) without %v: got imports %v, want %v", test.roots, test.prune, got, test.edges)
+		}
+	}
+	// The original graph is unchanged.
+	if got := len(pkgs["c"].Imports["e"].Imports); got != 1 {
+		t.Errorf("e has %d imports after Prune, want 1", got)
+	}
+}
+
 func errorMessages(errors []packages.Error) []string {
 	var msgs []string
 	for _, err := range errors {
@@ -3201,3 +4256,81 @@ func copyAll(srcPath, dstPath string) error {
 		return nil
 	})
 }
+
+func TestEmbedFiles(t *testing.T) { testAllOverlayModes(t, testEmbedFiles) }
+func testEmbedFiles(t *testing.T, exporter packagestest.Exporter) {
+	testenv.NeedsGo1Point(t, 16)
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"e/e.go":           "package e\n\nimport _ \"embed\"\n\n//go:embed data.txt\nvar s string\n",
+			"e/e_test.go":      "package e\n\nimport _ \"embed\"\n\n//go:embed testdata/t.txt\nvar ts string\n",
+			"e/x_test.go":      "package e_test\n\nimport \"embed\"\n\n//go:embed testdata\nvar fs embed.FS\n",
+			"e/data.txt":       "data\n",
+			"e/testdata/t.txt": "t\n",
+			"e/testdata/u.txt": "u\n",
+		},
+	}})
+	defer exported.Cleanup()
+	dir := filepath.Dir(exported.File("golang.org/fake", "e/e.go"))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedEmbedFiles | packages.NeedEmbedPatterns
+	exported.Config.Tests = true
+	// The overlay pass keeps the embedded files of the package to
+	// which it adds a file.
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "new.go"): []byte("package e\n"),
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := func(names ...string) []string {
+		var files []string
+		for _, name := range names {
+			files = append(files, filepath.Join(dir, filepath.FromSlash(name)))
+		}
+		return files
+	}
+	want := map[string]struct{ patterns, files []string }{
+		"golang.org/fake/e": {
+			[]string{"data.txt"},
+			abs("data.txt"),
+		},
+		"golang.org/fake/e [golang.org/fake/e.test]": {
+			[]string{"data.txt", "testdata/t.txt"},
+			abs("data.txt", "testdata/t.txt"),
+		},
+		"golang.org/fake/e_test [golang.org/fake/e.test]": {
+			[]string{"testdata"},
+			abs("testdata/t.txt", "testdata/u.txt"),
+		},
+	}
+	for _, pkg := range initial {
+		w, ok := want[pkg.ID]
+		if !ok {
+			continue
+		}
+		delete(want, pkg.ID)
+		if !reflect.DeepEqual(pkg.EmbedPatterns, w.patterns) {
+			t.Errorf("%s: got EmbedPatterns %v, want %v", pkg.ID, pkg.EmbedPatterns, w.patterns)
+		}
+		if !reflect.DeepEqual(pkg.EmbedFiles, w.files) {
+			t.Errorf("%s: got EmbedFiles %v, want %v", pkg.ID, pkg.EmbedFiles, w.files)
+		}
+	}
+	for id := range want {
+		t.Errorf("package %s is missing", id)
+	}
+
+	// The fields are reported only if they are requested.
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles
+	initial, err = packages.Load(exported.Config, "golang.org/fake/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range initial {
+		if pkg.EmbedPatterns != nil || pkg.EmbedFiles != nil {
+			t.Errorf("%s: got EmbedPatterns %v and EmbedFiles %v without NeedEmbedPatterns and NeedEmbedFiles", pkg.ID, pkg.EmbedPatterns, pkg.EmbedFiles)
+		}
+	}
+}
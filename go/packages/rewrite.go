@@ -0,0 +1,162 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+// This file implements the rewriting of reported file paths.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A PathPrefix is a pair of prefixes of file paths; see PathRewrite.
+type PathPrefix struct {
+	Old, New string
+}
+
+// A PathRewrite rewrites file paths by replacing their prefixes, as
+// the -trimpath flag of the go command does. A path is rewritten by
+// replacing the longest Old prefix that matches it with the
+// corresponding New prefix. A prefix matches a path if it equals the
+// path or is followed in it by a path separator; the empty prefix
+// matches relative paths. If New is empty, the separator that
+// followed the prefix is removed too, making the path relative.
+// Paths that no prefix matches are not rewritten.
+//
+// For example, given the rewrite
+//
+//	PathRewrite{
+//		{Old: "/home/user/hello", New: "example.com/hello"},
+//		{Old: "/home/user/go/pkg/mod", New: ""},
+//	}
+//
+// the Rewrite method maps
+// "/home/user/go/pkg/mod/golang.org/x/text@v0.3.2/width/width.go" to
+// "golang.org/x/text@v0.3.2/width/width.go", and
+// "/home/user/hello/main.go" to "example.com/hello/main.go", as the
+// go command reports them when building with -trimpath. It may be
+// used as Config.RewritePath.
+type PathRewrite []PathPrefix
+
+// Rewrite returns the rewrite of path.
+func (r PathRewrite) Rewrite(path string) string {
+	best, rest := -1, ""
+	for i, p := range r {
+		if best >= 0 && len(p.Old) <= len(r[best].Old) {
+			continue
+		}
+		if suffix, ok := trimPathPrefix(path, p.Old); ok {
+			best, rest = i, suffix
+		}
+	}
+	switch {
+	case best < 0:
+		return path
+	case r[best].New == "":
+		return rest
+	case rest == "":
+		return r[best].New
+	}
+	return strings.TrimSuffix(r[best].New, string(filepath.Separator)) + string(filepath.Separator) + rest
+}
+
+// Inverse returns the rewrite that exchanges the Old and New prefixes
+// of r, which maps rewritten paths back to the files they name, for
+// example to display positions with their actual file names. A path
+// that r rewrites is restored by the inverse, provided that its
+// rewrite is not matched by a New prefix longer than the one that
+// produced it.
+func (r PathRewrite) Inverse() PathRewrite {
+	inv := make(PathRewrite, len(r))
+	for i, p := range r {
+		inv[i] = PathPrefix{Old: p.New, New: p.Old}
+	}
+	return inv
+}
+
+// trimPathPrefix reports whether prefix matches path (see
+// PathRewrite), and returns the rest of path after the prefix and any
+// separator that follows it.
+func trimPathPrefix(path, prefix string) (string, bool) {
+	switch {
+	case prefix == "":
+		return path, path != "" && !filepath.IsAbs(path)
+	case path == prefix:
+		return "", true
+	case !strings.HasPrefix(path, prefix):
+		return "", false
+	case os.IsPathSeparator(prefix[len(prefix)-1]):
+		return path[len(prefix):], true
+	case os.IsPathSeparator(path[len(prefix)]):
+		return path[len(prefix)+1:], true
+	}
+	return "", false
+}
+
+// rewritePaths rewrites the file paths reported in pkg, as described
+// at Config.RewritePath.
+func rewritePaths(pkg *Package, rewrite func(string) string) {
+	rewriteAll := func(paths []string) {
+		for i, path := range paths {
+			paths[i] = rewrite(path)
+		}
+	}
+	rewriteAll(pkg.GoFiles)
+	rewriteAll(pkg.CompiledGoFiles)
+	rewriteAll(pkg.OtherFiles)
+	rewriteAll(pkg.IgnoredFiles)
+	rewriteAll(pkg.EmbedFiles)
+	if pkg.ExportFile != "" {
+		pkg.ExportFile = rewrite(pkg.ExportFile)
+	}
+	for i := range pkg.Errors {
+		pkg.Errors[i].Pos = rewritePos(pkg.Errors[i].Pos, rewrite)
+	}
+	// Copy the module, which the driver may share among packages.
+	var rewriteModule func(m *Module) *Module
+	rewriteModule = func(m *Module) *Module {
+		if m == nil {
+			return nil
+		}
+		mod := *m
+		if mod.Dir != "" {
+			mod.Dir = rewrite(mod.Dir)
+		}
+		if mod.GoMod != "" {
+			mod.GoMod = rewrite(mod.GoMod)
+		}
+		mod.Replace = rewriteModule(mod.Replace)
+		return &mod
+	}
+	pkg.Module = rewriteModule(pkg.Module)
+}
+
+// rewritePos rewrites the file name of pos, the position of an Error.
+func rewritePos(pos string, rewrite func(string) string) string {
+	if pos == "" || pos == "-" {
+		return pos
+	}
+	// Split "file:line:col" or "file:line"; the file name itself
+	// may contain colons.
+	file, suffix := pos, ""
+	for i := 0; i < 2; i++ {
+		j := strings.LastIndexByte(file, ':')
+		if j < 0 || !isDigits(file[j+1:]) {
+			break
+		}
+		file, suffix = file[:j], file[j:]+suffix
+	}
+	return rewrite(file) + suffix
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
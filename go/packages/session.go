@@ -0,0 +1,164 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/tools/internal/gocommand"
+)
+
+// A Session loads packages repeatedly with the same Config, as an
+// editor does after each change, and caches between the loads what
+// rarely changes: the environment of the go command and, in module
+// mode, the directories of the main module and of the modules it
+// replaces by directories, which are needed to give a package path to
+// a directory that exists only in the overlay.
+//
+// The cached module information is recomputed whenever the contents of
+// the main module's go.mod or go.sum file, on disk or in the overlay,
+// or those of any go.mod or go.sum file in the overlay, change.
+// Other changes, such as to the environment, must be reported by
+// calling Invalidate.
+//
+// A Session may be used by multiple goroutines at once.
+type Session struct {
+	cfg    *Config
+	runner *gocommand.Runner
+
+	mu       sync.Mutex
+	env      map[string]string // the environment of the go command, or nil if unknown
+	rootDirs map[string]string // see golistState.determineRootDirs, or nil if unknown
+	modKey   string            // the modFilesKey for which rootDirs was computed
+}
+
+// NewSession returns a Session that loads packages with cfg, which may
+// be nil, as for Load. Each Load uses the fields of cfg as they are at
+// the time of the call; they must not change while a Load is in
+// progress.
+func NewSession(cfg *Config) *Session {
+	return &Session{cfg: cfg, runner: &gocommand.Runner{}}
+}
+
+// Load loads and returns the Go packages named by the given patterns,
+// as does the Load function with the Config of the session.
+func (s *Session) Load(patterns ...string) ([]*Package, error) {
+	return Load(s.config(), patterns...)
+}
+
+// LoadWithEnv loads the Go packages named by the given patterns, as
+// does the LoadWithEnv function with the Config of the session. The
+// environment is the one that the session caches.
+func (s *Session) LoadWithEnv(patterns ...string) (*LoadResult, error) {
+	return LoadWithEnv(s.config(), patterns...)
+}
+
+// config returns the Config of a Load of the session.
+func (s *Session) config() *Config {
+	var cfg Config
+	if s.cfg != nil {
+		cfg = *s.cfg
+	}
+	if cfg.gocmdRunner == nil {
+		cfg.gocmdRunner = s.runner
+	}
+	cfg.session = s
+	return &cfg
+}
+
+// Invalidate discards all the information cached by the session.
+func (s *Session) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.env = nil
+	s.rootDirs = nil
+}
+
+// InvalidateModules discards the module information cached by the
+// session, but not the environment of the go command.
+func (s *Session) InvalidateModules() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rootDirs = nil
+}
+
+// getEnv returns the cached environment, calling load to compute it if
+// it is unknown. Errors are not cached.
+func (s *Session) getEnv(load func() (map[string]string, error)) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.env == nil {
+		env, err := load()
+		if err != nil {
+			return nil, err
+		}
+		s.env = env
+	}
+	return s.env, nil
+}
+
+// getRootDirs returns the cached root directories, calling load to
+// compute them if they are unknown or were computed for another key.
+// Errors are not cached.
+func (s *Session) getRootDirs(key string, load func() (map[string]string, error)) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rootDirs == nil || s.modKey != key {
+		dirs, err := load()
+		if err != nil {
+			return nil, err
+		}
+		s.rootDirs, s.modKey = dirs, key
+	}
+	return s.rootDirs, nil
+}
+
+// modFilesKey returns a digest of the contents of the go.mod and
+// go.sum files on which the root directories depend: those of the main
+// module, as seen through the overlay, and those in the overlay.
+func (state *golistState) modFilesKey() string {
+	files := make(map[string]bool)
+	if env, err := state.getEnv(); err == nil {
+		if env["GOMOD"] != "" {
+			files[env["GOMOD"]] = true
+			files[filepath.Join(filepath.Dir(env["GOMOD"]), "go.sum")] = true
+		}
+		if gowork := env["GOWORK"]; gowork != "" && gowork != "off" {
+			files[gowork] = true
+			files[gowork+".sum"] = true
+		}
+	}
+	for _, filename := range state.cfg.overlayFilenames() {
+		if isModFile(filename) {
+			files[filename] = true
+		}
+	}
+	var sorted []string
+	for filename := range files {
+		sorted = append(sorted, filename)
+	}
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, filename := range sorted {
+		contents, ok := state.cfg.overlayContents(filename)
+		if !ok {
+			var err error
+			if contents, err = ioutil.ReadFile(filename); err != nil {
+				fmt.Fprintf(h, "%q missing\n", filename)
+				continue
+			}
+		}
+		fmt.Fprintf(h, "%q %d\n", filename, len(contents))
+		h.Write(contents)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
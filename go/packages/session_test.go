@@ -0,0 +1,127 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+// exportSession exports a module whose overlay adds the package
+// golang.org/fake/b, whose package path depends on the module's root
+// directory. It returns the exported module and a pointer to the
+// number of go list -m commands run by loads with its Config.
+func exportSession(t testing.TB) (*packagestest.Exported, *int) {
+	exported := packagestest.Export(t, packagestest.Modules, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go": "package a\n",
+		},
+	}})
+	dir := filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go")))
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles
+	// The go command cannot update a go.mod file that is overlaid.
+	exported.Config.Env = append(exported.Config.Env, "GOFLAGS=-mod=readonly")
+	exported.Config.Overlay = map[string][]byte{
+		filepath.Join(dir, "b", "b.go"): []byte("package b\n"),
+	}
+	var mu sync.Mutex
+	count := new(int)
+	exported.Config.Logf = func(format string, args ...interface{}) {
+		if strings.Contains(fmt.Sprintf(format, args...), " -m -json") {
+			mu.Lock()
+			*count++
+			mu.Unlock()
+		}
+	}
+	return exported, count
+}
+
+func TestSession(t *testing.T) {
+	exported, count := exportSession(t)
+	defer exported.Cleanup()
+	// Only the go list driver, to process the overlay, runs go list -m.
+	defer packages.SetLegacyOverlay(true)()
+	gomod := filepath.Join(filepath.Dir(filepath.Dir(exported.File("golang.org/fake", "a/a.go"))), "go.mod")
+	contents, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := packages.NewSession(exported.Config)
+
+	load := func(step string, wantCount int) {
+		t.Helper()
+		pkgs, err := session.Load("golang.org/fake/b")
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if len(pkgs) != 1 || pkgs[0].ID != "golang.org/fake/b" || len(pkgs[0].Errors) > 0 {
+			t.Errorf("%s: got %v, want the package golang.org/fake/b of the overlay", step, pkgs)
+		}
+		if *count != wantCount {
+			t.Errorf("%s: go list -m ran %d times in all, want %d", step, *count, wantCount)
+		}
+	}
+	load("first load", 1)
+	load("second load", 1)
+	exported.Config.Overlay[gomod] = append(contents, "// changed\n"...)
+	load("after changing go.mod", 2)
+	load("after changing go.mod, again", 2)
+	session.InvalidateModules()
+	load("after InvalidateModules", 3)
+	session.Invalidate()
+	load("after Invalidate", 4)
+
+	// Concurrent loads share the cached information.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := session.Load("golang.org/fake/b"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if *count != 4 {
+		t.Errorf("after concurrent loads: go list -m ran %d times in all, want 4", *count)
+	}
+}
+
+// BenchmarkSession compares loads with and without a Session, which
+// runs go list -m only once.
+func BenchmarkSession(b *testing.B) {
+	exported, count := exportSession(b)
+	defer exported.Cleanup()
+	defer packages.SetLegacyOverlay(true)()
+
+	b.Run("Load", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := packages.Load(exported.Config, "golang.org/fake/b"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Session", func(b *testing.B) {
+		*count = 0
+		session := packages.NewSession(exported.Config)
+		for i := 0; i < b.N; i++ {
+			if _, err := session.Load("golang.org/fake/b"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if *count != 1 {
+			b.Errorf("go list -m ran %d times for %d loads, want 1", *count, b.N)
+		}
+	})
+}
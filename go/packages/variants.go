@@ -0,0 +1,119 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages
+
+// This file implements the loading of packages for several
+// environments at once; see Config.Variants.
+
+import (
+	"fmt"
+	"go/types"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// loadVariants queries the build system with driver for the patterns
+// once for each of the Variants of ld, concurrently, and returns a
+// response with the packages of all the queries, whose IDs are
+// suffixed with the keys of their variants. The sizes of each response
+// are recorded in the variantSizes of ld; the other fields that
+// describe the go command are those of the first response.
+func (ld *loader) loadVariants(driver driver, patterns []string) (*driverResponse, error) {
+	cfgs := make([]*Config, len(ld.Variants))
+	keys := make([]string, len(ld.Variants))
+	variantOf := make(map[string]int)
+	for i, variant := range ld.Variants {
+		cfg := ld.Config
+		cfg.Variants = nil
+		// The environment that a Session caches is that of its
+		// Config, not of the variant.
+		cfg.session = nil
+		cfg.Env = append(cfg.Env[:len(cfg.Env):len(cfg.Env)], variantEnv(variant)...)
+		keys[i] = variantKey(cfg.Env, variant)
+		if j, ok := variantOf[keys[i]]; ok {
+			return nil, fmt.Errorf("variants %d and %d have the same key %s", j, i, keys[i])
+		}
+		variantOf[keys[i]] = i
+		cfgs[i] = &cfg
+	}
+
+	responses := make([]*driverResponse, len(cfgs))
+	errs := make([]error, len(cfgs))
+	var wg sync.WaitGroup
+	for i, cfg := range cfgs {
+		wg.Add(1)
+		go func(i int, cfg *Config) {
+			defer wg.Done()
+			responses[i], errs[i] = driver(cfg, patterns...)
+		}(i, cfg)
+	}
+	wg.Wait()
+
+	merged := new(driverResponse)
+	ld.variantSizes = make(map[string]types.Sizes)
+	for i, response := range responses {
+		if errs[i] != nil {
+			return nil, xerrors.Errorf("loading variant %s: %w", keys[i], errs[i])
+		}
+		if i == 0 {
+			merged.Sizes = response.Sizes
+			merged.GoEnv = response.GoEnv
+			merged.GoVersion = response.GoVersion
+		}
+		suffix := " [" + keys[i] + "]"
+		for _, root := range response.Roots {
+			merged.Roots = append(merged.Roots, root+suffix)
+		}
+		for _, pkg := range response.Packages {
+			pkg.ID += suffix
+			for path, imp := range pkg.Imports {
+				pkg.Imports[path] = &Package{ID: imp.ID + suffix}
+			}
+			if response.Sizes != nil {
+				ld.variantSizes[pkg.ID] = response.Sizes
+			}
+			merged.Packages = append(merged.Packages, pkg)
+		}
+		merged.OverlayTrace = append(merged.OverlayTrace, response.OverlayTrace...)
+	}
+	return merged, nil
+}
+
+// variantEnv returns the variables of variant in the form of Env, in
+// order.
+func variantEnv(variant map[string]string) []string {
+	env := make([]string, 0, len(variant))
+	for k, v := range variant {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// variantKey returns the key of variant, whose variables have been
+// added to env: the GOOS and GOARCH of env, or those of the running
+// program if env lacks them, followed by the other variables of
+// variant; see Config.Variants.
+func variantKey(env []string, variant map[string]string) string {
+	goos, goarch := runtime.GOOS, runtime.GOARCH
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GOOS=") {
+			goos = kv[len("GOOS="):]
+		} else if strings.HasPrefix(kv, "GOARCH=") {
+			goarch = kv[len("GOARCH="):]
+		}
+	}
+	key := goos + "/" + goarch
+	for _, kv := range variantEnv(variant) {
+		if !strings.HasPrefix(kv, "GOOS=") && !strings.HasPrefix(kv, "GOARCH=") {
+			key += "," + kv
+		}
+	}
+	return key
+}
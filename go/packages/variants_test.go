@@ -0,0 +1,75 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packages_test
+
+import (
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/packages/packagestest"
+)
+
+// TestVariants checks that a load with Variants loads the packages for
+// each of them, with the files that their build constraints select, and
+// that the variants share the syntax trees of the files they have in
+// common.
+func TestVariants(t *testing.T) { packagestest.TestAll(t, testVariants) }
+func testVariants(t *testing.T, exporter packagestest.Exporter) {
+	exported := packagestest.Export(t, exporter, []packagestest.Module{{
+		Name: "golang.org/fake",
+		Files: map[string]interface{}{
+			"a/a.go":         "package a\n",
+			"a/a_linux.go":   "package a\n",
+			"a/a_windows.go": "package a\n",
+		},
+	}})
+	defer exported.Cleanup()
+	exported.Config.Mode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedSyntax
+	exported.Config.Variants = []map[string]string{
+		{"GOOS": "linux", "GOARCH": "amd64"},
+		{"GOOS": "windows", "GOARCH": "amd64"},
+	}
+	initial, err := packages.Load(exported.Config, "golang.org/fake/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	common := make(map[*ast.File]int)
+	for _, p := range initial {
+		var files []string
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		got[p.ID] = fmt.Sprintf("%s %v", p.PkgPath, files)
+		for i, f := range p.Syntax {
+			if filepath.Base(p.CompiledGoFiles[i]) == "a.go" {
+				common[f]++
+			}
+		}
+	}
+	want := map[string]string{
+		"golang.org/fake/a [linux/amd64]":   "golang.org/fake/a [a.go a_linux.go]",
+		"golang.org/fake/a [windows/amd64]": "golang.org/fake/a [a.go a_windows.go]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got packages %v, want %v", got, want)
+	}
+	if len(common) != 1 {
+		t.Errorf("the variants have %d syntax trees of a.go, want 1", len(common))
+	}
+
+	// Two variants may not have the same key.
+	exported.Config.Variants = []map[string]string{
+		{"GOOS": "linux", "GOARCH": "amd64"},
+		{"GOARCH": "amd64", "GOOS": "linux"},
+	}
+	if _, err := packages.Load(exported.Config, "golang.org/fake/a"); err == nil {
+		t.Error("Load of variants with the same key succeeded")
+	}
+}
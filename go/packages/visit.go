@@ -53,3 +53,67 @@ func PrintErrors(pkgs []*Package) int {
 	})
 	return n
 }
+
+// PrintErrorsWithDeps prints to os.Stderr the accumulated errors of all
+// packages in the import graph rooted at pkgs, as PrintErrors does, and
+// their DepsErrors, if NeedDepsErrors loaded them. A dependency error
+// that several packages report, or that is also an error of the package
+// that has it, is printed once. PrintErrorsWithDeps returns the number
+// of errors printed.
+func PrintErrorsWithDeps(pkgs []*Package) int {
+	var n int
+	printed := make(map[string]bool)
+	print := func(err Error) {
+		if s := err.Error(); !printed[s] {
+			printed[s] = true
+			fmt.Fprintln(os.Stderr, s)
+			n++
+		}
+	}
+	Visit(pkgs, nil, func(pkg *Package) {
+		for _, err := range pkg.Errors {
+			print(err)
+		}
+		for _, err := range pkg.DepsErrors {
+			print(err)
+		}
+	})
+	return n
+}
+
+// Prune returns a copy of the import graph whose roots are pkgs, limited
+// to the packages reachable from them through packages for which the
+// optional keep function reports true: a root or import that keep
+// rejects is dropped, along with the packages reachable only through
+// it. The result holds a copy of each retained package, in the
+// preorder of Visit, each before its imports; its Imports map the
+// retained imports to their copies, and the others to stubs that have
+// only their ID set. The other fields of the copies, such as Types and
+// Syntax, are shared with the originals, which Prune does not modify.
+func Prune(pkgs []*Package, keep func(*Package) bool) []*Package {
+	var kept []*Package
+	copies := make(map[*Package]*Package)
+	Visit(pkgs, func(pkg *Package) bool {
+		if keep != nil && !keep(pkg) {
+			return false
+		}
+		c := *pkg
+		copies[pkg] = &c
+		kept = append(kept, &c)
+		return true
+	}, nil)
+	for orig, c := range copies {
+		if orig.Imports == nil {
+			continue
+		}
+		c.Imports = make(map[string]*Package, len(orig.Imports))
+		for path, imp := range orig.Imports {
+			if ic, ok := copies[imp]; ok {
+				c.Imports[path] = ic
+			} else {
+				c.Imports[path] = &Package{ID: imp.ID}
+			}
+		}
+	}
+	return kept
+}
@@ -84,6 +84,11 @@ type Invocation struct {
 	Env        []string
 	WorkingDir string
 	Logf       func(format string, args ...interface{})
+
+	// KillProcessGroup, if set, runs the go command in a process group
+	// of its own, where the system supports them, so that cancelling
+	// ctx kills the processes it started along with it.
+	KillProcessGroup bool
 }
 
 // RunRaw is like RunPiped, but also returns the raw stderr and error for callers
@@ -93,19 +98,26 @@ func (i *Invocation) runRaw(ctx context.Context) (stdout *bytes.Buffer, stderr *
 	stderr = &bytes.Buffer{}
 	rawError = i.RunPiped(ctx, stdout, stderr)
 	if rawError != nil {
-		friendlyError = rawError
-		// Check for 'go' executable not being found.
-		if ee, ok := rawError.(*exec.Error); ok && ee.Err == exec.ErrNotFound {
-			friendlyError = fmt.Errorf("go command required, not found: %v", ee)
-		}
-		if ctx.Err() != nil {
-			friendlyError = ctx.Err()
-		}
-		friendlyError = fmt.Errorf("err: %v: stderr: %s", friendlyError, stderr)
+		friendlyError = FriendlyError(ctx, rawError, stderr)
 	}
 	return
 }
 
+// FriendlyError returns the error that Runner.Run reports for the
+// error rawError of a go command run with ctx, whose standard error
+// is stderr.
+func FriendlyError(ctx context.Context, rawError error, stderr *bytes.Buffer) error {
+	friendlyError := rawError
+	// Check for 'go' executable not being found.
+	if ee, ok := rawError.(*exec.Error); ok && ee.Err == exec.ErrNotFound {
+		friendlyError = fmt.Errorf("go command required, not found: %v", ee)
+	}
+	if ctx.Err() != nil {
+		friendlyError = ctx.Err()
+	}
+	return fmt.Errorf("err: %v: stderr: %s", friendlyError, stderr)
+}
+
 // RunPiped is like Run, but relies on the given stdout/stderr
 func (i *Invocation) RunPiped(ctx context.Context, stdout, stderr io.Writer) error {
 	log := i.Logf
@@ -144,9 +156,40 @@ func (i *Invocation) RunPiped(ctx context.Context, stdout, stderr io.Writer) err
 
 	defer func(start time.Time) { log("%s for %v", time.Since(start), cmdDebugStr(cmd)) }(time.Now())
 
+	if i.KillProcessGroup {
+		return runGroupContext(ctx, cmd)
+	}
 	return runCmdContext(ctx, cmd)
 }
 
+var (
+	setProcessGroup  = func(cmd *exec.Cmd) {}
+	killProcessGroup = func(cmd *exec.Cmd) error { return cmd.Process.Kill() }
+)
+
+// runGroupContext is like runCmdContext, but it starts cmd in a process
+// group of its own, and kills the group at once if ctx is done, as
+// processes started by the go command, such as the compiler or a test
+// binary, would otherwise keep its output open after it exits.
+func runGroupContext(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	resChan := make(chan error, 1)
+	go func() {
+		resChan <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-resChan:
+		return err
+	case <-ctx.Done():
+	}
+	killProcessGroup(cmd)
+	return <-resChan
+}
+
 // runCmdContext is like exec.CommandContext except it sends os.Interrupt
 // before os.Kill.
 func runCmdContext(ctx context.Context, cmd *exec.Cmd) error {
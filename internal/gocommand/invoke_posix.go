@@ -0,0 +1,30 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package gocommand
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func init() {
+	setProcessGroup = setProcessGroupPosix
+	killProcessGroup = killProcessGroupPosix
+}
+
+func setProcessGroupPosix(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroupPosix kills the process group whose leader is the
+// process of cmd, which setProcessGroupPosix made it.
+func killProcessGroupPosix(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
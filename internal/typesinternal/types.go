@@ -26,3 +26,15 @@ func SetUsesCgo(conf *types.Config) bool {
 
 	return true
 }
+
+// SetGoVersion sets the language version, such as "go1.19", of whose
+// features the type checker of conf accepts only those, and reports
+// whether it could: types.Config has had the field since Go 1.18.
+func SetGoVersion(conf *types.Config, version string) bool {
+	f := reflect.ValueOf(conf).Elem().FieldByName("GoVersion")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return false
+	}
+	f.SetString(version)
+	return true
+}